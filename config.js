@@ -0,0 +1,284 @@
+// 集中管理环境变量：启动时读取一次并校验，其他地方只使用返回的 config 对象
+const net = require('net');
+
+function parseList(value) {
+  return (value || '').split(',').map(item => item.trim()).filter(Boolean);
+}
+
+// Integer setting, unset or empty means the default
+function readInt(env, name, defaultValue, errors, min = 0) {
+  const raw = env[name];
+  if (raw === undefined || raw === '') return defaultValue;
+  const value = Number(raw);
+  if (!Number.isInteger(value) || value < min) {
+    errors.push(`${name} must be an integer >= ${min}, got "${raw}"`);
+    return defaultValue;
+  }
+  return value;
+}
+
+function readPercent(env, name, defaultValue, errors) {
+  const raw = env[name];
+  if (raw === undefined || raw === '') return defaultValue;
+  const value = Number(raw);
+  if (!Number.isFinite(value) || value <= 0 || value > 100) {
+    errors.push(`${name} must be a number between 0 and 100, got "${raw}"`);
+    return defaultValue;
+  }
+  return value;
+}
+
+function readFraction(env, name, defaultValue, errors) {
+  const raw = env[name];
+  if (raw === undefined || raw === '') return defaultValue;
+  const value = Number(raw);
+  if (!Number.isFinite(value) || value < 0 || value > 1) {
+    errors.push(`${name} must be a number between 0 and 1, got "${raw}"`);
+    return defaultValue;
+  }
+  return value;
+}
+
+function readBool(env, name) {
+  return env[name] === 'true';
+}
+
+// "model=value,model=value" -> { model: value }, values must be non-negative numbers (integers if integer is set)
+function readModelTable(env, name, errors, { integer = false, key = 'model' } = {}) {
+  const table = {};
+  for (const entry of parseList(env[name])) {
+    const [model, raw] = entry.split('=').map(part => (part || '').trim());
+    const value = Number(raw);
+    if (!model || raw === '' || !Number.isFinite(value) || value < 0 || (integer && !Number.isInteger(value))) {
+      errors.push(`${name} entries must look like ${key}=${integer ? 'count' : 'value'}, got "${entry}"`);
+      continue;
+    }
+    table[model] = value;
+  }
+  return table;
+}
+
+// GRPC_MODELS："model=grpc://host:port,..." -> { model: endpoint }，grpcs:// 使用 TLS
+function readGrpcModels(env, errors) {
+  const models = {};
+  for (const entry of parseList(env.GRPC_MODELS)) {
+    const separator = entry.indexOf('=');
+    const model = entry.slice(0, separator).trim();
+    const endpoint = entry.slice(separator + 1).trim();
+    if (separator <= 0 || !/^grpcs?:\/\/[^/?#]+$/i.test(endpoint)) {
+      errors.push(`GRPC_MODELS entries must look like model=grpc://host:port, got "${entry}"`);
+      continue;
+    }
+    models[model] = endpoint;
+  }
+  return models;
+}
+
+// Parse an auth mode string, returns null if it's not one we support
+function parseAuthMode(authMode) {
+  if (typeof authMode !== 'string') return null;
+  if (authMode === 'bearer') return { type: 'bearer' };
+
+  const match = authMode.match(/^(header|query):([A-Za-z0-9_.-]+)$/);
+  if (!match) return null;
+  return { type: match[1], name: match[2] };
+}
+
+// Express trust proxy 接受的预设名称
+const PROXY_PRESETS = ['loopback', 'linklocal', 'uniquelocal'];
+
+function isValidProxyEntry(entry) {
+  if (PROXY_PRESETS.includes(entry)) return true;
+  const [address, prefix, ...rest] = entry.split('/');
+  const version = net.isIP(address);
+  if (!version || rest.length > 0) return false;
+  if (prefix === undefined) return true;
+  const bits = Number(prefix);
+  return /^\d+$/.test(prefix) && bits <= (version === 4 ? 32 : 128);
+}
+
+const LOG_LEVELS = ['debug', 'info', 'warn', 'error'];
+const ACCESS_LOG_FORMATS = ['text', 'json', 'off'];
+const RESULT_STORES = ['file'];
+const WATERMARK_POSITIONS = ['top-left', 'top-right', 'bottom-left', 'bottom-right', 'center'];
+
+// Build the config from an env map, throws listing every invalid setting
+function loadConfig(env) {
+  const errors = [];
+
+  const config = {
+    port: readInt(env, 'PORT', 8080, errors, 1),
+    healthPath: env.HEALTH_PATH || '/health',
+    healthPort: readInt(env, 'HEALTH_PORT', 0, errors),
+    logLevel: (env.LOG_LEVEL || 'info').toLowerCase(),
+    maxErrorLength: readInt(env, 'MAX_ERROR_LENGTH', 2048, errors, 1),
+
+    // 上游调用
+    defaultModel: env.DEFAULT_MODEL || '',
+    upstreamAuthMode: env.UPSTREAM_AUTH_MODE || 'bearer',
+    retryJitterSeed: env.RETRY_JITTER_SEED === undefined ? null : readInt(env, 'RETRY_JITTER_SEED', 0, errors),
+    taskTimeoutMs: readInt(env, 'TASK_TIMEOUT_MS', 15 * 60 * 1000, errors, 1),
+    dnsRetryDelayMs: readInt(env, 'DNS_RETRY_DELAY_MS', 250, errors),
+    connectRetries: readInt(env, 'CONNECT_RETRIES', 0, errors),
+    connectRetryDelayMs: readInt(env, 'CONNECT_RETRY_DELAY_MS', 50, errors),
+    warmPoolSize: readInt(env, 'WARM_POOL_SIZE', 0, errors),
+    warmIntervalMs: readInt(env, 'WARM_INTERVAL', 3000, errors, 100),
+    allowedOutputHosts: parseList(env.ALLOWED_OUTPUT_HOSTS).map(host => host.toLowerCase()),
+    failureAlarmWindow: readInt(env, 'FAILURE_ALARM_WINDOW', 100, errors, 1),
+    failureAlarmMinSamples: readInt(env, 'FAILURE_ALARM_MIN_SAMPLES', 20, errors, 1),
+    failureAlarmThresholdPercent: readPercent(env, 'FAILURE_ALARM_THRESHOLD_PERCENT', 50, errors),
+    upstreamBaseUrlAllowlist: parseList(env.UPSTREAM_BASE_URL_ALLOWLIST).map(host => host.toLowerCase()),
+    upstreamRegions: parseList(env.UPSTREAM_REGIONS),
+    upstreamPermanentErrorPatterns: parseList(env.UPSTREAM_PERMANENT_ERROR_PATTERNS).map(pattern => pattern.toLowerCase()),
+    upstreamRequestIdHeaders: parseList(env.UPSTREAM_REQUEST_ID_HEADERS === undefined ? 'x-request-id,request-id,x-trace-id' : env.UPSTREAM_REQUEST_ID_HEADERS).map(name => name.toLowerCase()),
+    grpcModels: readGrpcModels(env, errors),
+    upstreamProbePercent: readPercent(env, 'UPSTREAM_PROBE_PERCENT', 10, errors),
+
+    // 并发与准入
+    maxConcurrency: readInt(env, 'MAX_CONCURRENCY', 0, errors),
+    minConcurrency: readInt(env, 'MIN_CONCURRENCY', 1, errors, 1),
+    memoryHighWaterPercent: readPercent(env, 'MEMORY_HIGH_WATER_PERCENT', 85, errors),
+    memoryLowWaterPercent: readPercent(env, 'MEMORY_LOW_WATER_PERCENT', 70, errors),
+    adaptiveCheckIntervalMs: readInt(env, 'ADAPTIVE_CHECK_INTERVAL_MS', 5000, errors, 100),
+    maxInflightTasks: readInt(env, 'MAX_INFLIGHT_TASKS', 1000, errors, 1),
+    concurrencyWarmupMs: readInt(env, 'CONCURRENCY_WARMUP_MS', 0, errors),
+    concurrencyWarmupStart: readInt(env, 'CONCURRENCY_WARMUP_START', 1, errors, 1),
+
+    // 图片下载与输入图片缓存
+    inputImageContentTypes: parseList(env.INPUT_IMAGE_CONTENT_TYPES || 'image/png,image/jpeg,image/webp,image/gif').map(type => type.toLowerCase()),
+    imageDownloadConcurrency: readInt(env, 'IMAGE_DOWNLOAD_CONCURRENCY', 4, errors, 1),
+    imageCacheTtlMs: readInt(env, 'IMAGE_CACHE_TTL_MS', 60 * 1000, errors),
+    imageCacheMaxEntries: readInt(env, 'IMAGE_CACHE_MAX_ENTRIES', 20, errors),
+
+    // 结果存储
+    resultStore: (env.RESULT_STORE || 'file').toLowerCase(),
+    resultDir: env.RESULT_DIR || '/tmp/aiyoutube-results',
+    resultTtlMs: readInt(env, 'RESULT_TTL_MS', 30 * 60 * 1000, errors, 1),
+    maxStoredResults: readInt(env, 'MAX_STORED_RESULTS', 10000, errors),
+    cleanupIntervalMs: readInt(env, 'CLEANUP_INTERVAL_MS', 60 * 1000, errors, 1),
+    cleanupJitter: readFraction(env, 'CLEANUP_JITTER', 0.2, errors),
+
+    // 输出水印
+    watermarkText: env.WATERMARK_TEXT || '',
+    watermarkPosition: (env.WATERMARK_POSITION || 'bottom-right').toLowerCase(),
+    watermarkOpacity: readFraction(env, 'WATERMARK_OPACITY', 0.5, errors),
+
+    // HTTP 接口
+    trustedProxies: parseList(env.TRUSTED_PROXIES),
+    accessLogFormat: (env.ACCESS_LOG_FORMAT || 'text').toLowerCase(),
+    accessLogExcludePaths: parseList(env.ACCESS_LOG_EXCLUDE_PATHS === undefined ? `${env.HEALTH_PATH || '/health'},/metrics` : env.ACCESS_LOG_EXCLUDE_PATHS),
+    corsAllowedOrigins: parseList(env.CORS_ALLOWED_ORIGINS),
+    corsAllowedMethods: parseList(env.CORS_ALLOWED_METHODS),
+    corsAllowedHeaders: parseList(env.CORS_ALLOWED_HEADERS),
+    compressionMinBytes: readInt(env, 'COMPRESSION_MIN_BYTES', 1024, errors),
+    statusCacheMaxAge: readInt(env, 'STATUS_CACHE_MAX_AGE', 60, errors),
+    enableBrotli: readBool(env, 'ENABLE_BROTLI'),
+    enableSimpleGet: readBool(env, 'ENABLE_SIMPLE_GET'),
+    disableSyncEndpoint: readBool(env, 'DISABLE_SYNC_ENDPOINT'),
+    syncEarlyHints: readBool(env, 'SYNC_EARLY_HINTS'),
+    maintenanceMode: readBool(env, 'MAINTENANCE_MODE'),
+    maintenanceMessage: env.MAINTENANCE_MESSAGE || 'Service is under maintenance, please retry later',
+    modelCostTable: readModelTable(env, 'MODEL_COST_TABLE', errors),
+    maxImagesPerModel: readModelTable(env, 'MAX_IMAGES_PER_MODEL', errors, { integer: true }),
+    quotaDaily: readInt(env, 'QUOTA_DAILY', 0, errors),
+    quotaMonthly: readInt(env, 'QUOTA_MONTHLY', 0, errors),
+    tenantDailyQuotas: readModelTable(env, 'TENANT_DAILY_QUOTAS', errors, { integer: true, key: 'tenant' }),
+    tenantMonthlyQuotas: readModelTable(env, 'TENANT_MONTHLY_QUOTAS', errors, { integer: true, key: 'tenant' }),
+    quotaTenantClaim: env.QUOTA_TENANT_CLAIM || 'sub',
+    callbackConcurrency: readInt(env, 'CALLBACK_CONCURRENCY', 5, errors, 1),
+    callbackMaxRetries: readInt(env, 'CALLBACK_MAX_RETRIES', 2, errors),
+    callbackBackoffMs: readInt(env, 'CALLBACK_BACKOFF', 1000, errors),
+    adminToken: env.ADMIN_TOKEN || '',
+    jwtJwksUrl: env.JWT_JWKS_URL || '',
+    jwtAudience: env.JWT_AUDIENCE || '',
+    jwtIssuer: env.JWT_ISSUER || '',
+    jwtJwksCacheMs: readInt(env, 'JWT_JWKS_CACHE_MS', 10 * 60 * 1000, errors),
+    jwtClockSkewSeconds: readInt(env, 'JWT_CLOCK_SKEW_SECONDS', 30, errors),
+    requireNonce: readBool(env, 'REQUIRE_NONCE'),
+    nonceMaxSkewSeconds: readInt(env, 'NONCE_MAX_SKEW_SECONDS', 300, errors, 1),
+    nonceCacheSize: readInt(env, 'NONCE_CACHE_SIZE', 100000, errors, 1),
+    promptEnhancerUrl: env.PROMPT_ENHANCER_URL || 'https://yunwu.zeabur.app/v1/chat/completions',
+    promptEnhancerModel: env.PROMPT_ENHANCER_MODEL || 'gpt-4o-mini',
+    promptEnhancerApiKey: env.PROMPT_ENHANCER_API_KEY || '',
+    moderationUrl: env.MODERATION_URL || '',
+    moderationApiKey: env.MODERATION_API_KEY || '',
+    moderationThreshold: readFraction(env, 'MODERATION_THRESHOLD', 0.5, errors),
+    callbackSigningSecret: env.CALLBACK_SIGNING_SECRET || '',
+    allowPrivateCallbacks: readBool(env, 'ALLOW_PRIVATE_CALLBACKS'),
+    requireHttpsCallbacks: readBool(env, 'REQUIRE_HTTPS_CALLBACKS'),
+    auditLog: env.AUDIT_LOG || ''
+  };
+
+  const invalidProxies = config.trustedProxies.filter(entry => !isValidProxyEntry(entry));
+  if (invalidProxies.length > 0) {
+    errors.push(`TRUSTED_PROXIES entries must be IPs, CIDRs or one of ${PROXY_PRESETS.join(', ')}, got "${invalidProxies.join(', ')}"`);
+  }
+  const invalidRegions = config.upstreamRegions.filter(entry => !/^https?:\/\/[^/?#]+(\/[^?#]*)?$/i.test(entry));
+  if (invalidRegions.length > 0) {
+    errors.push(`UPSTREAM_REGIONS entries must be http(s) base URLs without query or fragment, got "${invalidRegions.join(', ')}"`);
+  }
+  if (!/^\/[^?#\s]*$/.test(config.healthPath)) {
+    errors.push(`HEALTH_PATH must be a path starting with /, got "${config.healthPath}"`);
+  }
+  if (config.healthPort && config.healthPort === config.port) {
+    errors.push(`HEALTH_PORT must differ from PORT (${config.port}), leave it unset to serve health checks on the main port`);
+  }
+  if (!parseAuthMode(config.upstreamAuthMode)) {
+    errors.push(`UPSTREAM_AUTH_MODE must be bearer, header:<name> or query:<param>, got "${config.upstreamAuthMode}"`);
+  }
+  if (!RESULT_STORES.includes(config.resultStore)) {
+    errors.push(`RESULT_STORE must be one of ${RESULT_STORES.join(', ')}, got "${env.RESULT_STORE}"`);
+  }
+  if (!WATERMARK_POSITIONS.includes(config.watermarkPosition)) {
+    errors.push(`WATERMARK_POSITION must be one of ${WATERMARK_POSITIONS.join(', ')}, got "${env.WATERMARK_POSITION}"`);
+  }
+  if (!ACCESS_LOG_FORMATS.includes(config.accessLogFormat)) {
+    errors.push(`ACCESS_LOG_FORMAT must be one of ${ACCESS_LOG_FORMATS.join(', ')}, got "${env.ACCESS_LOG_FORMAT}"`);
+  }
+  if (!LOG_LEVELS.includes(config.logLevel)) {
+    errors.push(`LOG_LEVEL must be one of ${LOG_LEVELS.join(', ')}, got "${env.LOG_LEVEL}"`);
+  }
+  if (config.jwtJwksUrl) {
+    if (!/^https?:\/\//.test(config.jwtJwksUrl)) {
+      errors.push(`JWT_JWKS_URL must be an http(s) URL, got "${config.jwtJwksUrl}"`);
+    }
+    if (!config.jwtAudience || !config.jwtIssuer) {
+      errors.push('JWT_AUDIENCE and JWT_ISSUER are required when JWT_JWKS_URL is set');
+    }
+  }
+  if (config.maxConcurrency > 0 && config.minConcurrency > config.maxConcurrency) {
+    errors.push(`MIN_CONCURRENCY (${config.minConcurrency}) must not exceed MAX_CONCURRENCY (${config.maxConcurrency})`);
+  }
+  if (config.auditLog && config.auditLog !== 'stdout' && !/^file:.+/.test(config.auditLog)) {
+    errors.push(`AUDIT_LOG must be stdout or file:<path>, got "${config.auditLog}"`);
+  }
+  if (config.concurrencyWarmupMs > 0 && config.maxConcurrency === 0) {
+    errors.push('CONCURRENCY_WARMUP_MS requires MAX_CONCURRENCY');
+  } else if (config.maxConcurrency > 0 && config.concurrencyWarmupStart > config.maxConcurrency) {
+    errors.push(`CONCURRENCY_WARMUP_START (${config.concurrencyWarmupStart}) must not exceed MAX_CONCURRENCY (${config.maxConcurrency})`);
+  }
+  if (config.failureAlarmMinSamples > config.failureAlarmWindow) {
+    errors.push(`FAILURE_ALARM_MIN_SAMPLES (${config.failureAlarmMinSamples}) must not exceed FAILURE_ALARM_WINDOW (${config.failureAlarmWindow})`);
+  }
+  if (config.memoryLowWaterPercent >= config.memoryHighWaterPercent) {
+    errors.push('MEMORY_LOW_WATER_PERCENT must be below MEMORY_HIGH_WATER_PERCENT');
+  }
+
+  if (errors.length > 0) {
+    throw new Error(`Invalid configuration:\n  ${errors.join('\n  ')}`);
+  }
+  return Object.freeze(config);
+}
+
+const SECRET_KEYS = ['adminToken', 'callbackSigningSecret', 'moderationApiKey', 'promptEnhancerApiKey'];
+
+// Copy of the config that is safe to log
+function redactConfig(config) {
+  const redacted = { ...config };
+  for (const key of SECRET_KEYS) {
+    if (redacted[key]) redacted[key] = '[redacted]';
+  }
+  return redacted;
+}
+
+module.exports = { loadConfig, redactConfig, parseList, parseAuthMode, LOG_LEVELS };
@@ -0,0 +1,227 @@
+// 最小的 gRPC 客户端：只实现 proto/imagegen.proto 中的 ImageGenerator.Generate（一元调用）
+// 直接用 Node 自带的 http2 收发 gRPC 帧，不需要额外依赖
+// 方法路径和消息的字段表在加载时由 proto 文件生成，修改 proto 后不需要同步修改这里；消息只支持 string 字段
+const fs = require('fs');
+const http2 = require('http2');
+const path = require('path');
+
+const PROTO_PATH = path.join(__dirname, 'proto', 'imagegen.proto');
+// 单条响应消息的上限，超过后取消调用，避免异常的服务端把进程内存撑满
+const DEFAULT_MAX_MESSAGE_BYTES = 64 * 1024 * 1024;
+
+// https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const GRPC_STATUS_NAMES = ['OK', 'CANCELLED', 'UNKNOWN', 'INVALID_ARGUMENT', 'DEADLINE_EXCEEDED', 'NOT_FOUND', 'ALREADY_EXISTS',
+  'PERMISSION_DENIED', 'RESOURCE_EXHAUSTED', 'FAILED_PRECONDITION', 'ABORTED', 'OUT_OF_RANGE', 'UNIMPLEMENTED', 'INTERNAL',
+  'UNAVAILABLE', 'DATA_LOSS', 'UNAUTHENTICATED'];
+
+const camelCase = name => name.replace(/_([a-z])/g, (match, letter) => letter.toUpperCase());
+
+// Generates { path, requestFields, responseFields } for service.method from the proto source
+// Field tables map camelCase names to { number, repeated }, and throw for anything other than string fields
+function loadMethod(source, serviceName, methodName) {
+  const text = source.replace(/\/\/.*$/gm, '');
+  const packageName = (text.match(/^\s*package\s+([\w.]+)\s*;/m) || [])[1];
+  const service = text.match(new RegExp(`service\\s+${serviceName}\\s*\\{([\\s\\S]*?)\\}`));
+  if (!service) throw new Error(`Service ${serviceName} not found in proto`);
+  const rpc = service[1].match(new RegExp(`rpc\\s+${methodName}\\s*\\(\\s*(\\w+)\\s*\\)\\s*returns\\s*\\(\\s*(\\w+)\\s*\\)`));
+  if (!rpc) throw new Error(`Method ${serviceName}.${methodName} not found in proto`);
+
+  const messageFields = messageName => {
+    const message = text.match(new RegExp(`message\\s+${messageName}\\s*\\{([^}]*)\\}`));
+    if (!message) throw new Error(`Message ${messageName} not found in proto`);
+    const fields = {};
+    for (const declaration of message[1].split(';').map(part => part.trim()).filter(Boolean)) {
+      const field = declaration.match(/^(repeated\s+)?(\w+)\s+(\w+)\s*=\s*(\d+)$/);
+      if (!field || field[2] !== 'string') throw new Error(`Unsupported field in ${messageName}: ${declaration}`);
+      fields[camelCase(field[3])] = { number: Number(field[4]), repeated: Boolean(field[1]) };
+    }
+    return fields;
+  };
+
+  return {
+    path: `/${packageName ? `${packageName}.` : ''}${serviceName}/${methodName}`,
+    requestFields: messageFields(rpc[1]),
+    responseFields: messageFields(rpc[2])
+  };
+}
+
+const GENERATE = loadMethod(fs.readFileSync(PROTO_PATH, 'utf8'), 'ImageGenerator', 'Generate');
+const GENERATE_PATH = GENERATE.path;
+
+function encodeVarint(value) {
+  const bytes = [];
+  while (value > 0x7f) {
+    bytes.push((value & 0x7f) | 0x80);
+    value = Math.floor(value / 128);
+  }
+  bytes.push(value);
+  return Buffer.from(bytes);
+}
+
+function readVarint(buffer, offset) {
+  let value = 0;
+  let multiplier = 1;
+  for (;;) {
+    if (offset >= buffer.length) throw new Error('Truncated protobuf varint');
+    const byte = buffer[offset++];
+    value += (byte & 0x7f) * multiplier;
+    if (byte < 0x80) return [value, offset];
+    multiplier *= 128;
+  }
+}
+
+function encodeRequest(request) {
+  const parts = [];
+  for (const [name, { number: fieldNumber }] of Object.entries(GENERATE.requestFields)) {
+    const value = request[name];
+    for (const item of Array.isArray(value) ? value : [value]) {
+      if (typeof item !== 'string' || item === '') continue;
+      const bytes = Buffer.from(item, 'utf8');
+      parts.push(encodeVarint((fieldNumber << 3) | 2), encodeVarint(bytes.length), bytes);
+    }
+  }
+  return Buffer.concat(parts);
+}
+
+const responseFieldsByNumber = new Map(
+  Object.entries(GENERATE.responseFields).map(([name, field]) => [field.number, { name, ...field }])
+);
+
+// Decodes a GenerateResponse, unknown fields are skipped
+function decodeResponse(buffer) {
+  const response = {};
+  for (const [name, field] of Object.entries(GENERATE.responseFields)) {
+    response[name] = field.repeated ? [] : '';
+  }
+  let offset = 0;
+  while (offset < buffer.length) {
+    let key;
+    [key, offset] = readVarint(buffer, offset);
+    const fieldNumber = Math.floor(key / 8);
+    const wireType = key & 7;
+    if (wireType === 0) {
+      [, offset] = readVarint(buffer, offset);
+    } else if (wireType === 1 || wireType === 5) {
+      offset += wireType === 1 ? 8 : 4;
+    } else if (wireType === 2) {
+      let length;
+      [length, offset] = readVarint(buffer, offset);
+      if (offset + length > buffer.length) throw new Error('Truncated protobuf field');
+      const field = responseFieldsByNumber.get(fieldNumber);
+      if (field) {
+        const value = buffer.toString('utf8', offset, offset + length);
+        if (field.repeated) response[field.name].push(value);
+        else response[field.name] = value;
+      }
+      offset += length;
+    } else {
+      throw new Error(`Unsupported protobuf wire type ${wireType}`);
+    }
+  }
+  return response;
+}
+
+// gRPC 消息帧：1 字节压缩标记 + 4 字节大端长度 + 消息
+function frameMessage(message) {
+  const header = Buffer.alloc(5);
+  header.writeUInt32BE(message.length, 1);
+  return Buffer.concat([header, message]);
+}
+
+function grpcError(code, message) {
+  const error = new Error(`gRPC ${GRPC_STATUS_NAMES[code] || code}: ${message}`);
+  error.grpcCode = code;
+  return error;
+}
+
+// Calls ImageGenerator.Generate on endpoint (grpc://host:port or grpcs://host:port)
+// Resolves to { imageUrls, finishReason, responseBytes }, rejects with error.grpcCode set for non-OK statuses
+// timeoutMs is sent as grpc-timeout and also enforced locally, so a server that ignores it can't hold the call open
+function callGenerate(endpoint, request, { metadata = {}, timeoutMs, signal, maxMessageBytes = DEFAULT_MAX_MESSAGE_BYTES } = {}) {
+  const url = new URL(endpoint);
+  const authority = `${url.protocol === 'grpcs:' ? 'https' : 'http'}://${url.host}`;
+
+  return new Promise((resolve, reject) => {
+    const session = http2.connect(authority);
+    let stream = null;
+    let timer = null;
+    let settled = false;
+    const finish = (error, value) => {
+      if (settled) return;
+      settled = true;
+      clearTimeout(timer);
+      signal?.removeEventListener('abort', onAbort);
+      session.close();
+      if (error) reject(error);
+      else resolve(value);
+    };
+    // Cancels the stream (RST_STREAM CANCEL) and fails the call with error
+    const cancel = error => {
+      stream?.close(http2.constants.NGHTTP2_CANCEL);
+      finish(error);
+    };
+    const onAbort = () => cancel(Object.assign(new Error('gRPC call aborted'), { name: 'AbortError' }));
+    session.on('error', error => finish(error));
+
+    const headers = {
+      ':method': 'POST',
+      ':path': GENERATE_PATH,
+      'content-type': 'application/grpc',
+      te: 'trailers',
+      ...metadata
+    };
+    if (timeoutMs) {
+      headers['grpc-timeout'] = `${Math.max(1, Math.ceil(timeoutMs))}m`;
+      timer = setTimeout(() => cancel(grpcError(4, `no response within ${timeoutMs}ms`)), timeoutMs);
+    }
+    stream = session.request(headers);
+    signal?.addEventListener('abort', onAbort, { once: true });
+    if (signal?.aborted) return onAbort();
+
+    const chunks = [];
+    let receivedBytes = 0;
+    let responseHeaders = {};
+    let responseTrailers = {};
+    stream.on('response', received => {
+      responseHeaders = received;
+    });
+    stream.on('trailers', received => {
+      responseTrailers = received;
+    });
+    stream.on('data', chunk => {
+      receivedBytes += chunk.length;
+      // 5 字节的帧头不计入消息大小
+      if (receivedBytes - 5 > maxMessageBytes) {
+        return cancel(grpcError(8, `response message is larger than ${maxMessageBytes} bytes`));
+      }
+      chunks.push(chunk);
+    });
+    stream.on('error', error => finish(error));
+    stream.on('end', () => {
+      // 出错时服务端可能只返回头部（Trailers-Only），grpc-status 在头部里
+      const trailers = { ...responseHeaders, ...responseTrailers };
+      const httpStatus = Number(responseHeaders[':status']);
+      if (httpStatus !== 200) {
+        return finish(grpcError(2, `HTTP status ${httpStatus}`));
+      }
+      const status = Number(trailers['grpc-status']);
+      if (status !== 0) {
+        return finish(grpcError(Number.isInteger(status) ? status : 2, decodeURIComponent(trailers['grpc-message'] || 'no message')));
+      }
+
+      const body = Buffer.concat(chunks);
+      if (body.length < 5) return finish(grpcError(13, 'empty response'));
+      if (body[0] !== 0) return finish(grpcError(12, 'compressed responses are not supported'));
+      const length = body.readUInt32BE(1);
+      try {
+        finish(null, { ...decodeResponse(body.subarray(5, 5 + length)), responseBytes: body.length });
+      } catch (error) {
+        finish(grpcError(13, error.message));
+      }
+    });
+
+    stream.end(frameMessage(encodeRequest(request)));
+  });
+}
+
+module.exports = { callGenerate, encodeRequest, decodeResponse, loadMethod, GENERATE_PATH, GRPC_STATUS_NAMES };
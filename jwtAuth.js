@@ -0,0 +1,133 @@
+// JWT 校验：用 JWKS（JWT_JWKS_URL）中的公钥校验 Bearer token 的签名，并检查有效期、aud 和 iss
+// 只用 Node 自带的 crypto，不需要额外依赖；支持 RS256/384/512、PS256/384/512、ES256/384/512
+const crypto = require('crypto');
+
+const ALGORITHMS = {
+  RS256: { hash: 'sha256', keyTypes: ['rsa'] },
+  RS384: { hash: 'sha384', keyTypes: ['rsa'] },
+  RS512: { hash: 'sha512', keyTypes: ['rsa'] },
+  PS256: { hash: 'sha256', keyTypes: ['rsa', 'rsa-pss'], padding: crypto.constants.RSA_PKCS1_PSS_PADDING },
+  PS384: { hash: 'sha384', keyTypes: ['rsa', 'rsa-pss'], padding: crypto.constants.RSA_PKCS1_PSS_PADDING },
+  PS512: { hash: 'sha512', keyTypes: ['rsa', 'rsa-pss'], padding: crypto.constants.RSA_PKCS1_PSS_PADDING },
+  ES256: { hash: 'sha256', keyTypes: ['ec'], dsaEncoding: 'ieee-p1363' },
+  ES384: { hash: 'sha384', keyTypes: ['ec'], dsaEncoding: 'ieee-p1363' },
+  ES512: { hash: 'sha512', keyTypes: ['ec'], dsaEncoding: 'ieee-p1363' }
+};
+
+const JWKS_FETCH_TIMEOUT_MS = 5000;
+// token 的 kid 不在缓存中时（密钥轮换）提前刷新 JWKS，但两次刷新至少间隔这么久，避免伪造的 kid 打满 JWKS 服务
+const MIN_JWKS_REFRESH_INTERVAL_MS = 30 * 1000;
+
+// The token can't be accepted, answered with 401
+function invalidToken(message) {
+  return Object.assign(new Error(message), { invalidToken: true });
+}
+
+// The header and payload must both be JSON objects, anything else (null, arrays, numbers) is malformed
+function decodeSegment(segment, name) {
+  let value;
+  try {
+    value = JSON.parse(Buffer.from(segment, 'base64url').toString('utf8'));
+  } catch (error) {
+    throw invalidToken(`Malformed token ${name}`);
+  }
+  if (value === null || typeof value !== 'object' || Array.isArray(value)) {
+    throw invalidToken(`Malformed token ${name}`);
+  }
+  return value;
+}
+
+function createJwtVerifier({ jwksUrl, audience, issuer, cacheMs, clockSkewSeconds }) {
+  let keys = new Map(); // kid -> { key, alg }
+  let fetchedAt = 0;
+  let pending = null;
+
+  async function fetchKeys() {
+    const response = await fetch(jwksUrl, { signal: AbortSignal.timeout(JWKS_FETCH_TIMEOUT_MS) });
+    if (!response.ok) {
+      throw new Error(`JWKS request failed with status ${response.status}`);
+    }
+    const { keys: jwks } = await response.json();
+    if (!Array.isArray(jwks)) {
+      throw new Error('JWKS response has no keys array');
+    }
+
+    const loaded = new Map();
+    for (const jwk of jwks) {
+      if (jwk.use && jwk.use !== 'sig') continue;
+      try {
+        loaded.set(jwk.kid || '', { key: crypto.createPublicKey({ key: jwk, format: 'jwk' }), alg: jwk.alg });
+      } catch (error) {
+        console.warn(`[JWT] Skipping unusable JWKS key ${jwk.kid || '(no kid)'}: ${error.message}`);
+      }
+    }
+    keys = loaded;
+    fetchedAt = Date.now();
+    console.log(`[JWT] Loaded ${loaded.size} signing key(s) from JWKS`);
+  }
+
+  // Concurrent refreshes share one request; a failed refresh keeps the previous keys
+  function refresh() {
+    if (!pending) {
+      pending = fetchKeys().finally(() => {
+        pending = null;
+      });
+    }
+    return pending;
+  }
+
+  async function getKey(kid) {
+    const age = Date.now() - fetchedAt;
+    if (fetchedAt === 0 || age > cacheMs || (!keys.has(kid) && age > MIN_JWKS_REFRESH_INTERVAL_MS)) {
+      try {
+        await refresh();
+      } catch (error) {
+        if (fetchedAt === 0) throw error;
+        console.error('[JWT] JWKS refresh failed, using cached keys:', error.message);
+      }
+    }
+    return keys.get(kid) || null;
+  }
+
+  // Resolves to the token's claims, rejects with invalidToken set when the token is not acceptable
+  async function verify(token) {
+    const segments = token.split('.');
+    if (segments.length !== 3) throw invalidToken('Malformed token');
+    const header = decodeSegment(segments[0], 'header');
+    const claims = decodeSegment(segments[1], 'payload');
+
+    const algorithm = ALGORITHMS[header.alg];
+    if (!algorithm) throw invalidToken(`Unsupported token algorithm ${header.alg}`);
+    const entry = await getKey(header.kid || '');
+    if (!entry) throw invalidToken('Unknown token signing key');
+    if ((entry.alg && entry.alg !== header.alg) || !algorithm.keyTypes.includes(entry.key.asymmetricKeyType)) {
+      throw invalidToken('Token algorithm does not match the signing key');
+    }
+
+    let valid = false;
+    try {
+      valid = crypto.verify(algorithm.hash, Buffer.from(`${segments[0]}.${segments[1]}`), {
+        key: entry.key,
+        padding: algorithm.padding,
+        saltLength: algorithm.padding ? crypto.constants.RSA_PSS_SALTLEN_DIGEST : undefined,
+        dsaEncoding: algorithm.dsaEncoding
+      }, Buffer.from(segments[2], 'base64url'));
+    } catch (error) {
+      valid = false;
+    }
+    if (!valid) throw invalidToken('Invalid token signature');
+
+    const now = Date.now() / 1000;
+    if (typeof claims.exp !== 'number') throw invalidToken('Token has no expiry');
+    if (now > claims.exp + clockSkewSeconds) throw invalidToken('Token has expired');
+    if (typeof claims.nbf === 'number' && now < claims.nbf - clockSkewSeconds) throw invalidToken('Token is not valid yet');
+    const audiences = Array.isArray(claims.aud) ? claims.aud : [claims.aud];
+    if (!audiences.includes(audience)) throw invalidToken('Token audience is not accepted');
+    if (claims.iss !== issuer) throw invalidToken('Token issuer is not accepted');
+    return claims;
+  }
+
+  return { verify };
+}
+
+module.exports = { createJwtVerifier };
@@ -1,9 +1,28 @@
 const express = require('express');
 const cors = require('cors');
 const dns = require('dns').promises;
+const { lookup: dnsLookup } = require('dns');
 const os = require('os');
+const net = require('net');
 const http = require('http');
 const https = require('https');
+const crypto = require('crypto');
+const zlib = require('zlib');
+const { Readable, pipeline } = require('stream');
+const { EventEmitter } = require('events');
+const { AsyncLocalStorage } = require('async_hooks');
+const diagnosticsChannel = require('diagnostics_channel');
+const { loadConfig, redactConfig, parseAuthMode, LOG_LEVELS } = require('./config');
+const { callGenerate: callGrpcGenerate } = require('./grpcClient');
+const { createJwtVerifier } = require('./jwtAuth');
+
+let config;
+try {
+  config = loadConfig(process.env);
+} catch (error) {
+  console.error(error.message);
+  process.exit(1);
+}
 
 // 优化连接池配置：因为并发=1，不需要太大的连接池
 http.globalAgent.maxSockets = 10;
@@ -15,19 +34,104 @@ https.globalAgent.keepAliveMsecs = 1000;
 
 const app = express();
 
-app.use(cors());
+// 只信任 TRUSTED_PROXIES 中列出的代理转发的 X-Forwarded-For，未配置时 req.ip 就是直连的对端地址
+app.set('trust proxy', config.trustedProxies.length > 0 ? config.trustedProxies : false);
+
+// CORS：配置 CORS_ALLOWED_ORIGINS 后只允许列出的来源
+// 未配置时仍然允许所有来源：改动前一直是 app.use(cors())，默认关闭 CORS 会让现有的浏览器客户端失效
+// 浏览器端可以读取的响应头：请求 id 和同步生成的元数据头
+const EXPOSED_HEADERS = ['X-Request-Id', 'X-Task-Id', 'X-Model', 'X-Duration-Ms', 'X-Attempts', 'X-Upstream-Request-Id'];
+
+function buildCorsOptions({ corsAllowedOrigins: origins, corsAllowedMethods: methods, corsAllowedHeaders: headers }) {
+  const options = { exposedHeaders: EXPOSED_HEADERS };
+  if (origins.length > 0) {
+    options.origin = origins.includes('*') ? '*' : origins;
+  }
+  if (methods.length > 0) {
+    options.methods = methods;
+  }
+  if (headers.length > 0) {
+    options.allowedHeaders = headers;
+  }
+  return options;
+}
+
+// 访问日志：每个 HTTP 请求结束时输出一行（ACCESS_LOG_FORMAT=text|json|off），ACCESS_LOG_EXCLUDE_PATHS 中的路径不记录
+// 请求 id 沿用客户端的 X-Request-Id（没有时生成），并在响应头中返回，方便和客户端日志对应
+const REQUEST_ID_PATTERN = /^[A-Za-z0-9._:-]{1,128}$/;
+
+function accessLog(req, res, next) {
+  const incomingId = req.get('x-request-id');
+  req.requestId = incomingId && REQUEST_ID_PATTERN.test(incomingId) ? incomingId : crypto.randomUUID();
+  res.set('X-Request-Id', req.requestId);
+  if (config.accessLogFormat === 'off' || config.accessLogExcludePaths.includes(req.path)) {
+    return next();
+  }
+
+  const startTime = process.hrtime.bigint();
+  let bytes = 0;
+  const countBytes = (chunk, encoding) => {
+    if (chunk) bytes += Buffer.isBuffer(chunk) ? chunk.length : Buffer.byteLength(chunk, typeof encoding === 'string' ? encoding : 'utf8');
+  };
+  const write = res.write;
+  const end = res.end;
+  res.write = function (chunk, encoding, ...rest) {
+    countBytes(chunk, encoding);
+    return write.call(this, chunk, encoding, ...rest);
+  };
+  res.end = function (chunk, encoding, ...rest) {
+    if (typeof chunk !== 'function') countBytes(chunk, encoding);
+    return end.call(this, chunk, encoding, ...rest);
+  };
+
+  res.on('close', () => {
+    const entry = {
+      method: req.method,
+      path: req.path,
+      status: res.statusCode,
+      latencyMs: Math.round(Number(process.hrtime.bigint() - startTime) / 1e4) / 100,
+      ip: req.ip,
+      requestId: req.requestId,
+      bytes,
+      aborted: !res.writableFinished || undefined
+    };
+    if (config.accessLogFormat === 'json') {
+      process.stdout.write(JSON.stringify({ type: 'access', timestamp: new Date().toISOString(), ...entry }) + '\n');
+    } else {
+      console.log(`[ACCESS] ${entry.method} ${entry.path} ${entry.status} ${entry.latencyMs}ms ${entry.bytes}B ip=${entry.ip} id=${entry.requestId}${entry.aborted ? ' aborted' : ''}`);
+    }
+  });
+  next();
+}
+
+app.use(accessLog);
+
+// cors 中间件同时处理所有路由的 OPTIONS 预检请求
+app.use(cors(buildCorsOptions(config)));
 app.use(express.json({ limit: '50mb' }));
 
-const PORT = process.env.PORT || 8080;
+// 请求体不是合法 JSON 时返回结构化错误，而不是默认的 HTML 错误页
+app.use((error, req, res, next) => {
+  if (error.type !== 'entity.parse.failed' && error.type !== 'entity.too.large') {
+    return next(error);
+  }
+  res.status(error.status || 400).json({
+    error: error.type === 'entity.too.large' ? 'Request body too large' : 'Request body must be valid JSON',
+    errorCode: 'INVALID_REQUEST',
+    fields: []
+  });
+});
 
 // Pre-warm DNS cache for Cloudflare Workers domain
 const CLOUDFLARE_WORKER_DOMAIN = 'aiyoutube-backend-prod.hueshu.workers.dev';
 
 // Pre-resolve DNS on startup to warm the cache
+let dnsPreResolved = false;
 (async () => {
   try {
     const addresses = await dns.resolve4(CLOUDFLARE_WORKER_DOMAIN);
     if (addresses && addresses.length > 0) {
+      dnsPreResolved = true;
       console.log(`DNS cache warmed for ${CLOUDFLARE_WORKER_DOMAIN}: ${addresses[0]}`);
     }
   } catch (error) {
@@ -35,44 +139,240 @@ const CLOUDFLARE_WORKER_DOMAIN = 'aiyoutube-backend-prod.hueshu.workers.dev';
   }
 })();
 
+// 最近 N 个样本的环形缓冲，用于计算分位数
+const STATS_SAMPLE_SIZE = 200;
+
+function percentile(sorted, p) {
+  if (sorted.length === 0) return null;
+  const index = Math.min(sorted.length - 1, Math.ceil((p / 100) * sorted.length) - 1);
+  return sorted[Math.max(0, index)];
+}
+
+function createSampleWindow(size) {
+  const samples = [];
+  let next = 0;
+  return {
+    add(value) {
+      if (samples.length < size) {
+        samples.push(value);
+      } else {
+        samples[next] = value;
+        next = (next + 1) % size;
+      }
+    },
+    summary() {
+      const sorted = [...samples].sort((a, b) => a - b);
+      return {
+        p50: percentile(sorted, 50),
+        p95: percentile(sorted, 95),
+        max: sorted.length > 0 ? sorted[sorted.length - 1] : null,
+        samples: sorted.length
+      };
+    }
+  };
+}
+
+// 任务耗时统计：EMA 反映趋势，分位数来自最近的样本
+const LATENCY_EMA_ALPHA = 0.2;
+const latencyWindow = createSampleWindow(STATS_SAMPLE_SIZE);
+let latencyEma = null;
+
+function recordLatency(durationMs) {
+  latencyEma = latencyEma === null
+    ? durationMs
+    : LATENCY_EMA_ALPHA * durationMs + (1 - LATENCY_EMA_ALPHA) * latencyEma;
+  latencyWindow.add(durationMs);
+}
+
+// 按模型统计的上游调用耗时 EMA（只统计成功返回的调用），用于 /api/generate/estimate
+const modelLatency = new Map(); // model -> { ema, samples }
+
+function recordModelLatency(model, durationMs) {
+  const entry = modelLatency.get(model);
+  modelLatency.set(model, entry
+    ? { ema: LATENCY_EMA_ALPHA * durationMs + (1 - LATENCY_EMA_ALPHA) * entry.ema, samples: entry.samples + 1 }
+    : { ema: durationMs, samples: 1 });
+}
+
+function getLatencySummary() {
+  return {
+    ema: latencyEma === null ? null : Math.round(latencyEma),
+    ...latencyWindow.summary()
+  };
+}
+
+// 上游响应体大小统计（Gemini 的 base64 响应可能有几MB，用于对照内存峰值）
+const responseSizeWindow = createSampleWindow(STATS_SAMPLE_SIZE);
+
+// 最近一分钟的吞吐量：按秒分桶滚动计数，桶在下次写入或读取时按时间戳懒惰清零，不需要定时器
+const ROLLING_WINDOW_SECONDS = 60;
+
+function createRollingCounter(fields, windowSeconds = ROLLING_WINDOW_SECONDS, now = () => Date.now()) {
+  const buckets = Array.from({ length: windowSeconds }, () => ({ second: -1, counts: {} }));
+
+  function bucketFor(second) {
+    const bucket = buckets[second % windowSeconds];
+    if (bucket.second !== second) {
+      bucket.second = second;
+      bucket.counts = {};
+    }
+    return bucket;
+  }
+
+  return {
+    add(field) {
+      const bucket = bucketFor(Math.floor(now() / 1000));
+      bucket.counts[field] = (bucket.counts[field] || 0) + 1;
+    },
+    snapshot() {
+      const current = Math.floor(now() / 1000);
+      const totals = Object.fromEntries(fields.map(field => [field, 0]));
+      for (const bucket of buckets) {
+        if (current - bucket.second >= windowSeconds || bucket.second > current) continue;
+        for (const field of fields) totals[field] += bucket.counts[field] || 0;
+      }
+      return totals;
+    }
+  };
+}
+
+const lastMinute = createRollingCounter(['processed', 'succeeded', 'failed']);
+
+// 失败率告警：最近 N 次生成里失败比例超过阈值（且样本数足够）时标记 degraded，比例回落后自动清除
+const failureAlarm = { outcomes: [], degraded: false };
+
+function recordOutcome(succeeded) {
+  lastMinute.add(succeeded ? 'succeeded' : 'failed');
+  const { outcomes } = failureAlarm;
+  outcomes.push(succeeded);
+  if (outcomes.length > config.failureAlarmWindow) outcomes.shift();
+  if (outcomes.length < config.failureAlarmMinSamples) return;
+
+  const failurePercent = outcomes.filter(ok => !ok).length / outcomes.length * 100;
+  const exceeded = failurePercent > config.failureAlarmThresholdPercent;
+  if (exceeded && !failureAlarm.degraded) {
+    failureAlarm.degraded = true;
+    console.warn(`[ALARM] Failure ratio ${failurePercent.toFixed(1)}% over last ${outcomes.length} generations exceeds ${config.failureAlarmThresholdPercent}%, marking service degraded`);
+  } else if (!exceeded && failureAlarm.degraded) {
+    failureAlarm.degraded = false;
+    console.log(`[ALARM] Failure ratio recovered to ${failurePercent.toFixed(1)}%, clearing degraded flag`);
+  }
+}
+
 // Health check
-app.get('/', (req, res) => {
+function healthHandler(req, res) {
   res.json({ 
-    status: 'healthy', 
+    status: failureAlarm.degraded ? 'degraded' : 'healthy',
     service: 'AI Image Generation Proxy',
     timestamp: new Date().toISOString(),
-    dnsPreResolved: !!cloudflareWorkerHost
+    degraded: failureAlarm.degraded,
+    maintenance: maintenance.enabled,
+    logLevel,
+    dnsPreResolved,
+    activeTasks,
+    totalProcessed,
+    lastMinute: lastMinute.snapshot(),
+    callbacks: callbackSlots.stats(),
+    upstreamRegions: upstreamRegions.length > 0 ? getRegionSummary() : undefined,
+    latencyMs: getLatencySummary(),
+    responseBytes: responseSizeWindow.summary()
   });
+}
+
+// 健康检查路径 HEALTH_PATH；设置 HEALTH_PORT 时健康检查和 /readyz 只在单独的端口上提供，不占用业务端口
+const healthRoutes = express.Router();
+healthRoutes.get(config.healthPath, healthHandler);
+
+// Readiness probe, fails while the failure-ratio alarm is raised
+healthRoutes.get('/readyz', (req, res) => {
+  if (failureAlarm.degraded) {
+    return res.status(503).json({ ready: false, reason: 'failure ratio above threshold' });
+  }
+  res.json({ ready: true });
 });
 
+app.get('/', healthHandler);
+if (!config.healthPort) {
+  app.use(healthRoutes);
+}
+
 // Helper function to wait
 const wait = (ms) => new Promise(resolve => setTimeout(resolve, ms));
 
+// 日志级别：设置 LOG_LEVEL=debug 时才输出完整的上游错误等详细内容
+// 运行中可以通过 POST /admin/loglevel 修改，不需要重新部署
+let logLevel = config.logLevel;
+
+function debugLog(...args) {
+  if (logLevel === 'debug') {
+    console.log('[DEBUG]', ...args);
+  }
+}
+
+// 截断错误信息（MAX_ERROR_LENGTH），避免把几KB的HTML错误页存进结果或发给回调方
+function truncateErrorText(text, maxLength = config.maxErrorLength) {
+  if (typeof text !== 'string' || text.length <= maxLength) {
+    return text;
+  }
+  return `${text.slice(0, maxLength)}... [truncated ${text.length - maxLength} chars]`;
+}
+
+// 回调签名：配置 CALLBACK_SIGNING_SECRET 后，对 "<timestamp>.<body>" 做 HMAC-SHA256，接收方可据此校验来源
+function signCallback(timestamp, body) {
+  return `sha256=${crypto.createHmac('sha256', config.callbackSigningSecret).update(`${timestamp}.${body}`).digest('hex')}`;
+}
+
+// 回调请求体格式（callbackContentType）：默认 JSON；表单格式时数组字段重复同一个键，对象字段（tags）展开为 key[name]
+const CALLBACK_CONTENT_TYPES = ['application/json', 'application/x-www-form-urlencoded'];
+
+function encodeCallbackBody(data, contentType) {
+  if (contentType !== 'application/x-www-form-urlencoded') return JSON.stringify(data);
+
+  const form = new URLSearchParams();
+  for (const [key, value] of Object.entries(data)) {
+    if (value === undefined || value === null) continue;
+    if (Array.isArray(value)) {
+      for (const item of value) form.append(key, typeof item === 'object' ? JSON.stringify(item) : String(item));
+    } else if (typeof value === 'object') {
+      for (const [name, item] of Object.entries(value)) form.append(`${key}[${name}]`, typeof item === 'object' ? JSON.stringify(item) : String(item));
+    } else {
+      form.append(key, String(value));
+    }
+  }
+  return form.toString();
+}
+
 // Optimized callback function using fetch for better performance in container environments
 // fetch performs much better than https.request in GCR containers (55-500ms vs 15-22s)
-async function sendCallback(callbackUrl, data) {
+async function sendCallback(callbackUrl, data, extraHeaders = {}, contentType = 'application/json') {
+  if (data && typeof data.error === 'string') {
+    data = { ...data, error: truncateErrorText(data.error) };
+  }
+
+  // Create AbortController for timeout
+  const controller = new AbortController();
+  const timeoutId = setTimeout(() => controller.abort(), 30000); // 30 seconds timeout
+
   try {
-    // Create AbortController for timeout
-    const controller = new AbortController();
-    const timeoutId = setTimeout(() => controller.abort(), 30000); // 30 seconds timeout
-    
-    const response = await fetch(callbackUrl, {
-      method: 'POST',
-      headers: {
-        'Content-Type': 'application/json',
-        'Accept': 'application/json'
-      },
-      body: JSON.stringify(data),
-      signal: controller.signal
-    });
-    
-    clearTimeout(timeoutId);
+    const body = encodeCallbackBody(data, contentType);
+    const headers = {
+      ...extraHeaders,
+      'Content-Type': contentType,
+      'Accept': 'application/json'
+    };
+    if (config.callbackSigningSecret) {
+      const timestamp = Math.floor(Date.now() / 1000).toString();
+      headers['X-Callback-Timestamp'] = timestamp;
+      headers['X-Callback-Signature'] = signCallback(timestamp, body);
+    }
+
+    const status = await postCallback(callbackUrl, headers, body, controller.signal);
     
     // Don't wait for response body - just check status
     // This allows Workers to return immediately without us waiting for body
     return {
-      ok: response.ok,
-      status: response.status,
+      ok: status >= 200 && status < 300,
+      status,
       text: async () => 'Response not read to improve callback speed'
     };
   } catch (error) {
@@ -80,6 +380,241 @@ async function sendCallback(callbackUrl, data) {
       throw new Error('Request timeout after 30 seconds');
     }
     throw error;
+  } finally {
+    clearTimeout(timeoutId);
+  }
+}
+
+// 回调用 http(s).request 发送：连接时通过 guardedLookup 解析并检查地址，检查的就是实际连接的地址，
+// 不会被 DNS rebinding 绕过（先检查、再由 fetch 重新解析时，第二次解析可能指向内网）
+function postCallback(callbackUrl, headers, body, signal) {
+  return new Promise((resolve, reject) => {
+    const url = new URL(callbackUrl);
+    const guarded = !config.allowPrivateCallbacks && !internalCallbackUrls.has(callbackUrl);
+    const hostname = url.hostname.replace(/^\[|\]$/g, '');
+    // IP 地址不经过 lookup，直接检查
+    if (guarded && net.isIP(hostname) && isPrivateAddress(hostname)) {
+      return reject(privateCallbackError(hostname));
+    }
+
+    const request = (url.protocol === 'https:' ? https : http).request(url, {
+      method: 'POST',
+      headers: { ...headers, 'Content-Length': Buffer.byteLength(body) },
+      lookup: guarded ? guardedLookup : undefined,
+      signal
+    }, response => {
+      response.resume();
+      resolve(response.statusCode);
+    });
+    request.on('error', reject);
+    request.end(body);
+  });
+}
+
+function privateCallbackError(hostname) {
+  return Object.assign(new Error(`Callback host ${hostname} resolves to a private address`), { permanent: true });
+}
+
+// dns.lookup with the same signature, failing when any resolved address is private
+function guardedLookup(hostname, options, callback) {
+  dnsLookup(hostname, { ...options, all: true }, (error, addresses) => {
+    if (error) return callback(error);
+    if (addresses.some(({ address }) => isPrivateAddress(address))) {
+      return callback(privateCallbackError(hostname));
+    }
+    if (options.all) return callback(null, addresses);
+    callback(null, addresses[0].address, addresses[0].family);
+  });
+}
+
+function isValidCallbackUrl(callbackUrl) {
+  try {
+    const { protocol } = new URL(callbackUrl);
+    return protocol === 'https:' || protocol === 'http:';
+  } catch (error) {
+    return false;
+  }
+}
+
+// REQUIRE_HTTPS_CALLBACKS=true 时拒绝 http:// 回调地址，避免结果（含图片地址）明文传输
+// Returns an error message if callbackUrl can't be used, otherwise null
+function validateCallbackUrl(callbackUrl) {
+  if (!isValidCallbackUrl(callbackUrl)) {
+    return 'callbackUrl must be an http(s) URL';
+  }
+  if (config.requireHttpsCallbacks && new URL(callbackUrl).protocol !== 'https:') {
+    return 'callbackUrl must use https';
+  }
+  return null;
+}
+
+// SSRF 防护（回调地址和 uploadUrl）：解析主机名，任何一个地址落在内网、回环或链路本地网段时拒绝（ALLOW_PRIVATE_CALLBACKS=true 时跳过）
+const PRIVATE_NETWORKS = new net.BlockList();
+for (const [address, prefix] of [['0.0.0.0', 8], ['10.0.0.0', 8], ['100.64.0.0', 10], ['127.0.0.0', 8], ['169.254.0.0', 16], ['172.16.0.0', 12], ['192.168.0.0', 16]]) {
+  PRIVATE_NETWORKS.addSubnet(address, prefix, 'ipv4');
+}
+for (const [address, prefix] of [['::', 128], ['::1', 128], ['fc00::', 7], ['fe80::', 10]]) {
+  PRIVATE_NETWORKS.addSubnet(address, prefix, 'ipv6');
+}
+
+function isPrivateAddress(address) {
+  const mapped = address.match(/^::ffff:(\d+\.\d+\.\d+\.\d+)$/i);
+  if (mapped) return PRIVATE_NETWORKS.check(mapped[1], 'ipv4');
+  return PRIVATE_NETWORKS.check(address, net.isIPv6(address) ? 'ipv6' : 'ipv4');
+}
+
+// POST /api/generate/test 在本机临时起的回调接收端，不经过 SSRF 检查
+const internalCallbackUrls = new Set();
+
+// Returns an error message if the URL points at an internal address, otherwise null
+async function checkCallbackTarget(callbackUrl) {
+  if (config.allowPrivateCallbacks || internalCallbackUrls.has(callbackUrl)) return null;
+
+  const hostname = new URL(callbackUrl).hostname.replace(/^\[|\]$/g, '');
+  let addresses;
+  try {
+    addresses = net.isIP(hostname) ? [{ address: hostname }] : await dns.lookup(hostname, { all: true });
+  } catch (error) {
+    return `Could not resolve callback host ${hostname}`;
+  }
+  if (addresses.some(({ address }) => isPrivateAddress(address))) {
+    return `Callback host ${hostname} resolves to a private address`;
+  }
+  return null;
+}
+
+function validateCallbackContentType(callbackContentType) {
+  if (callbackContentType === undefined || CALLBACK_CONTENT_TYPES.includes(callbackContentType)) return null;
+  return `callbackContentType must be one of ${CALLBACK_CONTENT_TYPES.join(', ')}`;
+}
+
+const MAX_CALLBACK_HEADERS = 20;
+// 调用方只能设置 Authorization 和 X- 开头的自定义头；签名、转发相关的头由代理设置，不能覆盖
+const RESERVED_CALLBACK_HEADERS = /^x-(callback-|forwarded-|real-ip$)/i;
+
+function isAllowedCallbackHeader(name) {
+  return /^authorization$/i.test(name) || (/^x-/i.test(name) && !RESERVED_CALLBACK_HEADERS.test(name));
+}
+
+function validateCallbackHeaders(callbackHeaders) {
+  if (callbackHeaders === undefined) return null;
+  if (typeof callbackHeaders !== 'object' || callbackHeaders === null || Array.isArray(callbackHeaders)) {
+    return 'callbackHeaders must be an object';
+  }
+  const entries = Object.entries(callbackHeaders);
+  if (entries.length > MAX_CALLBACK_HEADERS) {
+    return `callbackHeaders must have at most ${MAX_CALLBACK_HEADERS} entries`;
+  }
+  for (const [name, value] of entries) {
+    if (!/^[A-Za-z0-9-]+$/.test(name) || typeof value !== 'string' || /[\r\n]/.test(value)) {
+      return `Invalid callback header "${name}"`;
+    }
+    if (!isAllowedCallbackHeader(name)) {
+      return `Callback header "${name}" can't be set, only Authorization and X- headers are allowed`;
+    }
+  }
+  return null;
+}
+
+// 任务状态：pending（排队中）、processing（调用上游中）、completed、failed、cancelled，后三种为最终状态
+const TERMINAL_STATUSES = ['completed', 'failed', 'cancelled'];
+
+// 已存储结果对应的任务状态（旧结果没有 status 字段时根据 success 推断）
+function resultStatus(result) {
+  if (result.status) return result.status;
+  if (result.success) return 'completed';
+  return result.cancelled ? 'cancelled' : 'failed';
+}
+
+function isTerminalResult(result) {
+  return TERMINAL_STATUSES.includes(resultStatus(result));
+}
+
+// 回调内容：任务的最终状态
+function buildCallbackPayload(taskId, result) {
+  return {
+    taskId,
+    parentTaskId: result.parentTaskId,
+    status: resultStatus(result),
+    imageUrl: result.imageUrl,
+    imageUrls: result.imageUrls,
+    error: result.error,
+    errorCode: result.errorCode,
+    finishReason: result.finishReason,
+    timings: result.timings,
+    cancelledBy: result.cancelledBy,
+    upstreamRequestId: result.upstreamRequestId,
+    model: result.model,
+    tags: result.tags,
+    durationMs: result.durationMs,
+    createdAt: result.createdAt,
+    completedAt: result.completedAt,
+    timestamp: result.timestamp
+  };
+}
+
+// 简单的计数信号量：最多 limit 个同时进行，其余按到达顺序排队
+function createSemaphore(limit) {
+  let running = 0;
+  const waiters = [];
+  return {
+    acquire() {
+      if (running < limit) {
+        running++;
+        return Promise.resolve();
+      }
+      return new Promise(resolve => waiters.push(resolve));
+    },
+    // Hand the slot straight to the next waiter, if any
+    release() {
+      const next = waiters.shift();
+      if (next) {
+        next();
+      } else {
+        running--;
+      }
+    },
+    stats() {
+      return { running, queued: waiters.length };
+    }
+  };
+}
+
+// 回调发送限流（CALLBACK_CONCURRENCY）：大量任务同时完成时排队发送，避免同时压到慢的接收方
+const callbackSlots = createSemaphore(config.callbackConcurrency);
+
+// 回调重试与上游重试分开配置（CALLBACK_MAX_RETRIES、CALLBACK_BACKOFF）：网络错误、5xx 和 429 时重试，等待时间从 CALLBACK_BACKOFF 毫秒开始翻倍
+// 等待期间不占用发送名额
+const MAX_CALLBACK_BACKOFF_MS = 5 * 60 * 1000;
+
+function isRetryableCallbackStatus(status) {
+  return status >= 500 || status === 429;
+}
+
+// Fire-and-forget delivery, the result stays available for polling either way
+async function deliverCallback(callbackUrl, payload, taskId, contentType) {
+  const attempts = config.callbackMaxRetries + 1;
+  for (let attempt = 1; ; attempt++) {
+    await callbackSlots.acquire();
+    const startTime = Date.now();
+    let response;
+    try {
+      // 提交时已经检查过，发送时 postCallback 还会检查实际连接的地址，防止域名之后被改指向内网地址
+      response = await sendCallback(callbackUrl, payload, {}, contentType);
+      console.log(`[${taskId}] Callback delivered in ${Date.now() - startTime}ms, status: ${response.status}`);
+    } catch (error) {
+      console.error(`[${taskId}] Callback failed (attempt ${attempt} of ${attempts}):`, error.message);
+      if (error.permanent || attempt >= attempts) throw error;
+    } finally {
+      callbackSlots.release();
+    }
+
+    if (response && (!isRetryableCallbackStatus(response.status) || attempt >= attempts)) {
+      return response;
+    }
+    const delay = Math.min(config.callbackBackoffMs * Math.pow(2, attempt - 1), MAX_CALLBACK_BACKOFF_MS);
+    console.log(`[${taskId}] Retrying callback in ${delay}ms`);
+    await wait(delay);
   }
 }
 
@@ -125,11 +660,245 @@ function getResourceUsage() {
 let activeTasks = 0;
 let totalProcessed = 0;
 
+// 上游并发控制（MAX_CONCURRENCY，默认 0 不限制，和之前一样全部并行）：同时调用上游的任务数不超过当前上限，其余排队等待
+// 设置上限后，内存高于高水位时降低上限，低于低水位时逐步恢复（接近 512MB 限制时避免 OOM）
+// 启动预热（CONCURRENCY_WARMUP_MS > 0 时，需要设置 MAX_CONCURRENCY）：上限从 CONCURRENCY_WARMUP_START 线性增长到 MAX_CONCURRENCY，避免冷启动时压垮上游
+const concurrency = {
+  limit: config.maxConcurrency || Infinity,
+  ceiling: config.concurrencyWarmupMs > 0 ? config.concurrencyWarmupStart : (config.maxConcurrency || Infinity),
+  running: 0,
+  waiters: []
+};
+
+// The memory-adjusted limit, capped by the warmup ceiling
+function effectiveLimit() {
+  return Math.min(concurrency.limit, concurrency.ceiling);
+}
+
+// Warmup ceiling at a given time since startup
+function warmupCeiling(elapsedMs) {
+  const { concurrencyWarmupMs: duration, concurrencyWarmupStart: start, maxConcurrency: max } = config;
+  if (duration <= 0 || elapsedMs >= duration) return max;
+  return Math.floor(start + (max - start) * (elapsedMs / duration));
+}
+
+// Wait until a slot is free under the current limit
+function acquireSlot() {
+  if (concurrency.running < effectiveLimit()) {
+    concurrency.running++;
+    return Promise.resolve();
+  }
+  return new Promise(resolve => concurrency.waiters.push(resolve));
+}
+
+function releaseSlot() {
+  concurrency.running--;
+  drainWaiters();
+}
+
+// Hand free slots to queued tasks in arrival order
+function drainWaiters() {
+  while (concurrency.waiters.length > 0 && concurrency.running < effectiveLimit()) {
+    concurrency.running++;
+    concurrency.waiters.shift()();
+  }
+}
+
+// 新任务大约还要等多久才能拿到并发名额：排在它前面的任务按当前上限分批完成，每批按平均任务耗时估算
+function estimateQueueWait() {
+  const queueDepth = concurrency.waiters.length;
+  const limit = effectiveLimit();
+  if (concurrency.running < limit && queueDepth === 0) {
+    return { queueDepth, estimatedStartSeconds: 0 };
+  }
+  const averageMs = latencyEma === null ? FALLBACK_MODEL_LATENCY_MS : latencyEma;
+  return { queueDepth, estimatedStartSeconds: Math.ceil((queueDepth + 1) / limit * averageMs / 1000) };
+}
+
+// 后台任务数满时建议的重试等待：需要有多少个任务完成才能空出名额，按当前并发上限和平均任务耗时估算
+function estimateRetryAfterSeconds(tasksToDrain) {
+  const averageMs = latencyEma === null ? FALLBACK_MODEL_LATENCY_MS : latencyEma;
+  return Math.max(1, Math.ceil(Math.max(1, tasksToDrain) / effectiveLimit() * averageMs / 1000));
+}
+
+// Lower the limit under memory pressure and raise it back step by step once memory recovers
+function adjustConcurrency(memoryPercent) {
+  const previous = concurrency.limit;
+
+  if (memoryPercent >= config.memoryHighWaterPercent) {
+    concurrency.limit = Math.max(config.minConcurrency, Math.floor(previous / 2));
+  } else if (memoryPercent <= config.memoryLowWaterPercent) {
+    concurrency.limit = Math.min(config.maxConcurrency, previous + 1);
+  }
+
+  if (concurrency.limit !== previous) {
+    console.warn(`[CONCURRENCY] Limit ${previous} -> ${concurrency.limit} (memory ${memoryPercent}%)`);
+    drainWaiters();
+  }
+  return concurrency.limit;
+}
+
+if (config.maxConcurrency > 0) {
+  setInterval(() => {
+    adjustConcurrency(parseFloat(getResourceUsage().memoryMB.percent));
+  }, config.adaptiveCheckIntervalMs).unref();
+}
+
+if (concurrency.ceiling < config.maxConcurrency) {
+  const warmupStartedAt = Date.now();
+  console.log(`[CONCURRENCY] Warming up from ${concurrency.ceiling} to ${config.maxConcurrency} over ${config.concurrencyWarmupMs}ms`);
+  const warmupTimer = setInterval(() => {
+    const ceiling = warmupCeiling(Date.now() - warmupStartedAt);
+    if (ceiling === concurrency.ceiling) return;
+
+    console.log(`[CONCURRENCY] Warmup ceiling ${concurrency.ceiling} -> ${ceiling}`);
+    concurrency.ceiling = ceiling;
+    drainWaiters();
+    if (ceiling >= config.maxConcurrency) {
+      clearInterval(warmupTimer);
+    }
+  }, 1000);
+  warmupTimer.unref();
+}
+
+// 上游鉴权方式：bearer（默认）、header:<name>（如 header:x-api-key）、query:<param>（如 query:key），格式由 config.js 的 parseAuthMode 校验
+// Place the API key on the request according to the auth mode, returns the final URL
+function applyAuth(apiUrl, headers, apiKey, authMode) {
+  const mode = parseAuthMode(authMode) || { type: 'bearer' };
+
+  if (mode.type === 'header') {
+    headers[mode.name] = apiKey;
+    return apiUrl;
+  }
+  if (mode.type === 'query') {
+    const url = new URL(apiUrl);
+    url.searchParams.set(mode.name, apiKey);
+    return url.toString();
+  }
+  headers['Authorization'] = `Bearer ${apiKey}`;
+  return apiUrl;
+}
+
+// 上游调用的默认尝试次数（首次 + 重试），请求中可用 maxRetries 覆盖重试次数，0 表示不重试
+const DEFAULT_API_ATTEMPTS = 3;
+const MAX_RETRIES_LIMIT = 5;
+
+// Returns an error message if maxRetries isn't a non-negative integer, otherwise null
+function validateMaxRetries(maxRetries) {
+  if (maxRetries === undefined) return null;
+  if (!Number.isInteger(maxRetries) || maxRetries < 0) {
+    return 'maxRetries must be a non-negative integer';
+  }
+  return null;
+}
+
+// Number of upstream attempts for a request, retries above the limit are clamped
+function resolveAttempts(maxRetries) {
+  if (maxRetries === undefined) return DEFAULT_API_ATTEMPTS;
+  return Math.min(maxRetries, MAX_RETRIES_LIMIT) + 1;
+}
+
+// 重试退避的随机源：默认 Math.random；设置 RETRY_JITTER_SEED 后使用固定种子，便于复现退避时间
+function createSeededRandom(seed) {
+  // mulberry32
+  let state = seed >>> 0;
+  return () => {
+    state = (state + 0x6d2b79f5) >>> 0;
+    let t = state;
+    t = Math.imul(t ^ (t >>> 15), t | 1);
+    t ^= t + Math.imul(t ^ (t >>> 7), t | 61);
+    return ((t ^ (t >>> 14)) >>> 0) / 4294967296;
+  };
+}
+
+const jitterRandom = config.retryJitterSeed !== null
+  ? createSeededRandom(config.retryJitterSeed)
+  : Math.random;
+
+// Exponential backoff capped at 10s, randomized over the upper half so retries don't line up
+function backoffDelay(attempt) {
+  const base = Math.min(1000 * Math.pow(2, attempt), 10000);
+  return Math.round(base / 2 + jitterRandom() * base / 2);
+}
+
+const DNS_ERROR_CODES = ['ENOTFOUND', 'EAI_AGAIN'];
+
+// fetch wraps network errors as "fetch failed" with the original error as cause
+function getDnsErrorCode(error) {
+  const code = error.cause?.code || error.code;
+  return DNS_ERROR_CODES.includes(code) ? code : null;
+}
+
+// 连接级重试（CONNECT_RETRIES，默认关闭）：建立连接或 TLS 握手失败时请求还没发出，短暂等待后直接重连
+// 在请求级重试之前处理，不消耗 maxRetries 的次数，也不走指数退避
+// 只认确定发生在连接阶段的错误码；ECONNRESET、ETIMEDOUT、UND_ERR_SOCKET 等也可能在请求发出后出现，重连会让上游重复生成，交给请求级重试
+const CONNECT_ERROR_CODES = ['ECONNREFUSED', 'EHOSTUNREACH', 'ENETUNREACH', 'UND_ERR_CONNECT_TIMEOUT'];
+
+function isConnectError(error) {
+  const code = error.cause?.code || error.code;
+  return CONNECT_ERROR_CODES.includes(code) || (typeof code === 'string' && code.startsWith('ERR_TLS_'));
+}
+
+async function fetchWithConnectRetry(url, options, taskId) {
+  for (let retry = 0; ; retry++) {
+    try {
+      return await fetch(url, options);
+    } catch (error) {
+      if (retry >= config.connectRetries || options.signal?.aborted || !isConnectError(error)) throw error;
+      const code = error.cause?.code || error.code;
+      console.warn(`[${taskId}] Connection failed (${code}), reconnecting (${retry + 1}/${config.connectRetries})`);
+      await wait(config.connectRetryDelayMs);
+    }
+  }
+}
+
+// 上游请求各阶段耗时：订阅 fetch（undici）的 diagnostics_channel 连接事件，用 AsyncLocalStorage 对应到发起请求的那次调用；
+// firstByteMs 在 fetch 返回（收到响应头）时记录，读取响应体时超时同样带上这些耗时
+// 新建连接时记录 connectMs（undici 在连接阶段内解析主机名，所以包括 DNS 解析、TCP 连接，https 还包括 TLS 握手）；复用连接时为空
+// undici 没有单独的 DNS 事件，DNS 耗时无法单独测量，不作为独立字段返回
+const requestTimingStore = new AsyncLocalStorage();
+// 进行中的上游请求：taskId -> timing，合并请求的参与方到达截止时间时从这里取发起方的耗时
+const activeRequestTimings = new Map();
+
+diagnosticsChannel.subscribe('undici:client:beforeConnect', ({ connectParams }) => {
+  const timing = requestTimingStore.getStore();
+  if (!timing) return;
+  timing.connectStartedAt = Date.now();
+  timing.tls = connectParams.protocol === 'https:';
+});
+diagnosticsChannel.subscribe('undici:client:connected', () => {
+  const timing = requestTimingStore.getStore();
+  if (timing && timing.connectStartedAt) timing.connectMs = Date.now() - timing.connectStartedAt;
+});
+
+// Phase breakdown of an upstream request, for timeout errors and debug logs
+function summarizeRequestTiming(timing) {
+  return {
+    connectMs: timing.connectMs,
+    tls: timing.tls,
+    firstByteMs: timing.firstByteMs,
+    totalMs: Date.now() - timing.startedAt,
+    reusedConnection: timing.connectStartedAt === undefined
+  };
+}
+
+// 上游返回的请求 ID（UPSTREAM_REQUEST_ID_HEADERS，按顺序取第一个存在的响应头），向上游提交工单时使用
+function getUpstreamRequestId(headers) {
+  for (const name of config.upstreamRequestIdHeaders) {
+    const value = headers.get(name);
+    if (value) return value.slice(0, 200);
+  }
+  return undefined;
+}
+
 // Helper function to make API call with retry
-async function callAPIWithRetry(apiUrl, requestBody, apiKey, maxRetries = 3, taskId = 'unknown') {
+async function callAPIWithRetry(apiUrl, requestBody, apiKey, maxRetries = 3, taskId = 'unknown', authMode = config.upstreamAuthMode, signal = null, extraHeaders = {}) {
   let lastError = null;
 
   for (let attempt = 1; attempt <= maxRetries; attempt++) {
+    throwIfCancelled(signal);
+    let timing = null;
+    let release = null;
     try {
       console.log(`[${taskId}] Attempt ${attempt} of ${maxRetries}...`);
 
@@ -140,29 +909,40 @@ async function callAPIWithRetry(apiUrl, requestBody, apiKey, maxRetries = 3, tas
         console.log(`[${taskId}] TIMEOUT: Aborting request after 4 minutes`);
         controller.abort();
       }, 4 * 60 * 1000); // 4 minutes per attempt
+      const onCancel = () => controller.abort();
+      signal?.addEventListener('abort', onCancel, { once: true });
+      release = () => {
+        clearTimeout(timeoutId);
+        signal?.removeEventListener('abort', onCancel);
+      };
 
-      console.log(`[${taskId}] Sending POST request to ${apiUrl}`);
+      // 注意：query 模式下 URL 中带有 key，只记录原始 URL
+      console.log(`[${taskId}] Sending POST request to ${apiUrl} (auth: ${authMode.split(':')[0]})`);
       const fetchStartTime = Date.now();
+      timing = { startedAt: fetchStartTime };
+      activeRequestTimings.set(taskId, timing);
+
+      const headers = { 'Content-Type': 'application/json', ...extraHeaders };
+      const requestUrl = applyAuth(apiUrl, headers, apiKey, authMode);
 
-      const response = await fetch(apiUrl, {
+      const response = await requestTimingStore.run(timing, () => fetchWithConnectRetry(requestUrl, {
         method: 'POST',
-        headers: {
-          'Content-Type': 'application/json',
-          'Authorization': `Bearer ${apiKey}`
-        },
+        headers,
         body: JSON.stringify(requestBody),
         signal: controller.signal
-      });
+      }, taskId));
+      // fetch 在收到响应头时返回，undici:request:headers 事件不在发起请求的异步上下文中，在这里记录
+      timing.firstByteMs = Date.now() - timing.startedAt;
 
       const fetchDuration = ((Date.now() - fetchStartTime) / 1000).toFixed(2);
-      console.log(`[${taskId}] Response received after ${fetchDuration}s, status: ${response.status}`);
-
-      clearTimeout(timeoutId);
-      console.log(`[${taskId}] Timeout cleared`);
+      const upstreamRequestId = getUpstreamRequestId(response.headers);
+      console.log(`[${taskId}] Response received after ${fetchDuration}s, status: ${response.status}${upstreamRequestId ? `, upstream request id: ${upstreamRequestId}` : ''}`);
+      debugLog(`[${taskId}] Upstream timings:`, JSON.stringify(summarizeRequestTiming(timing)));
       
       if (!response.ok) {
         const errorText = await response.text();
-        console.error(`API error on attempt ${attempt}:`, response.status, errorText);
+        console.error(`API error on attempt ${attempt}:`, response.status, truncateErrorText(errorText));
+        debugLog(`[${taskId}] Full API error body on attempt ${attempt}:`, errorText);
         
         // Parse error text if it's JSON
         let errorMessage = `API error: ${response.status}`;
@@ -181,47 +961,103 @@ async function callAPIWithRetry(apiUrl, requestBody, apiKey, maxRetries = 3, tas
         }
         
         lastError = new Error(errorMessage);
+        lastError.upstreamStatus = response.status;
+        lastError.upstreamRequestId = upstreamRequestId;
+        lastError.attempts = attempt;
         
         // Don't retry on client errors (4xx)
+        // 标记为 permanent，否则下面的 catch 会把它当作普通错误继续重试
         if (response.status >= 400 && response.status < 500) {
+          lastError.permanent = true;
+          throw lastError;
+        }
+
+        // 有些上游把内容审核失败包装成 5xx 返回，响应体匹配 UPSTREAM_PERMANENT_ERROR_PATTERNS 时不再重试，按 CONTENT_REJECTED 失败
+        if (isPermanentUpstreamError(errorText)) {
+          console.warn(`[${taskId}] Upstream ${response.status} matches a permanent error pattern, not retrying`);
+          lastError.message = `${CONTENT_REJECTED_MESSAGE}: ${errorMessage}`;
+          lastError.errorCode = 'CONTENT_REJECTED';
+          lastError.permanent = true;
           throw lastError;
         }
         
         // Wait before retry for server errors
         if (attempt < maxRetries) {
-          const waitTime = Math.min(1000 * Math.pow(2, attempt), 10000); // Exponential backoff, max 10s
+          const waitTime = backoffDelay(attempt); // Exponential backoff with jitter, max 10s
           console.log(`Waiting ${waitTime}ms before retry...`);
           await wait(waitTime);
           continue;
         }
       } else {
-        // Success!
+        // Success! 记录用了几次尝试，同步接口通过 X-Attempts 返回
+        // 响应体由调用方读取，超时和取消在读完后由调用方调用 response.release() 清除，读取卡住时仍会被中止
+        // 耗时记录保留到响应体读完，读取时超时也能报告各阶段耗时
+        const releaseAttempt = release;
+        response.attempts = attempt;
+        response.timing = timing;
+        response.release = () => {
+          releaseAttempt();
+          if (activeRequestTimings.get(taskId) === timing) activeRequestTimings.delete(taskId);
+        };
+        release = null;
         return response;
       }
     } catch (error) {
-      console.error(`[${taskId}] Attempt ${attempt} failed:`, error.message);
-      console.error(`[${taskId}] Error name: ${error.name}, Stack: ${error.stack?.split('\n')[0]}`);
+      // 任务被取消时立即停止，不再重试；超过截止时间时带上这次请求的各阶段耗时
+      try {
+        throwIfCancelled(signal);
+      } catch (cancelError) {
+        if (cancelError.deadlineExceeded && timing) cancelError.timings = summarizeRequestTiming(timing);
+        throw cancelError;
+      }
+      if (error.permanent) throw error;
+      console.error(`[${taskId}] Attempt ${attempt} failed:`, truncateErrorText(error.message));
+      console.error(`[${taskId}] Error name: ${error.name}, Stack: ${truncateErrorText(error.stack?.split('\n')[0])}`);
       lastError = error;
 
       if (error.name === 'AbortError') {
         console.error(`[${taskId}] Request aborted - timeout after 4 minutes`);
         lastError = new Error('Request timeout after 4 minutes');
+        lastError.timings = summarizeRequestTiming(timing);
+        console.error(`[${taskId}] Timings of timed out request:`, JSON.stringify(lastError.timings));
+      } else if (timing) {
+        debugLog(`[${taskId}] Upstream timings:`, JSON.stringify(summarizeRequestTiming(timing)));
       }
 
+      // DNS 解析失败通常是瞬时的，用较短的固定间隔重试
+      const dnsErrorCode = getDnsErrorCode(error);
+      if (dnsErrorCode) {
+        const hostname = error.cause?.hostname || new URL(apiUrl).hostname;
+        console.error(`[${taskId}] [DNS] Failed to resolve ${hostname} (${dnsErrorCode}) on attempt ${attempt}`);
+        lastError = new Error(`DNS resolution failed for ${hostname}: ${dnsErrorCode}`);
+      }
+      lastError.attempts = attempt;
+
       // Wait before retry
       if (attempt < maxRetries) {
-        const waitTime = Math.min(1000 * Math.pow(2, attempt), 10000);
+        const waitTime = dnsErrorCode ? config.dnsRetryDelayMs : backoffDelay(attempt);
         console.log(`[${taskId}] Waiting ${waitTime}ms before retry...`);
         await wait(waitTime);
       } else {
         console.log(`[${taskId}] All ${maxRetries} attempts failed`);
       }
+    } finally {
+      // 每次尝试结束（包括连接失败抛错）都清除超时、取消监听和耗时记录，成功的响应交给调用方清除
+      if (release) {
+        release();
+        if (timing && activeRequestTimings.get(taskId) === timing) activeRequestTimings.delete(taskId);
+      }
     }
   }
   
   throw lastError || new Error('API call failed after all retries');
 }
 
+function isPermanentUpstreamError(body) {
+  const text = (body || '').toLowerCase();
+  return config.upstreamPermanentErrorPatterns.some(pattern => text.includes(pattern));
+}
+
 // Test endpoint to measure callback speed from GCR to Cloudflare
 app.get('/api/test-callback', async (req, res) => {
   console.log('Testing callback speed to Cloudflare Workers...');
@@ -267,516 +1103,3868 @@ app.get('/api/test-callback', async (req, res) => {
   }
 });
 
-// Proxy endpoint for image generation (立即返回，后台处理)
-app.post('/api/generate/async', async (req, res) => {
-  try {
-    const { model, prompt, imageUrl, imageUrls, imageSize, apiKey, taskId, parentTaskId } = req.body;
-    // callbackUrl removed - using polling instead
-    
-    if (!apiKey) {
-      return res.status(401).json({ error: 'API key required' });
-    }
+// 任务标签限制（多租户场景下用于筛选结果）
+const MAX_TAGS = 10;
+const MAX_TAG_KEY_LENGTH = 64;
+const MAX_TAG_VALUE_LENGTH = 256;
 
-    console.log(`Starting async generation with model: ${model}, taskId: ${taskId}`);
-    // Callback logging removed - using polling instead
-    
-    // 立即返回 taskId，让客户端轮询
-    res.json({ 
-      success: true, 
-      taskId: taskId,
-      message: 'Generation started'
-    });
-    
-    // 使用 setImmediate 确保响应先发送，然后在下一个事件循环中处理
-    setImmediate(async () => {
-      try {
-        await processGeneration(model, prompt, imageUrl, imageUrls, imageSize, apiKey, taskId, parentTaskId);
-      } catch (error) {
-        console.error('Background processing error:', error);
-      }
-    });
-  } catch (error) {
-    console.error('Async endpoint error:', error);
-    res.status(500).json({ error: error.message || 'Internal server error' });
+// Returns an error message if tags aren't a small flat map of strings, otherwise null
+function validateTags(tags) {
+  if (tags === undefined) return null;
+  if (!tags || typeof tags !== 'object' || Array.isArray(tags)) {
+    return 'tags must be an object of string values';
   }
-});
 
-// 将后台处理逻辑移到独立函数
-async function processGeneration(model, prompt, imageUrl, imageUrls, imageSize, apiKey, taskId, parentTaskId) {
-  const startTime = Date.now();  // Move outside try block for finally block access
-  try {
-    activeTasks++;
-    totalProcessed++;
-    
-    // Log resource usage at start
-    const startResources = getResourceUsage();
-    console.log(`[RESOURCE_START] Task ${taskId} | Active: ${activeTasks} | Total: ${totalProcessed} | Memory: ${startResources.memoryMB.used}/${startResources.memoryMB.total}MB (${startResources.memoryMB.percent}%) | CPU: ${startResources.cpu.percent}% | Load: [${startResources.loadAvg.join(', ')}]`);
+  const entries = Object.entries(tags);
+  if (entries.length > MAX_TAGS) {
+    return `tags supports at most ${MAX_TAGS} entries`;
+  }
+  for (const [key, value] of entries) {
+    if (typeof value !== 'string') {
+      return `tag "${key}" must be a string`;
+    }
+    if (key.length === 0 || key.length > MAX_TAG_KEY_LENGTH) {
+      return `tag keys must be 1-${MAX_TAG_KEY_LENGTH} characters`;
+    }
+    if (value.length > MAX_TAG_VALUE_LENGTH) {
+      return `tag "${key}" exceeds ${MAX_TAG_VALUE_LENGTH} characters`;
+    }
+  }
+  return null;
+}
 
-    // Determine API URL based on model
-    const apiUrl = model === 'sora_image' 
-      ? 'https://yunwu.zeabur.app/v1/chat/completions'
-      : 'https://yunwu.zeabur.app/v1beta/models/gemini-2.5-flash-image-preview:generateContent';
+// taskId / parentTaskId 由客户端提供，会作为存储键并出现在日志中：只允许 UUID 或字母数字加 . _ : -，最长 128
+const TASK_ID_PATTERN = /^[A-Za-z0-9][A-Za-z0-9._:-]{0,127}$/;
 
-    // Handle multiple image URLs - prioritize imageUrls array, fallback to single imageUrl
-    const allImageUrls = imageUrls || (imageUrl ? [imageUrl] : []);
-    console.log(`[${taskId}] Processing generation with ${allImageUrls.length} images`);
-    console.log(`[${taskId}] Model: ${model}, Size: ${imageSize}`);
-    
-    // Build request body
-    let requestBody;
-    if (model === 'sora_image') {
-      // Build content array with all images
-      const content = [];
-      content.push({ type: 'text', text: `${prompt} ${imageSize}` });
-      
-      // Add all images to the content
-      for (const imgUrl of allImageUrls) {
-        content.push({ type: 'image_url', image_url: { url: imgUrl } });
-      }
-      
-      // If no images, just use text
-      const finalContent = allImageUrls.length > 0 ? content : `${prompt} ${imageSize}`;
-      
-      requestBody = {
-        model: 'sora_image',
-        messages: [{ role: 'user', content: finalContent }]
-      };
-    } else {
-      // Gemini format
-      if (imageUrl) {
-        // Convert image URL to base64 for Gemini
-        let base64Data = imageUrl;
-        if (imageUrl.startsWith('http')) {
-          try {
-            console.log('Converting image URL to base64 for Gemini:', imageUrl);
-            const imageResponse = await fetch(imageUrl);
-            const buffer = await imageResponse.arrayBuffer();
-            base64Data = Buffer.from(buffer).toString('base64');
-            console.log('Successfully converted to base64, length:', base64Data.length);
-          } catch (error) {
-            console.error('Failed to convert image to base64:', error);
-            // Fall back to using URL directly
-            base64Data = imageUrl;
-          }
-        }
-        
-        requestBody = {
-          contents: [{
-            role: 'user',
-            parts: [
-              { text: `${prompt} ${imageSize}` },
-              { inline_data: { mime_type: 'image/jpeg', data: base64Data } }
-            ]
-          }]
-        };
-      } else {
-        requestBody = {
-          contents: [{
-            role: 'user',
-            parts: [{ text: `${prompt} ${imageSize}` }]
-          }]
-        };
-      }
+function isValidTaskId(taskId) {
+  return typeof taskId === 'string' && TASK_ID_PATTERN.test(taskId);
+}
+
+function validateTaskId(field, taskId) {
+  if (taskId === undefined || isValidTaskId(taskId)) return null;
+  return `${field} must be 1-128 characters of letters, digits, ".", "_", ":" or "-"`;
+}
+
+// Escape control characters so client-supplied values can't forge log lines
+function sanitizeForLog(value) {
+  return String(value).replace(/[\u0000-\u001f\u007f]/g, char => `\\x${char.charCodeAt(0).toString(16).padStart(2, '0')}`).slice(0, 200);
+}
+
+// 路径中的 taskId / parentTaskId 同样校验，不合法时直接返回 400
+for (const name of ['taskId', 'parentTaskId']) {
+  app.param(name, (req, res, next, value) => {
+    if (!isValidTaskId(value)) {
+      console.warn(`Rejected request with invalid ${name}: ${sanitizeForLog(value)}`);
+      return res.status(400).json({ error: `Invalid ${name}` });
     }
+    next();
+  });
+}
 
-    console.log(`[${taskId}] Calling third-party API with retry logic...`);
+// 生成请求的参数校验：一次检查所有字段，返回 { fields: [{ field, message }], imageSize }
+// async 为 true 时额外校验只有异步接口才有的字段（tags、callbackUrl、uploadUrl）
+function validateGenerateRequest(body, { async = false } = {}) {
+  const { model, taskId, parentTaskId, fallbackModels, prompt, negativePrompt, imageUrl, imageUrls, imageDimensions, responseFormat, contentOrder, outputImageFormat, outputQuality, convertOutput, authMode, maxRetries, upstreamBaseUrl, moderateInputs, wantPreviews, enhancePrompt, nonce, timestamp, tags, callbackUrl, uploadUrl } = body;
+  const fields = [];
+  const check = (field, message) => {
+    if (message) fields.push({ field, message });
+  };
 
-    // Call API with retry
-    const response = await callAPIWithRetry(apiUrl, requestBody, apiKey, 3, taskId);
-    
-    const duration = (Date.now() - startTime) / 1000;
-    console.log(`[${taskId}] API call completed successfully in ${duration}s`);
+  check('model', typeof model === 'string' && model ? null : 'model is required');
+  check('taskId', validateTaskId('taskId', taskId));
+  check('parentTaskId', validateTaskId('parentTaskId', parentTaskId));
+  check('imageUrl', imageUrl === undefined || typeof imageUrl === 'string' ? null : 'imageUrl must be a string');
+  check('imageUrls', imageUrls === undefined || (Array.isArray(imageUrls) && imageUrls.every(url => typeof url === 'string'))
+    ? null
+    : 'imageUrls must be an array of strings');
+  check('authMode', authMode === undefined || parseAuthMode(authMode)
+    ? null
+    : 'Invalid authMode, expected bearer, header:<name> or query:<param>');
 
-    const data = await response.json();
-    // 保存原始响应
-    console.log('API Response for taskId', taskId, ':', JSON.stringify(data, null, 2));
-    
-    // 先存储原始响应，方便调试
-    await storeResult(taskId, { 
-      success: true, 
-      rawResponse: data,
-      timestamp: new Date().toISOString()
-    });
+  const fallbackError = validateFallbackModels(fallbackModels);
+  check('fallbackModels', fallbackError);
 
-    // 处理不同模型的响应格式
-    let imageUrlResult = null;
-    
-    if (model === 'sora_image') {
-      // Sora 模型返回格式
-      if (data.choices && data.choices[0]) {
-        const content = data.choices[0].message?.content;
-        console.log('Sora content:', content);
-        
-        if (typeof content === 'string') {
-          // 提取URL - 确保匹配完整的URL
-          const urlMatch = content.match(/https?:\/\/[^\s\]}"']+\.(jpg|jpeg|png|webp|gif)/i);
-          if (urlMatch) {
-            imageUrlResult = urlMatch[0];
-            console.log('Extracted Sora image URL:', imageUrlResult);
-          }
-        }
-      }
-    } else {
-      // Gemini 模型返回格式
-      console.log('Processing Gemini response...');
-      if (data.candidates && data.candidates[0]) {
-        const candidate = data.candidates[0];
-        console.log('Gemini candidate preview:', JSON.stringify(candidate).substring(0, 500) + '...');
-        
-        if (candidate.content && candidate.content.parts) {
-          for (const part of candidate.content.parts) {
-            // 检查是否有base64图片数据（Gemini返回的格式）
-            if (part.inlineData && part.inlineData.data && part.inlineData.mimeType) {
-              console.log('Found Gemini base64 image data with mimeType:', part.inlineData.mimeType);
-              
-              // 将base64数据保存为data URL
-              const base64Data = part.inlineData.data;
-              const mimeType = part.inlineData.mimeType;
-              imageUrlResult = `data:${mimeType};base64,${base64Data}`;
-              console.log('Created data URL for Gemini image (length):', imageUrlResult.length);
-              break;
-            }
-            // 如果有文本，也记录下来
-            else if (part.text) {
-              console.log('Gemini text part:', part.text);
-              // 尝试从文本中提取图片URL（备用）
-              const urlMatch = part.text.match(/https?:\/\/[^\s\]}"']+\.(jpg|jpeg|png|webp|gif)/i);
-              if (urlMatch && !imageUrlResult) {
-                imageUrlResult = urlMatch[0];
-                console.log('Extracted Gemini image URL from text:', imageUrlResult);
-              }
-            }
-          }
-        }
-      }
-    }
+  const hasImages = (Array.isArray(imageUrls) && imageUrls.length > 0) || Boolean(imageUrl);
+  check('prompt', validatePrompt([model, ...(fallbackError ? [] : fallbackModels || [])], prompt, hasImages));
+  check('negativePrompt', validateNegativePrompt(negativePrompt));
+  check('maxRetries', validateMaxRetries(maxRetries));
+  check('upstreamBaseUrl', validateUpstreamBaseUrl(upstreamBaseUrl));
+  check('enhancePrompt', enhancePrompt === undefined || typeof enhancePrompt === 'boolean' ? null : 'enhancePrompt must be a boolean');
+  check('wantPreviews', wantPreviews === undefined || typeof wantPreviews === 'boolean' ? null : 'wantPreviews must be a boolean');
+  check('nonce', nonce === undefined || (typeof nonce === 'string' && NONCE_PATTERN.test(nonce))
+    ? null
+    : 'nonce must be 8-128 characters of letters, digits, ".", "_", "~" or "-"');
+  check('timestamp', timestamp === undefined || Number.isInteger(timestamp) ? null : 'timestamp must be a Unix time in seconds');
+  if (moderateInputs !== undefined && typeof moderateInputs !== 'boolean') {
+    check('moderateInputs', 'moderateInputs must be a boolean');
+  } else if (moderateInputs && !config.moderationUrl) {
+    check('moderateInputs', 'moderateInputs requires MODERATION_URL to be configured');
+  }
+  check('responseFormat', validateResponseFormat(model, responseFormat));
+  check('contentOrder', contentOrder === undefined || CONTENT_ORDERS.includes(contentOrder) ? null : `contentOrder must be one of ${CONTENT_ORDERS.join(', ')}`);
+  check('outputImageFormat', validateOutputFormat(outputImageFormat, undefined));
+  check('convertOutput', validateOutputFormat(undefined, convertOutput));
+  check('outputQuality', validateOutputQuality(outputQuality));
 
-    // 最终结果处理
-    if (imageUrlResult) {
-      console.log('Successfully extracted image URL for taskId', taskId, ':', imageUrlResult);
-      
-      // 更新存储结果
-      await storeResult(taskId, { 
-        success: true, 
-        imageUrl: imageUrlResult,
-        rawResponse: data 
-      });
-      
-      // Callback removed - using polling instead
-      // Workers will poll /api/status/:taskId to get the result
-    } else {
-      console.error('Failed to extract image URL from response for taskId:', taskId);
-      console.error('Full response data:', JSON.stringify(data, null, 2));
-      
-      // Extract error message from API response
-      let errorMessage = 'No image URL in response';
-      
-      // Try to extract error from Sora API response
-      if (data.choices && data.choices[0] && data.choices[0].message) {
-        const content = data.choices[0].message.content;
-        if (typeof content === 'string') {
-          // Extract failure reason from content (e.g., "生成失败 ❌\n失败原因：input_moderation")
-          if (content.includes('生成失败')) {
-            errorMessage = content;  // Use the full error message from API
-          }
-        }
-      }
-      
-      await storeResult(taskId, { 
-        success: false, 
-        error: errorMessage, 
-        rawResponse: data 
-      });
-      
-      // Failure callback removed - using polling instead
+  if (async) {
+    check('tags', validateTags(tags));
+    check('callbackUrl', callbackUrl === undefined ? null : validateCallbackUrl(callbackUrl));
+    check('callbackContentType', validateCallbackContentType(body.callbackContentType));
+    check('uploadUrl', uploadUrl === undefined || isValidCallbackUrl(uploadUrl) ? null : 'uploadUrl must be an http(s) URL');
+    if (body.failFast !== undefined && typeof body.failFast !== 'boolean') {
+      check('failFast', 'failFast must be a boolean');
+    } else if (body.failFast && !parentTaskId) {
+      check('failFast', 'failFast requires parentTaskId');
     }
-  } catch (error) {
-    console.error('Proxy error for taskId', taskId, ':', error);
-    
-    // Get error message - it already includes full response if we modified it above
-    const errorMessage = error.message || 'Internal server error';
-    
-    // 存储错误状态
-    if (taskId) {
-      await storeResult(taskId, { 
-        success: false, 
-        error: errorMessage,
-        timestamp: new Date().toISOString()
+  }
+
+  const { imageSize, error: sizeError } = resolveImageSize(model, body.imageSize, imageDimensions);
+  check(imageDimensions === undefined ? 'imageSize' : 'imageDimensions', sizeError);
+
+  return { fields, imageSize };
+}
+
+// 每个模型最多接受的输入图片数（MAX_IMAGES_PER_MODEL 可覆盖），超出时上游只会返回难以理解的错误
+// 没有单独配置的模型按家族（modelFamily）使用 sora_image、claude 或 gemini 这一项
+const DEFAULT_MAX_IMAGES_PER_MODEL = { sora_image: 5, gemini: 1, claude: 20 };
+
+function maxImagesForModel(model) {
+  const family = modelFamily(model);
+  return config.maxImagesPerModel[model] ?? config.maxImagesPerModel[family] ?? DEFAULT_MAX_IMAGES_PER_MODEL[family] ?? null;
+}
+
+// Rejects with 422 if any model in the chain accepts fewer input images than requested
+function sendImageLimitError(res, { model, fallbackModels, imageUrl, imageUrls }) {
+  const count = (imageUrls || (imageUrl ? [imageUrl] : [])).length;
+  for (const candidate of [model, ...(fallbackModels || [])]) {
+    const limit = maxImagesForModel(candidate);
+    if (limit !== null && count > limit) {
+      const message = `Model ${candidate} accepts at most ${limit} input image(s), got ${count}`;
+      res.status(422).json({
+        error: message,
+        errorCode: 'TOO_MANY_IMAGES',
+        fields: [{ field: imageUrls ? 'imageUrls' : 'imageUrl', message }],
+        model: candidate,
+        limit
       });
-      
-      // Error callback removed - using polling instead
-    }
-    
-    // Note: Response already sent, so we can't send error response here
-    // The error is stored and will be available via status endpoint
-  } finally {
-    // Log resource usage at end
-    activeTasks--;
-    const endResources = getResourceUsage();
-    const duration = ((Date.now() - startTime) / 1000).toFixed(2);
-    console.log(`[RESOURCE_END] Task ${taskId} | Duration: ${duration}s | Active: ${activeTasks} | Memory: ${endResources.memoryMB.used}/${endResources.memoryMB.total}MB (${endResources.memoryMB.percent}%) | CPU: ${endResources.cpu.percent}% | Load: [${endResources.loadAvg.join(', ')}]`);
-    
-    // Warning if resources are high
-    if (parseFloat(endResources.memoryMB.percent) > 80) {
-      console.warn(`[RESOURCE_WARNING] High memory usage: ${endResources.memoryMB.percent}%`);
-    }
-    if (parseFloat(endResources.cpu.percent) > 80) {
-      console.warn(`[RESOURCE_WARNING] High CPU usage: ${endResources.cpu.percent}%`);
-    }
-    if (activeTasks > 50) {
-      console.warn(`[RESOURCE_WARNING] High concurrent tasks: ${activeTasks}`);
+      return true;
     }
   }
+  return false;
 }
 
-// 使用文件系统存储结果（简单的持久化方案）
-const fs = require('fs').promises;
-const path = require('path');
+// 防重放：请求可以带 nonce 和 timestamp（Unix 秒），REQUIRE_NONCE=true 时必须带
+// timestamp 与服务器时间相差超过 NONCE_MAX_SKEW_SECONDS 时拒绝；时间窗口内用过的 nonce 再次出现时返回 409
+// 已用 nonce 记录两倍窗口时长（之后 timestamp 必然过期），数量超过 NONCE_CACHE_SIZE 时淘汰最早的
+// 其他检查（截止时间、回调地址、配额、taskId、准入）都通过、任务即将开始时才记录 nonce，被拒绝的请求可以用同一个 nonce 重试
+const NONCE_PATTERN = /^[A-Za-z0-9._~-]{8,128}$/;
+const seenNonces = new Map(); // nonce -> expiresAt，按插入顺序淘汰
 
-// 创建临时存储目录
-const STORAGE_DIR = path.join('/tmp', 'aiyoutube-results');
-fs.mkdir(STORAGE_DIR, { recursive: true }).catch(console.error);
+function isNonceSeen(nonce, now) {
+  const expiresAt = seenNonces.get(nonce);
+  return Boolean(expiresAt && expiresAt > now);
+}
 
-async function storeResult(taskId, result) {
-  try {
-    const filePath = path.join(STORAGE_DIR, `${taskId}.json`);
-    await fs.writeFile(filePath, JSON.stringify({
-      ...result,
-      timestamp: new Date().toISOString()
-    }));
-    
-    // 30分钟后自动清理
-    setTimeout(async () => {
-      try {
-        await fs.unlink(filePath);
-      } catch (err) {
-        // File might already be deleted
-      }
-    }, 30 * 60 * 1000);
-  } catch (error) {
-    console.error('Failed to store result:', error);
-  }
+function sendNonceReplayed(res, nonce) {
+  console.warn(`Rejected replayed nonce ${nonce}`);
+  res.status(409).json({ error: 'Nonce has already been used', errorCode: 'NONCE_REPLAYED' });
 }
 
-async function getResult(taskId) {
-  try {
-    const filePath = path.join(STORAGE_DIR, `${taskId}.json`);
-    const data = await fs.readFile(filePath, 'utf8');
-    return JSON.parse(data);
-  } catch (error) {
-    // File doesn't exist or error reading
-    return null;
+// Returns { field, message } for a missing or stale nonce, { replayed: true } for a used one, otherwise null; doesn't record the nonce
+function replayError({ nonce, timestamp }) {
+  if (nonce === undefined && timestamp === undefined && !config.requireNonce) return null;
+  if (nonce === undefined || timestamp === undefined) {
+    return { field: nonce === undefined ? 'nonce' : 'timestamp', message: 'nonce and timestamp are required' };
   }
+
+  const now = Date.now();
+  if (Math.abs(now / 1000 - timestamp) > config.nonceMaxSkewSeconds) {
+    return { field: 'timestamp', message: `timestamp must be within ${config.nonceMaxSkewSeconds}s of server time` };
+  }
+  return isNonceSeen(nonce, now) ? { replayed: true } : null;
 }
 
-// 查询结果端点
-app.get('/api/status/:taskId', async (req, res) => {
-  const { taskId } = req.params;
-  const result = await getResult(taskId);
-  
-  if (!result) {
-    res.json({ 
-      success: false, 
-      status: 'processing',
-      message: 'Still generating...'
-    });
-  } else if (result.success) {
-    res.json({ 
-      success: true,
-      status: 'completed',
-      imageUrl: result.imageUrl 
-    });
+// Rejects missing, stale or already used nonces without recording the nonce
+function rejectReplay(res, body) {
+  const error = replayError(body);
+  if (!error) return false;
+  if (error.replayed) {
+    sendNonceReplayed(res, body.nonce);
   } else {
-    res.json({ 
-      success: false,
-      status: 'failed',
-      error: result.error 
-    });
+    sendValidationError(res, [error]);
   }
-});
+  return true;
+}
 
-// 同步生成端点（保留兼容性）
-app.post('/api/generate', async (req, res) => {
+// Records the nonce, returns false when it was used in the meantime
+function recordNonce(nonce) {
+  const now = Date.now();
+  if (isNonceSeen(nonce, now)) return false;
+
+  seenNonces.delete(nonce);
+  seenNonces.set(nonce, now + config.nonceMaxSkewSeconds * 2 * 1000);
+  while (seenNonces.size > config.nonceCacheSize) {
+    seenNonces.delete(seenNonces.keys().next().value);
+  }
+  return true;
+}
+
+// Records the nonce right before the task starts; checks again so only one of two concurrent requests with the same nonce gets through
+function claimNonce(res, { nonce }) {
+  if (nonce === undefined || recordNonce(nonce)) return false;
+  sendNonceReplayed(res, nonce);
+  return true;
+}
+
+// 客户端截止时间：X-Task-Deadline 可以是 RFC3339 时间或距现在的秒数，任务的超时不会超过它
+// 截止时间已过时直接返回 504 TIMEOUT，不再处理客户端已经放弃的请求
+const RFC3339_PATTERN = /^\d{4}-\d{2}-\d{2}[Tt ]\d{2}:\d{2}:\d{2}(\.\d+)?([Zz]|[+-]\d{2}:\d{2})$/;
+
+// Returns the deadline in epoch ms, null without the header, NaN if it can't be parsed
+function parseTaskDeadline(value) {
+  if (value === undefined || value === '') return null;
+  if (/^\d+(\.\d+)?$/.test(value)) return Date.now() + Number(value) * 1000;
+  return RFC3339_PATTERN.test(value) ? Date.parse(value) : NaN;
+}
+
+function rejectTaskDeadline(res, deadline) {
+  if (deadline === null) return false;
+  if (Number.isNaN(deadline)) {
+    sendValidationError(res, [{ field: 'X-Task-Deadline', message: 'X-Task-Deadline must be an RFC3339 time or a number of seconds from now' }]);
+    return true;
+  }
+  if (deadline <= Date.now()) {
+    res.status(504).json({ success: false, error: 'Task deadline has already passed', errorCode: 'TIMEOUT' });
+    return true;
+  }
+  return false;
+}
+
+// ?echoRequest=true：在响应中附上代理解析后的请求（已应用默认值，apiKey 脱敏），用于排查集成问题，任务照常执行
+function buildEchoRequest(body, { imageSize, negativePrompt, deadline }) {
+  const { model, fallbackModels, prompt, imageUrl, imageUrls } = body;
+  return {
+    taskId: body.taskId,
+    parentTaskId: body.parentTaskId,
+    model,
+    fallbackModels: fallbackModels || [],
+    prompt,
+    effectivePrompt: NEGATIVE_PROMPT_PARAM_MODELS.includes(model)
+      ? buildPromptText(prompt, imageSize)
+      : buildPromptText(prompt, imageSize, negativePrompt),
+    negativePrompt,
+    imageUrls: imageUrls || (imageUrl ? [imageUrl] : []),
+    imageSize,
+    responseFormat: body.responseFormat,
+    contentOrder: body.contentOrder || 'text-first',
+    outputImageFormat: body.outputImageFormat,
+    outputQuality: body.outputQuality,
+    convertOutput: Boolean(body.convertOutput),
+    apiKey: body.apiKey ? '[redacted]' : undefined,
+    authMode: body.authMode || config.upstreamAuthMode,
+    attempts: resolveAttempts(body.maxRetries),
+    timeoutMs: deadline ? Math.min(config.taskTimeoutMs, deadline - Date.now()) : config.taskTimeoutMs,
+    upstreamBaseUrl: body.upstreamBaseUrl,
+    moderateInputs: Boolean(body.moderateInputs),
+    wantPreviews: Boolean(body.wantPreviews),
+    enhancePrompt: Boolean(body.enhancePrompt),
+    tags: body.tags,
+    callbackUrl: body.callbackUrl,
+    uploadUrl: body.uploadUrl,
+    failFast: Boolean(body.failFast)
+  };
+}
+
+// DEFAULT_MODEL：请求没有指定 model（也没有用 models 多模型对比）时使用，在校验之前填入
+function withDefaultModel(body) {
+  if (!config.defaultModel || body.model !== undefined || body.models !== undefined) return body;
+  return { ...body, model: config.defaultModel };
+}
+
+// error 保留可读的汇总信息，兼容只读取 error 的旧客户端
+function sendValidationError(res, fields) {
+  res.status(400).json({
+    error: fields.map(item => item.message).join('; '),
+    errorCode: 'INVALID_REQUEST',
+    fields
+  });
+}
+
+// Proxy endpoint for image generation (立即返回，后台处理)
+// 后台任务数上限：从接受请求起计数（包括排队等待并发名额的任务和 /v1/images/generations 的任务），超过后直接返回 503
+let inflightAsyncTasks = 0;
+
+// 维护模式（MAINTENANCE_MODE，运行中可通过 POST /admin/maintenance 切换）：生成接口返回 503，
+// 状态查询、结果下载、健康检查和 /admin/stats 照常可用，已提交的任务继续执行
+let maintenance = { enabled: config.maintenanceMode, message: config.maintenanceMessage };
+
+function rejectDuringMaintenance(req, res, next) {
+  if (!maintenance.enabled) return next();
+  res.status(503).json({ error: maintenance.message, errorCode: 'MAINTENANCE', message: maintenance.message });
+}
+
+// 调用方鉴权（可选）：配置 JWT_JWKS_URL 后，生成、状态查询、取消、回调重发和结果下载接口要求 Authorization: Bearer <jwt>，
+// 校验通过后 claims 挂在 req.auth 上；管理员 token 同样放行（两者共用 Authorization 头）
+// 未配置时不做鉴权，请求体中的 apiKey 只用于调用上游；JWKS 取不到（且没有缓存）时返回 503
+const jwtVerifier = config.jwtJwksUrl
+  ? createJwtVerifier({
+    jwksUrl: config.jwtJwksUrl,
+    audience: config.jwtAudience,
+    issuer: config.jwtIssuer,
+    cacheMs: config.jwtJwksCacheMs,
+    clockSkewSeconds: config.jwtClockSkewSeconds
+  })
+  : null;
+
+async function authenticate(req, res, next) {
+  if (!jwtVerifier || hasAdminToken(req)) return next();
+
+  const header = req.get('authorization') || '';
+  const token = header.startsWith('Bearer ') ? header.slice('Bearer '.length).trim() : '';
+  if (!token) {
+    res.set('WWW-Authenticate', 'Bearer');
+    return res.status(401).json({ error: 'Bearer token required', errorCode: 'UNAUTHORIZED' });
+  }
   try {
-    const { model, prompt, imageUrl, imageSize, apiKey } = req.body;
-    
-    if (!apiKey) {
-      return res.status(401).json({ error: 'API key required' });
+    const claims = await jwtVerifier.verify(token);
+    req.auth = { subject: claims.sub, claims };
+  } catch (error) {
+    if (error.invalidToken) {
+      res.set('WWW-Authenticate', 'Bearer error="invalid_token"');
+      return res.status(401).json({ error: error.message, errorCode: 'INVALID_TOKEN' });
     }
+    console.error('[JWT] Could not verify token:', error.message);
+    return res.status(503).json({ error: 'Authentication is temporarily unavailable', errorCode: 'AUTH_UNAVAILABLE' });
+  }
+  next();
+}
 
-    console.log(`Starting sync generation with model: ${model}`);
-    const startTime = Date.now();
+// 多模型对比：models 代替 model 时，同一个请求按模型拆成多个子任务，共用 parentTaskId（请求的 taskId，未提供时自动生成）
+// 子任务 taskId 为 <parentTaskId>:<model>，各自占用并发名额，通过 /api/status/parent/:parentTaskId 查询
+const MAX_FAN_OUT_MODELS = 5;
 
-    // Determine API URL based on model
-    const apiUrl = model === 'sora_image' 
-      ? 'https://yunwu.zeabur.app/v1/chat/completions'
-      : 'https://yunwu.zeabur.app/v1beta/models/gemini-2.5-flash-image-preview:generateContent';
+// Returns an error message if the models list can't be fanned out, otherwise null
+function validateModelList(body) {
+  const { models } = body;
+  if (body.model !== undefined) return 'models and model are mutually exclusive';
+  if (body.parentTaskId !== undefined) return 'models can\'t be combined with parentTaskId, taskId is used as the parent id';
+  if (!Array.isArray(models) || models.length === 0 || !models.every(model => typeof model === 'string' && model)) {
+    return 'models must be a non-empty array of model names';
+  }
+  if (models.length > MAX_FAN_OUT_MODELS) return `models accepts at most ${MAX_FAN_OUT_MODELS} entries`;
+  if (new Set(models).size !== models.length) return 'models must not contain duplicates';
+  return null;
+}
 
-    // Handle multiple image URLs - prioritize imageUrls array, fallback to single imageUrl
-    const allImageUrls = imageUrls || (imageUrl ? [imageUrl] : []);
-    console.log(`[${taskId}] Processing generation with ${allImageUrls.length} images`);
-    console.log(`[${taskId}] Model: ${model}, Size: ${imageSize}`);
-    
-    // Build request body
-    let requestBody;
-    if (model === 'sora_image') {
-      // Build content array with all images
-      const content = [];
-      content.push({ type: 'text', text: `${prompt} ${imageSize}` });
-      
-      // Add all images to the content
-      for (const imgUrl of allImageUrls) {
-        content.push({ type: 'image_url', image_url: { url: imgUrl } });
-      }
-      
-      // If no images, just use text
-      const finalContent = allImageUrls.length > 0 ? content : `${prompt} ${imageSize}`;
-      
-      requestBody = {
-        model: 'sora_image',
-        messages: [{ role: 'user', content: finalContent }]
-      };
-    } else {
-      // Gemini format
-      if (imageUrl) {
-        // Convert image URL to base64 for Gemini
-        let base64Data = imageUrl;
-        if (imageUrl.startsWith('http')) {
-          try {
-            console.log('Converting image URL to base64 for Gemini:', imageUrl);
-            const imageResponse = await fetch(imageUrl);
-            const buffer = await imageResponse.arrayBuffer();
-            base64Data = Buffer.from(buffer).toString('base64');
-            console.log('Successfully converted to base64, length:', base64Data.length);
-          } catch (error) {
-            console.error('Failed to convert image to base64:', error);
-            // Fall back to using URL directly
-            base64Data = imageUrl;
-          }
-        }
-        
-        requestBody = {
-          contents: [{
-            role: 'user',
-            parts: [
-              { text: `${prompt} ${imageSize}` },
-              { inline_data: { mime_type: 'image/jpeg', data: base64Data } }
-            ]
-          }]
-        };
-      } else {
-        requestBody = {
-          contents: [{
-            role: 'user',
-            parts: [{ text: `${prompt} ${imageSize}` }]
-          }]
-        };
-      }
+// Register an async task and start it in the background, returns its cancel token
+// tenantId is the tenant whose reserved quota the task settles when it finishes
+function startAsyncTask(req, body, { imageSize, negativePrompt, deadline, createdAt, tenantId }) {
+  const { model, fallbackModels, prompt, imageUrl, imageUrls, responseFormat, contentOrder, outputImageFormat, outputQuality, convertOutput, apiKey, taskId, parentTaskId, authMode, maxRetries, upstreamBaseUrl, moderateInputs, wantPreviews, enhancePrompt, tags, callbackUrl, callbackContentType, uploadUrl } = body;
+  inflightAsyncTasks++;
+  const { signal, cancelToken } = registerTask(taskId, parentTaskId, deadline, body.failFast);
+
+  console.log(`Starting async generation with model: ${model}, taskId: ${taskId}, client: ${req.ip}${req.auth ? `, subject: ${req.auth.subject}` : ''}`);
+  if (callbackUrl) {
+    console.log(`[${taskId}] Callback requested: ${callbackUrl}`);
+    if (callbackUrl.startsWith('http:') && !internalCallbackUrls.has(callbackUrl)) {
+      console.warn(`[${taskId}] Callback URL uses plaintext http, results will be sent unencrypted`);
     }
+  }
 
-    console.log(`[${taskId}] Calling third-party API with retry logic...`);
+  // 使用 setImmediate 确保响应先发送，然后在下一个事件循环中处理
+  setImmediate(async () => {
+    let succeeded = false;
+    try {
+      const finalResult = await processGeneration({ model, fallbackModels, prompt, negativePrompt, imageUrl, imageUrls, imageSize, responseFormat, contentOrder, outputImageFormat, outputQuality, convertOutput, apiKey, taskId, parentTaskId, authMode, maxRetries, upstreamBaseUrl, moderateInputs, wantPreviews, enhancePrompt, tags, callbackUrl, callbackContentType, uploadUrl, deadline, debug: req.query.debug === 'true', createdAt, signal });
+      succeeded = Boolean(finalResult && finalResult.success);
+    } catch (error) {
+      console.error('Background processing error:', error);
+    } finally {
+      inflightAsyncTasks--;
+      await settleQuota(tenantId, succeeded);
+    }
+  });
+  return cancelToken;
+}
 
-    // Call API with retry
-    const response = await callAPIWithRetry(apiUrl, requestBody, apiKey, 3, taskId);
+app.post('/api/generate/async', authenticate, rejectDuringMaintenance, async (req, res) => {
+  try {
+    req.body = withDefaultModel(req.body);
+    const { apiKey, taskId, callbackUrl } = req.body;
+    // callbackUrl 可选：默认由客户端轮询，提供时完成后额外回调一次
     
-    const duration = (Date.now() - startTime) / 1000;
-    console.log(`API responded successfully in ${duration}s`);
+    if (!apiKey) {
+      return res.status(401).json({ error: 'API key required' });
+    }
 
-    const data = await response.json();
-    console.log('API Response:', JSON.stringify(data, null, 2));
+    const fanOut = req.body.models !== undefined;
+    const modelsError = fanOut ? validateModelList(req.body) : null;
+    if (modelsError) {
+      return sendValidationError(res, [{ field: 'models', message: modelsError }]);
+    }
+    // 未提供 taskId 时自动生成，任务和结果都按 taskId 存放
+    const parentTaskId = fanOut ? (taskId || crypto.randomUUID()) : undefined;
+    const children = fanOut
+      ? req.body.models.map(model => ({ ...req.body, models: undefined, model, taskId: `${parentTaskId}:${model}`, parentTaskId }))
+      : [{ ...req.body, taskId: taskId || crypto.randomUUID() }];
 
-    // 处理不同模型的响应格式
-    let imageUrlResult = null;
-    
-    if (model === 'sora_image') {
-      // Sora 模型返回格式
-      if (data.choices && data.choices[0]) {
-        const content = data.choices[0].message?.content;
-        console.log('Sora content:', content);
-        
-        if (typeof content === 'string') {
-          // 提取URL - 确保匹配完整的URL
-          const urlMatch = content.match(/https?:\/\/[^\s\]}"']+\.(jpg|jpeg|png|webp|gif)/i);
-          if (urlMatch) {
-            imageUrlResult = urlMatch[0];
-            console.log('Extracted Sora image URL:', imageUrlResult);
-          }
-        }
+    const imageSizes = [];
+    for (const child of children) {
+      const { fields, imageSize } = validateGenerateRequest(child, { async: true });
+      if (fields.length > 0) {
+        return sendValidationError(res, fields);
       }
-    } else {
-      // Gemini 模型返回格式
-      console.log('Processing Gemini response...');
-      if (data.candidates && data.candidates[0]) {
-        const candidate = data.candidates[0];
-        console.log('Gemini candidate preview:', JSON.stringify(candidate).substring(0, 500) + '...');
-        
-        if (candidate.content && candidate.content.parts) {
-          for (const part of candidate.content.parts) {
-            // 检查是否有base64图片数据（Gemini返回的格式）
-            if (part.inlineData && part.inlineData.data && part.inlineData.mimeType) {
-              console.log('Found Gemini base64 image data with mimeType:', part.inlineData.mimeType);
-              
-              // 将base64数据保存为data URL
-              const base64Data = part.inlineData.data;
-              const mimeType = part.inlineData.mimeType;
-              imageUrlResult = `data:${mimeType};base64,${base64Data}`;
-              console.log('Created data URL for Gemini image (length):', imageUrlResult.length);
-              break;
-            }
-            // 如果有文本，也记录下来
-            else if (part.text) {
-              console.log('Gemini text part:', part.text);
-              // 尝试从文本中提取图片URL（备用）
-              const urlMatch = part.text.match(/https?:\/\/[^\s\]}"']+\.(jpg|jpeg|png|webp|gif)/i);
-              if (urlMatch && !imageUrlResult) {
-                imageUrlResult = urlMatch[0];
-                console.log('Extracted Gemini image URL from text:', imageUrlResult);
-              }
-            }
-          }
-        }
+      if (sendImageLimitError(res, child)) return;
+      imageSizes.push(imageSize);
+    }
+    if (rejectReplay(res, req.body)) return;
+    const deadline = parseTaskDeadline(req.get('x-task-deadline'));
+    if (rejectTaskDeadline(res, deadline)) return;
+    if (callbackUrl) {
+      const targetError = await checkCallbackTarget(callbackUrl);
+      if (targetError) {
+        return sendValidationError(res, [{ field: 'callbackUrl', message: targetError }]);
       }
     }
+    const negativePrompt = effectiveNegativePrompt(req.body.negativePrompt);
 
-    // 最终结果处理
+    const tenantId = resolveTenant(req, req.body);
+    if (await rejectOverQuota(res, tenantId, children.length)) return;
+    if (rejectRunningTaskIds(res, children.map(child => child.taskId))) {
+      await Promise.all(children.map(() => settleQuota(tenantId, false)));
+      return;
+    }
+    // 准入检查放在最后一个 await 之后，和 startAsyncTask 的计数之间不让出事件循环，并发的请求不会都通过检查
+    if (inflightAsyncTasks + children.length > config.maxInflightTasks) {
+      console.warn(`[ADMISSION] Rejecting task ${parentTaskId || children[0].taskId}: ${inflightAsyncTasks} tasks in flight (max ${config.maxInflightTasks})`);
+      await Promise.all(children.map(() => settleQuota(tenantId, false)));
+      const retryAfter = estimateRetryAfterSeconds(inflightAsyncTasks + children.length - config.maxInflightTasks);
+      res.set('Retry-After', String(retryAfter));
+      return res.status(503).json({ error: 'Server busy, too many tasks in flight', retryAfter });
+    }
+    if (claimNonce(res, req.body)) {
+      await Promise.all(children.map(() => settleQuota(tenantId, false)));
+      return;
+    }
+
+    // 立即返回 taskId，让客户端轮询
+    const createdAt = new Date().toISOString();
+    const { queueDepth, estimatedStartSeconds } = estimateQueueWait();
+    const childTokens = children.map((child, i) => startAsyncTask(req, child, { imageSize: imageSizes[i], negativePrompt, deadline, createdAt, tenantId }));
+
+    if (fanOut) {
+      return res.json({
+        success: true,
+        parentTaskId,
+        tasks: children.map((child, i) => ({ taskId: child.taskId, model: child.model, cancelToken: childTokens[i] })),
+        queueDepth,
+        estimatedStartSeconds,
+        message: 'Generation started'
+      });
+    }
+    res.json({ 
+      success: true, 
+      taskId: children[0].taskId,
+      cancelToken: childTokens[0],
+      queueDepth,
+      estimatedStartSeconds,
+      request: req.query.echoRequest === 'true' ? buildEchoRequest(children[0], { imageSize: imageSizes[0], negativePrompt, deadline }) : undefined,
+      message: 'Generation started'
+    });
+  } catch (error) {
+    console.error('Async endpoint error:', error);
+    res.status(500).json({ error: error.message || 'Internal server error' });
+  }
+});
+
+// 结构化尺寸 {width, height} 的限制，按模型区分（sora_image 只支持固定比例）
+const IMAGE_DIMENSION_RULES = {
+  sora_image: { min: 256, max: 2048, ratios: ['1:1', '2:3', '3:2'] },
+  default: { min: 64, max: 4096 }
+};
+
+function gcd(a, b) {
+  return b === 0 ? a : gcd(b, a % b);
+}
+
+// Resolve the size text appended to the prompt; structured imageDimensions win over the imageSize string.
+// Returns { imageSize } or { error }
+function resolveImageSize(model, imageSize, imageDimensions) {
+  if (imageDimensions === undefined) {
+    return { imageSize };
+  }
+
+  const { width, height } = imageDimensions || {};
+  if (!Number.isInteger(width) || !Number.isInteger(height)) {
+    return { error: 'imageDimensions must have integer width and height' };
+  }
+
+  const rules = IMAGE_DIMENSION_RULES[model] || IMAGE_DIMENSION_RULES.default;
+  if (width < rules.min || width > rules.max || height < rules.min || height > rules.max) {
+    return { error: `imageDimensions for ${model} must be between ${rules.min} and ${rules.max}` };
+  }
+
+  const divisor = gcd(width, height);
+  const ratio = `${width / divisor}:${height / divisor}`;
+  if (rules.ratios && !rules.ratios.includes(ratio)) {
+    return { error: `imageDimensions for ${model} must have one of the ratios ${rules.ratios.join(', ')}` };
+  }
+
+  if (imageSize) {
+    console.log(`Both imageSize and imageDimensions provided, using imageDimensions ${width}x${height}`);
+  }
+  return { imageSize: `[${ratio}]` };
+}
+
+// 根据模型选择上游地址
+function getApiUrl(model) {
+  if (isAnthropicModel(model)) {
+    return 'https://yunwu.zeabur.app/v1/messages';
+  }
+  return model === 'sora_image' 
+    ? 'https://yunwu.zeabur.app/v1/chat/completions'
+    : 'https://yunwu.zeabur.app/v1beta/models/gemini-2.5-flash-image-preview:generateContent';
+}
+
+// 单个请求可以用 upstreamBaseUrl 指定其他上游（只替换域名和路径前缀），域名必须在 UPSTREAM_BASE_URL_ALLOWLIST 中，防止 SSRF
+function validateUpstreamBaseUrl(upstreamBaseUrl) {
+  if (upstreamBaseUrl === undefined) return null;
+  if (typeof upstreamBaseUrl !== 'string') return 'upstreamBaseUrl must be a string';
+
+  let url;
+  try {
+    url = new URL(upstreamBaseUrl);
+  } catch (error) {
+    return 'upstreamBaseUrl must be a valid URL';
+  }
+  if (url.protocol !== 'https:' && url.protocol !== 'http:') {
+    return 'upstreamBaseUrl must be an http(s) URL';
+  }
+  if (url.username || url.password || url.search || url.hash) {
+    return 'upstreamBaseUrl must not contain credentials, query or fragment';
+  }
+  if (!config.upstreamBaseUrlAllowlist.includes(url.hostname.toLowerCase())) {
+    return `upstreamBaseUrl host ${url.hostname} is not allowed`;
+  }
+  return null;
+}
+
+function resolveApiUrl(model, upstreamBaseUrl) {
+  const defaultUrl = getApiUrl(model);
+  if (!upstreamBaseUrl) return defaultUrl;
+
+  const { pathname, search } = new URL(defaultUrl);
+  const base = new URL(upstreamBaseUrl);
+  return `${base.origin}${base.pathname.replace(/\/$/, '')}${pathname}${search}`;
+}
+
+// 多区域上游（UPSTREAM_REGIONS）：按最近的响应耗时选最快的健康区域，没有指定 upstreamBaseUrl 的任务才参与选择
+// 有 UPSTREAM_PROBE_PERCENT 的概率改走其他健康区域，耗时数据过期的区域优先探测，慢区域恢复后能被重新发现
+// 调用失败的区域暂停使用一段时间
+const REGION_COOLDOWN_MS = 30 * 1000;
+const REGION_STALE_MS = 5 * 60 * 1000;
+
+const upstreamRegions = config.upstreamRegions.map(baseUrl => ({ baseUrl, ema: null, samples: 0, lastSampleAt: 0, unhealthyUntil: 0 }));
+
+function selectUpstreamRegion() {
+  if (upstreamRegions.length === 0) return null;
+  const now = Date.now();
+  const healthy = upstreamRegions.filter(region => region.unhealthyUntil <= now);
+  if (healthy.length === 0) {
+    // 全部暂停时选最早恢复的，不让任务直接失败
+    return upstreamRegions.reduce((a, b) => (a.unhealthyUntil <= b.unhealthyUntil ? a : b));
+  }
+
+  const unmeasured = healthy.find(region => region.ema === null);
+  if (unmeasured) return unmeasured;
+
+  const fastest = healthy.reduce((a, b) => (a.ema <= b.ema ? a : b));
+  const others = healthy.filter(region => region !== fastest);
+  if (others.length > 0 && Math.random() * 100 < config.upstreamProbePercent) {
+    return others.find(region => now - region.lastSampleAt > REGION_STALE_MS) || others[Math.floor(Math.random() * others.length)];
+  }
+  return fastest;
+}
+
+function recordRegionLatency(region, durationMs) {
+  region.ema = region.ema === null ? durationMs : LATENCY_EMA_ALPHA * durationMs + (1 - LATENCY_EMA_ALPHA) * region.ema;
+  region.samples++;
+  region.lastSampleAt = Date.now();
+  region.unhealthyUntil = 0;
+}
+
+function recordRegionFailure(region, taskId) {
+  region.unhealthyUntil = Date.now() + REGION_COOLDOWN_MS;
+  console.warn(`[${taskId}] Upstream region ${region.baseUrl} failed, skipping it for ${REGION_COOLDOWN_MS / 1000}s`);
+}
+
+// 只有网络错误、超时和可重试的 5xx 说明区域本身有问题；4xx、内容审核和匹配永久错误的响应是请求本身的问题
+function isRegionFailure(error) {
+  if (error.cancelled || error.deadlineExceeded || error.permanent) return false;
+  return error.upstreamStatus === undefined || error.upstreamStatus >= 500;
+}
+
+function getRegionSummary() {
+  const now = Date.now();
+  return upstreamRegions.map(region => ({
+    baseUrl: region.baseUrl,
+    latencyMs: region.ema === null ? null : Math.round(region.ema),
+    samples: region.samples,
+    healthy: region.unhealthyUntil <= now
+  }));
+}
+
+// Anthropic 兼容接口（Messages API）：claude 开头的模型名走这个分支
+const ANTHROPIC_VERSION = '2023-06-01';
+const ANTHROPIC_MAX_TOKENS = 4096;
+
+function isAnthropicModel(model) {
+  return typeof model === 'string' && model.startsWith('claude');
+}
+
+// 模型家族：sora_image、claude 开头的 Anthropic 模型，其余模型都走 Gemini 接口（见 getApiUrl）
+function modelFamily(model) {
+  if (model === 'sora_image') return 'sora_image';
+  return isAnthropicModel(model) ? 'claude' : 'gemini';
+}
+
+// Extra headers the upstream needs besides auth and content type
+function getApiHeaders(model) {
+  return isAnthropicModel(model) ? { 'anthropic-version': ANTHROPIC_VERSION } : {};
+}
+
+// 连接预热（默认关闭）：定期对上游并发发送 OPTIONS 请求（HEAD 请求会让 undici 关闭连接），让 fetch 的连接池保持 WARM_POOL_SIZE 个已握手的 keep-alive 连接
+// 间隔需要小于连接池的空闲超时（undici 默认 4 秒），否则连接在两次预热之间就会被关闭
+// 配置了 UPSTREAM_REGIONS 时预热各区域，否则预热默认上游
+const UPSTREAM_ORIGINS = upstreamRegions.length > 0
+  ? [...new Set(upstreamRegions.map(region => new URL(region.baseUrl).origin))]
+  : [...new Set(['sora_image', 'gemini'].map(model => new URL(getApiUrl(model)).origin))];
+
+async function warmConnections() {
+  const requests = [];
+  for (const origin of UPSTREAM_ORIGINS) {
+    for (let i = 0; i < config.warmPoolSize; i++) {
+      // 读完响应体，连接才会回到连接池
+      requests.push(fetch(origin, { method: 'OPTIONS', signal: AbortSignal.timeout(10000) })
+        .then(response => response.arrayBuffer()));
+    }
+  }
+  const results = await Promise.allSettled(requests);
+  const failed = results.filter(result => result.status === 'rejected');
+  if (failed.length > 0) {
+    debugLog(`[WARM] ${failed.length}/${results.length} warm-up requests failed:`, failed[0].reason.message);
+  }
+}
+
+if (config.warmPoolSize > 0) {
+  console.log(`[WARM] Keeping ${config.warmPoolSize} connection(s) warm to ${UPSTREAM_ORIGINS.join(', ')} every ${config.warmIntervalMs}ms`);
+  warmConnections();
+  setInterval(warmConnections, config.warmIntervalMs).unref();
+}
+
+// 输入图片下载去重：同一 URL 的并发下载共用一次请求，下载结果短暂缓存（批量图生图常用同一张参考图）
+const inflightImageDownloads = new Map();
+const imageCache = new Map(); // url -> { base64, expiresAt }，按插入顺序淘汰
+
+// 图片下载单独限流（IMAGE_DOWNLOAD_CONCURRENCY），与生成并发 MAX_CONCURRENCY 无关，批量任务时避免下载占满带宽
+const imageDownloads = createSemaphore(config.imageDownloadConcurrency);
+
+// Fetch an image under the download limit, read consumes the response body
+async function fetchImage(url, read) {
+  await imageDownloads.acquire();
+  try {
+    const imageResponse = await fetch(url);
+    if (!imageResponse.ok) {
+      throw new Error(`Image download failed with status ${imageResponse.status}`);
+    }
+    return await read(imageResponse);
+  } finally {
+    imageDownloads.release();
+  }
+}
+
+async function downloadImage(url) {
+  return fetchImage(url, async imageResponse => Buffer.from(await imageResponse.arrayBuffer()));
+}
+
+// 边下载边编码：每块按 3 字节对齐转成 base64，余下的字节并入下一块，不需要同时持有完整的原始图片和编码结果
+async function encodeStreamAsBase64(body) {
+  let base64 = '';
+  let remainder = Buffer.alloc(0);
+  for await (const chunk of body) {
+    const bytes = Buffer.from(chunk.buffer, chunk.byteOffset, chunk.byteLength);
+    const data = remainder.length > 0 ? Buffer.concat([remainder, bytes]) : bytes;
+    const aligned = data.length - (data.length % 3);
+    base64 += data.subarray(0, aligned).toString('base64');
+    remainder = data.subarray(aligned);
+  }
+  return base64 + remainder.toString('base64');
+}
+
+// 输入图片类型白名单（INPUT_IMAGE_CONTENT_TYPES）：先看 Content-Type，再用文件头确认，不符合时任务直接失败
+function invalidInputImage(message) {
+  const error = new Error(message);
+  error.errorCode = 'INVALID_INPUT_IMAGE';
+  return error;
+}
+
+async function downloadImageAsBase64(url) {
+  return fetchImage(url, async imageResponse => {
+    const allowed = config.inputImageContentTypes;
+    const contentType = (imageResponse.headers.get('content-type') || '').split(';')[0].trim().toLowerCase();
+    if (contentType && contentType !== 'application/octet-stream' && !allowed.includes(contentType)) {
+      await imageResponse.body?.cancel();
+      throw invalidInputImage(`Input image content type ${contentType} is not allowed (allowed: ${allowed.join(', ')})`);
+    }
+
+    const base64 = await encodeStreamAsBase64(imageResponse.body);
+    const sniffed = sniffImageMimeType(base64);
+    if (!sniffed || !allowed.includes(sniffed)) {
+      throw invalidInputImage(`Input image content is ${sniffed || 'not a recognised image'} (allowed: ${allowed.join(', ')})`);
+    }
+    return base64;
+  });
+}
+
+async function fetchImageAsBase64(url) {
+  const cached = imageCache.get(url);
+  if (cached && cached.expiresAt > Date.now()) {
+    debugLog('Image cache hit:', url);
+    return cached.base64;
+  }
+  imageCache.delete(url);
+
+  if (inflightImageDownloads.has(url)) {
+    debugLog('Joining in-flight image download:', url);
+    return inflightImageDownloads.get(url);
+  }
+
+  const download = downloadImageAsBase64(url);
+  inflightImageDownloads.set(url, download);
+  try {
+    const base64 = await download;
+    imageCache.set(url, { base64, expiresAt: Date.now() + config.imageCacheTtlMs });
+    while (imageCache.size > config.imageCacheMaxEntries) {
+      imageCache.delete(imageCache.keys().next().value);
+    }
+    return base64;
+  } finally {
+    inflightImageDownloads.delete(url);
+  }
+}
+
+// 发给上游的文本：提示词后接尺寸标记，空的部分省略；没有结构化参数的模型把反向提示词追加在最后
+function buildPromptText(prompt, imageSize, negativePrompt) {
+  const text = [(prompt || '').trim(), imageSize].filter(Boolean).join(' ');
+  return negativePrompt ? `${text}\nAvoid: ${negativePrompt}` : text;
+}
+
+// 反向提示词：NEGATIVE_PROMPT_PARAM_MODELS 中的模型通过 negative_prompt 字段传递，其他模型追加到提示词
+const MAX_NEGATIVE_PROMPT_LENGTH = 1000;
+const NEGATIVE_PROMPT_PARAM_MODELS = ['sora_image'];
+
+function validateNegativePrompt(negativePrompt) {
+  if (negativePrompt === undefined) return null;
+  if (typeof negativePrompt !== 'string') return 'negativePrompt must be a string';
+  if (negativePrompt.length > MAX_NEGATIVE_PROMPT_LENGTH) {
+    return `negativePrompt must be at most ${MAX_NEGATIVE_PROMPT_LENGTH} characters`;
+  }
+  return null;
+}
+
+// The negative prompt actually sent upstream, undefined when blank
+function effectiveNegativePrompt(negativePrompt) {
+  return (negativePrompt || '').trim() || undefined;
+}
+
+// 支持只传图片、不写提示词（图片编辑）的模型
+const IMAGE_ONLY_MODELS = ['sora_image'];
+
+// Returns an error message unless every model in the chain gets a usable prompt, otherwise null
+function validatePrompt(models, prompt, hasImages) {
+  if (prompt !== undefined && typeof prompt !== 'string') {
+    return 'prompt must be a string';
+  }
+  if ((prompt || '').trim()) return null;
+
+  const needsPrompt = models.filter(model => !(hasImages && IMAGE_ONLY_MODELS.includes(model)));
+  if (needsPrompt.length === 0) return null;
+  if (!hasImages && models.some(model => IMAGE_ONLY_MODELS.includes(model))) {
+    return 'prompt must not be empty unless input images are provided';
+  }
+  return `prompt must not be empty for model ${needsPrompt[0]}`;
+}
+
+// 内容顺序（contentOrder）：sora_image 和 Gemini 默认文本在前、图片在后，image-first 时图片在前；Anthropic 固定图片在前
+const CONTENT_ORDERS = ['text-first', 'image-first'];
+
+// Put the text part before or after the image parts
+function orderContent(textPart, imageParts, contentOrder) {
+  return contentOrder === 'image-first' ? [...imageParts, textPart] : [textPart, ...imageParts];
+}
+
+// 按模型构建上游请求体
+async function buildRequestBody(model, { prompt, negativePrompt, imageUrl, imageUrls, imageSize, responseFormat, contentOrder, taskId }) {
+  // Handle multiple image URLs - prioritize imageUrls array, fallback to single imageUrl
+  const allImageUrls = imageUrls || (imageUrl ? [imageUrl] : []);
+  console.log(`[${taskId}] Processing generation with ${allImageUrls.length} images`);
+  console.log(`[${taskId}] Model: ${model}, Size: ${imageSize}`);
+  
+  if (model === 'sora_image') {
+    // Build content array with all images
+    const content = orderContent(
+      { type: 'text', text: buildPromptText(prompt, imageSize) },
+      allImageUrls.map(imgUrl => ({ type: 'image_url', image_url: { url: imgUrl } })),
+      contentOrder
+    );
+    
+    // If no images, just use text
+    const finalContent = allImageUrls.length > 0 ? content : buildPromptText(prompt, imageSize);
+    
+    const body = {
+      model: 'sora_image',
+      messages: [{ role: 'user', content: finalContent }]
+    };
+    if (negativePrompt) {
+      body.negative_prompt = negativePrompt;
+    }
+    if (responseFormat) {
+      body.response_format = { type: responseFormat };
+    }
+    return body;
+  }
+
+  if (isAnthropicModel(model)) {
+    return buildAnthropicRequestBody(model, { prompt, negativePrompt, imageSize, allImageUrls, taskId });
+  }
+
+  // Gemini format
+  if (imageUrl) {
+    // Convert image URL to base64 for Gemini
+    let base64Data = imageUrl;
+    if (imageUrl.startsWith('http')) {
+      try {
+        console.log('Converting image URL to base64 for Gemini:', imageUrl);
+        base64Data = await fetchImageAsBase64(imageUrl);
+        console.log('Successfully converted to base64, length:', base64Data.length);
+      } catch (error) {
+        if (error.errorCode === 'INVALID_INPUT_IMAGE') throw error;
+        console.error('Failed to convert image to base64:', error);
+        // Fall back to using URL directly
+        base64Data = imageUrl;
+      }
+    }
+    
+    return {
+      contents: [{
+        role: 'user',
+        parts: orderContent(
+          { text: buildPromptText(prompt, imageSize, negativePrompt) },
+          [{ inline_data: { mime_type: 'image/jpeg', data: base64Data } }],
+          contentOrder
+        )
+      }]
+    };
+  }
+
+  return {
+    contents: [{
+      role: 'user',
+      parts: [{ text: buildPromptText(prompt, imageSize, negativePrompt) }]
+    }]
+  };
+}
+
+// Anthropic Messages 格式：图片在前、文本在后，图片统一转为 base64 source
+async function buildAnthropicRequestBody(model, { prompt, negativePrompt, imageSize, allImageUrls, taskId }) {
+  const content = [];
+  for (const url of allImageUrls) {
+    const match = url.match(DATA_URL_PATTERN);
+    let data;
+    try {
+      data = match ? url.slice(match[0].length) : await fetchImageAsBase64(url);
+    } catch (error) {
+      if (error.errorCode === 'INVALID_INPUT_IMAGE') throw error;
+      console.error(`[${taskId}] Failed to download input image, sending as URL source:`, error.message);
+      content.push({ type: 'image', source: { type: 'url', url } });
+      continue;
+    }
+    const mediaType = (match && match[1]) || sniffImageMimeType(data) || 'image/jpeg';
+    content.push({ type: 'image', source: { type: 'base64', media_type: mediaType, data } });
+  }
+  content.push({ type: 'text', text: buildPromptText(prompt, imageSize, negativePrompt) });
+
+  return {
+    model,
+    max_tokens: ANTHROPIC_MAX_TOKENS,
+    messages: [{ role: 'user', content }]
+  };
+}
+
+// 根据文件头识别图片类型，识别不出时返回 null
+const IMAGE_SIGNATURES = [
+  { mimeType: 'image/png', bytes: [0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a] },
+  { mimeType: 'image/jpeg', bytes: [0xff, 0xd8, 0xff] },
+  { mimeType: 'image/gif', bytes: [0x47, 0x49, 0x46, 0x38] }
+];
+
+function sniffImageMimeType(base64Data) {
+  const header = Buffer.from(base64Data.slice(0, 24), 'base64');
+  for (const { mimeType, bytes } of IMAGE_SIGNATURES) {
+    if (bytes.every((byte, i) => header[i] === byte)) return mimeType;
+  }
+  if (header.toString('latin1', 0, 4) === 'RIFF' && header.toString('latin1', 8, 12) === 'WEBP') {
+    return 'image/webp';
+  }
+  return null;
+}
+
+// 上游没给 mimeType 或只给了 application/octet-stream 时，用实际内容识别出的类型
+function resolveInlineMimeType(mimeType, base64Data) {
+  if (mimeType && mimeType !== 'application/octet-stream') return mimeType;
+
+  const sniffed = sniffImageMimeType(base64Data);
+  if (!sniffed) return mimeType || 'application/octet-stream';
+  console.log(`Corrected inline image mimeType ${mimeType || '(missing)'} -> ${sniffed}`);
+  return sniffed;
+}
+
+// Anthropic 返回格式：content 中的 image 块（base64 或 url source），没有图片块时从文本中提取 URL
+function extractAnthropicImageURLs(data) {
+  const imageUrls = [];
+  let textImageUrl = null;
+
+  for (const block of Array.isArray(data.content) ? data.content : []) {
+    if (block.type === 'image' && block.source) {
+      if (block.source.type === 'base64' && block.source.data) {
+        const mimeType = resolveInlineMimeType(block.source.media_type, block.source.data);
+        imageUrls.push(`data:${mimeType};base64,${block.source.data}`);
+      } else if (block.source.type === 'url' && block.source.url) {
+        imageUrls.push(block.source.url);
+      }
+    } else if (block.type === 'text' && typeof block.text === 'string' && !textImageUrl) {
+      const urlMatch = block.text.match(/https?:\/\/[^\s\]}"']+\.(jpg|jpeg|png|webp|gif)/i);
+      if (urlMatch) textImageUrl = urlMatch[0];
+    }
+  }
+
+  if (imageUrls.length === 0 && textImageUrl) {
+    imageUrls.push(textImageUrl);
+  }
+  console.log(`Extracted ${imageUrls.length} image(s) from Anthropic response`);
+  return imageUrls;
+}
+
+// 提取响应中的所有图片：Gemini 会遍历所有 candidates 的所有 parts，按顺序返回
+function extractImageURLs(model, data) {
+  if (model === 'sora_image') {
+    // Sora 模型返回格式
+    if (data.choices && data.choices[0]) {
+      const content = data.choices[0].message?.content;
+      console.log('Sora content:', content);
+      
+      if (typeof content === 'string') {
+        // 提取URL - 确保匹配完整的URL
+        const urlMatch = content.match(/https?:\/\/[^\s\]}"']+\.(jpg|jpeg|png|webp|gif)/i);
+        if (urlMatch) {
+          console.log('Extracted Sora image URL:', urlMatch[0]);
+          return [urlMatch[0]];
+        }
+      }
+    }
+    return [];
+  }
+
+  if (isAnthropicModel(model)) {
+    return extractAnthropicImageURLs(data);
+  }
+
+  // Gemini 模型返回格式
+  console.log('Processing Gemini response...');
+  const imageUrls = [];
+  let textImageUrl = null;
+
+  for (const candidate of data.candidates || []) {
+    console.log('Gemini candidate preview:', JSON.stringify(candidate).substring(0, 500) + '...');
+    if (!candidate.content || !candidate.content.parts) continue;
+
+    for (const part of candidate.content.parts) {
+      // 检查是否有base64图片数据（Gemini返回的格式）
+      if (part.inlineData && part.inlineData.data) {
+        console.log('Found Gemini base64 image data with mimeType:', part.inlineData.mimeType);
+        
+        // 将base64数据保存为data URL
+        const mimeType = resolveInlineMimeType(part.inlineData.mimeType, part.inlineData.data);
+        const dataUrl = `data:${mimeType};base64,${part.inlineData.data}`;
+        console.log('Created data URL for Gemini image (length):', dataUrl.length);
+        imageUrls.push(dataUrl);
+      }
+      // 如果有文本，也记录下来
+      else if (part.text) {
+        console.log('Gemini text part:', part.text);
+        // 尝试从文本中提取图片URL（备用，仅在没有 inlineData 图片时使用）
+        const urlMatch = part.text.match(/https?:\/\/[^\s\]}"']+\.(jpg|jpeg|png|webp|gif)/i);
+        if (urlMatch && !textImageUrl) {
+          textImageUrl = urlMatch[0];
+          console.log('Extracted Gemini image URL from text:', textImageUrl);
+        }
+      }
+    }
+  }
+
+  if (imageUrls.length === 0 && textImageUrl) {
+    imageUrls.push(textImageUrl);
+  }
+  if (imageUrls.length > 1) {
+    console.log(`Collected ${imageUrls.length} Gemini images`);
+  }
+  return imageUrls;
+}
+
+// 对话补全格式（sora_image）的 finish_reason：stop、length、content_filter 等，其他模型没有这个字段
+function extractFinishReason(model, data) {
+  if (model !== 'sora_image') return undefined;
+  return data.choices?.[0]?.finish_reason || undefined;
+}
+
+// 上游返回的安全评分，统一成 { blockReason, ratings: [{ category, level, score, blocked }] }，没有时为 undefined
+// Gemini：candidates[].safetyRatings 和 promptFeedback；对话补全格式：choices[].content_filter_results 和 prompt_filter_results
+function extractSafety(model, data) {
+  const ratings = [];
+  let blockReason;
+
+  if (model === 'sora_image') {
+    const filterResults = [
+      ...(data.prompt_filter_results || []).map(entry => entry.content_filter_results),
+      ...(data.choices || []).map(choice => choice.content_filter_results)
+    ];
+    for (const results of filterResults) {
+      for (const [category, result] of Object.entries(results || {})) {
+        if (!result || typeof result !== 'object') continue;
+        ratings.push({ category, level: result.severity, blocked: Boolean(result.filtered) });
+      }
+    }
+  } else if (!isAnthropicModel(model)) {
+    const safetyRatings = [
+      ...(data.promptFeedback?.safetyRatings || []),
+      ...(data.candidates || []).flatMap(candidate => candidate.safetyRatings || [])
+    ];
+    for (const rating of safetyRatings) {
+      ratings.push({ category: rating.category, level: rating.probability, score: rating.probabilityScore, blocked: Boolean(rating.blocked) });
+    }
+    blockReason = data.promptFeedback?.blockReason;
+  }
+
+  if (ratings.length === 0 && !blockReason) return undefined;
+  return { blockReason, ratings };
+}
+
+// 被上游内容审核拦截：即使响应里有部分图片地址也按失败处理
+const CONTENT_REJECTED_MESSAGE = 'Content rejected by upstream content filter';
+
+function isContentRejected(finishReason) {
+  return finishReason === 'content_filter';
+}
+
+// 输入图片审核（moderateInputs: true）：生成前逐张发给 MODERATION_URL，接口返回 { flagged, score }
+// flagged 为 true 或 score 达到 MODERATION_THRESHOLD 时任务以 CONTENT_REJECTED 失败，不调用上游；审核接口不可用时同样失败
+const MODERATION_TIMEOUT_MS = 10 * 1000;
+
+async function moderateInputImages(imageUrls, taskId) {
+  for (const imageUrl of imageUrls) {
+    let verdict;
+    try {
+      const headers = { 'Content-Type': 'application/json' };
+      if (config.moderationApiKey) headers['Authorization'] = `Bearer ${config.moderationApiKey}`;
+      const response = await fetch(config.moderationUrl, {
+        method: 'POST',
+        headers,
+        body: JSON.stringify({ imageUrl }),
+        signal: AbortSignal.timeout(MODERATION_TIMEOUT_MS)
+      });
+      if (!response.ok) {
+        throw new Error(`status ${response.status}`);
+      }
+      verdict = await response.json();
+    } catch (error) {
+      throw new Error(`Input moderation failed: ${error.message}`);
+    }
+
+    const score = typeof verdict.score === 'number' ? verdict.score : null;
+    if (verdict.flagged === true || (score !== null && score >= config.moderationThreshold)) {
+      console.warn(`[${taskId}] Input image flagged by moderation (score: ${score})`);
+      const error = new Error('Input image rejected by moderation');
+      error.errorCode = 'CONTENT_REJECTED';
+      throw error;
+    }
+  }
+}
+
+// Extract a failure reason from a response that had no image
+function extractErrorMessage(data) {
+  let errorMessage = 'No image URL in response';
+  
+  // Try to extract error from Sora API response
+  if (data.choices && data.choices[0] && data.choices[0].message) {
+    const content = data.choices[0].message.content;
+    if (typeof content === 'string') {
+      // Extract failure reason from content (e.g., "生成失败 ❌\n失败原因：input_moderation")
+      if (content.includes('生成失败')) {
+        errorMessage = content;  // Use the full error message from API
+      }
+    }
+  }
+
+  return errorMessage;
+}
+
+// 输出格式转换：使用可选依赖 sharp，未安装或转换失败时保留原格式（配置了水印时除外，见下方水印说明）
+// base64 结果总是转换；URL 结果只有 convertOutput: true 时才下载后转换（结果变为 base64）
+const OUTPUT_IMAGE_FORMATS = ['png', 'jpeg', 'webp', 'avif'];
+// outputQuality（1-100）只对有损格式生效，未指定时使用 sharp 的默认值 80
+const LOSSY_OUTPUT_FORMATS = ['jpeg', 'webp', 'avif'];
+const DEFAULT_OUTPUT_QUALITY = 80;
+const MAX_TRANSCODE_INPUT_BYTES = 20 * 1024 * 1024;
+const MAX_TRANSCODE_PIXELS = 4096 * 4096;
+
+let sharp = null;
+try {
+  sharp = require('sharp');
+  // 单线程、不缓存，控制转换时的内存占用
+  sharp.cache(false);
+  sharp.concurrency(1);
+} catch (error) {
+  // Optional, outputImageFormat is ignored without it
+}
+
+// 配置了水印就必须能加水印：没有 sharp 时拒绝启动，而不是返回没有水印的图片
+if (config.watermarkText && !sharp) {
+  console.error('WATERMARK_TEXT is set but the optional dependency sharp is not installed, install sharp or unset WATERMARK_TEXT');
+  process.exit(1);
+}
+
+function validateOutputFormat(outputImageFormat, convertOutput) {
+  if (outputImageFormat !== undefined && !OUTPUT_IMAGE_FORMATS.includes(outputImageFormat)) {
+    return `outputImageFormat must be one of ${OUTPUT_IMAGE_FORMATS.join(', ')}`;
+  }
+  if (convertOutput !== undefined && typeof convertOutput !== 'boolean') {
+    return 'convertOutput must be a boolean';
+  }
+  return null;
+}
+
+function validateOutputQuality(outputQuality) {
+  if (outputQuality === undefined) return null;
+  if (!Number.isInteger(outputQuality) || outputQuality < 1 || outputQuality > 100) {
+    return 'outputQuality must be an integer between 1 and 100';
+  }
+  return null;
+}
+
+// 水印（WATERMARK_TEXT）：用 SVG 文字叠加在 WATERMARK_POSITION 角落，和格式转换在同一次编码中完成
+// 所有结果都加水印：URL 结果也会下载后重新编码，以 base64 返回；图片过大或无法解码时任务失败（WATERMARK_FAILED），不返回没有水印的原图
+const WATERMARK_GRAVITY = {
+  'top-left': 'northwest',
+  'top-right': 'northeast',
+  'bottom-left': 'southwest',
+  'bottom-right': 'southeast',
+  center: 'centre'
+};
+
+function escapeXml(text) {
+  return text.replace(/[<>&"']/g, char => `&#${char.charCodeAt(0)};`);
+}
+
+// SVG overlay sized to the text, scaled with the image width
+function buildWatermark(width, height) {
+  const fontSize = Math.max(12, Math.round(width * 0.04));
+  const padding = Math.round(fontSize / 2);
+  const overlayWidth = Math.min(width, Math.ceil(config.watermarkText.length * fontSize * 0.6) + padding * 2);
+  const overlayHeight = Math.min(height, Math.ceil(fontSize * 1.4) + padding * 2);
+  const svg = `<svg xmlns="http://www.w3.org/2000/svg" width="${overlayWidth}" height="${overlayHeight}">`
+    + `<text x="${padding}" y="${overlayHeight - padding - Math.round(fontSize * 0.3)}" font-family="sans-serif" font-size="${fontSize}" `
+    + `fill="#ffffff" fill-opacity="${config.watermarkOpacity}" stroke="#000000" stroke-opacity="${config.watermarkOpacity}" stroke-width="${Math.max(1, Math.round(fontSize / 24))}">`
+    + `${escapeXml(config.watermarkText)}</text></svg>`;
+  return { input: Buffer.from(svg), gravity: WATERMARK_GRAVITY[config.watermarkPosition] };
+}
+
+function watermarkFailed(message) {
+  return Object.assign(new Error(message), { errorCode: 'WATERMARK_FAILED' });
+}
+
+async function transcodeImage(imageUrl, format, outputQuality, convertOutput, taskId) {
+  const match = imageUrl.match(DATA_URL_PATTERN);
+  const watermark = Boolean(config.watermarkText);
+  if (!match && !convertOutput && !watermark) return imageUrl;
+  // 格式相同、没有指定质量也不加水印时不需要重新编码
+  if (match && (!format || match[1] === `image/${format}`) && outputQuality === undefined && !watermark) return imageUrl;
+
+  try {
+    const input = match
+      ? Buffer.from(imageUrl.slice(match[0].length), 'base64')
+      : await downloadImage(imageUrl);
+    if (input.length > MAX_TRANSCODE_INPUT_BYTES) {
+      if (watermark) throw watermarkFailed(`Image too large to watermark (${input.length} bytes)`);
+      console.warn(`[${taskId}] Image too large to transcode (${input.length} bytes), keeping original`);
+      return imageUrl;
+    }
+    let image = sharp(input, { limitInputPixels: MAX_TRANSCODE_PIXELS });
+    if (watermark) {
+      const { width, height } = await image.metadata();
+      image = image.composite([buildWatermark(width, height)]);
+    }
+    const options = LOSSY_OUTPUT_FORMATS.includes(format) ? { quality: outputQuality || DEFAULT_OUTPUT_QUALITY } : {};
+    if (format) image = image.toFormat(format, options);
+    const { data: output, info } = await image.toBuffer({ resolveWithObject: true });
+    const mimeType = format ? `image/${format}` : (match ? match[1] : `image/${info.format === 'heif' ? 'avif' : info.format}`);
+    console.log(`[${taskId}] Transcoded output image to ${mimeType}${options.quality ? ` (quality ${options.quality})` : ''}${watermark ? ' with watermark' : ''}: ${input.length} -> ${output.length} bytes`);
+    return `data:${mimeType};base64,${output.toString('base64')}`;
+  } catch (error) {
+    if (watermark) {
+      console.error(`[${taskId}] Watermarking the output image failed:`, error.message);
+      throw error.errorCode ? error : watermarkFailed(`Failed to watermark output image: ${error.message}`);
+    }
+    console.error(`[${taskId}] Output transcoding to ${format} failed, keeping original:`, error.message);
+    return imageUrl;
+  }
+}
+
+// 上传到调用方提供的预签名 PUT 地址（uploadUrl），结果和回调里只保留上传后的地址（去掉签名参数）
+// data URL 分块解码后流式上传，远程图片直接转发下载流，不在内存中拼出完整图片
+const UPLOAD_TIMEOUT_MS = 60 * 1000;
+
+async function uploadImage(imageUrl, uploadUrl, taskId) {
+  const targetError = await checkCallbackTarget(uploadUrl);
+  if (targetError) {
+    throw new Error(`Upload to uploadUrl failed: ${targetError}`);
+  }
+
+  const match = imageUrl.match(DATA_URL_PATTERN);
+  if (!match) await imageDownloads.acquire();
+  try {
+    let body, contentType, contentLength;
+    if (match) {
+      contentType = match[1];
+      contentLength = Buffer.byteLength(imageUrl.slice(match[0].length), 'base64');
+      body = Readable.from(decodeDataUrl(imageUrl));
+    } else {
+      const download = await fetch(imageUrl);
+      if (!download.ok) {
+        throw new Error(`Image download failed with status ${download.status}`);
+      }
+      body = download.body;
+      contentType = download.headers.get('content-type');
+      contentLength = download.headers.get('content-length');
+    }
+
+    const headers = { 'Content-Type': contentType || 'application/octet-stream' };
+    if (contentLength) headers['Content-Length'] = String(contentLength);
+    const startTime = Date.now();
+    const response = await fetch(uploadUrl, {
+      method: 'PUT',
+      headers,
+      body,
+      duplex: 'half',
+      signal: AbortSignal.timeout(UPLOAD_TIMEOUT_MS)
+    });
+    await response.arrayBuffer();
+    if (!response.ok) {
+      throw new Error(`Upload to uploadUrl failed with status ${response.status}`);
+    }
+    console.log(`[${taskId}] Uploaded ${contentLength || 'unknown'} bytes to uploadUrl in ${Date.now() - startTime}ms`);
+  } catch (error) {
+    throw error.message.startsWith('Upload to uploadUrl failed')
+      ? error
+      : new Error(`Upload to uploadUrl failed: ${error.message}`);
+  } finally {
+    if (!match) imageDownloads.release();
+  }
+
+  const { origin, pathname } = new URL(uploadUrl);
+  return `${origin}${pathname}`;
+}
+
+// Convert all result images to the requested format, returns { imageUrl, imageUrls }
+async function applyOutputFormat(imageUrls, { outputImageFormat, outputQuality, convertOutput, taskId }) {
+  if (!outputImageFormat && !config.watermarkText) {
+    return { imageUrl: imageUrls[0], imageUrls };
+  }
+  if (!sharp) {
+    // 启动时已保证配置了水印就有 sharp，这里只可能是格式转换
+    console.warn(`[${taskId}] outputImageFormat ${outputImageFormat} requested but sharp is not installed, keeping original image`);
+    return { imageUrl: imageUrls[0], imageUrls };
+  }
+
+  const converted = [];
+  for (const url of imageUrls) {
+    converted.push(await transcodeImage(url, outputImageFormat, outputQuality, convertOutput, taskId));
+  }
+  return { imageUrl: converted[0], imageUrls: converted };
+}
+
+// OpenAI 兼容的 response_format，只对 chat completions 接口（sora_image）有效
+const RESPONSE_FORMATS = ['text', 'json_object'];
+
+// Returns an error message if responseFormat isn't accepted for the model, otherwise null
+function validateResponseFormat(model, responseFormat) {
+  if (responseFormat === undefined) return null;
+  if (!RESPONSE_FORMATS.includes(responseFormat)) {
+    return `responseFormat must be one of ${RESPONSE_FORMATS.join(', ')}`;
+  }
+  if (model !== 'sora_image') {
+    return 'responseFormat is only supported for sora_image';
+  }
+  return null;
+}
+
+// 输出图片域名白名单：配置 ALLOWED_OUTPUT_HOSTS 后，上游返回的图片 URL 必须在列表中（*.example.com 匹配子域名）
+// base64 内联图片不受限制；未配置时接受任何域名
+function isAllowedOutputUrl(url) {
+  if (config.allowedOutputHosts.length === 0 || url.startsWith('data:')) return true;
+
+  let hostname;
+  try {
+    hostname = new URL(url).hostname.toLowerCase();
+  } catch (error) {
+    return false;
+  }
+  return config.allowedOutputHosts.some(host => host.startsWith('*.')
+    ? hostname.endsWith(host.slice(1))
+    : hostname === host);
+}
+
+// 预览图（wantPreviews: true，仅 sora_image）：以 stream 模式调用对话补全接口，边读 SSE 边累积文本
+// 文本中依次出现的图片链接，最后一张是最终图片，之前的都是预览；每出现一张新链接就通过 onPreview 通知
+const IMAGE_URL_PATTERN = /https?:\/\/[^\s\]}"']+\.(jpg|jpeg|png|webp|gif)/gi;
+
+async function readStreamedCompletion(response, taskId, onPreview) {
+  const decoder = new TextDecoder();
+  let buffer = '';
+  let content = '';
+  let finishReason = null;
+  let responseBytes = 0;
+  const imageUrls = [];
+
+  for await (const chunk of response.body) {
+    responseBytes += chunk.byteLength;
+    buffer += decoder.decode(chunk, { stream: true });
+    const lines = buffer.split('\n');
+    buffer = lines.pop();
+
+    for (const line of lines) {
+      const payload = line.startsWith('data:') ? line.slice('data:'.length).trim() : '';
+      if (!payload || payload === '[DONE]') continue;
+      let event;
+      try {
+        event = JSON.parse(payload);
+      } catch (error) {
+        debugLog(`[${taskId}] Skipping malformed stream event:`, payload);
+        continue;
+      }
+      const choice = event.choices && event.choices[0];
+      if (!choice) continue;
+      if (choice.delta && typeof choice.delta.content === 'string') content += choice.delta.content;
+      if (choice.finish_reason) finishReason = choice.finish_reason;
+    }
+
+    for (const [url] of content.matchAll(IMAGE_URL_PATTERN)) {
+      if (imageUrls.includes(url)) continue;
+      imageUrls.push(url);
+      console.log(`[${taskId}] Streamed image URL #${imageUrls.length}: ${url}`);
+      if (onPreview) await onPreview(url);
+    }
+  }
+
+  const data = { choices: [{ message: { role: 'assistant', content }, finish_reason: finishReason }] };
+  return { data, responseBytes, imageUrls };
+}
+
+// Drops images from a content_filter response and rejects hosts outside ALLOWED_OUTPUT_HOSTS
+function checkOutputUrls(imageUrls, finishReason, taskId) {
+  if (isContentRejected(finishReason) && imageUrls.length > 0) {
+    console.warn(`[${taskId}] Discarding ${imageUrls.length} image URL(s) from a content_filter response`);
+    return [];
+  }
+  const disallowed = imageUrls.find(url => !isAllowedOutputUrl(url));
+  if (disallowed) {
+    const error = new Error(`Output image host ${new URL(disallowed).hostname} is not in ALLOWED_OUTPUT_HOSTS`);
+    console.error(`[${taskId}] ${error.message}`);
+    throw error;
+  }
+  return imageUrls;
+}
+
+// gRPC 传输（GRPC_MODELS）：本地部署的模型通过 proto/imagegen.proto 的 Generate 调用，不经过 HTTP 上游
+// apiKey 作为 authorization 元数据传递；UNAVAILABLE、RESOURCE_EXHAUSTED 和连接错误按 maxRetries 重试
+const GRPC_CALL_TIMEOUT_MS = 4 * 60 * 1000;
+const GRPC_RETRYABLE_CODES = [8, 14];
+
+function isGrpcModel(model) {
+  return Object.prototype.hasOwnProperty.call(config.grpcModels, model);
+}
+
+async function callGrpcWithRetry(endpoint, request, { apiKey, taskId, maxRetries, signal }) {
+  const attempts = resolveAttempts(maxRetries);
+  for (let attempt = 1; ; attempt++) {
+    throwIfCancelled(signal);
+    try {
+      const response = await callGrpcGenerate(endpoint, request, {
+        metadata: apiKey ? { authorization: `Bearer ${apiKey}` } : {},
+        timeoutMs: GRPC_CALL_TIMEOUT_MS,
+        signal
+      });
+      return { ...response, attempts: attempt };
+    } catch (error) {
+      throwIfCancelled(signal);
+      console.error(`[${taskId}] gRPC attempt ${attempt} failed:`, truncateErrorText(error.message));
+      const retryable = error.grpcCode === undefined || GRPC_RETRYABLE_CODES.includes(error.grpcCode);
+      if (!retryable || attempt >= attempts) {
+        error.attempts = attempt;
+        throw error;
+      }
+      const waitTime = backoffDelay(attempt);
+      console.log(`[${taskId}] Waiting ${waitTime}ms before retry...`);
+      await wait(waitTime);
+    }
+  }
+}
+
+async function generateWithGrpc(model, params) {
+  const { prompt, negativePrompt, imageUrl, imageUrls, imageSize, taskId } = params;
+  const endpoint = config.grpcModels[model];
+  console.log(`[${taskId}] Calling gRPC model ${model} at ${endpoint}...`);
+  const startTime = Date.now();
+
+  const request = {
+    model,
+    prompt,
+    imageUrls: imageUrls || (imageUrl ? [imageUrl] : []),
+    imageSize,
+    negativePrompt,
+    taskId
+  };
+  const redactedBody = redactRequestBody(request);
+  debugLog(`[${taskId}] Upstream request body: ${JSON.stringify(redactedBody)}`);
+
+  let response;
+  try {
+    response = await callGrpcWithRetry(endpoint, request, params);
+  } catch (error) {
+    error.requestBody = redactedBody;
+    throw error;
+  }
+
+  console.log(`[${taskId}] gRPC call completed in ${(Date.now() - startTime) / 1000}s, ${response.imageUrls.length} image(s)`);
+  recordModelLatency(model, Date.now() - startTime);
+  responseSizeWindow.add(response.responseBytes);
+
+  const finishReason = response.finishReason || undefined;
+  const data = { imageUrls: response.imageUrls, finishReason };
+  const outputUrls = checkOutputUrls(response.imageUrls, finishReason, taskId);
+  return { data, imageUrl: outputUrls[0] || null, imageUrls: outputUrls, responseBytes: response.responseBytes, finishReason, attempts: response.attempts, requestBody: redactedBody };
+}
+
+// 调试用的上游请求体副本：key/token 类字段替换为 [redacted]，base64 图片数据只保留长度
+const REDACTED_BODY_KEYS = /^(api_?key|key|token|access_token|authorization)$/i;
+const MAX_LOGGED_BASE64_LENGTH = 256;
+
+function redactRequestBody(value, key) {
+  if (typeof value === 'string') {
+    if (key && REDACTED_BODY_KEYS.test(key)) return '[redacted]';
+    const dataUrl = value.match(/^data:[^,]*;base64,/);
+    if (dataUrl) return `${dataUrl[0]}[${value.length - dataUrl[0].length} chars]`;
+    if (value.length > MAX_LOGGED_BASE64_LENGTH && /^[A-Za-z0-9+/=\r\n]+$/.test(value)) return `[base64, ${value.length} chars]`;
+    return value;
+  }
+  if (Array.isArray(value)) return value.map(item => redactRequestBody(item));
+  if (value && typeof value === 'object') {
+    return Object.fromEntries(Object.entries(value).map(([name, item]) => [name, redactRequestBody(item, name)]));
+  }
+  return value;
+}
+
+// 调用单个模型：构建请求、带重试调用上游、解析响应
+async function generateWithModel(model, params) {
+  if (isGrpcModel(model)) {
+    return generateWithGrpc(model, params);
+  }
+
+  const { apiKey, taskId, authMode = config.upstreamAuthMode, maxRetries, upstreamBaseUrl, signal } = params;
+  const requestBody = await buildRequestBody(model, params);
+  const streamPreviews = Boolean(params.wantPreviews) && model === 'sora_image';
+  if (streamPreviews) {
+    requestBody.stream = true;
+  }
+  const redactedBody = redactRequestBody(requestBody);
+  debugLog(`[${taskId}] Upstream request body: ${JSON.stringify(redactedBody)}`);
+
+  const region = upstreamBaseUrl ? null : selectUpstreamRegion();
+  console.log(`[${taskId}] Calling third-party API with retry logic...${region ? ` (region ${region.baseUrl})` : ''}`);
+  const startTime = Date.now();
+
+  // Call API with retry
+  let response;
+  try {
+    response = await callAPIWithRetry(resolveApiUrl(model, upstreamBaseUrl || region?.baseUrl), requestBody, apiKey, resolveAttempts(maxRetries), taskId, authMode, signal, getApiHeaders(model));
+  } catch (error) {
+    if (region && isRegionFailure(error)) recordRegionFailure(region, taskId);
+    error.requestBody = redactedBody;
+    throw error;
+  }
+  
+  const upstreamLatencyMs = Date.now() - startTime;
+  console.log(`[${taskId}] API call completed successfully in ${upstreamLatencyMs / 1000}s`);
+  recordModelLatency(model, upstreamLatencyMs);
+  if (region) recordRegionLatency(region, upstreamLatencyMs);
+
+  // 读取响应体期间仍受单次请求超时和任务取消约束，读完再清除
+  let data, responseBytes, streamedUrls;
+  try {
+    if (streamPreviews) {
+      ({ data, responseBytes, imageUrls: streamedUrls } = await readStreamedCompletion(response, taskId, params.onPreview));
+    } else {
+      const body = await response.text();
+      responseBytes = Buffer.byteLength(body);
+      data = JSON.parse(body);
+    }
+  } catch (error) {
+    try {
+      throwIfCancelled(signal);
+    } catch (cancelError) {
+      if (cancelError.deadlineExceeded) cancelError.timings = summarizeRequestTiming(response.timing);
+      throw cancelError;
+    }
+    if (error.name === 'AbortError') {
+      console.error(`[${taskId}] Reading the upstream response timed out after 4 minutes`);
+      throw Object.assign(new Error('Request timeout after 4 minutes'), { requestBody: redactedBody, timings: summarizeRequestTiming(response.timing) });
+    }
+    throw error;
+  } finally {
+    response.release();
+  }
+  responseSizeWindow.add(responseBytes);
+  debugLog(`[${taskId}] Upstream response body: ${responseBytes} bytes`);
+
+  // 保存原始响应
+  console.log('API Response for taskId', taskId, ':', JSON.stringify(data, null, 2));
+
+  const finishReason = extractFinishReason(model, data);
+  const imageUrls = checkOutputUrls(streamedUrls ? streamedUrls.slice(-1) : extractImageURLs(model, data), finishReason, taskId);
+  const previews = streamedUrls ? streamedUrls.slice(0, -1) : undefined;
+  return {
+    data, imageUrl: imageUrls[0] || null, imageUrls, responseBytes, finishReason, previews,
+    safety: extractSafety(model, data),
+    upstreamRegion: region ? region.baseUrl : undefined,
+    upstreamLatencyMs: region ? upstreamLatencyMs : undefined,
+    upstreamRequestId: getUpstreamRequestId(response.headers),
+    attempts: response.attempts,
+    requestBody: redactedBody
+  };
+}
+
+// 每个任务最多的备用模型数，整个模型链受 TASK_TIMEOUT_MS 总时限约束
+const MAX_FALLBACK_MODELS = 3;
+
+// Returns an error message if fallbackModels isn't a short list of model names, otherwise null
+function validateFallbackModels(fallbackModels) {
+  if (fallbackModels === undefined) return null;
+  if (!Array.isArray(fallbackModels) || fallbackModels.some(m => typeof m !== 'string' || !m)) {
+    return 'fallbackModels must be an array of model names';
+  }
+  if (fallbackModels.length > MAX_FALLBACK_MODELS) {
+    return `fallbackModels supports at most ${MAX_FALLBACK_MODELS} models`;
+  }
+  return null;
+}
+
+// 提示词扩写（enhancePrompt: true）：生成前先调用一次对话补全模型，把简短的提示词扩写成详细描述
+// 和生成共用同一个并发名额和任务超时；扩写失败时记录日志并使用原始提示词
+const PROMPT_ENHANCER_TIMEOUT_MS = 30 * 1000;
+const PROMPT_ENHANCER_INSTRUCTIONS = 'Rewrite the user\'s image generation prompt into a single detailed, vivid prompt. Keep the original intent, language and any constraints. Reply with the rewritten prompt only.';
+
+async function expandPrompt({ prompt, apiKey, authMode = config.upstreamAuthMode, taskId, signal }, deadline) {
+  const controller = new AbortController();
+  const timeoutId = setTimeout(() => controller.abort(), Math.max(0, Math.min(PROMPT_ENHANCER_TIMEOUT_MS, deadline - Date.now())));
+  const onCancel = () => controller.abort();
+  signal?.addEventListener('abort', onCancel, { once: true });
+
+  const startTime = Date.now();
+  try {
+    const headers = { 'Content-Type': 'application/json' };
+    const requestUrl = config.promptEnhancerApiKey
+      ? applyAuth(config.promptEnhancerUrl, headers, config.promptEnhancerApiKey, 'bearer')
+      : applyAuth(config.promptEnhancerUrl, headers, apiKey, authMode);
+    const response = await fetch(requestUrl, {
+      method: 'POST',
+      headers,
+      body: JSON.stringify({
+        model: config.promptEnhancerModel,
+        messages: [
+          { role: 'system', content: PROMPT_ENHANCER_INSTRUCTIONS },
+          { role: 'user', content: prompt }
+        ]
+      }),
+      signal: controller.signal
+    });
+    if (!response.ok) {
+      throw new Error(`status ${response.status}`);
+    }
+    const data = await response.json();
+    const enhanced = data.choices?.[0]?.message?.content;
+    if (typeof enhanced !== 'string' || !enhanced.trim()) {
+      throw new Error('empty response');
+    }
+    console.log(`[${taskId}] Prompt enhanced in ${Date.now() - startTime}ms (${prompt.length} -> ${enhanced.trim().length} chars)`);
+    return enhanced.trim();
+  } catch (error) {
+    throwIfCancelled(signal);
+    console.warn(`[${taskId}] Prompt enhancement failed, using original prompt:`, error.message);
+    return null;
+  } finally {
+    clearTimeout(timeoutId);
+    signal?.removeEventListener('abort', onCancel);
+  }
+}
+
+// 进行中的生成（包括排队等待名额的），供 /admin/stats 按模型和 apiKey 统计
+const activeGenerations = new Set();
+
+// 主模型失败（重试后仍失败或没有返回图片）时，按顺序尝试备用模型
+// Returns { model, data, imageUrl } for the model that produced the final outcome,
+// and rethrows the last error if the final model failed outright
+async function generateWithFallbacks(params) {
+  const { model, fallbackModels = [] } = params;
+  const generation = { model, apiKeyHash: hashForAudit(params.apiKey), state: 'queued' };
+  activeGenerations.add(generation);
+
+  // 排队等待并发名额，整个模型链占用同一个名额
+  await acquireSlot();
+  generation.state = 'running';
+  const startTime = Date.now();
+  const cleanups = [];
+  try {
+    // 排队期间可能已被取消
+    throwIfCancelled(params.signal);
+    if (params.onStarted) await params.onStarted();
+    const deadline = Math.min(startTime + config.taskTimeoutMs, params.deadline || Infinity);
+    // 到达 TASK_TIMEOUT_MS 时中止进行中的上游调用，而不只是在切换备用模型前检查
+    const chainSignal = linkDeadline(params.signal, deadline, cleanups);
+    const chainParams = { ...params, signal: chainSignal };
+    const enhancedPrompt = params.enhancePrompt && (params.prompt || '').trim()
+      ? await expandPrompt(chainParams, deadline)
+      : null;
+    const outcome = await runModelChain([model, ...fallbackModels], enhancedPrompt ? { ...chainParams, prompt: enhancedPrompt } : chainParams, deadline);
+    recordOutcome(Boolean(outcome.imageUrl));
+    return { ...outcome, enhancedPrompt: enhancedPrompt || undefined };
+  } catch (error) {
+    if (!error.cancelled && !error.deadlineExceeded) recordOutcome(false);
+    throw error;
+  } finally {
+    cleanups.forEach(cleanup => cleanup());
+    activeGenerations.delete(generation);
+    releaseSlot();
+    recordLatency(Date.now() - startTime);
+    lastMinute.add('processed');
+  }
+}
+
+// 相同请求合并：并发的相同生成请求（不含 taskId、tags、callbackUrl 等任务信息）共用一次上游调用
+// 共享调用有自己的 AbortController，所有参与的任务都取消后才会中止
+// 同一请求要生成多张不同的图片时（OpenAI 接口的 n），各张用不同的 variant 区分，不会合并成一次调用
+const inflightGenerations = new Map();
+const COALESCE_KEY_FIELDS = ['variant', 'model', 'fallbackModels', 'prompt', 'negativePrompt', 'imageUrl', 'imageUrls', 'imageSize', 'responseFormat', 'contentOrder', 'apiKey', 'authMode', 'maxRetries', 'upstreamBaseUrl', 'wantPreviews', 'enhancePrompt'];
+
+function generationKey(params) {
+  const normalized = COALESCE_KEY_FIELDS.map(field => params[field] === undefined ? null : params[field]);
+  return crypto.createHash('sha256').update(JSON.stringify(normalized)).digest('hex');
+}
+
+// Reject with the cancellation error as soon as the signal aborts, without waiting for the promise
+function untilCancelled(promise, signal) {
+  if (!signal) return promise;
+  return new Promise((resolve, reject) => {
+    const onAbort = () => {
+      try {
+        throwIfCancelled(signal);
+      } catch (error) {
+        reject(error);
+      }
+    };
+    if (signal.aborted) return onAbort();
+    signal.addEventListener('abort', onAbort, { once: true });
+    promise.then(resolve, reject).finally(() => signal.removeEventListener('abort', onAbort));
+  });
+}
+
+// 共享调用只受 TASK_TIMEOUT_MS 限制，不用发起者的截止时间：各任务的 signal 在自己的截止时间中止，只让该任务退出
+function startSharedGeneration(key, params) {
+  const entry = { leaderTaskId: params.taskId, controller: new AbortController(), participants: 0, started: false, startListeners: [], previews: [], previewListeners: [] };
+  entry.promise = generateWithFallbacks({
+    ...params,
+    deadline: undefined,
+    signal: entry.controller.signal,
+    onStarted: async () => {
+      entry.started = true;
+      await Promise.all(entry.startListeners.map(listener => listener()));
+    },
+    onPreview: async (url) => {
+      entry.previews.push(url);
+      await Promise.all(entry.previewListeners.map(listener => listener(url)));
+    }
+  }).finally(() => releaseSharedGeneration(key, entry));
+  inflightGenerations.set(key, entry);
+  return entry;
+}
+
+// 中止后立即移出，之后到达的相同请求发起新的调用，不会加入已中止的调用
+function releaseSharedGeneration(key, entry) {
+  if (inflightGenerations.get(key) === entry) inflightGenerations.delete(key);
+}
+
+async function generateCoalesced(params) {
+  const { taskId, signal, onStarted, onPreview } = params;
+  const key = generationKey(params);
+
+  const entry = inflightGenerations.get(key) || startSharedGeneration(key, params);
+  if (entry.leaderTaskId !== taskId) {
+    console.log(`[${taskId}] Joining in-flight generation started by ${entry.leaderTaskId}`);
+  }
+
+  entry.participants++;
+  if (onStarted) {
+    if (entry.started) await onStarted();
+    else entry.startListeners.push(onStarted);
+  }
+  if (onPreview) {
+    for (const url of entry.previews) await onPreview(url);
+    entry.previewListeners.push(onPreview);
+  }
+
+  const onAbort = () => {
+    entry.participants--;
+    if (entry.participants === 0) {
+      releaseSharedGeneration(key, entry);
+      entry.controller.abort();
+    }
+  };
+  signal?.addEventListener('abort', onAbort, { once: true });
+  try {
+    return await untilCancelled(entry.promise, signal);
+  } catch (error) {
+    // 到达截止时间时共享调用可能还在进行，带上它当前这次上游请求的耗时
+    if (error.deadlineExceeded && !error.timings && activeRequestTimings.has(entry.leaderTaskId)) {
+      error.timings = summarizeRequestTiming(activeRequestTimings.get(entry.leaderTaskId));
+    }
+    throw error;
+  } finally {
+    signal?.removeEventListener('abort', onAbort);
+  }
+}
+
+async function runModelChain(models, params, deadline) {
+  const { taskId } = params;
+  let lastOutcome = null;
+  let lastError = null;
+
+  for (let i = 0; i < models.length; i++) {
+    const currentModel = models[i];
+    if (i > 0) {
+      if (Date.now() >= deadline) {
+        console.warn(`[${taskId}] Task timeout reached, skipping remaining fallback models`);
+        break;
+      }
+      console.log(`[${taskId}] Model ${models[i - 1]} failed, falling back to ${currentModel}`);
+    }
+
+    try {
+      lastOutcome = { model: currentModel, ...await generateWithModel(currentModel, params) };
+      lastError = null;
+      if (lastOutcome.imageUrl) {
+        return lastOutcome;
+      }
+      console.error(`[${taskId}] No image URL from model ${currentModel}`);
+    } catch (error) {
+      if (error.cancelled || error.deadlineExceeded) {
+        error.model = currentModel;
+        throw error;
+      }
+      console.error(`[${taskId}] Model ${currentModel} failed:`, truncateErrorText(error.message));
+      error.model = currentModel;
+      lastError = error;
+    }
+  }
+
+  if (lastError) {
+    throw lastError;
+  }
+  return lastOutcome;
+}
+
+// 任务进入最终状态时发出 completed(taskId, result) 事件，批量结果流等待子任务完成时使用
+const taskEvents = new EventEmitter();
+taskEvents.setMaxListeners(0);
+
+// 进行中的异步任务：taskId -> { controller, parentTaskId, cancelToken, failFast }，以及 parentTaskId -> Set<taskId> 的索引
+// cancelToken 是随机 UUID，持有者可以不知道 taskId 直接取消任务，任务结束后失效
+const runningTasks = new Map();
+const parentIndex = new Map();
+const cancelTokens = new Map();
+
+// 到达客户端截止时间时用这个原因中止任务，任务以 TIMEOUT 失败，而不是标记为取消
+const DEADLINE_EXCEEDED = Symbol('deadline exceeded');
+
+function throwIfCancelled(signal) {
+  if (signal && signal.aborted) {
+    if (signal.reason === DEADLINE_EXCEEDED) {
+      const error = new Error('Task deadline exceeded');
+      error.errorCode = 'TIMEOUT';
+      error.deadlineExceeded = true;
+      throw error;
+    }
+    const error = new Error('Task cancelled');
+    error.cancelled = true;
+    throw error;
+  }
+}
+
+// setTimeout 超过 2^31-1 毫秒（约 24.8 天）会立即触发，更远的截止时间分段等待
+const MAX_TIMER_MS = 2 ** 31 - 1;
+
+// Abort controller for a client deadline, call the returned function to stop the timer
+function abortAtDeadline(controller, deadline) {
+  if (!deadline) return () => {};
+  let timer;
+  const schedule = () => {
+    const remaining = deadline - Date.now();
+    timer = remaining > MAX_TIMER_MS
+      ? setTimeout(schedule, MAX_TIMER_MS)
+      : setTimeout(() => controller.abort(DEADLINE_EXCEEDED), Math.max(0, remaining));
+  };
+  schedule();
+  return () => clearTimeout(timer);
+}
+
+// Signal that aborts with the parent signal or at the deadline, the timer and listener are removed by the pushed cleanups
+function linkDeadline(signal, deadline, cleanups) {
+  const controller = new AbortController();
+  if (signal) {
+    const onAbort = () => controller.abort(signal.reason);
+    if (signal.aborted) onAbort();
+    else signal.addEventListener('abort', onAbort, { once: true });
+    cleanups.push(() => signal.removeEventListener('abort', onAbort));
+  }
+  cleanups.push(abortAtDeadline(controller, deadline));
+  return controller.signal;
+}
+
+// 同一 taskId 的任务还在运行时返回 409：重新注册会覆盖前一个任务的取消入口，两个任务的结果也会互相覆盖
+// 在注册任务前同步检查，中间不能有 await
+function rejectRunningTaskIds(res, taskIds) {
+  const running = taskIds.find(taskId => runningTasks.has(taskId));
+  if (!running) return false;
+  res.status(409).json({ error: `Task ${running} is already running`, errorCode: 'TASK_ALREADY_RUNNING', taskId: running });
+  return true;
+}
+
+// Register an in-flight task so it can be cancelled, returns its abort signal and cancel token
+function registerTask(taskId, parentTaskId, deadline, failFast = false) {
+  const controller = new AbortController();
+  const cancelToken = crypto.randomUUID();
+  runningTasks.set(taskId, { controller, parentTaskId, cancelToken, failFast, clearDeadline: abortAtDeadline(controller, deadline) });
+  cancelTokens.set(cancelToken, taskId);
+  if (parentTaskId) {
+    if (!parentIndex.has(parentTaskId)) parentIndex.set(parentTaskId, new Set());
+    parentIndex.get(parentTaskId).add(taskId);
+  }
+  return { signal: controller.signal, cancelToken };
+}
+
+function unregisterTask(taskId) {
+  const task = runningTasks.get(taskId);
+  if (!task) return;
+  task.clearDeadline();
+  runningTasks.delete(taskId);
+  cancelTokens.delete(task.cancelToken);
+  const siblings = task.parentTaskId && parentIndex.get(task.parentTaskId);
+  if (siblings) {
+    siblings.delete(taskId);
+    if (siblings.size === 0) parentIndex.delete(task.parentTaskId);
+  }
+}
+
+// Abort an in-flight task, returns false if it isn't running (unknown or already finished)
+// cancelledBy 记录导致取消的失败任务（failFast 批次），会保存到被取消任务的结果中
+function cancelTask(taskId, cancelledBy) {
+  const task = runningTasks.get(taskId);
+  if (!task || task.controller.signal.aborted) return false;
+  console.log(`[${taskId}] Cancelling task${cancelledBy ? ` (batch task ${cancelledBy.taskId} failed)` : ''}`);
+  task.cancelledBy = cancelledBy;
+  task.controller.abort();
+  return true;
+}
+
+// failFast 批次：以 failFast 提交的子任务失败时，取消同一 parentTaskId 下其余进行中（包括排队）的子任务
+taskEvents.on('completed', (taskId, result) => {
+  const task = runningTasks.get(taskId);
+  if (!task || !task.failFast || result.success || result.cancelled) return;
+  const cancelledBy = { taskId, error: result.error, errorCode: result.errorCode };
+  const siblings = [...(parentIndex.get(task.parentTaskId) || [])].filter(id => id !== taskId);
+  const cancelledTaskIds = siblings.filter(id => cancelTask(id, cancelledBy));
+  if (cancelledTaskIds.length > 0) {
+    console.warn(`[${task.parentTaskId}] Batch task ${taskId} failed, cancelled ${cancelledTaskIds.length} remaining tasks`);
+  }
+});
+
+// 审计日志（AUDIT_LOG=stdout 或 file:<path>）：每个任务一行 JSON，与运行日志分开
+// 只记录 apiKey 和 prompt 的哈希，不记录原文；文件模式每行同步写入，进程崩溃也不会丢失已写的记录
+let auditFd = null;
+if (config.auditLog.startsWith('file:')) {
+  const auditPath = config.auditLog.slice('file:'.length);
+  try {
+    auditFd = require('fs').openSync(auditPath, 'a');
+    console.log(`[AUDIT] Writing audit log to ${auditPath}`);
+  } catch (error) {
+    console.error(`[AUDIT] Failed to open audit log ${auditPath}:`, error.message);
+    process.exit(1);
+  }
+}
+
+function hashForAudit(value) {
+  if (!value) return null;
+  return crypto.createHash('sha256').update(String(value)).digest('hex');
+}
+
+function writeAuditRecord({ taskId, parentTaskId, model, apiKey, prompt, tags, status }) {
+  if (!config.auditLog) return;
+
+  const line = JSON.stringify({
+    taskId,
+    parentTaskId,
+    model,
+    apiKeyHash: hashForAudit(apiKey),
+    promptHash: hashForAudit(prompt),
+    tags,
+    status,
+    timestamp: new Date().toISOString()
+  }) + '\n';
+
+  try {
+    if (auditFd !== null) {
+      require('fs').writeSync(auditFd, line);
+    } else {
+      process.stdout.write(line);
+    }
+  } catch (error) {
+    console.error(`[AUDIT] Failed to write audit record for ${taskId}:`, error.message);
+  }
+}
+
+// 将后台处理逻辑移到独立函数
+// signal 来自 registerTask（在接受请求时注册，保证返回 cancelToken 后即可取消），结束时注销
+// 返回存储的最终结果，进程内的调用方直接使用，不需要再从存储读取（存储可能已被清理）
+async function processGeneration({ variant, model, fallbackModels, prompt, negativePrompt, imageUrl, imageUrls, imageSize, responseFormat, contentOrder, outputImageFormat, outputQuality, convertOutput, apiKey, taskId, parentTaskId, authMode = config.upstreamAuthMode, maxRetries, upstreamBaseUrl, moderateInputs, wantPreviews, enhancePrompt, tags, callbackUrl, callbackContentType, uploadUrl, deadline, debug, createdAt = new Date().toISOString(), signal }) {
+  const startTime = Date.now();  // Move outside try block for finally block access
+
+  // 记录进行中的状态，轮询时可以区分排队和生成中
+  // 收到的预览图随状态一起保存，轮询时可以展示进度
+  const previews = [];
+  let currentStatus = 'pending';
+  const storeTaskState = (status) => {
+    currentStatus = status;
+    return resultStore.store(taskId, { success: false, status, model, parentTaskId, tags, createdAt, previews: previews.length > 0 ? previews : undefined });
+  };
+
+  // 存储最终结果（带上任务的公共信息），提供了 callbackUrl 时再发送回调
+  // createdAt 是提交时间，completedAt 是进入最终状态的时间，timestamp 保留为 completedAt 的别名
+  let finalResult = null;
+  const storeTaskResult = async (result) => {
+    const completedAt = new Date().toISOString();
+    const taskResult = {
+      ...result,
+      status: resultStatus(result),
+      parentTaskId,
+      tags,
+      callbackUrl,
+      callbackContentType,
+      cancelTokenHash: hashForAudit(runningTasks.get(taskId)?.cancelToken) || undefined,
+      negativePrompt,
+      durationMs: Date.now() - startTime,
+      createdAt,
+      completedAt,
+      timestamp: completedAt
+    };
+    finalResult = taskResult;
+    await resultStore.store(taskId, taskResult);
+    taskEvents.emit('completed', taskId, taskResult);
+    writeAuditRecord({ taskId, parentTaskId, model: taskResult.model, apiKey, prompt, tags, status: taskResult.status });
+    if (callbackUrl) {
+      deliverCallback(callbackUrl, buildCallbackPayload(taskId, taskResult), taskId, callbackContentType).catch(() => {
+        // Already logged, the result is still available via polling
+      });
+    }
+  };
+  try {
+    activeTasks++;
+    totalProcessed++;
+    await storeTaskState('pending');
+    
+    // Log resource usage at start
+    const startResources = getResourceUsage();
+    console.log(`[RESOURCE_START] Task ${taskId} | Active: ${activeTasks} | Total: ${totalProcessed} | Memory: ${startResources.memoryMB.used}/${startResources.memoryMB.total}MB (${startResources.memoryMB.percent}%) | CPU: ${startResources.cpu.percent}% | Load: [${startResources.loadAvg.join(', ')}]`);
+
+    if (moderateInputs) {
+      await moderateInputImages(imageUrls || (imageUrl ? [imageUrl] : []), taskId);
+    }
+
+    const { model: usedModel, data, imageUrl: imageUrlResult, imageUrls: imageUrlsResult, responseBytes, finishReason, previews: previewsResult, enhancedPrompt, upstreamRegion, upstreamLatencyMs, upstreamRequestId, safety, requestBody } = await generateCoalesced({
+      variant, model, fallbackModels, prompt, negativePrompt, imageUrl, imageUrls, imageSize, responseFormat, contentOrder, apiKey, taskId, authMode, maxRetries, upstreamBaseUrl, wantPreviews, enhancePrompt, deadline, signal,
+      onStarted: () => storeTaskState('processing'),
+      onPreview: wantPreviews
+        ? (url) => {
+          previews.push(url);
+          return storeTaskState(currentStatus);
+        }
+        : undefined
+    });
+
+    // 最终结果处理
+    if (imageUrlResult) {
+      console.log('Successfully extracted image URL for taskId', taskId, ':', imageUrlResult);
+      const output = await applyOutputFormat(imageUrlsResult, { outputImageFormat, outputQuality, convertOutput, taskId });
+      if (uploadUrl) {
+        try {
+          const location = await uploadImage(output.imageUrl, uploadUrl, taskId);
+          output.imageUrl = location;
+          output.imageUrls = [location];
+        } catch (error) {
+          error.model = usedModel;
+          throw error;
+        }
+      }
+      
+      // 更新存储结果
+      await storeTaskResult({ 
+        success: true, 
+        imageUrl: output.imageUrl,
+        imageUrls: output.imageUrls,
+        model: usedModel,
+        finishReason,
+        previews: previewsResult,
+        prompt: enhancedPrompt ? prompt : undefined,
+        enhancedPrompt,
+        upstreamRegion,
+        upstreamLatencyMs,
+        upstreamRequestId,
+        safety,
+        responseBytes,
+        requestBody: debug ? requestBody : undefined,
+        rawResponse: data 
+      });
+      
+      // Workers will poll /api/status/:taskId to get the result
+    } else {
+      console.error('Failed to extract image URL from response for taskId:', taskId);
+      console.error('Full response data:', JSON.stringify(data, null, 2));
+      
+      const rejected = isContentRejected(finishReason);
+      await storeTaskResult({ 
+        success: false, 
+        error: rejected ? CONTENT_REJECTED_MESSAGE : extractErrorMessage(data), 
+        errorCode: rejected ? 'CONTENT_REJECTED' : undefined,
+        model: usedModel,
+        finishReason,
+        safety,
+        upstreamRequestId,
+        responseBytes,
+        requestBody: debug ? requestBody : undefined,
+        rawResponse: data 
+      });
+
+    }
+  } catch (error) {
+    console.error('Proxy error for taskId', taskId, ':', truncateErrorText(error.message));
+    debugLog(`[${taskId}] Full proxy error:`, error);
+    
+    // Get error message - it already includes full response if we modified it above
+    const errorMessage = error.message || 'Internal server error';
+    const cancelledBy = error.cancelled ? runningTasks.get(taskId)?.cancelledBy : undefined;
+    
+    // 存储错误状态（取消的任务单独标记，回调中状态为 cancelled）
+    if (taskId) {
+      await storeTaskResult({ 
+        success: false, 
+        error: cancelledBy ? `Task cancelled: batch task ${cancelledBy.taskId} failed` : errorMessage,
+        errorCode: error.errorCode,
+        cancelled: error.cancelled || undefined,
+        cancelledBy,
+        timings: error.timings,
+        upstreamRequestId: error.upstreamRequestId,
+        requestBody: debug ? error.requestBody : undefined,
+        model: error.model || model
+      });
+
+    }
+    
+    // Note: Response already sent, so we can't send error response here
+    // The error is stored and will be available via status endpoint
+  } finally {
+    unregisterTask(taskId);
+    // Log resource usage at end
+    activeTasks--;
+    const endResources = getResourceUsage();
+    const duration = ((Date.now() - startTime) / 1000).toFixed(2);
+    console.log(`[RESOURCE_END] Task ${taskId} | Duration: ${duration}s | Active: ${activeTasks} | Memory: ${endResources.memoryMB.used}/${endResources.memoryMB.total}MB (${endResources.memoryMB.percent}%) | CPU: ${endResources.cpu.percent}% | Load: [${endResources.loadAvg.join(', ')}]`);
+    
+    // Warning if resources are high
+    if (parseFloat(endResources.memoryMB.percent) > 80) {
+      console.warn(`[RESOURCE_WARNING] High memory usage: ${endResources.memoryMB.percent}%`);
+    }
+    if (parseFloat(endResources.cpu.percent) > 80) {
+      console.warn(`[RESOURCE_WARNING] High CPU usage: ${endResources.cpu.percent}%`);
+    }
+    if (activeTasks > 50) {
+      console.warn(`[RESOURCE_WARNING] High concurrent tasks: ${activeTasks}`);
+    }
+  }
+  return finalResult;
+}
+
+// 使用文件系统存储结果（简单的持久化方案）
+const fs = require('fs').promises;
+const path = require('path');
+
+// 存储目录（RESULT_DIR，默认 /tmp/aiyoutube-results），每个 taskId 一个 JSON 文件，重启后仍然可用
+const STORAGE_DIR = path.resolve(config.resultDir);
+fs.mkdir(STORAGE_DIR, { recursive: true }).catch(console.error);
+
+// 结果数量上限（MAX_STORED_RESULTS，0 为不限制）：按最后写入时间排序，超出时立即删除最早的结果，不等清理周期
+// 正在运行的任务不淘汰，完成时会重新写入
+const storedResults = new Map(); // taskId -> 最后写入时间，按写入顺序排列
+
+// 启动时按修改时间载入已有的结果文件
+(async () => {
+  try {
+    const files = (await fs.readdir(STORAGE_DIR)).filter(file => file.endsWith('.json'));
+    const entries = [];
+    for (const file of files) {
+      const { mtimeMs } = await fs.stat(path.join(STORAGE_DIR, file)).catch(() => ({ mtimeMs: 0 }));
+      entries.push([file.slice(0, -'.json'.length), mtimeMs]);
+    }
+    entries.sort((a, b) => a[1] - b[1]);
+    for (const [taskId, mtimeMs] of entries) {
+      if (!storedResults.has(taskId)) storedResults.set(taskId, mtimeMs);
+    }
+  } catch (error) {
+    // Storage directory not created yet, nothing to index
+  }
+})();
+
+async function evictStoredResults() {
+  if (config.maxStoredResults === 0) return;
+  let excess = storedResults.size - config.maxStoredResults;
+  if (excess <= 0) return;
+
+  const evicted = [];
+  for (const taskId of storedResults.keys()) {
+    if (excess <= 0) break;
+    if (runningTasks.has(taskId)) continue;
+    storedResults.delete(taskId);
+    excess--;
+    evicted.push(taskId);
+  }
+  await Promise.all(evicted.map(taskId => fs.unlink(resultStore.filePath(taskId)).catch(() => {})));
+  if (evicted.length > 0) {
+    console.warn(`[EVICT] Stored results over MAX_STORED_RESULTS (${config.maxStoredResults}), evicted ${evicted.length} oldest: ${evicted.slice(0, 10).join(', ')}${evicted.length > 10 ? ', ...' : ''}`);
+  }
+}
+
+// 先写临时文件再 rename 覆盖，并发读取（或多个实例共用目录时）不会读到写了一半的文件
+async function writeFileAtomic(filePath, data) {
+  const tempPath = `${filePath}.${process.pid}.${crypto.randomBytes(6).toString('hex')}.tmp`;
+  try {
+    await fs.writeFile(tempPath, data);
+    await fs.rename(tempPath, filePath);
+  } catch (error) {
+    await fs.unlink(tempPath).catch(() => {});
+    throw error;
+  }
+}
+
+// 结果存储的统一入口：所有读写都经过这里，保证取出的结果形状一致
+const resultStore = {
+  filePath(taskId) {
+    return path.join(STORAGE_DIR, `${taskId}.json`);
+  },
+
+  async store(taskId, result) {
+    if (!toTaskResult(result)) {
+      console.error(`Refusing to store malformed result for taskId ${taskId}`);
+      return;
+    }
+    if (typeof result.error === 'string' && result.error.length > config.maxErrorLength) {
+      debugLog(`[${taskId}] Full error before truncation:`, result.error);
+      result = { ...result, error: truncateErrorText(result.error) };
+    }
+    try {
+      await writeFileAtomic(this.filePath(taskId), JSON.stringify({
+        ...result,
+        timestamp: result.completedAt || new Date().toISOString()
+      }));
+      storedResults.delete(taskId);
+      storedResults.set(taskId, Date.now());
+    } catch (error) {
+      console.error('Failed to store result:', error);
+    }
+    await evictStoredResults();
+  },
+
+  // Returns the stored result, or null if missing or malformed
+  async load(taskId) {
+    try {
+      const data = await fs.readFile(this.filePath(taskId), 'utf8');
+      return toTaskResult(JSON.parse(data));
+    } catch (error) {
+      // File doesn't exist or error reading
+      return null;
+    }
+  },
+
+  // Removes every stored result, returns how many were removed
+  async clear() {
+    let files;
+    try {
+      files = await fs.readdir(STORAGE_DIR);
+    } catch (error) {
+      return 0;
+    }
+    let removed = 0;
+    for (const file of files) {
+      if (!file.endsWith('.json')) continue;
+      try {
+        await fs.unlink(path.join(STORAGE_DIR, file));
+        storedResults.delete(file.slice(0, -'.json'.length));
+        removed++;
+      } catch (err) {
+        // Already removed by the cleanup timer
+      }
+    }
+    return removed;
+  },
+
+  // Calls fn(taskId, result) for every valid stored result, stops early if fn returns false
+  async range(fn) {
+    let files;
+    try {
+      files = await fs.readdir(STORAGE_DIR);
+    } catch (error) {
+      return;
+    }
+    for (const file of files) {
+      if (!file.endsWith('.json')) continue;
+      const taskId = file.slice(0, -'.json'.length);
+      const result = await this.load(taskId);
+      if (result && fn(taskId, result) === false) break;
+    }
+  }
+};
+
+// Anything that isn't an object with a boolean success flag isn't a task result
+function toTaskResult(value) {
+  if (!value || typeof value !== 'object' || Array.isArray(value)) return null;
+  if (typeof value.success !== 'boolean') return null;
+  return value;
+}
+
+// 租户配额：按租户统计每天（UTC）和每月成功的生成次数，达到上限后生成接口返回 429 QUOTA_EXCEEDED
+// 租户 id 依次取 JWT claim（QUOTA_TENANT_CLAIM）、X-Tenant-Id 请求头（只在未启用 JWT 时使用）、apiKey 哈希（key:<前 16 位>）
+// 上限为 QUOTA_DAILY / QUOTA_MONTHLY（0 为不限制），TENANT_DAILY_QUOTAS / TENANT_MONTHLY_QUOTAS 按租户覆盖，POST /admin/quotas/:tenantId 可在运行中修改
+// 计数存放在结果存储目录的 quotas/ 下，每个租户一个文件，重启后保留；进行中的生成先占用名额，失败时归还
+// 多实例共用存储目录时，检查和占用名额都在租户的锁文件（<文件>.lock）内重新读取再写入，不会互相覆盖；
+// 每个实例把自己占用的名额数写在租户文件的 pending 中，其他实例检查时一并计入；实例崩溃没有归还的名额在 QUOTA_RESERVATION_TTL_MS 后失效
+// 内存中只保存本实例的占用数，租户数量不会让内存增长
+const QUOTA_DIR = path.join(STORAGE_DIR, 'quotas');
+const QUOTA_PERIODS = ['daily', 'monthly'];
+const TENANT_ID_PATTERN = /^[A-Za-z0-9._:@-]{1,128}$/;
+// 持有锁的实例崩溃时锁文件会残留，超过这个时间视为失效并删除；正常的读改写远用不了这么久；等待锁的上限比它长，残留的锁会先被清掉
+const QUOTA_LOCK_STALE_MS = 5 * 1000;
+const QUOTA_LOCK_TIMEOUT_MS = 2 * QUOTA_LOCK_STALE_MS;
+const QUOTA_LOCK_RETRY_MS = 20;
+// 每次占用或归还都会刷新本实例的过期时间；排队等待并发名额的时间不算在任务超时内，所以留两倍任务超时
+const QUOTA_RESERVATION_TTL_MS = 2 * config.taskTimeoutMs;
+const QUOTA_INSTANCE_ID = crypto.randomUUID();
+fs.mkdir(QUOTA_DIR, { recursive: true }).catch(console.error);
+
+const quotaPending = new Map(); // tenantId -> 本实例进行中、还没计数的生成数
+const quotaUpdates = new Map(); // tenantId -> 上一次修改，本实例内同一租户的修改按顺序进行，不用争抢锁文件
+
+function resolveTenant(req, body) {
+  if (req.auth) {
+    const claim = req.auth.claims[config.quotaTenantClaim];
+    if (typeof claim === 'string' || typeof claim === 'number') return String(claim);
+  }
+  if (!jwtVerifier) {
+    const header = req.get('x-tenant-id');
+    if (header && TENANT_ID_PATTERN.test(header)) return header;
+  }
+  return body.apiKey ? `key:${hashForAudit(body.apiKey).slice(0, 16)}` : null;
+}
+
+function quotaFilePath(tenantId) {
+  return path.join(QUOTA_DIR, `${crypto.createHash('sha256').update(tenantId).digest('hex')}.json`);
+}
+
+// The tenant's counters for the current day and month, read from disk so usage counted by other instances is included
+async function loadQuotaRecord(tenantId) {
+  let record = { tenantId, day: null, daily: 0, month: null, monthly: 0, limits: null, pending: null };
+  try {
+    record = { ...record, ...JSON.parse(await fs.readFile(quotaFilePath(tenantId), 'utf8')), tenantId };
+  } catch (error) {
+    // No usage recorded yet
+  }
+
+  const now = new Date().toISOString();
+  if (record.day !== now.slice(0, 10)) {
+    record.day = now.slice(0, 10);
+    record.daily = 0;
+  }
+  if (record.month !== now.slice(0, 7)) {
+    record.month = now.slice(0, 7);
+    record.monthly = 0;
+  }
+  return record;
+}
+
+// Runs fn while holding the tenant's lock file, shared by every instance using the same storage
+async function withQuotaLock(tenantId, fn) {
+  const lockPath = `${quotaFilePath(tenantId)}.lock`;
+  const startedAt = Date.now();
+  for (;;) {
+    try {
+      await (await fs.open(lockPath, 'wx')).close();
+      break;
+    } catch (error) {
+      if (error.code !== 'EEXIST') throw error;
+    }
+    const stat = await fs.stat(lockPath).catch(() => null);
+    if (stat && Date.now() - stat.mtimeMs > QUOTA_LOCK_STALE_MS) {
+      console.warn(`[QUOTA] Removing stale lock for tenant ${tenantId}`);
+      await fs.unlink(lockPath).catch(() => {});
+      continue;
+    }
+    if (Date.now() - startedAt > QUOTA_LOCK_TIMEOUT_MS) {
+      throw new Error(`Timed out waiting for the quota lock of tenant ${tenantId}`);
+    }
+    await wait(QUOTA_LOCK_RETRY_MS);
+  }
+
+  try {
+    return await fn();
+  } finally {
+    await fs.unlink(lockPath).catch(() => {});
+  }
+}
+
+// Re-reads the tenant's record under its lock, applies mutate and writes it back, resolves to the record;
+// nothing is written when mutate returns false
+function updateQuotaRecord(tenantId, mutate) {
+  const previous = quotaUpdates.get(tenantId) || Promise.resolve();
+  const update = previous.then(() => withQuotaLock(tenantId, async () => {
+    const record = await loadQuotaRecord(tenantId);
+    if (mutate(record) !== false) {
+      await writeFileAtomic(quotaFilePath(tenantId), JSON.stringify(record));
+    }
+    return record;
+  }));
+  const settled = update.catch(() => {}).finally(() => {
+    if (quotaUpdates.get(tenantId) === settled) quotaUpdates.delete(tenantId);
+  });
+  quotaUpdates.set(tenantId, settled);
+  return update;
+}
+
+// Generations reserved by every instance, this one included, whose reservation hasn't expired
+function pendingGenerations(record) {
+  const now = Date.now();
+  let pending = quotaPending.get(record.tenantId) || 0;
+  for (const [instanceId, entry] of Object.entries(record.pending || {})) {
+    if (instanceId !== QUOTA_INSTANCE_ID && entry.expiresAt > now) pending += entry.count;
+  }
+  return pending;
+}
+
+// Writes this instance's reservation count into the record and drops expired reservations of other instances
+function syncQuotaReservation(record) {
+  const now = Date.now();
+  const pending = {};
+  for (const [instanceId, entry] of Object.entries(record.pending || {})) {
+    if (instanceId !== QUOTA_INSTANCE_ID && entry.expiresAt > now) pending[instanceId] = entry;
+  }
+  const count = quotaPending.get(record.tenantId) || 0;
+  if (count > 0 && hasQuotaLimit(record)) pending[QUOTA_INSTANCE_ID] = { count, expiresAt: now + QUOTA_RESERVATION_TTL_MS };
+  record.pending = Object.keys(pending).length > 0 ? pending : null;
+}
+
+function hasQuotaLimit(record) {
+  const limits = quotaLimits(record);
+  return QUOTA_PERIODS.some(period => limits[period] > 0);
+}
+
+function quotaLimits(record) {
+  const limits = record.limits || {};
+  return {
+    daily: limits.daily ?? config.tenantDailyQuotas[record.tenantId] ?? config.quotaDaily,
+    monthly: limits.monthly ?? config.tenantMonthlyQuotas[record.tenantId] ?? config.quotaMonthly
+  };
+}
+
+// Start of the next UTC day or month
+function quotaResetAt(period) {
+  const now = new Date();
+  return period === 'daily'
+    ? new Date(Date.UTC(now.getUTCFullYear(), now.getUTCMonth(), now.getUTCDate() + 1))
+    : new Date(Date.UTC(now.getUTCFullYear(), now.getUTCMonth() + 1, 1));
+}
+
+function releaseQuotaReservation(tenantId) {
+  const pending = (quotaPending.get(tenantId) || 1) - 1;
+  if (pending > 0) {
+    quotaPending.set(tenantId, pending);
+  } else {
+    quotaPending.delete(tenantId);
+  }
+}
+
+// Responds 429 when count more generations would go over a limit, otherwise reserves them;
+// the check and the reservation happen under the tenant's lock, so instances sharing the storage can't both take the last slot;
+// every reserved generation must be settled with settleQuota
+async function rejectOverQuota(res, tenantId, count) {
+  if (!tenantId) return false;
+  // 没有上限的租户不会被拒绝，只在本实例计数，不取锁也不写文件
+  if (!hasQuotaLimit(await loadQuotaRecord(tenantId))) {
+    quotaPending.set(tenantId, (quotaPending.get(tenantId) || 0) + count);
+    return false;
+  }
+  let rejected = null;
+  let reserved = false;
+  try {
+    await updateQuotaRecord(tenantId, record => {
+      const limits = quotaLimits(record);
+      const pending = pendingGenerations(record);
+      const period = QUOTA_PERIODS.find(name => limits[name] > 0 && record[name] + pending + count > limits[name]);
+      if (period) {
+        rejected = { period, limit: limits[period], used: record[period], pending };
+        return false;
+      }
+      quotaPending.set(tenantId, (quotaPending.get(tenantId) || 0) + count);
+      reserved = true;
+      syncQuotaReservation(record);
+    });
+  } catch (error) {
+    if (reserved) {
+      for (let i = 0; i < count; i++) releaseQuotaReservation(tenantId);
+    }
+    console.error(`[QUOTA] Failed to check quota for tenant ${tenantId}:`, error.message);
+    res.status(503).json({ error: 'Quota check is temporarily unavailable', errorCode: 'QUOTA_UNAVAILABLE' });
+    return true;
+  }
+  if (!rejected) return false;
+
+  const { period, limit, used, pending } = rejected;
+  const resetAt = quotaResetAt(period);
+  console.warn(`[QUOTA] Rejecting request for tenant ${tenantId}: ${period} quota ${limit} reached (${used} used, ${pending} in progress)`);
+  const retryAfter = Math.ceil((resetAt.getTime() - Date.now()) / 1000);
+  res.set('Retry-After', String(retryAfter));
+  res.status(429).json({
+    error: `${period === 'daily' ? 'Daily' : 'Monthly'} generation quota of ${limit} exceeded`,
+    errorCode: 'QUOTA_EXCEEDED',
+    tenantId,
+    period,
+    limit,
+    used,
+    inProgress: pending,
+    resetAt: resetAt.toISOString(),
+    retryAfter
+  });
+  return true;
+}
+
+// Counts one reserved generation when it succeeded and releases the reservation in the same write,
+// so a check never sees the generation as neither used nor in progress
+async function settleQuota(tenantId, succeeded) {
+  if (!tenantId) return;
+  let released = false;
+  try {
+    await updateQuotaRecord(tenantId, record => {
+      const shared = Boolean(record.pending && record.pending[QUOTA_INSTANCE_ID]);
+      if (succeeded) {
+        record.daily++;
+        record.monthly++;
+      }
+      releaseQuotaReservation(tenantId);
+      released = true;
+      if (!succeeded && !shared) return false;
+      syncQuotaReservation(record);
+    });
+  } catch (error) {
+    console.error(`[QUOTA] Failed to save usage for tenant ${tenantId}:`, error.message);
+  }
+  if (!released) releaseQuotaReservation(tenantId);
+}
+
+// 结果清理：每 CLEANUP_INTERVAL_MS（默认 1 分钟）扫描存储目录，按文件修改时间计算，最终结果保留 RESULT_TTL_MS（默认 30 分钟）；进行中的状态多保留一个任务超时（进程重启后不会再被覆盖），无法解析的文件同样清理
+// 写入中途进程退出留下的临时文件超过一个清理间隔后删除
+// 单个文件出错只记日志、继续处理其他文件；整轮出错也会安排下一轮，看门狗发现清理停滞时重新启动
+// 多实例共用存储时，首轮延迟随机一段时间，每个实例的清理间隔也在 ±CLEANUP_JITTER 范围内随机偏移，避免同时扫描
+const RESULT_TTL_MS = config.resultTtlMs;
+const cleanupIntervalMs = Math.round(config.cleanupIntervalMs * (1 + (Math.random() * 2 - 1) * config.cleanupJitter));
+const initialCleanupDelayMs = Math.round(Math.random() * cleanupIntervalMs * config.cleanupJitter);
+let cleanupTimer = null;
+let cleanupRunning = false;
+let lastCleanupAt = Date.now();
+
+async function cleanupResults() {
+  let files;
+  try {
+    files = await fs.readdir(STORAGE_DIR);
+  } catch (error) {
+    return;
+  }
+
+  const now = Date.now();
+  let removed = 0;
+  for (const file of files) {
+    if (file.endsWith('.tmp')) {
+      const filePath = path.join(STORAGE_DIR, file);
+      const stats = await fs.stat(filePath).catch(() => null);
+      if (stats && now - stats.mtimeMs >= cleanupIntervalMs) {
+        await fs.unlink(filePath).catch(() => {});
+      }
+      continue;
+    }
+    if (!file.endsWith('.json')) continue;
+    try {
+      const filePath = path.join(STORAGE_DIR, file);
+      const { mtimeMs } = await fs.stat(filePath);
+      // 还没到最短保留时间的文件不用读取内容
+      if (now - mtimeMs < RESULT_TTL_MS) continue;
+      const result = await resultStore.load(file.slice(0, -'.json'.length));
+      const ttl = !result || isTerminalResult(result) ? RESULT_TTL_MS : RESULT_TTL_MS + config.taskTimeoutMs;
+      if (now - mtimeMs < ttl) continue;
+      await fs.unlink(filePath);
+      storedResults.delete(file.slice(0, -'.json'.length));
+      removed++;
+    } catch (error) {
+      if (error.code !== 'ENOENT') {
+        console.error(`[CLEANUP] Failed to clean up ${file}:`, error.message);
+      }
+    }
+  }
+  if (removed > 0) {
+    console.log(`[CLEANUP] Removed ${removed} expired result(s)`);
+  }
+}
+
+function scheduleCleanup(delayMs = cleanupIntervalMs) {
+  cleanupTimer = setTimeout(async () => {
+    cleanupRunning = true;
+    try {
+      await cleanupResults();
+    } catch (error) {
+      console.error('[CLEANUP] Cleanup run failed:', error);
+    } finally {
+      cleanupRunning = false;
+      lastCleanupAt = Date.now();
+      scheduleCleanup();
+    }
+  }, delayMs);
+  cleanupTimer.unref();
+}
+
+console.log(`[CLEANUP] First sweep in ${cleanupIntervalMs + initialCleanupDelayMs}ms, then every ${cleanupIntervalMs}ms`);
+scheduleCleanup(cleanupIntervalMs + initialCleanupDelayMs);
+setInterval(() => {
+  if (Date.now() - lastCleanupAt > cleanupIntervalMs * 3 + initialCleanupDelayMs) {
+    // 扫描还在进行时不重启，否则结束后会和新的循环同时运行
+    if (cleanupRunning) {
+      console.warn(`[CLEANUP] Sweep still running after ${Math.round((Date.now() - lastCleanupAt) / 1000)}s, waiting for it to finish`);
+      return;
+    }
+    console.warn(`[CLEANUP] No cleanup run for ${Math.round((Date.now() - lastCleanupAt) / 1000)}s, restarting cleanup loop`);
+    clearTimeout(cleanupTimer);
+    lastCleanupAt = Date.now();
+    scheduleCleanup();
+  }
+}, cleanupIntervalMs).unref();
+
+// 管理接口鉴权：需要配置 ADMIN_TOKEN，请求头带 Authorization: Bearer <token>
+function requireAdmin(req, res, next) {
+  if (!config.adminToken) {
+    return res.status(403).json({ error: 'Admin endpoints are disabled, set ADMIN_TOKEN to enable them' });
+  }
+  if (!hasAdminToken(req)) {
+    return res.status(401).json({ error: 'Invalid admin token' });
+  }
+  next();
+}
+
+// Endpoints that make requests to caller-chosen hosts, open only to JWT callers or, without JWT, to the admin
+function requireCaller(req, res, next) {
+  return jwtVerifier ? authenticate(req, res, next) : requireAdmin(req, res, next);
+}
+
+function hasAdminToken(req) {
+  if (!config.adminToken) return false;
+  const header = req.get('authorization') || '';
+  const token = header.startsWith('Bearer ') ? header.slice('Bearer '.length) : '';
+  // 比较哈希值，长度固定，避免时序攻击
+  const expected = crypto.createHash('sha256').update(config.adminToken).digest();
+  const actual = crypto.createHash('sha256').update(token).digest();
+  return crypto.timingSafeEqual(expected, actual);
+}
+
+// 清空所有任务结果（不影响正在运行的任务，它们完成后会照常写入结果）
+app.post('/admin/flush', requireAdmin, async (req, res) => {
+  const removed = await resultStore.clear();
+  totalProcessed = 0;
+  console.log(`[ADMIN] Flushed ${removed} stored results, active tasks: ${activeTasks}`);
+  res.json({ success: true, removed, activeTasks });
+});
+
+// 详细的运行时状态，排查并发打满时使用：按模型统计的生成数、各 apiKey（哈希前 12 位）的进行中数量、各限流器占用
+app.get('/admin/stats', requireAdmin, (req, res) => {
+  const byModel = {};
+  const byApiKey = {};
+  for (const { model, apiKeyHash, state } of activeGenerations) {
+    byModel[model] = byModel[model] || { queued: 0, running: 0 };
+    byModel[model][state]++;
+    const key = apiKeyHash ? apiKeyHash.slice(0, 12) : 'none';
+    byApiKey[key] = (byApiKey[key] || 0) + 1;
+  }
+
+  const activeResources = {};
+  for (const type of process.getActiveResourcesInfo()) {
+    activeResources[type] = (activeResources[type] || 0) + 1;
+  }
+
+  res.json({
+    // 不限制并发时上限为 null
+    concurrency: {
+      limit: effectiveLimit(),
+      memoryLimit: concurrency.limit,
+      warmupCeiling: concurrency.ceiling,
+      running: concurrency.running,
+      queued: concurrency.waiters.length
+    },
+    tasks: {
+      active: activeTasks,
+      inflightAsync: inflightAsyncTasks,
+      maxInflightAsync: config.maxInflightTasks,
+      cancellable: runningTasks.size,
+      coalescedGenerations: inflightGenerations.size
+    },
+    generations: { byModel, byApiKey },
+    limiters: {
+      imageDownloads: { ...imageDownloads.stats(), limit: config.imageDownloadConcurrency },
+      callbacks: { ...callbackSlots.stats(), limit: config.callbackConcurrency }
+    },
+    upstreamRegions: upstreamRegions.length > 0 ? getRegionSummary() : undefined,
+    failureAlarm: { degraded: failureAlarm.degraded, samples: failureAlarm.outcomes.length },
+    process: {
+      uptimeSeconds: Math.round(process.uptime()),
+      memoryMB: Math.round(process.memoryUsage().rss / 1024 / 1024),
+      activeResources
+    }
+  });
+});
+
+// 修改运行时日志级别，例如排查问题时临时打开 debug，结束后再改回来
+app.post('/admin/loglevel', requireAdmin, (req, res) => {
+  const level = typeof (req.body && req.body.level) === 'string' ? req.body.level.toLowerCase() : '';
+  if (!LOG_LEVELS.includes(level)) {
+    return res.status(400).json({ error: `level must be one of ${LOG_LEVELS.join(', ')}` });
+  }
+  const previous = logLevel;
+  logLevel = level;
+  console.log(`[ADMIN] Log level ${previous} -> ${level}`);
+  res.json({ success: true, level, previous });
+});
+
+// 租户配额用量和上限；POST 设置运行中的上限 { "daily": 100, "monthly": 3000 }，null 表示恢复为环境变量中的配置
+app.get('/admin/quotas/:tenantId', requireAdmin, async (req, res) => {
+  if (!TENANT_ID_PATTERN.test(req.params.tenantId)) {
+    return res.status(400).json({ error: 'Invalid tenant id' });
+  }
+  const record = await loadQuotaRecord(req.params.tenantId);
+  res.json(describeQuota(record));
+});
+
+app.post('/admin/quotas/:tenantId', requireAdmin, async (req, res) => {
+  const { tenantId } = req.params;
+  if (!TENANT_ID_PATTERN.test(tenantId)) {
+    return res.status(400).json({ error: 'Invalid tenant id' });
+  }
+  const fields = [];
+  const limits = {};
+  for (const period of QUOTA_PERIODS) {
+    const value = req.body && req.body[period];
+    if (value === undefined || value === null) continue;
+    if (!Number.isInteger(value) || value < 0) {
+      fields.push({ field: period, message: `${period} must be a non-negative integer or null` });
+    }
+    limits[period] = value;
+  }
+  if (fields.length > 0) {
+    return sendValidationError(res, fields);
+  }
+
+  let record;
+  try {
+    record = await updateQuotaRecord(tenantId, current => {
+      current.limits = Object.keys(limits).length > 0 ? limits : null;
+    });
+  } catch (error) {
+    console.error(`[QUOTA] Failed to save limits for tenant ${tenantId}:`, error.message);
+    return res.status(500).json({ error: 'Failed to save quota limits' });
+  }
+  console.log(`[ADMIN] Quota limits for tenant ${tenantId}: ${JSON.stringify(quotaLimits(record))}`);
+  res.json({ success: true, ...describeQuota(record) });
+});
+
+function describeQuota(record) {
+  const limits = quotaLimits(record);
+  const quota = { tenantId: record.tenantId, inProgress: pendingGenerations(record) };
+  for (const period of QUOTA_PERIODS) {
+    quota[period] = { used: record[period], limit: limits[period] || null, resetAt: quotaResetAt(period).toISOString() };
+  }
+  quota.overrides = record.limits;
+  return quota;
+}
+
+// 开关维护模式：{ "enabled": true, "message": "..." }，不传 message 时使用 MAINTENANCE_MESSAGE
+app.post('/admin/maintenance', requireAdmin, (req, res) => {
+  const { enabled, message } = req.body || {};
+  if (typeof enabled !== 'boolean') {
+    return res.status(400).json({ error: 'enabled must be a boolean' });
+  }
+  if (message !== undefined && (typeof message !== 'string' || !message.trim())) {
+    return res.status(400).json({ error: 'message must be a non-empty string' });
+  }
+  const previous = maintenance.enabled;
+  maintenance = { enabled, message: message || config.maintenanceMessage };
+  console.log(`[ADMIN] Maintenance mode ${previous ? 'on' : 'off'} -> ${enabled ? 'on' : 'off'}`);
+  res.json({ success: true, maintenance: maintenance.enabled, message: maintenance.message, previous });
+});
+
+// JSON 响应压缩：按客户端 Accept-Encoding 选择 gzip（ENABLE_BROTLI=true 时优先 br），小于阈值的响应不压缩
+// Pick the encoding to use from an Accept-Encoding header, null if the client accepts neither
+function pickEncoding(acceptEncoding) {
+  const accepted = new Set();
+  for (const item of (acceptEncoding || '').split(',')) {
+    const [name, ...params] = item.trim().toLowerCase().split(';');
+    const q = params.map(param => param.trim()).find(param => param.startsWith('q='));
+    if (name && !(q && parseFloat(q.slice(2)) === 0)) accepted.add(name);
+  }
+  if (config.enableBrotli && accepted.has('br')) return 'br';
+  if (accepted.has('gzip') || accepted.has('*')) return 'gzip';
+  return null;
+}
+
+function compressJson(req, res, next) {
+  const encoding = pickEncoding(req.headers['accept-encoding']);
+  res.set('Vary', 'Accept-Encoding');
+  if (!encoding) return next();
+
+  res.json = (body) => {
+    const raw = Buffer.from(JSON.stringify(body));
+    res.type('application/json');
+    if (raw.length < config.compressionMinBytes) {
+      return res.send(raw);
+    }
+
+    const compress = encoding === 'br' ? zlib.brotliCompress : zlib.gzip;
+    compress(raw, (error, compressed) => {
+      if (error) {
+        console.error('Response compression failed:', error.message);
+        return res.send(raw);
+      }
+      res.set('Content-Encoding', encoding);
+      res.send(compressed);
+    });
+    return res;
+  };
+  next();
+}
+
+// 缓存头：进行中的任务 no-store，最终结果可以短暂缓存（STATUS_CACHE_MAX_AGE 秒），并带 ETag 支持 304
+// 用弱 ETag：同一结果可能以 gzip/br/原文不同编码返回
+function resultETag(result) {
+  const digest = crypto.createHash('sha256').update(JSON.stringify(result)).digest('base64url');
+  return `W/"${digest.slice(0, 27)}"`;
+}
+
+// Weak comparison as required for If-None-Match
+function etagMatches(ifNoneMatch, etag) {
+  if (!ifNoneMatch) return false;
+  const opaque = tag => tag.trim().replace(/^W\//, '');
+  return ifNoneMatch.split(',').some(tag => tag.trim() === '*' || opaque(tag) === opaque(etag));
+}
+
+// 查询结果端点
+app.get('/api/status/:taskId', authenticate, compressJson, async (req, res) => {
+  const { taskId } = req.params;
+  const result = await resultStore.load(taskId);
+
+  if (result && isTerminalResult(result)) {
+    const etag = resultETag(result);
+    res.set('Cache-Control', `private, max-age=${config.statusCacheMaxAge}`);
+    res.set('ETag', etag);
+    if (etagMatches(req.headers['if-none-match'], etag)) {
+      return res.status(304).end();
+    }
+  } else {
+    res.set('Cache-Control', 'no-store');
+  }
+  
+  if (!result) {
+    // 刚接受的异步任务在后台开始前还没有存储状态，按排队中报告；同步任务不存储中间状态，登记时已经开始生成
+    const task = runningTasks.get(taskId);
+    res.json({ 
+      success: false, 
+      status: task && !task.sync ? 'pending' : 'processing',
+      message: 'Still generating...'
+    });
+  } else if (!isTerminalResult(result)) {
+    res.json({ 
+      success: false, 
+      status: resultStatus(result),
+      message: 'Still generating...',
+      previews: result.previews,
+      tags: result.tags,
+      createdAt: result.createdAt
+    });
+  } else if (result.success) {
+    res.json({ 
+      success: true,
+      status: 'completed',
+      imageUrl: result.imageUrl,
+      imageUrls: result.imageUrls,
+      model: result.model,
+      tags: result.tags,
+      negativePrompt: result.negativePrompt,
+      finishReason: result.finishReason,
+      previews: result.previews,
+      prompt: result.prompt,
+      enhancedPrompt: result.enhancedPrompt,
+      upstreamRegion: result.upstreamRegion,
+      upstreamLatencyMs: result.upstreamLatencyMs,
+      upstreamRequestId: result.upstreamRequestId,
+      safety: result.safety,
+      durationMs: result.durationMs,
+      createdAt: result.createdAt,
+      completedAt: result.completedAt,
+      responseBytes: result.responseBytes
+    });
+  } else {
+    res.json({ 
+      success: false,
+      status: resultStatus(result),
+      error: result.error,
+      errorCode: result.errorCode,
+      finishReason: result.finishReason,
+      safety: result.safety,
+      timings: result.timings,
+      cancelledBy: result.cancelledBy,
+      upstreamRequestId: result.upstreamRequestId,
+      tags: result.tags,
+      durationMs: result.durationMs,
+      createdAt: result.createdAt,
+      completedAt: result.completedAt,
+      responseBytes: result.responseBytes
+    });
+  }
+});
+
+// 重新发送已完成任务的回调（接收方当时不可用时使用）
+// 需要管理员 token，或在 X-Cancel-Token 请求头中带上提交任务时返回的 cancelToken；只有管理员可以在 body 中传 callbackUrl 覆盖原地址
+app.post('/api/callback/resend/:taskId', authenticate, async (req, res) => {
+  const { taskId } = req.params;
+  const result = await resultStore.load(taskId);
+
+  const admin = hasAdminToken(req);
+  if (!admin && !(result && matchesCancelToken(result, req.get('x-cancel-token')))) {
+    return res.status(403).json({ error: 'Resending a callback requires the admin token or the task\'s cancelToken', errorCode: 'FORBIDDEN' });
+  }
+  if (!result || !isTerminalResult(result)) {
+    return res.status(404).json({ error: 'Task not found or still in progress' });
+  }
+  if (!admin && req.body && req.body.callbackUrl) {
+    return res.status(403).json({ error: 'Only admins can override callbackUrl', errorCode: 'FORBIDDEN' });
+  }
+
+  const callbackUrl = (req.body && req.body.callbackUrl) || result.callbackUrl;
+  const callbackContentType = (req.body && req.body.callbackContentType) || result.callbackContentType;
+  if (validateCallbackContentType(callbackContentType)) {
+    return res.status(400).json({ error: validateCallbackContentType(callbackContentType) });
+  }
+  if (!callbackUrl) {
+    return res.status(400).json({ error: 'No callbackUrl stored for task, provide one in the request body' });
+  }
+  if (validateCallbackUrl(callbackUrl)) {
+    return res.status(400).json({ error: validateCallbackUrl(callbackUrl) });
+  }
+
+  try {
+    const response = await deliverCallback(callbackUrl, buildCallbackPayload(taskId, result), taskId, callbackContentType);
+    res.json({ success: response.ok, taskId, callbackStatus: response.status });
+  } catch (error) {
+    res.status(502).json({ success: false, taskId, error: error.message });
+  }
+});
+
+// The cancelToken is only kept while the task runs, the stored result has its hash
+function matchesCancelToken(result, cancelToken) {
+  if (!cancelToken || typeof result.cancelTokenHash !== 'string') return false;
+  const expected = Buffer.from(result.cancelTokenHash, 'hex');
+  const actual = Buffer.from(hashForAudit(cancelToken), 'hex');
+  return expected.length === actual.length && crypto.timingSafeEqual(expected, actual);
+}
+
+// 向 callbackUrl 发送一个示例回调（带 test: true 标记和签名），返回接收方的状态码和耗时，用于接入前自测
+// 会向调用方给出的地址发请求，需要鉴权：启用 JWT 时要求 token，否则要求管理员 token
+app.post('/api/callback/test', requireCaller, async (req, res) => {
+  const { callbackUrl, callbackHeaders, callbackContentType } = req.body || {};
+  const callbackUrlError = callbackUrl ? validateCallbackUrl(callbackUrl) : 'callbackUrl must be an http(s) URL';
+  if (callbackUrlError) {
+    return res.status(400).json({ error: callbackUrlError });
+  }
+  const contentTypeError = validateCallbackContentType(callbackContentType);
+  if (contentTypeError) {
+    return res.status(400).json({ error: contentTypeError });
+  }
+  const headersError = validateCallbackHeaders(callbackHeaders);
+  if (headersError) {
+    return res.status(400).json({ error: headersError });
+  }
+  const targetError = await checkCallbackTarget(callbackUrl);
+  if (targetError) {
+    return res.status(400).json({ error: targetError });
+  }
+
+  const taskId = `callback-test-${Date.now()}`;
+  const now = new Date().toISOString();
+  const payload = {
+    ...buildCallbackPayload(taskId, {
+      status: 'completed',
+      imageUrl: 'https://example.com/sample.png',
+      imageUrls: ['https://example.com/sample.png'],
+      model: 'sora_image',
+      durationMs: 0,
+      createdAt: now,
+      completedAt: now,
+      timestamp: now
+    }),
+    test: true
+  };
+
+  const startTime = Date.now();
+  try {
+    const response = await sendCallback(callbackUrl, payload, callbackHeaders, callbackContentType);
+    res.json({ success: response.ok, callbackStatus: response.status, latencyMs: Date.now() - startTime, signed: Boolean(config.callbackSigningSecret) });
+  } catch (error) {
+    res.status(502).json({ success: false, error: error.message, latencyMs: Date.now() - startTime });
+  }
+});
+
+// 生成并等待回调（集成自测）：在 127.0.0.1 随机端口临时起一个回调接收端，按异步接口提交一次生成，
+// 收到回调后把任务结果和收到的回调（含签名校验结果）一起返回；等待时间为任务超时加 TEST_CALLBACK_GRACE_MS，接收端随后关闭
+const TEST_CALLBACK_GRACE_MS = 60 * 1000;
+
+// Listen for a single callback, resolves once the receiver is listening
+function startCallbackReceiver() {
+  return new Promise((resolve, reject) => {
+    let onCallback;
+    const received = new Promise(done => { onCallback = done; });
+    const server = http.createServer((req, res) => {
+      const chunks = [];
+      req.on('data', chunk => chunks.push(chunk));
+      req.on('end', () => {
+        res.writeHead(200, { 'Content-Type': 'application/json' });
+        res.end('{"received":true}');
+        onCallback({ headers: req.headers, body: Buffer.concat(chunks).toString('utf8'), receivedAt: Date.now() });
+      });
+    });
+    server.once('error', reject);
+    server.listen(0, '127.0.0.1', () => {
+      resolve({
+        url: `http://127.0.0.1:${server.address().port}/callback`,
+        received,
+        close: () => {
+          server.close();
+          server.closeIdleConnections();
+        }
+      });
+    });
+  });
+}
+
+// true/false when CALLBACK_SIGNING_SECRET is set, null when callbacks aren't signed
+function verifyCallbackSignature(headers, body) {
+  if (!config.callbackSigningSecret) return null;
+  const timestamp = headers['x-callback-timestamp'];
+  const signature = headers['x-callback-signature'];
+  if (!timestamp || !signature) return false;
+  const expected = Buffer.from(signCallback(timestamp, body));
+  const actual = Buffer.from(signature);
+  return expected.length === actual.length && crypto.timingSafeEqual(expected, actual);
+}
+
+function decodeCallbackBody(body, contentType = '') {
+  if (contentType.startsWith('application/x-www-form-urlencoded')) {
+    return Object.fromEntries(new URLSearchParams(body));
+  }
+  try {
+    return JSON.parse(body);
+  } catch (error) {
+    return body;
+  }
+}
+
+app.post('/api/generate/test', authenticate, rejectDuringMaintenance, async (req, res) => {
+  // 测试接口同样在请求内等待生成和回调完成
+  if (rejectSyncDisabled(res)) return;
+  const body = { ...withDefaultModel(req.body || {}) };
+  if (!body.apiKey) {
+    return res.status(401).json({ error: 'API key required' });
+  }
+  if (body.callbackUrl !== undefined) {
+    return sendValidationError(res, [{ field: 'callbackUrl', message: 'callbackUrl is set by the test harness' }]);
+  }
+  if (body.models !== undefined) {
+    return sendValidationError(res, [{ field: 'models', message: 'models is not supported by the test harness' }]);
+  }
+  body.taskId = body.taskId || `generate-test-${crypto.randomUUID()}`;
+
+  const { fields, imageSize } = validateGenerateRequest(body, { async: true });
+  if (fields.length > 0) {
+    return sendValidationError(res, fields);
+  }
+  if (sendImageLimitError(res, body)) return;
+  if (rejectReplay(res, body)) return;
+  const deadline = parseTaskDeadline(req.get('x-task-deadline'));
+  if (rejectTaskDeadline(res, deadline)) return;
+  const tenantId = resolveTenant(req, body);
+  if (await rejectOverQuota(res, tenantId, 1)) return;
+
+  let receiver;
+  try {
+    receiver = await startCallbackReceiver();
+  } catch (error) {
+    console.error('Failed to start test callback receiver:', error);
+    await settleQuota(tenantId, false);
+    return res.status(500).json({ error: 'Failed to start callback receiver' });
+  }
+  internalCallbackUrls.add(receiver.url);
+
+  const { taskId } = body;
+  const startTime = Date.now();
+  let timer;
+  try {
+    if (rejectRunningTaskIds(res, [taskId])) {
+      await settleQuota(tenantId, false);
+      return;
+    }
+    // 和 /api/generate/async 一样，准入检查紧挨着 startAsyncTask
+    if (inflightAsyncTasks + 1 > config.maxInflightTasks) {
+      await settleQuota(tenantId, false);
+      const retryAfter = estimateRetryAfterSeconds(inflightAsyncTasks + 1 - config.maxInflightTasks);
+      res.set('Retry-After', String(retryAfter));
+      return res.status(503).json({ error: 'Server busy, too many tasks in flight', retryAfter });
+    }
+    if (claimNonce(res, body)) {
+      await settleQuota(tenantId, false);
+      return;
+    }
+    startAsyncTask(req, { ...body, callbackUrl: receiver.url }, { imageSize, negativePrompt: effectiveNegativePrompt(body.negativePrompt), deadline, createdAt: new Date().toISOString(), tenantId });
+    const timedOut = new Promise(resolve => {
+      timer = setTimeout(resolve, config.taskTimeoutMs + TEST_CALLBACK_GRACE_MS, null);
+    });
+    const callback = await Promise.race([receiver.received, timedOut]);
+    const result = await resultStore.load(taskId);
+    if (!callback) {
+      return res.status(504).json({ success: false, taskId, error: 'Timed out waiting for the callback', errorCode: 'TIMEOUT', result });
+    }
+
+    const contentType = callback.headers['content-type'] || '';
+    res.json({
+      success: Boolean(result && result.success),
+      taskId,
+      result,
+      callback: {
+        contentType,
+        payload: decodeCallbackBody(callback.body, contentType),
+        signed: Boolean(callback.headers['x-callback-signature']),
+        signatureVerified: verifyCallbackSignature(callback.headers, callback.body),
+        latencyMs: callback.receivedAt - startTime
+      }
+    });
+  } catch (error) {
+    console.error(`[${taskId}] Generate test error:`, error);
+    res.status(500).json({ error: error.message || 'Internal server error' });
+  } finally {
+    clearTimeout(timer);
+    internalCallbackUrls.delete(receiver.url);
+    receiver.close();
+  }
+});
+
+// Whether cancelToken belongs to taskId: running tasks keep the token, finished results only its hash
+async function matchesTaskCancelToken(taskId, cancelToken) {
+  const task = runningTasks.get(taskId);
+  if (task) return matchesCancelToken({ cancelTokenHash: hashForAudit(task.cancelToken) }, cancelToken);
+  const result = await resultStore.load(taskId);
+  return Boolean(result) && matchesCancelToken(result, cancelToken);
+}
+
+// 取消进行中的任务，任务会以 cancelled 状态存储并发送回调
+// 需要管理员 token，或在 X-Cancel-Token 请求头中带上提交任务时返回的 cancelToken
+app.post('/api/cancel/:taskId', authenticate, async (req, res) => {
+  const { taskId } = req.params;
+  if (!hasAdminToken(req) && !(await matchesTaskCancelToken(taskId, req.get('x-cancel-token')))) {
+    return res.status(403).json({ error: 'Cancelling a task requires the admin token or the task\'s cancelToken', errorCode: 'FORBIDDEN' });
+  }
+  if (cancelTask(taskId)) {
+    return res.json({ success: true, taskId, status: 'cancelling' });
+  }
+
+  const result = await resultStore.load(taskId);
+  if (!result || !isTerminalResult(result)) {
+    return res.status(404).json({ error: 'Task not found' });
+  }
+  res.status(409).json({ success: false, taskId, status: resultStatus(result), error: 'Task already finished' });
+});
+
+// 通过异步接口返回的 cancelToken 取消任务，任务结束后 token 失效
+app.delete('/api/generate/:cancelToken', authenticate, (req, res) => {
+  const taskId = cancelTokens.get(req.params.cancelToken);
+  if (!taskId || !cancelTask(taskId)) {
+    return res.status(404).json({ error: 'Unknown or expired cancel token' });
+  }
+  res.json({ success: true, taskId, status: 'cancelling' });
+});
+
+// Whether cancelToken belongs to one of parentTaskId's children, running or finished
+async function matchesParentCancelToken(parentTaskId, cancelToken) {
+  if (!cancelToken) return false;
+  const taskId = cancelTokens.get(cancelToken);
+  if (taskId && runningTasks.get(taskId).parentTaskId === parentTaskId) return true;
+  let matched = false;
+  await resultStore.range((taskId, result) => {
+    if (result.parentTaskId === parentTaskId && matchesCancelToken(result, cancelToken)) matched = true;
+  });
+  return matched;
+}
+
+// 取消某个 parentTaskId 下所有进行中的子任务
+// 需要管理员 token，或在 X-Cancel-Token 请求头中带上该批次任一子任务的 cancelToken
+app.post('/api/cancel/parent/:parentTaskId', authenticate, async (req, res) => {
+  const { parentTaskId } = req.params;
+  if (!hasAdminToken(req) && !(await matchesParentCancelToken(parentTaskId, req.get('x-cancel-token')))) {
+    return res.status(403).json({ error: 'Cancelling a batch requires the admin token or a cancelToken from the batch', errorCode: 'FORBIDDEN' });
+  }
+
+  const cancelledTaskIds = [...(parentIndex.get(parentTaskId) || [])].filter(cancelTask);
+
+  const finishedTaskIds = [];
+  await resultStore.range((taskId, result) => {
+    if (result.parentTaskId === parentTaskId && isTerminalResult(result) && !cancelledTaskIds.includes(taskId)) {
+      finishedTaskIds.push(taskId);
+    }
+  });
+
+  console.log(`[${parentTaskId}] Cancelled ${cancelledTaskIds.length} child tasks, ${finishedTaskIds.length} already finished`);
+  res.json({
+    success: true,
+    parentTaskId,
+    cancelled: cancelledTaskIds.length,
+    alreadyFinished: finishedTaskIds.length,
+    cancelledTaskIds
+  });
+});
+
+// 父任务状态：汇总 parentTaskId 下所有子任务（包括进行中的）的状态和结果，overall 在全部结束前为 processing
+app.get('/api/status/parent/:parentTaskId', authenticate, compressJson, async (req, res) => {
+  const { parentTaskId } = req.params;
+
+  const tasks = new Map();
+  for (const taskId of parentIndex.get(parentTaskId) || []) {
+    tasks.set(taskId, { taskId, status: 'pending' });
+  }
+  await resultStore.range((taskId, result) => {
+    if (result.parentTaskId !== parentTaskId) return;
+    tasks.set(taskId, {
+      taskId,
+      model: result.model,
+      status: resultStatus(result),
+      imageUrl: result.imageUrl,
+      imageUrls: result.imageUrls,
+      error: result.error,
+      errorCode: result.errorCode,
+      durationMs: result.durationMs,
+      completedAt: result.completedAt
+    });
+  });
+
+  if (tasks.size === 0) {
+    return res.status(404).json({ error: 'No tasks found for parentTaskId' });
+  }
+
+  const counts = {};
+  for (const { status } of tasks.values()) {
+    counts[status] = (counts[status] || 0) + 1;
+  }
+  const finished = [...tasks.values()].every(task => TERMINAL_STATUSES.includes(task.status));
+  res.set('Cache-Control', 'no-store');
+  res.json({
+    parentTaskId,
+    status: finished ? 'completed' : 'processing',
+    total: tasks.size,
+    counts,
+    tasks: [...tasks.values()].sort((a, b) => a.taskId.localeCompare(b.taskId))
+  });
+});
+
+// 批量结果流（JSON Lines）：先按完成时间输出已结束的子任务，再在每个子任务完成时输出一行，全部结束后关闭
+// 每行的内容和回调相同；客户端断开时停止监听，不影响任务本身
+app.get('/api/generate/batch/:parentTaskId/stream', authenticate, async (req, res) => {
+  const { parentTaskId } = req.params;
+  const sent = new Set();
+  const pending = new Set();
+  let closed = false;
+
+  const writeResult = (taskId, result) => {
+    if (closed || sent.has(taskId)) return;
+    sent.add(taskId);
+    pending.delete(taskId);
+    res.write(JSON.stringify(buildCallbackPayload(taskId, result)) + '\n');
+  };
+  const finish = () => {
+    if (closed) return;
+    closed = true;
+    taskEvents.off('completed', onCompleted);
+    res.end();
+  };
+  const onCompleted = (taskId, result) => {
+    if (result.parentTaskId !== parentTaskId) return;
+    writeResult(taskId, result);
+    if (pending.size === 0) finish();
+  };
+
+  // 先注册监听再扫描，扫描期间完成的任务不会漏掉（sent 去重）
+  const buffered = [];
+  const bufferCompleted = (taskId, result) => {
+    if (result.parentTaskId === parentTaskId) buffered.push([taskId, result]);
+  };
+  taskEvents.on('completed', bufferCompleted);
+
+  for (const taskId of parentIndex.get(parentTaskId) || []) pending.add(taskId);
+  const finished = [];
+  await resultStore.range((taskId, result) => {
+    if (result.parentTaskId !== parentTaskId) return;
+    if (isTerminalResult(result)) finished.push([taskId, result]);
+    else pending.add(taskId);
+  });
+  taskEvents.off('completed', bufferCompleted);
+
+  if (finished.length === 0 && pending.size === 0 && buffered.length === 0) {
+    return res.status(404).json({ error: 'No tasks found for parentTaskId' });
+  }
+
+  // 存储里还没开始的子任务如果已不在运行，不会再完成，不必等待
+  for (const taskId of [...pending]) {
+    if (!runningTasks.has(taskId)) pending.delete(taskId);
+  }
+
+  res.status(200);
+  res.set('Content-Type', 'application/x-ndjson');
+  res.set('Cache-Control', 'no-store');
+  res.flushHeaders();
+  res.on('close', finish);
+
+  finished.sort(([, a], [, b]) => String(a.completedAt || a.timestamp).localeCompare(String(b.completedAt || b.timestamp)));
+  for (const [taskId, result] of [...finished, ...buffered]) writeResult(taskId, result);
+  if (pending.size === 0) return finish();
+  taskEvents.on('completed', onCompleted);
+});
+
+// base64 图片分块解码后流式返回，不在内存中生成完整的二进制副本
+const DATA_URL_PATTERN = /^data:([^;,]+);base64,/;
+const BASE64_CHUNK_SIZE = 64 * 1024; // 必须是 4 的倍数，保证每块都能独立解码
+
+// Decodes a base64 data URL chunk by chunk
+function* decodeDataUrl(dataUrl) {
+  const match = dataUrl.match(DATA_URL_PATTERN);
+  for (let offset = match[0].length; offset < dataUrl.length; offset += BASE64_CHUNK_SIZE) {
+    yield Buffer.from(dataUrl.slice(offset, offset + BASE64_CHUNK_SIZE), 'base64');
+  }
+}
+
+async function streamDataUrl(res, dataUrl, taskId) {
+  const match = dataUrl.match(DATA_URL_PATTERN);
+  res.set('Content-Type', match[1]);
+  res.set('Content-Length', String(Buffer.byteLength(dataUrl.slice(match[0].length), 'base64')));
+
+  // pipeline 处理背压，客户端中途断开时也会结束，不会一直等待 drain
+  await new Promise(resolve => {
+    pipeline(Readable.from(decodeDataUrl(dataUrl)), res, error => {
+      if (error) console.warn(`[${taskId}] Image stream aborted:`, error.message);
+      resolve();
+    });
+  });
+}
+
+// 图片地址结果：从源地址下载并原样转发，不在内存中缓存整张图片
+const IMAGE_PROXY_TIMEOUT_MS = 60 * 1000;
+
+async function streamRemoteImage(res, imageUrl, taskId) {
+  let response;
+  try {
+    response = await fetch(imageUrl, { signal: AbortSignal.timeout(IMAGE_PROXY_TIMEOUT_MS) });
+  } catch (error) {
+    console.warn(`[${taskId}] Image source unreachable:`, error.message);
+    return res.status(502).json({ error: 'Image source is no longer available' });
+  }
+  if (!response.ok || !response.body) {
+    await response.body?.cancel();
+    console.warn(`[${taskId}] Image source returned status ${response.status}`);
+    return res.status(502).json({ error: 'Image source is no longer available', sourceStatus: response.status });
+  }
+
+  res.set('Content-Type', response.headers.get('content-type') || 'application/octet-stream');
+  const contentLength = response.headers.get('content-length');
+  if (contentLength) res.set('Content-Length', contentLength);
+
+  await new Promise(resolve => {
+    pipeline(Readable.fromWeb(response.body), res, error => {
+      if (error) console.warn(`[${taskId}] Image stream aborted:`, error.message);
+      resolve();
+    });
+  });
+}
+
+// 直接获取任务结果的图片字节：base64 结果分块解码，图片地址结果从源地址转发
+app.get('/api/image/:taskId', authenticate, async (req, res) => {
+  const { taskId } = req.params;
+  const result = await resultStore.load(taskId);
+
+  if (!result || !result.success || typeof result.imageUrl !== 'string') {
+    return res.status(404).json({ error: 'No completed result for task' });
+  }
+
+  if (DATA_URL_PATTERN.test(result.imageUrl)) {
+    return streamDataUrl(res, result.imageUrl, taskId);
+  }
+  if (!/^https?:\/\//i.test(result.imageUrl)) {
+    return res.status(404).json({ error: 'Task result has no downloadable image' });
+  }
+  await streamRemoteImage(res, result.imageUrl, taskId);
+});
+
+// 供 <img src> 直接引用：URL 结果 302 跳转到图片地址，base64 结果无法跳转，直接返回图片字节
+// 任务仍在进行中时返回 409，未知任务或失败任务返回 404
+app.get('/api/image/:taskId/redirect', authenticate, async (req, res) => {
+  const { taskId } = req.params;
+  const result = await resultStore.load(taskId);
+
+  if (!result ? runningTasks.has(taskId) : !isTerminalResult(result)) {
+    return res.status(409).json({ error: 'Task is still processing', status: result ? resultStatus(result) : 'processing' });
+  }
+  if (!result || !result.success || typeof result.imageUrl !== 'string') {
+    return res.status(404).json({ error: 'No completed result for task' });
+  }
+
+  if (DATA_URL_PATTERN.test(result.imageUrl)) {
+    return streamDataUrl(res, result.imageUrl, taskId);
+  }
+  if (!/^https?:\/\//i.test(result.imageUrl)) {
+    return res.status(404).json({ error: 'Task result has no downloadable image' });
+  }
+  res.redirect(302, result.imageUrl);
+});
+
+// 调试用：返回以 ?debug=true 提交的任务发给上游的请求体（已脱敏，需要管理员 token）
+app.get('/api/raw/:taskId/request', requireAdmin, async (req, res) => {
+  const { taskId } = req.params;
+  const result = await resultStore.load(taskId);
+
+  if (!result || result.requestBody === undefined) {
+    return res.status(404).json({ error: 'No request body stored for task, submit it with ?debug=true' });
+  }
+
+  res.json(result.requestBody);
+});
+
+// 调试用：返回任务存储的上游原始响应（需要管理员 token）
+app.get('/api/raw/:taskId', requireAdmin, async (req, res) => {
+  const { taskId } = req.params;
+  const result = await resultStore.load(taskId);
+
+  if (!result || result.rawResponse === undefined) {
+    return res.status(404).json({ error: 'No raw response stored for task' });
+  }
+
+  res.type('application/json').send(JSON.stringify(result.rawResponse));
+});
+
+// 结果列表，支持 ?tag=key:value 筛选（可传多个，需全部匹配）；包含所有租户的结果，需要管理员 token
+app.get('/api/results', authenticate, requireAdmin, compressJson, async (req, res) => {
+  const tagFilters = [].concat(req.query.tag || []);
+  const filters = [];
+  for (const filter of tagFilters) {
+    const separator = String(filter).indexOf(':');
+    if (separator <= 0) {
+      return res.status(400).json({ error: 'tag filter must look like key:value' });
+    }
+    filters.push([filter.slice(0, separator), filter.slice(separator + 1)]);
+  }
+  const limit = Math.min(parseInt(req.query.limit, 10) || 100, 500);
+
+  const results = [];
+  await resultStore.range((taskId, result) => {
+    const tags = result.tags || {};
+    if (filters.every(([key, value]) => tags[key] === value)) {
+      results.push({
+        taskId,
+        parentTaskId: result.parentTaskId,
+        success: result.success,
+        status: resultStatus(result),
+        imageUrl: result.imageUrl,
+        error: result.error,
+        tags: result.tags,
+        createdAt: result.createdAt,
+        completedAt: result.completedAt,
+        timestamp: result.timestamp
+      });
+    }
+    return results.length < limit;
+  });
+
+  res.json({ success: true, count: results.length, results });
+});
+
+// 生成前预估耗时和相对成本，不调用上游
+// 耗时取该模型最近的耗时 EMA（还没有样本时用所属模型家族的默认值）加上输入图片的处理时间，成本来自 MODEL_COST_TABLE（未配置的模型为 1）
+// imageSize 只是追加在提示词后的比例标记，不决定输出像素数，不参与预估
+const DEFAULT_MODEL_LATENCY_MS = { sora_image: 60 * 1000, gemini: 20 * 1000 };
+const FALLBACK_MODEL_LATENCY_MS = 30 * 1000;
+const INPUT_IMAGE_LATENCY_MS = 2 * 1000;
+const INPUT_IMAGE_COST_FACTOR = 0.1;
+
+app.post('/api/generate/estimate', (req, res) => {
+  const body = withDefaultModel(req.body || {});
+  const { fields } = validateGenerateRequest(body);
+  if (fields.length > 0) {
+    return sendValidationError(res, fields);
+  }
+
+  const { model } = body;
+  const inputImages = (body.imageUrls || (body.imageUrl ? [body.imageUrl] : [])).length;
+  const latency = modelLatency.get(model);
+  const baseMs = latency ? latency.ema : (DEFAULT_MODEL_LATENCY_MS[modelFamily(model)] || FALLBACK_MODEL_LATENCY_MS);
+  const cost = (config.modelCostTable[model] ?? 1) * (1 + INPUT_IMAGE_COST_FACTOR * inputImages);
+
+  res.json({
+    model,
+    estimatedSeconds: Math.round((baseMs + inputImages * INPUT_IMAGE_LATENCY_MS) / 100) / 10,
+    estimatedRelativeCost: Math.round(cost * 100) / 100,
+    latencySamples: latency ? latency.samples : 0
+  });
+});
+
+// 同步生成端点（保留兼容性）
+app.post('/api/generate', authenticate, rejectDuringMaintenance, async (req, res) => {
+  await handleSyncGenerate(req, res, req.body);
+});
+
+// OpenAI 兼容接口：POST /v1/images/generations 接受 OpenAI 的请求格式 { prompt, model, size, n, response_format }，
+// 返回 { created, data: [{ url } | { b64_json }] }，用 OpenAI SDK 的客户端只需要改 base URL
+// 上游 key 取 Authorization: Bearer <key>（启用 JWT 鉴权时 Authorization 用于 JWT，上游 key 改用 X-Api-Key 请求头）
+// n 张图片各自作为一个任务（taskId 为 <id>:<序号>）并行生成（各自调用上游，不会被相同请求合并），结果照常存储；base64 结果要求 url 格式时返回 /api/image/:taskId 地址
+// 和 /api/generate/async 一样支持 nonce/timestamp 防重放，任务计入 MAX_INFLIGHT_TASKS，超出时返回 503 和 Retry-After
+const MAX_OPENAI_IMAGES = 4;
+const OPENAI_RESPONSE_FORMATS = ['url', 'b64_json'];
+const OPENAI_PARAM_NAMES = { imageDimensions: 'size', imageSize: 'size' };
+
+function sendOpenAIError(res, status, message, { type = 'invalid_request_error', param = null, code = null } = {}) {
+  res.status(status).json({ error: { message, type, param, code } });
+}
+
+function sendOpenAINonceReplayed(res, nonce) {
+  console.warn(`Rejected replayed nonce ${nonce}`);
+  sendOpenAIError(res, 409, 'Nonce has already been used', { param: 'nonce', code: 'nonce_replayed' });
+}
+
+// Map one finished task to an OpenAI image object
+async function toOpenAIImage(req, taskId, result, responseFormat) {
+  const image = { revised_prompt: result.enhancedPrompt };
+  const dataUrl = result.imageUrl.match(DATA_URL_PATTERN);
+  if (responseFormat === 'b64_json') {
+    image.b64_json = dataUrl ? result.imageUrl.slice(dataUrl[0].length) : (await downloadImage(result.imageUrl)).toString('base64');
+  } else {
+    image.url = dataUrl ? `${req.protocol}://${req.get('host')}/api/image/${encodeURIComponent(taskId)}` : result.imageUrl;
+  }
+  return image;
+}
+
+app.post('/v1/images/generations', authenticate, rejectDuringMaintenance, async (req, res) => {
+  if (config.disableSyncEndpoint) {
+    return sendOpenAIError(res, 501, 'Synchronous generation is disabled on this server, use POST /api/generate/async', { code: 'SYNC_DISABLED' });
+  }
+
+  const { prompt, size, n = 1, response_format: responseFormat = 'url', nonce, timestamp } = req.body || {};
+  const header = req.get('authorization') || '';
+  const apiKey = jwtVerifier ? req.get('x-api-key') : (header.startsWith('Bearer ') ? header.slice('Bearer '.length).trim() : '');
+  if (!apiKey) {
+    return sendOpenAIError(res, 401, jwtVerifier ? 'Upstream API key required in the X-Api-Key header' : 'API key required in the Authorization header', { code: 'invalid_api_key' });
+  }
+  if (!Number.isInteger(n) || n < 1 || n > MAX_OPENAI_IMAGES) {
+    return sendOpenAIError(res, 400, `n must be an integer between 1 and ${MAX_OPENAI_IMAGES}`, { param: 'n' });
+  }
+  if (!OPENAI_RESPONSE_FORMATS.includes(responseFormat)) {
+    return sendOpenAIError(res, 400, `response_format must be one of ${OPENAI_RESPONSE_FORMATS.join(', ')}`, { param: 'response_format' });
+  }
+  const sizeMatch = typeof size === 'string' ? size.match(/^(\d+)x(\d+)$/) : null;
+  if (size !== undefined && size !== 'auto' && !sizeMatch) {
+    return sendOpenAIError(res, 400, 'size must look like 1024x1024', { param: 'size' });
+  }
+
+  const body = withDefaultModel({
+    model: req.body.model,
+    prompt,
+    apiKey,
+    imageDimensions: sizeMatch ? { width: Number(sizeMatch[1]), height: Number(sizeMatch[2]) } : undefined,
+    nonce,
+    timestamp
+  });
+  const { fields, imageSize } = validateGenerateRequest(body);
+  if (fields.length > 0) {
+    const param = OPENAI_PARAM_NAMES[fields[0].field] || fields[0].field;
+    return sendOpenAIError(res, 400, fields[0].message.replace(fields[0].field, param), { param });
+  }
+  const replay = replayError(body);
+  if (replay) {
+    return replay.replayed ? sendOpenAINonceReplayed(res, nonce) : sendOpenAIError(res, 400, replay.message, { param: replay.field });
+  }
+  const deadline = parseTaskDeadline(req.get('x-task-deadline'));
+  if (Number.isNaN(deadline) || (deadline !== null && deadline <= Date.now())) {
+    return sendOpenAIError(res, 400, 'X-Task-Deadline must be a future RFC3339 time or a number of seconds from now', { param: 'X-Task-Deadline' });
+  }
+  const tenantId = resolveTenant(req, body);
+  if (await rejectOverQuota(res, tenantId, n)) return;
+  // 准入检查和计数之间不让出事件循环，同 /api/generate/async
+  if (inflightAsyncTasks + n > config.maxInflightTasks) {
+    console.warn(`[ADMISSION] Rejecting OpenAI-compatible generation: ${inflightAsyncTasks} tasks in flight (max ${config.maxInflightTasks})`);
+    await Promise.all(Array.from({ length: n }, () => settleQuota(tenantId, false)));
+    const retryAfter = estimateRetryAfterSeconds(inflightAsyncTasks + n - config.maxInflightTasks);
+    res.set('Retry-After', String(retryAfter));
+    res.status(503).json({ error: { message: 'Server busy, too many tasks in flight', type: 'server_error', param: null, code: 'server_busy' }, retryAfter });
+    return;
+  }
+  if (nonce !== undefined && !recordNonce(nonce)) {
+    await Promise.all(Array.from({ length: n }, () => settleQuota(tenantId, false)));
+    return sendOpenAINonceReplayed(res, nonce);
+  }
+
+  const baseTaskId = `openai-${crypto.randomUUID()}`;
+  const createdAt = new Date().toISOString();
+  const negativePrompt = effectiveNegativePrompt(undefined);
+  console.log(`Starting OpenAI-compatible generation with model: ${body.model}, n: ${n}, taskId: ${baseTaskId}`);
+
+  const results = await Promise.all(Array.from({ length: n }, async (_, i) => {
+    const taskId = n === 1 ? baseTaskId : `${baseTaskId}:${i + 1}`;
+    const parentTaskId = n === 1 ? undefined : baseTaskId;
+    inflightAsyncTasks++;
+    const { signal } = registerTask(taskId, parentTaskId, deadline);
+    let result = null;
+    try {
+      result = await processGeneration({ ...body, variant: i || undefined, imageDimensions: undefined, imageSize, negativePrompt, taskId, parentTaskId, deadline, createdAt, signal });
+    } finally {
+      inflightAsyncTasks--;
+      await settleQuota(tenantId, Boolean(result && result.success));
+    }
+    return { taskId, result };
+  }));
+
+  const succeeded = results.filter(({ result }) => result && result.success && typeof result.imageUrl === 'string');
+  if (succeeded.length === 0) {
+    const failed = (results.find(({ result }) => result) || {}).result || {};
+    if (failed.errorCode === 'CONTENT_REJECTED' || failed.errorCode === 'INVALID_INPUT_IMAGE') {
+      return sendOpenAIError(res, 400, failed.error, { code: failed.errorCode === 'CONTENT_REJECTED' ? 'content_policy_violation' : 'invalid_image' });
+    }
+    if (failed.errorCode === 'TIMEOUT' || (failed.error || '').includes('timeout')) {
+      return sendOpenAIError(res, 504, failed.error || 'Generation timed out', { type: 'server_error', code: 'timeout' });
+    }
+    return sendOpenAIError(res, 500, truncateErrorText(failed.error || 'Generation failed'), { type: 'server_error' });
+  }
+  if (succeeded.length < n) {
+    console.warn(`[${baseTaskId}] ${n - succeeded.length} of ${n} images failed, returning ${succeeded.length}`);
+  }
+
+  try {
+    const data = await Promise.all(succeeded.map(({ taskId, result }) => toOpenAIImage(req, taskId, result, responseFormat)));
+    res.json({ created: Math.floor(Date.now() / 1000), data });
+  } catch (error) {
+    console.error(`[${baseTaskId}] Failed to prepare OpenAI response:`, error.message);
+    sendOpenAIError(res, 502, `Could not download generated image: ${error.message}`, { type: 'server_error' });
+  }
+});
+
+// 客户端可以据此选择调用方式（DISABLE_SYNC_ENDPOINT=true 时只能用异步接口）
+app.get('/api/config', (req, res) => {
+  res.json({
+    endpoints: {
+      sync: !config.disableSyncEndpoint,
+      simpleGet: config.enableSimpleGet && !config.disableSyncEndpoint,
+      async: true,
+      estimate: true,
+      admin: Boolean(config.adminToken)
+    },
+    defaultModel: config.defaultModel || null,
+    authentication: jwtVerifier ? 'jwt' : 'none',
+    maintenance: maintenance.enabled
+  });
+});
+
+// 只能发 GET 请求的集成（如部分 no-code 工具）使用，需显式开启：apiKey 会出现在 URL 和访问日志中
+const SIMPLE_GET_PARAMS = ['model', 'prompt', 'apiKey', 'imageSize'];
+
+if (config.enableSimpleGet) {
+  console.warn('[SIMPLE_GET] GET /api/generate/simple is enabled, API keys will appear in query strings and access logs');
+
+  app.get('/api/generate/simple', authenticate, rejectDuringMaintenance, async (req, res) => {
+    const body = {};
+    for (const name of SIMPLE_GET_PARAMS) {
+      const value = req.query[name];
+      if (value !== undefined && typeof value !== 'string') {
+        return res.status(400).json({ error: `Query parameter ${name} must be given once` });
+      }
+      body[name] = value;
+    }
+    const missing = (config.defaultModel ? ['prompt'] : ['model', 'prompt']).filter(name => !body[name]);
+    if (missing.length > 0) {
+      return res.status(400).json({ error: `Missing query parameters: ${missing.join(', ')}` });
+    }
+
+    await handleSyncGenerate(req, res, body);
+  });
+}
+
+// 同步生成的元数据也放在响应头中（X-Task-Id、X-Model、X-Duration-Ms、X-Attempts、X-Upstream-Request-Id），不用解析 JSON 也能记录和排查
+// 没有的值不设置对应的头
+function setGenerationHeaders(res, { taskId, model, durationMs, attempts, upstreamRequestId }) {
+  const headers = { 'X-Task-Id': taskId, 'X-Model': model, 'X-Duration-Ms': durationMs, 'X-Attempts': attempts, 'X-Upstream-Request-Id': upstreamRequestId };
+  for (const [name, value] of Object.entries(headers)) {
+    if (value !== undefined && value !== null && value !== '') res.set(name, String(value));
+  }
+}
+
+// 只允许异步调用的部署（DISABLE_SYNC_ENDPOINT）：避免长时间占用连接触发负载均衡器超时
+// 所有在请求内等待生成完成的接口都要检查，返回 true 表示已经响应 501
+function rejectSyncDisabled(res) {
+  if (!config.disableSyncEndpoint) return false;
+  res.status(501).json({
+    error: 'Synchronous generation is disabled on this server, use POST /api/generate/async and poll /api/status/:taskId',
+    errorCode: 'SYNC_DISABLED',
+    asyncEndpoint: '/api/generate/async'
+  });
+  return true;
+}
+
+// 同步生成：等待上游完成后直接返回图片，POST /api/generate 和 GET /api/generate/simple 共用
+async function handleSyncGenerate(req, res, body) {
+  if (rejectSyncDisabled(res)) return;
+
+  body = withDefaultModel(body);
+  const { model, fallbackModels, prompt, imageUrl, imageUrls, responseFormat, contentOrder, outputImageFormat, outputQuality, convertOutput, apiKey, authMode = config.upstreamAuthMode, maxRetries, upstreamBaseUrl, moderateInputs, wantPreviews, enhancePrompt } = body;
+  const taskId = body.taskId || `sync-${crypto.randomUUID()}`;
+  const createdAt = new Date().toISOString();
+  let registered = false;
+  let quotaTenantId = null;
+  let generated = false;
+
+  // 客户端在结果返回前断开（例如负载均衡器或客户端超时）时任务继续执行，不浪费已经开始的生成，
+  // 最终结果按 taskId 存储，之后可以通过 /api/status/:taskId 取回
+  let detached = false;
+  res.on('close', () => {
+    if (!res.writableEnded) {
+      detached = true;
+      console.warn(`[${taskId}] Client disconnected before the sync response, result will be stored for /api/status/${taskId}`);
+    }
+  });
+  const reply = (statusCode, payload) => {
+    if (!detached) {
+      return res.status(statusCode).json(payload);
+    }
+    const completedAt = new Date().toISOString();
+    const success = statusCode < 400;
+    return resultStore.store(taskId, {
+      ...payload,
+      request: undefined,
+      duration: undefined,
+      success,
+      status: success ? 'completed' : 'failed',
+      createdAt,
+      completedAt,
+      timestamp: completedAt
+    });
+  };
+
+  try {
+    
+    if (!apiKey) {
+      return res.status(401).json({ error: 'API key required' });
+    }
+
+    const { fields, imageSize } = validateGenerateRequest(body);
+    if (fields.length > 0) {
+      return sendValidationError(res, fields);
+    }
+    if (sendImageLimitError(res, body)) return;
+    if (rejectReplay(res, body)) return;
+    const deadline = parseTaskDeadline(req.get('x-task-deadline'));
+    if (rejectTaskDeadline(res, deadline)) return;
+    const tenantId = resolveTenant(req, body);
+    if (await rejectOverQuota(res, tenantId, 1)) return;
+    // 同步任务同样登记为运行中：客户端断开后存储的结果不会覆盖同一 taskId 的其他任务，运行期间 redirect 接口返回 409
+    if (rejectRunningTaskIds(res, [taskId]) || claimNonce(res, body)) {
+      await settleQuota(tenantId, false);
+      return;
+    }
+    quotaTenantId = tenantId;
+    const { signal } = registerTask(taskId, undefined, deadline);
+    runningTasks.get(taskId).sync = true;
+    registered = true;
+    const negativePrompt = effectiveNegativePrompt(body.negativePrompt);
+    const echoedRequest = req.query.echoRequest === 'true' ? buildEchoRequest(body, { imageSize, negativePrompt, deadline }) : undefined;
+
+    // SYNC_EARLY_HINTS=true 时，生成开始前先用 103 Early Hints 发出 X-Task-Id 和指向状态接口的 Link，客户端在结果返回前超时断开时也知道去哪里取回结果
+    // 默认不发送：部分 HTTP 客户端和代理不能正确处理 1xx 响应
+    if (config.syncEarlyHints) {
+      res.writeEarlyHints({ link: `</api/status/${encodeURIComponent(taskId)}>; rel="monitor"`, 'X-Task-Id': taskId });
+    }
+
+    console.log(`Starting sync generation with model: ${model}`);
+    const startTime = Date.now();
+
+    if (moderateInputs) {
+      await moderateInputImages(imageUrls || (imageUrl ? [imageUrl] : []), taskId);
+    }
+
+    const { model: usedModel, data, imageUrl: imageUrlResult, imageUrls: imageUrlsResult, responseBytes, finishReason, previews, enhancedPrompt, safety, upstreamRequestId, attempts } = await generateWithFallbacks({
+      model, fallbackModels, prompt, negativePrompt, imageUrl, imageUrls, imageSize, responseFormat, contentOrder, apiKey, taskId, authMode, maxRetries, upstreamBaseUrl, wantPreviews, enhancePrompt, deadline, signal
+    });
+    
+    const durationMs = Date.now() - startTime;
+    const duration = durationMs / 1000;
+    console.log(`API responded successfully in ${duration}s`);
+    setGenerationHeaders(res, { taskId, model: usedModel, durationMs, attempts, upstreamRequestId });
+
+    // 最终结果处理
     if (imageUrlResult) {
       console.log('Successfully extracted image URL:', imageUrlResult);
-      res.json({ 
+      const output = await applyOutputFormat(imageUrlsResult, { outputImageFormat, outputQuality, convertOutput, taskId });
+      writeAuditRecord({ taskId, model: usedModel, apiKey, prompt, status: 'completed' });
+      // 先计入用量再返回，客户端收到结果后立即发出的下一个请求（包括发到其他实例的）能看到这次用量
+      generated = true;
+      await settleQuota(quotaTenantId, true);
+      quotaTenantId = null;
+      await reply(200, { 
         success: true, 
-        imageUrl: imageUrlResult,
+        imageUrl: output.imageUrl,
+        imageUrls: output.imageUrls,
+        model: usedModel,
+        negativePrompt,
+        finishReason,
+        previews,
+        enhancedPrompt,
+        safety,
+        upstreamRequestId,
         duration: duration,
+        durationMs: durationMs,
+        responseBytes,
+        request: echoedRequest,
         rawResponse: data 
       });
     } else {
       console.error('Failed to extract image URL from response');
-      res.status(500).json({ 
-        error: 'No image URL in response',
+      writeAuditRecord({ taskId, model: usedModel, apiKey, prompt, status: 'failed' });
+      const rejected = isContentRejected(finishReason);
+      await reply(rejected ? 422 : 500, { 
+        error: rejected ? CONTENT_REJECTED_MESSAGE : 'No image URL in response',
+        errorCode: rejected ? 'CONTENT_REJECTED' : undefined,
+        model: usedModel,
+        finishReason,
+        safety,
+        upstreamRequestId,
+        durationMs: durationMs,
+        responseBytes,
+        request: echoedRequest,
         rawResponse: data 
       });
     }
   } catch (error) {
-    console.error('Proxy error:', error);
+    console.error('Proxy error:', truncateErrorText(error.message));
+    debugLog('Full proxy error:', error);
+    writeAuditRecord({ taskId, model: error.model || model, apiKey, prompt, status: 'failed' });
+    setGenerationHeaders(res, { taskId, model: error.model || model, attempts: error.attempts, upstreamRequestId: error.upstreamRequestId });
     
     // Return appropriate error status
-    if (error.message.includes('timeout')) {
-      res.status(504).json({ 
+    if (error.errorCode === 'CONTENT_REJECTED' || error.errorCode === 'INVALID_INPUT_IMAGE') {
+      await reply(422, { 
         success: false,
-        error: 'Request timeout - API took too long to respond' 
+        error: error.message,
+        errorCode: error.errorCode
+      });
+    } else if (error.deadlineExceeded) {
+      await reply(504, { 
+        success: false,
+        error: 'Task deadline exceeded',
+        errorCode: 'TIMEOUT',
+        timings: error.timings
+      });
+    } else if (error.message.includes('timeout')) {
+      await reply(504, { 
+        success: false,
+        error: 'Request timeout - API took too long to respond',
+        timings: error.timings
       });
     } else if (error.message.includes('API error: 4')) {
-      res.status(400).json({ 
+      await reply(400, { 
         success: false,
-        error: error.message 
+        error: truncateErrorText(error.message),
+        upstreamRequestId: error.upstreamRequestId
       });
     } else {
-      res.status(500).json({ 
+      await reply(500, { 
         success: false,
-        error: error.message || 'Internal server error' 
+        error: truncateErrorText(error.message) || 'Internal server error',
+        upstreamRequestId: error.upstreamRequestId
       });
     }
+  } finally {
+    if (registered) unregisterTask(taskId);
+    await settleQuota(quotaTenantId, generated);
   }
+}
+
+app.listen(config.port, '0.0.0.0', () => {
+  console.log(`Proxy server running on http://0.0.0.0:${config.port}`);
+  console.log('Effective config:', JSON.stringify(redactConfig(config)));
 });
 
-app.listen(PORT, '0.0.0.0', () => {
-  console.log(`Proxy server running on http://0.0.0.0:${PORT}`);
-});
\ No newline at end of file
+if (config.healthPort) {
+  const healthApp = express();
+  healthApp.use(healthRoutes);
+  healthApp.listen(config.healthPort, '0.0.0.0', () => {
+    console.log(`Health checks served on http://0.0.0.0:${config.healthPort}${config.healthPath} and /readyz`);
+  });
+}
\ No newline at end of file
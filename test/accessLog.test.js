@@ -0,0 +1,75 @@
+// 访问日志：每个请求一行（ACCESS_LOG_FORMAT=text|json|off），包含方法、路径、状态码、耗时、客户端 IP、请求 id 和响应大小；默认不记录 /health 和 /metrics
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, wait } = require('./helpers');
+
+async function waitForLog(server, pattern) {
+  for (let i = 0; i < 100; i++) {
+    const match = server.logs.match(pattern);
+    if (match) return match;
+    await wait(20);
+  }
+  assert.fail(`no log line matching ${pattern}`);
+}
+
+function accessEntries(server) {
+  return server.logs.split('\n')
+    .filter(line => line.startsWith('{') && line.includes('"type":"access"'))
+    .map(line => JSON.parse(line));
+}
+
+test('json access log entries', async t => {
+  const server = await startServer({ ACCESS_LOG_FORMAT: 'json' });
+  t.after(() => server.close());
+
+  const response = await fetch(`${server.url}/api/config`, { headers: { 'x-request-id': 'client-req-1' } });
+  const body = await response.text();
+  assert.strictEqual(response.headers.get('x-request-id'), 'client-req-1');
+  await waitForLog(server, /"requestId":"client-req-1"/);
+
+  const entry = accessEntries(server).find(item => item.requestId === 'client-req-1');
+  assert.strictEqual(entry.method, 'GET');
+  assert.strictEqual(entry.path, '/api/config');
+  assert.strictEqual(entry.status, 200);
+  assert.strictEqual(entry.ip, '127.0.0.1');
+  assert.strictEqual(entry.bytes, Buffer.byteLength(body));
+  assert.strictEqual(typeof entry.latencyMs, 'number');
+  assert.ok(!Number.isNaN(Date.parse(entry.timestamp)));
+
+  await t.test('ids are generated when missing or invalid', async () => {
+    const generated = await fetch(`${server.url}/api/image/no-such-task`, { headers: { 'x-request-id': 'has spaces' } });
+    const requestId = generated.headers.get('x-request-id');
+    assert.match(requestId, /^[0-9a-f-]{36}$/);
+    await waitForLog(server, new RegExp(`"requestId":"${requestId}"`));
+    assert.strictEqual(accessEntries(server).find(item => item.requestId === requestId).status, 404);
+  });
+
+  await t.test('health and metrics are excluded by default', async () => {
+    await fetch(`${server.url}/health`);
+    await fetch(`${server.url}/metrics`);
+    await fetch(`${server.url}/api/config`, { headers: { 'x-request-id': 'after-health' } });
+    await waitForLog(server, /"requestId":"after-health"/);
+    assert.deepStrictEqual(accessEntries(server).filter(item => item.path === '/health' || item.path === '/metrics'), []);
+  });
+});
+
+test('text format and custom exclusions', async t => {
+  const server = await startServer({ ACCESS_LOG_EXCLUDE_PATHS: '/api/config' });
+  t.after(() => server.close());
+
+  await fetch(`${server.url}/api/config`);
+  await fetch(`${server.url}/health`, { headers: { 'x-request-id': 'health-req' } });
+  const [line] = await waitForLog(server, /\[ACCESS\] GET \/health .*/);
+  assert.match(line, /^\[ACCESS\] GET \/health 200 [\d.]+ms \d+B ip=127\.0\.0\.1 id=health-req$/);
+  assert.doesNotMatch(server.logs, /\[ACCESS\] GET \/api\/config/);
+});
+
+test('access logging can be turned off', async t => {
+  const server = await startServer({ ACCESS_LOG_FORMAT: 'off' });
+  t.after(() => server.close());
+
+  const response = await fetch(`${server.url}/api/config`);
+  assert.ok(response.headers.get('x-request-id'), 'request ids are still returned');
+  await wait(200);
+  assert.doesNotMatch(server.logs, /\[ACCESS\]|"type":"access"/);
+});
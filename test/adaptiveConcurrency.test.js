@@ -0,0 +1,75 @@
+// 自适应并发：默认不限制并发；设置 MAX_CONCURRENCY 后，内存超过高水位时上限减半（不低于 MIN_CONCURRENCY），排队的任务按新上限执行
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, runServerToExit, soraResponse, wait } = require('./helpers');
+
+const ADMIN = { authorization: 'Bearer admin-token' };
+
+// Stub upstream that holds each generation for holdMs and records the peak number in flight
+async function startSlowUpstream(holdMs) {
+  const state = { inflight: 0, peak: 0 };
+  const upstream = await startUpstream(async () => {
+    state.inflight++;
+    state.peak = Math.max(state.peak, state.inflight);
+    await wait(holdMs);
+    state.inflight--;
+    return { body: soraResponse() };
+  });
+  return Object.assign(upstream, { state });
+}
+
+function generateMany(server, count) {
+  return Promise.all(Array.from({ length: count }, (_, i) => server.request('/api/generate', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: `prompt ${i}`, apiKey: 'key' }
+  })));
+}
+
+test('concurrency is unlimited unless MAX_CONCURRENCY is set', async t => {
+  const upstream = await startSlowUpstream(300);
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ADMIN_TOKEN: 'admin-token' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const responses = await generateMany(server, 15);
+  assert.ok(responses.every(({ status }) => status === 200));
+  assert.strictEqual(upstream.state.peak, 15);
+  const { body } = await server.request('/admin/stats', { headers: ADMIN });
+  assert.strictEqual(body.concurrency.limit, null);
+});
+
+test('high memory shrinks the ceiling down to MIN_CONCURRENCY', async t => {
+  const upstream = await startSlowUpstream(200);
+  // 高水位设为 1%，任何机器的内存占用都会超过，模拟内存压力
+  const server = await startServer({
+    UPSTREAM_REGIONS: upstream.url,
+    ADMIN_TOKEN: 'admin-token',
+    MAX_CONCURRENCY: '8',
+    MIN_CONCURRENCY: '2',
+    MEMORY_HIGH_WATER_PERCENT: '1',
+    MEMORY_LOW_WATER_PERCENT: '0.5',
+    ADAPTIVE_CHECK_INTERVAL_MS: '100'
+  });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  await wait(600);
+  assert.match(server.logs, /\[CONCURRENCY\] Limit 8 -> 4 \(memory [\d.]+%\)/);
+  assert.match(server.logs, /\[CONCURRENCY\] Limit 4 -> 2 \(memory [\d.]+%\)/);
+  const { body } = await server.request('/admin/stats', { headers: ADMIN });
+  assert.strictEqual(body.concurrency.limit, 2);
+
+  const responses = await generateMany(server, 6);
+  assert.ok(responses.every(({ status }) => status === 200));
+  assert.strictEqual(upstream.state.peak, 2);
+});
+
+test('CONCURRENCY_WARMUP_MS requires MAX_CONCURRENCY', async () => {
+  const { code, logs } = await runServerToExit({ CONCURRENCY_WARMUP_MS: '1000' });
+  assert.strictEqual(code, 1);
+  assert.match(logs, /CONCURRENCY_WARMUP_MS requires MAX_CONCURRENCY/);
+});
@@ -0,0 +1,48 @@
+// POST /admin/flush：清空结果存储并把 totalProcessed 归零，进行中的任务不受影响，完成后照常写入结果
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+const ADMIN = { authorization: 'Bearer admin-token' };
+
+test('flushing clears stored results without disturbing running tasks', async t => {
+  const upstream = await startUpstream(request => ({ body: soraResponse(), delayMs: request.body.includes('slow') ? 800 : 0 }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ADMIN_TOKEN: 'admin-token' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const submit = async prompt => {
+    const { body } = await server.request('/api/generate/async', { method: 'POST', body: { model: 'sora_image', prompt, apiKey: 'key' } });
+    return body.taskId;
+  };
+  const done = [await submit('one'), await submit('two')];
+  await Promise.all(done.map(taskId => server.waitForTask(taskId)));
+  const running = await submit('slow');
+  await wait(100);
+
+  assert.strictEqual((await server.request('/admin/flush', { method: 'POST' })).status, 401);
+
+  const { status, body } = await server.request('/admin/flush', { method: 'POST', headers: ADMIN });
+  assert.strictEqual(status, 200);
+  // 两个已完成的结果，加上进行中任务的 processing 记录
+  assert.strictEqual(body.removed, 3);
+  assert.strictEqual(body.activeTasks, 1);
+
+  const { body: listed } = await server.request('/api/results', { headers: ADMIN });
+  assert.deepStrictEqual(listed.results, []);
+  // 找不到结果的任务按原有约定报告为 processing
+  for (const taskId of done) {
+    const { body: status } = await server.request(`/api/status/${taskId}`);
+    assert.strictEqual(status.status, 'processing');
+    assert.strictEqual(status.imageUrl, undefined);
+  }
+  const { body: health } = await server.request('/health');
+  assert.strictEqual(health.totalProcessed, 0);
+  assert.strictEqual(health.activeTasks, 1);
+
+  // 进行中的任务在清空后完成，结果照常保存
+  const result = await server.waitForTask(running);
+  assert.strictEqual(result.status, 'completed');
+});
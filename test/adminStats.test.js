@@ -0,0 +1,68 @@
+// GET /admin/stats：需要管理员 token；返回并发名额、任务计数、按模型和 apiKey 哈希统计的进行中生成、下载和回调限流器状态
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('crypto');
+const { startServer, startUpstream, soraResponse, geminiResponse, wait } = require('./helpers');
+
+const ADMIN = { authorization: 'Bearer admin-token' };
+const GEMINI = 'gemini-2.5-flash-image-preview';
+
+function keyHash(apiKey) {
+  return crypto.createHash('sha256').update(apiKey).digest('hex').slice(0, 12);
+}
+
+test('stats reflect the current load', async t => {
+  const upstream = await startUpstream(request => ({
+    body: request.url.includes('generateContent') ? geminiResponse() : soraResponse(),
+    delayMs: 1500
+  }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ADMIN_TOKEN: 'admin-token', MAX_CONCURRENCY: '2', MAX_INFLIGHT_TASKS: '50' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const stats = async () => (await server.request('/admin/stats', { headers: ADMIN })).body;
+
+  await t.test('admin only', async () => {
+    assert.strictEqual((await server.request('/admin/stats')).status, 401);
+    assert.strictEqual((await server.request('/admin/stats', { headers: { authorization: 'Bearer wrong' } })).status, 401);
+  });
+
+  await t.test('idle', async () => {
+    const body = await stats();
+    assert.deepStrictEqual(body.concurrency, { limit: 2, memoryLimit: 2, warmupCeiling: 2, running: 0, queued: 0 });
+    assert.deepStrictEqual(body.generations, { byModel: {}, byApiKey: {} });
+    assert.strictEqual(body.tasks.maxInflightAsync, 50);
+    assert.deepStrictEqual(body.limiters.callbacks, { running: 0, queued: 0, limit: 5 });
+    assert.strictEqual(typeof body.process.memoryMB, 'number');
+  });
+
+  await t.test('under load', async () => {
+    const submit = (model, apiKey, i) => server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model, prompt: `load ${i}`, apiKey }
+    });
+    // 按提交顺序拿名额：前两个 sora_image 运行，其余排队
+    const taskIds = [];
+    for (const [i, [model, apiKey]] of [['sora_image', 'key-a'], ['sora_image', 'key-a'], ['sora_image', 'key-a'], [GEMINI, 'key-b']].entries()) {
+      taskIds.push((await submit(model, apiKey, i)).body.taskId);
+      while (Object.values((await stats()).generations.byApiKey).reduce((a, b) => a + b, 0) < i + 1) await wait(10);
+    }
+    let body = await stats();
+
+    assert.strictEqual(body.concurrency.running, 2);
+    assert.strictEqual(body.concurrency.queued, 2);
+    assert.deepStrictEqual(body.generations.byModel, { sora_image: { queued: 1, running: 2 }, [GEMINI]: { queued: 1, running: 0 } });
+    assert.deepStrictEqual(body.generations.byApiKey, { [keyHash('key-a')]: 3, [keyHash('key-b')]: 1 });
+    assert.strictEqual(body.tasks.inflightAsync, 4);
+    assert.strictEqual(body.tasks.cancellable, 4);
+    assert.doesNotMatch(JSON.stringify(body), /key-a|key-b/);
+
+    await Promise.all(taskIds.map(taskId => server.waitForTask(taskId)));
+    body = await stats();
+    assert.deepStrictEqual(body.generations, { byModel: {}, byApiKey: {} });
+    assert.strictEqual(body.concurrency.running, 0);
+    assert.strictEqual(body.tasks.inflightAsync, 0);
+  });
+});
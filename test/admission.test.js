@@ -0,0 +1,40 @@
+// 准入检查：进行中的异步任务达到 MAX_INFLIGHT_TASKS 时新任务直接返回 503 和 Retry-After，不启动任务；有任务结束后恢复接收
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+test('a flood of async tasks is rejected above MAX_INFLIGHT_TASKS', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse(), delayMs: 800 }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, MAX_INFLIGHT_TASKS: '3' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const submit = (i, fields = {}) => server.request('/api/generate/async', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: `flood ${i}`, apiKey: 'key', ...fields }
+  });
+
+  const responses = await Promise.all(Array.from({ length: 8 }, (_, i) => submit(i)));
+  const accepted = responses.filter(({ status }) => status === 200);
+  const rejected = responses.filter(({ status }) => status === 503);
+  assert.strictEqual(accepted.length, 3);
+  assert.strictEqual(rejected.length, 5);
+  for (const { headers, body } of rejected) {
+    assert.ok(Number(headers.get('retry-after')) >= 1);
+    assert.strictEqual(body.retryAfter, Number(headers.get('retry-after')));
+    assert.strictEqual(body.taskId, undefined);
+  }
+  assert.match(server.logs, /\[ADMISSION\] Rejecting task .+: 3 tasks in flight \(max 3\)/);
+
+  // 一次提交的多模型子任务整体计数，放不下时整批拒绝
+  const fanOut = await submit('fan-out', { model: undefined, models: ['sora_image', 'gemini-2.5-flash-image-preview'] });
+  assert.strictEqual(fanOut.status, 503);
+
+  // 被拒绝的任务没有启动
+  await Promise.all(accepted.map(({ body }) => server.waitForTask(body.taskId)));
+  assert.strictEqual(upstream.generationRequests().length, 3);
+
+  assert.strictEqual((await submit('after')).status, 200);
+});
@@ -0,0 +1,55 @@
+// ALLOWED_OUTPUT_HOSTS：上游返回的图片地址必须在白名单中（*.example.com 匹配子域名），否则任务失败；base64 图片不受限制，未配置时接受任何域名
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse } = require('./helpers');
+
+// Upstream stub returning the image url named in the prompt
+async function startImageUpstream() {
+  return startUpstream(request => {
+    if (request.url.includes('generateContent')) return { body: geminiResponse() };
+    return { body: soraResponse(JSON.parse(request.body).messages[0].content) };
+  });
+}
+
+test('output image hosts are checked against the allowlist', async t => {
+  const upstream = await startImageUpstream();
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ALLOWED_OUTPUT_HOSTS: 'cdn.example.com,*.images.example.net' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const generate = async (prompt, model = 'sora_image') => {
+    const { body } = await server.request('/api/generate/async', { method: 'POST', body: { model, prompt, apiKey: 'key', maxRetries: 0 } });
+    return server.waitForTask(body.taskId);
+  };
+
+  await t.test('allowed hosts', async () => {
+    assert.strictEqual((await generate('https://cdn.example.com/a.png')).status, 'completed');
+    assert.strictEqual((await generate('https://eu.images.example.net/b.png')).status, 'completed');
+    // base64 内联图片
+    assert.strictEqual((await generate('p', 'gemini-2.5-flash-image-preview')).status, 'completed');
+  });
+
+  await t.test('disallowed hosts', async () => {
+    for (const url of ['https://evil.example.org/a.png', 'https://cdn.example.com.evil.org/a.png', 'https://images.example.net/a.png']) {
+      const result = await generate(url);
+      assert.strictEqual(result.status, 'failed', url);
+      assert.match(result.error, /Output image host .+ is not in ALLOWED_OUTPUT_HOSTS/);
+      assert.strictEqual(result.imageUrl, undefined);
+    }
+  });
+});
+
+test('any host is accepted when unset', async t => {
+  const upstream = await startImageUpstream();
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const { status, body } = await server.request('/api/generate', { method: 'POST', body: { model: 'sora_image', prompt: 'https://anywhere.example.org/a.png', apiKey: 'key' } });
+  assert.strictEqual(status, 200);
+  assert.strictEqual(body.imageUrl, 'https://anywhere.example.org/a.png');
+});
@@ -0,0 +1,57 @@
+// Anthropic 兼容接口：claude 开头的模型发送 Messages 格式（图片在前、base64 source），从 content 中的 image 块提取结果
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream } = require('./helpers');
+
+const MODEL = 'claude-image-preview';
+const PNG = Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0, 0, 0, 0]).toString('base64');
+
+const RESPONSES = {
+  base64: { content: [{ type: 'text', text: 'Here you go' }, { type: 'image', source: { type: 'base64', media_type: 'image/png', data: PNG } }], stop_reason: 'end_turn' },
+  url: { content: [{ type: 'image', source: { type: 'url', url: 'https://cdn.example.com/claude.webp' } }], stop_reason: 'end_turn' },
+  text: { content: [{ type: 'text', text: 'Rendered at https://cdn.example.com/in-text.png' }], stop_reason: 'end_turn' }
+};
+
+test('Anthropic-shaped requests and responses', async t => {
+  const upstream = await startUpstream(request => {
+    const { content } = JSON.parse(request.body).messages[0];
+    return { body: RESPONSES[content.at(-1).text.split(' ')[0]] };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const generate = fields => server.request('/api/generate', { method: 'POST', body: { model: MODEL, apiKey: 'key', ...fields } });
+
+  await t.test('request shape', async () => {
+    const { status } = await generate({ prompt: 'base64 please', imageUrl: `data:image/png;base64,${PNG}` });
+    assert.strictEqual(status, 200);
+    const request = upstream.generationRequests().at(-1);
+    assert.strictEqual(request.url, '/v1/messages');
+    assert.strictEqual(request.headers['anthropic-version'], '2023-06-01');
+    const sent = JSON.parse(request.body);
+    assert.strictEqual(sent.model, MODEL);
+    assert.ok(sent.max_tokens > 0);
+    assert.deepStrictEqual(sent.messages[0].content, [
+      { type: 'image', source: { type: 'base64', media_type: 'image/png', data: PNG } },
+      { type: 'text', text: 'base64 please' }
+    ]);
+  });
+
+  await t.test('base64 image blocks', async () => {
+    const { body } = await generate({ prompt: 'base64' });
+    assert.strictEqual(body.imageUrl, `data:image/png;base64,${PNG}`);
+  });
+
+  await t.test('url image blocks', async () => {
+    const { body } = await generate({ prompt: 'url' });
+    assert.strictEqual(body.imageUrl, 'https://cdn.example.com/claude.webp');
+  });
+
+  await t.test('urls in text when there is no image block', async () => {
+    const { body } = await generate({ prompt: 'text' });
+    assert.strictEqual(body.imageUrl, 'https://cdn.example.com/in-text.png');
+  });
+});
@@ -0,0 +1,72 @@
+// 审计日志：AUDIT_LOG=file:<path> 或 stdout 时每个任务写一行 JSON，只有 apiKey 和 prompt 的哈希，不含原文
+const test = require('node:test');
+const assert = require('node:assert');
+const fs = require('fs');
+const os = require('os');
+const path = require('path');
+const crypto = require('crypto');
+const { startServer, startUpstream, soraResponse, runServerToExit, freePort } = require('./helpers');
+
+const sha256 = value => crypto.createHash('sha256').update(value).digest('hex');
+const API_KEY = 'sk-audit-secret-key';
+const PROMPT = 'a confidential product mockup';
+
+test('one redacted audit line is written per task', async t => {
+  const auditPath = path.join(fs.mkdtempSync(path.join(os.tmpdir(), 'audit-')), 'audit.log');
+  const upstream = await startUpstream(request => (request.body.includes('fail')
+    ? { status: 400, body: { error: 'rejected' } }
+    : { body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, AUDIT_LOG: `file:${auditPath}` });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+    fs.rmSync(path.dirname(auditPath), { recursive: true, force: true });
+  });
+
+  const submit = async (prompt, fields = {}) => {
+    const { body } = await server.request('/api/generate/async', { method: 'POST', body: { model: 'sora_image', prompt, apiKey: API_KEY, maxRetries: 0, ...fields } });
+    await server.waitForTask(body.taskId);
+    return body.taskId;
+  };
+  const completed = await submit(PROMPT, { tags: { team: 'design' }, parentTaskId: 'audit-batch' });
+  const failed = await submit('please fail');
+
+  const lines = fs.readFileSync(auditPath, 'utf8').trim().split('\n').map(line => JSON.parse(line));
+  assert.strictEqual(lines.length, 2);
+
+  const [first, second] = lines;
+  assert.strictEqual(first.taskId, completed);
+  assert.strictEqual(first.parentTaskId, 'audit-batch');
+  assert.strictEqual(first.model, 'sora_image');
+  assert.strictEqual(first.status, 'completed');
+  assert.deepStrictEqual(first.tags, { team: 'design' });
+  assert.strictEqual(first.apiKeyHash, sha256(API_KEY));
+  assert.strictEqual(first.promptHash, sha256(PROMPT));
+  assert.ok(!Number.isNaN(Date.parse(first.timestamp)));
+  assert.strictEqual(second.taskId, failed);
+  assert.strictEqual(second.status, 'failed');
+
+  const raw = fs.readFileSync(auditPath, 'utf8');
+  assert.ok(!raw.includes(API_KEY) && !raw.includes(PROMPT), 'no raw key or prompt');
+});
+
+test('audit lines go to stdout', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, AUDIT_LOG: 'stdout' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const { body } = await server.request('/api/generate', { method: 'POST', body: { model: 'sora_image', prompt: PROMPT, apiKey: API_KEY } });
+  assert.ok(body.success);
+  const line = server.logs.split('\n').find(entry => entry.startsWith('{') && entry.includes('"promptHash"'));
+  assert.ok(line, 'audit line on stdout');
+  assert.strictEqual(JSON.parse(line).promptHash, sha256(PROMPT));
+});
+
+test('AUDIT_LOG is validated', async () => {
+  const { code, logs } = await runServerToExit({ AUDIT_LOG: 'syslog', PORT: String(await freePort()) });
+  assert.strictEqual(code, 1);
+  assert.match(logs, /AUDIT_LOG must be stdout or file:<path>/);
+});
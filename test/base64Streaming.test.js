@@ -0,0 +1,99 @@
+// 输入图片边下载边编码 base64：分块边界不对齐时结果仍然正确，峰值内存不包含完整的原始图片
+const test = require('node:test');
+const assert = require('node:assert');
+const { execFileSync } = require('node:child_process');
+const { startServer, startUpstream, geminiResponse } = require('./helpers');
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+// 不是 3 的倍数的分块大小，覆盖余数并入下一块的各种情况
+const CHUNK_SIZES = [1, 2, 7, 4096, 65537, 100000];
+
+test('streamed encoding matches the whole-buffer encoding', async t => {
+  const image = Buffer.alloc(3 * 1024 * 1024 + 1);
+  image.set([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]);
+  for (let i = 8; i < image.length; i++) image[i] = (i * 31) & 0xff;
+
+  const upstream = await startUpstream((request, res) => {
+    if (!request.url.startsWith('/ref')) return { body: geminiResponse() };
+    res.writeHead(200, { 'content-type': 'image/png' });
+    let offset = 0;
+    for (let i = 0; offset < image.length; i++) {
+      const size = CHUNK_SIZES[i % CHUNK_SIZES.length];
+      res.write(image.subarray(offset, offset + size));
+      offset += size;
+    }
+    res.end();
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const { status } = await server.request('/api/generate', {
+    method: 'POST',
+    body: { model: GEMINI, prompt: 'p', apiKey: 'key', imageUrl: `${upstream.url}/ref.png` }
+  });
+  assert.strictEqual(status, 200);
+  const sent = JSON.parse(upstream.generationRequests()[0].body).contents[0].parts[1].inline_data.data;
+  assert.strictEqual(sent.length, Math.ceil(image.length / 3) * 4);
+  assert.ok(sent === image.toString('base64'));
+});
+
+// Same streaming encoder as server.js, compared with reading the whole body first; runs with --expose-gc so the peak is stable
+const BENCHMARK = `
+async function encodeStreamAsBase64(body) {
+  let base64 = '';
+  let remainder = Buffer.alloc(0);
+  for await (const chunk of body) {
+    const bytes = Buffer.from(chunk.buffer, chunk.byteOffset, chunk.byteLength);
+    const data = remainder.length > 0 ? Buffer.concat([remainder, bytes]) : bytes;
+    const aligned = data.length - (data.length % 3);
+    base64 += data.subarray(0, aligned).toString('base64');
+    remainder = data.subarray(aligned);
+  }
+  return base64 + remainder.toString('base64');
+}
+
+async function encodeWhole(body) {
+  const chunks = [];
+  for await (const chunk of body) chunks.push(chunk);
+  return Buffer.concat(chunks).toString('base64');
+}
+
+let peak = 0;
+function sample() {
+  global.gc();
+  peak = Math.max(peak, process.memoryUsage().arrayBuffers);
+}
+
+async function* source() {
+  for (let i = 0; i < 512; i++) {
+    yield Buffer.alloc(64 * 1024 + 1, i);
+    if (i % 8 === 0) sample();
+  }
+  sample();
+}
+
+(async () => {
+  global.gc();
+  const baseline = process.memoryUsage().arrayBuffers;
+  const encode = process.argv[1] === 'whole' ? encodeWhole : encodeStreamAsBase64;
+  const result = await encode(source());
+  sample();
+  process.stdout.write(JSON.stringify({ peakBytes: peak - baseline, length: result.length }));
+})();
+`;
+
+function measure(mode) {
+  return JSON.parse(execFileSync(process.execPath, ['--expose-gc', '-e', BENCHMARK, mode], { encoding: 'utf8' }));
+}
+
+test('streamed encoding keeps peak buffer memory bounded', () => {
+  const streamed = measure('stream');
+  const whole = measure('whole');
+  assert.strictEqual(streamed.length, whole.length);
+  // 32MB 的原始数据：一次性读取时全部留在内存中，流式编码只保留当前分块
+  assert.ok(whole.peakBytes > 30 * 1024 * 1024, `whole-body peak ${whole.peakBytes}`);
+  assert.ok(streamed.peakBytes < whole.peakBytes / 8, `streamed peak ${streamed.peakBytes} vs ${whole.peakBytes}`);
+});
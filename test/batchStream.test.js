@@ -0,0 +1,88 @@
+// GET /api/generate/batch/:parentTaskId/stream：按完成顺序逐行输出子任务结果（NDJSON），全部结束后关闭；已结束的先按完成时间输出，未知批次 404
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+const DELAYS = { slow: 1200, medium: 700, fast: 200 };
+
+async function readLines(response) {
+  const lines = [];
+  let buffer = '';
+  const decoder = new TextDecoder();
+  for await (const chunk of response.body) {
+    buffer += decoder.decode(chunk, { stream: true });
+    let newline;
+    while ((newline = buffer.indexOf('\n')) >= 0) {
+      lines.push(JSON.parse(buffer.slice(0, newline)));
+      buffer = buffer.slice(newline + 1);
+    }
+  }
+  assert.strictEqual(buffer, '', 'the stream ends with a complete line');
+  return lines;
+}
+
+test('batch results stream in completion order', async t => {
+  const upstream = await startUpstream(request => {
+    if (request.body.includes('broken')) return { status: 400, body: { error: 'bad request' }, delayMs: 450 };
+    const speed = Object.keys(DELAYS).find(name => request.body.includes(name));
+    return { body: soraResponse(`https://cdn.example.com/${speed}.png`), delayMs: DELAYS[speed] };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const submitBatch = async (parentTaskId, prompts) => {
+    const taskIds = {};
+    for (const prompt of prompts) {
+      const { body } = await server.request('/api/generate/async', {
+        method: 'POST',
+        body: { model: 'sora_image', prompt: `${parentTaskId} ${prompt}`, apiKey: 'key', parentTaskId, maxRetries: 0 }
+      });
+      taskIds[body.taskId] = prompt;
+    }
+    return taskIds;
+  };
+
+  await t.test('streamed as children finish', async () => {
+    const taskIds = await submitBatch('batch-live', ['slow', 'medium', 'fast', 'broken']);
+    const response = await fetch(`${server.url}/api/generate/batch/batch-live/stream`);
+    assert.strictEqual(response.status, 200);
+    assert.strictEqual(response.headers.get('content-type'), 'application/x-ndjson');
+
+    const lines = await readLines(response);
+    assert.deepStrictEqual(lines.map(line => taskIds[line.taskId]), ['fast', 'broken', 'medium', 'slow']);
+    assert.deepStrictEqual(lines.map(line => line.status), ['completed', 'failed', 'completed', 'completed']);
+    assert.strictEqual(lines[0].imageUrl, 'https://cdn.example.com/fast.png');
+    assert.strictEqual(lines[0].parentTaskId, 'batch-live');
+  });
+
+  await t.test('finished batches are replayed by completion time', async () => {
+    const taskIds = await submitBatch('batch-done', ['medium', 'fast']);
+    await Promise.all(Object.keys(taskIds).map(taskId => server.waitForTask(taskId)));
+
+    const lines = await readLines(await fetch(`${server.url}/api/generate/batch/batch-done/stream`));
+    assert.deepStrictEqual(lines.map(line => taskIds[line.taskId]), ['fast', 'medium']);
+  });
+
+  await t.test('client disconnects', async () => {
+    const taskIds = await submitBatch('batch-gone', ['slow', 'fast']);
+    const controller = new AbortController();
+    const response = await fetch(`${server.url}/api/generate/batch/batch-gone/stream`, { signal: controller.signal });
+    const reader = response.body.getReader();
+    await reader.read();
+    controller.abort();
+
+    // 断开后任务照常完成，服务继续可用
+    await Promise.all(Object.keys(taskIds).map(taskId => server.waitForTask(taskId)));
+    await wait(50);
+    const lines = await readLines(await fetch(`${server.url}/api/generate/batch/batch-gone/stream`));
+    assert.strictEqual(lines.length, 2);
+  });
+
+  await t.test('unknown batches', async () => {
+    const { status } = await server.request('/api/generate/batch/no-such-batch/stream');
+    assert.strictEqual(status, 404);
+  });
+});
@@ -0,0 +1,50 @@
+// CALLBACK_CONCURRENCY：大量任务同时完成时回调排队发送，同时发往接收端的回调不超过上限，重试同样占用名额
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+const RECEIVE_MS = 300;
+
+test('callbacks are dispatched within the concurrency bound', async t => {
+  const delivery = { active: 0, peak: 0 };
+  const attempts = new Map();
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const receiver = await startUpstream(request => {
+    delivery.active++;
+    delivery.peak = Math.max(delivery.peak, delivery.active);
+    setTimeout(() => delivery.active--, RECEIVE_MS);
+    // 每个任务的第一次回调失败一次，走重试
+    const { taskId } = JSON.parse(request.body);
+    attempts.set(taskId, (attempts.get(taskId) || 0) + 1);
+    return attempts.get(taskId) === 1 && taskId.endsWith('retry')
+      ? { status: 503, body: { error: 'busy' }, delayMs: RECEIVE_MS }
+      : { body: { received: true }, delayMs: RECEIVE_MS };
+  });
+  const server = await startServer({
+    UPSTREAM_REGIONS: upstream.url,
+    ALLOW_PRIVATE_CALLBACKS: 'true',
+    CALLBACK_CONCURRENCY: '2',
+    CALLBACK_BACKOFF: '10'
+  });
+  t.after(async () => {
+    await server.close();
+    await Promise.all([upstream.close(), receiver.close()]);
+  });
+
+  const taskIds = [1, 2, 3, 4, 5, 6].map(i => `burst-${i}${i % 2 ? '-retry' : ''}`);
+  await Promise.all(taskIds.map((taskId, i) => server.request('/api/generate/async', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: `p${i}`, apiKey: 'key', taskId, callbackUrl: `${receiver.url}/hook` }
+  })));
+  for (const taskId of taskIds) await server.waitForTask(taskId);
+
+  let sawQueue = false;
+  for (let i = 0; i < 100 && receiver.requests.length < 9; i++) {
+    sawQueue ||= (await server.request('/health')).body.callbacks.queued > 0;
+    await wait(50);
+  }
+  assert.strictEqual(receiver.requests.length, 9, 'six callbacks plus three retries');
+  assert.deepStrictEqual([...attempts.keys()].sort(), [...taskIds].sort());
+  assert.strictEqual(delivery.peak, 2);
+  assert.ok(sawQueue, 'callbacks waited for a slot');
+});
@@ -0,0 +1,67 @@
+// callbackContentType：默认 JSON 回调；application/x-www-form-urlencoded 时数组字段重复同一个键、tags 展开为 tags[name]，签名按实际发送的请求体计算
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('crypto');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+const FORM = 'application/x-www-form-urlencoded';
+
+test('callbacks are encoded in the requested content type', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const receiver = await startUpstream(() => ({ body: { received: true } }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ALLOW_PRIVATE_CALLBACKS: 'true', CALLBACK_SIGNING_SECRET: 'signing-secret' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+    await receiver.close();
+  });
+
+  const callbackFor = async fields => {
+    const { status, body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: `callback ${JSON.stringify(fields)}`, apiKey: 'key', callbackUrl: `${receiver.url}/hook`, ...fields }
+    });
+    assert.strictEqual(status, 200);
+    await server.waitForTask(body.taskId);
+    let request;
+    for (let i = 0; i < 50 && !request; i++) {
+      request = receiver.requests.find(item => item.body.includes(body.taskId));
+      if (!request) await wait(50);
+    }
+    assert.ok(request, 'the callback arrived');
+    return { taskId: body.taskId, request };
+  };
+
+  await t.test('form-encoded', async () => {
+    const { taskId, request } = await callbackFor({ callbackContentType: FORM, tags: { env: 'prod', team: 'growth' } });
+    assert.strictEqual(request.headers['content-type'], FORM);
+    const form = new URLSearchParams(request.body);
+    assert.strictEqual(form.get('taskId'), taskId);
+    assert.strictEqual(form.get('status'), 'completed');
+    assert.strictEqual(form.get('imageUrl'), 'https://cdn.example.com/result.png');
+    assert.deepStrictEqual(form.getAll('imageUrls'), ['https://cdn.example.com/result.png']);
+    assert.strictEqual(form.get('tags[env]'), 'prod');
+    assert.strictEqual(form.get('tags[team]'), 'growth');
+    assert.ok(!request.body.includes('undefined'));
+
+    const expected = crypto.createHmac('sha256', 'signing-secret').update(`${request.headers['x-callback-timestamp']}.${request.body}`).digest('hex');
+    assert.strictEqual(request.headers['x-callback-signature'], `sha256=${expected}`);
+  });
+
+  await t.test('json by default', async () => {
+    const { taskId, request } = await callbackFor({});
+    assert.strictEqual(request.headers['content-type'], 'application/json');
+    const payload = JSON.parse(request.body);
+    assert.strictEqual(payload.taskId, taskId);
+    assert.deepStrictEqual(payload.imageUrls, ['https://cdn.example.com/result.png']);
+  });
+
+  await t.test('unsupported content types are rejected', async () => {
+    const { status, body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'p', apiKey: 'key', callbackUrl: `${receiver.url}/hook`, callbackContentType: 'text/plain' }
+    });
+    assert.strictEqual(status, 400);
+    assert.deepStrictEqual(body.fields, [{ field: 'callbackContentType', message: `callbackContentType must be one of application/json, ${FORM}` }]);
+  });
+});
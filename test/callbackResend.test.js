@@ -0,0 +1,71 @@
+// POST /api/callback/resend/:taskId：重新发送已结束任务的回调，需要管理员 token 或任务的 cancelToken；未知或进行中的任务返回 404
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+const ADMIN = { authorization: 'Bearer admin-token' };
+
+test('a completed task callback can be resent', async t => {
+  let receiverUp = false;
+  const upstream = await startUpstream(request => ({ body: soraResponse(), delayMs: request.body.includes('slow') ? 2000 : 0 }));
+  const receiver = await startUpstream(() => (receiverUp ? { body: { received: true } } : { status: 503, body: { error: 'down' } }));
+  const other = await startUpstream(() => ({ body: { received: true } }));
+  const server = await startServer({
+    UPSTREAM_REGIONS: upstream.url,
+    ALLOW_PRIVATE_CALLBACKS: 'true',
+    ADMIN_TOKEN: 'admin-token',
+    CALLBACK_MAX_RETRIES: '0'
+  });
+  t.after(async () => {
+    await server.close();
+    await Promise.all([upstream, receiver, other].map(stub => stub.close()));
+  });
+
+  const { body: submitted } = await server.request('/api/generate/async', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: 'p', apiKey: 'key', callbackUrl: `${receiver.url}/hook` }
+  });
+  const { taskId, cancelToken } = submitted;
+  await server.waitForTask(taskId);
+  for (let i = 0; i < 40 && receiver.requests.length === 0; i++) await wait(50);
+  assert.strictEqual(receiver.requests.length, 1, 'the original callback hit the receiver while it was down');
+
+  const resend = (id, { headers = {}, body } = {}) => server.request(`/api/callback/resend/${id}`, { method: 'POST', headers, body });
+
+  await t.test('with the cancelToken', async () => {
+    receiverUp = true;
+    const { status, body } = await resend(taskId, { headers: { 'x-cancel-token': cancelToken } });
+    assert.strictEqual(status, 200);
+    assert.deepStrictEqual(body, { success: true, taskId, callbackStatus: 200 });
+    assert.strictEqual(receiver.requests.length, 2);
+    const payload = JSON.parse(receiver.requests[1].body);
+    assert.strictEqual(payload.taskId, taskId);
+    assert.strictEqual(payload.status, 'completed');
+    assert.strictEqual(payload.imageUrl, 'https://cdn.example.com/result.png');
+  });
+
+  await t.test('admins can override the callbackUrl', async () => {
+    const { status } = await resend(taskId, { headers: ADMIN, body: { callbackUrl: `${other.url}/other` } });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(other.requests.length, 1);
+    assert.strictEqual(JSON.parse(other.requests[0].body).taskId, taskId);
+
+    const denied = await resend(taskId, { headers: { 'x-cancel-token': cancelToken }, body: { callbackUrl: `${other.url}/other` } });
+    assert.strictEqual(denied.status, 403);
+  });
+
+  await t.test('ownership is required', async () => {
+    assert.strictEqual((await resend(taskId)).status, 403);
+    assert.strictEqual((await resend(taskId, { headers: { 'x-cancel-token': 'wrong-token' } })).status, 403);
+  });
+
+  await t.test('unknown and running tasks', async () => {
+    assert.strictEqual((await resend('no-such-task', { headers: ADMIN })).status, 404);
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'slow', apiKey: 'key', callbackUrl: `${receiver.url}/hook` }
+    });
+    const { status } = await resend(body.taskId, { headers: ADMIN });
+    assert.strictEqual(status, 404);
+  });
+});
@@ -0,0 +1,39 @@
+// 回调重试次数只由 CALLBACK_MAX_RETRIES 决定，和任务的 maxRetries（上游重试）无关
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+async function countCallbackDeliveries(env, maxRetries) {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const receiver = await startUpstream(() => ({ status: 503, body: { error: 'receiver down' } }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ALLOW_PRIVATE_CALLBACKS: 'true', CALLBACK_BACKOFF: '10', ...env });
+  try {
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'p', apiKey: 'key', maxRetries, callbackUrl: `${receiver.url}/hook` }
+    });
+    await server.waitForTask(body.taskId);
+    // 回调在结果存储后发送，等重试全部结束
+    let previous = -1;
+    while (receiver.requests.length !== previous) {
+      previous = receiver.requests.length;
+      await wait(300);
+    }
+    return { callbacks: receiver.requests.length, upstreamCalls: upstream.generationRequests().length };
+  } finally {
+    await server.close();
+    await upstream.close();
+    await receiver.close();
+  }
+}
+
+test('callbacks retry CALLBACK_MAX_RETRIES times even when maxRetries is 1', async () => {
+  const { callbacks, upstreamCalls } = await countCallbackDeliveries({ CALLBACK_MAX_RETRIES: '3' }, 1);
+  assert.strictEqual(upstreamCalls, 1);
+  assert.strictEqual(callbacks, 4);
+});
+
+test('CALLBACK_MAX_RETRIES=0 sends one callback even when maxRetries is 5', async () => {
+  const { callbacks } = await countCallbackDeliveries({ CALLBACK_MAX_RETRIES: '0' }, 5);
+  assert.strictEqual(callbacks, 1);
+});
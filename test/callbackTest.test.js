@@ -0,0 +1,71 @@
+// POST /api/callback/test：向 callbackUrl 发送带 test: true 的示例回调（配置了签名密钥时带签名），返回接收端的状态码和耗时
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('node:crypto');
+const { startServer, startUpstream } = require('./helpers');
+
+const ADMIN = { authorization: 'Bearer admin-token' };
+const SECRET = 'signing-secret';
+
+test('the callback test endpoint sends a signed sample payload', async t => {
+  const receiver = await startUpstream(request => (request.url === '/broken' ? { status: 500, body: { error: 'boom' } } : { body: { received: true } }));
+  const server = await startServer({ ADMIN_TOKEN: 'admin-token', ALLOW_PRIVATE_CALLBACKS: 'true', CALLBACK_SIGNING_SECRET: SECRET });
+  t.after(async () => {
+    await server.close();
+    await receiver.close();
+  });
+
+  const send = (body, headers = ADMIN) => server.request('/api/callback/test', { method: 'POST', headers, body });
+
+  await t.test('signed sample payload', async () => {
+    const { status, body } = await send({ callbackUrl: `${receiver.url}/hook`, callbackHeaders: { 'X-Receiver-Key': 'abc' } });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.success, true);
+    assert.strictEqual(body.callbackStatus, 200);
+    assert.strictEqual(body.signed, true);
+    assert.ok(Number.isInteger(body.latencyMs) && body.latencyMs >= 0);
+
+    const [request] = receiver.requests;
+    assert.strictEqual(request.url, '/hook');
+    assert.strictEqual(request.headers['x-receiver-key'], 'abc');
+    const payload = JSON.parse(request.body);
+    assert.strictEqual(payload.test, true);
+    assert.match(payload.taskId, /^callback-test-\d+$/);
+    assert.strictEqual(payload.status, 'completed');
+    assert.strictEqual(payload.imageUrl, 'https://example.com/sample.png');
+
+    const timestamp = request.headers['x-callback-timestamp'];
+    const expected = crypto.createHmac('sha256', SECRET).update(`${timestamp}.${request.body}`).digest('hex');
+    assert.strictEqual(request.headers['x-callback-signature'], `sha256=${expected}`);
+  });
+
+  await t.test('receiver errors are reported', async () => {
+    const { status, body } = await send({ callbackUrl: `${receiver.url}/broken` });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.success, false);
+    assert.strictEqual(body.callbackStatus, 500);
+  });
+
+  await t.test('invalid requests', async () => {
+    const requests = receiver.requests.length;
+    assert.strictEqual((await send({})).status, 400);
+    assert.strictEqual((await send({ callbackUrl: 'ftp://example.com/hook' })).status, 400);
+    assert.strictEqual((await send({ callbackUrl: `${receiver.url}/hook`, callbackHeaders: { Host: 'evil.example.com' } })).status, 400);
+    assert.strictEqual((await send({ callbackUrl: `${receiver.url}/hook` }, {})).status, 401);
+    assert.strictEqual(receiver.requests.length, requests);
+  });
+});
+
+test('private callback targets are refused', async t => {
+  const receiver = await startUpstream(() => ({ body: { received: true } }));
+  const server = await startServer({ ADMIN_TOKEN: 'admin-token' });
+  t.after(async () => {
+    await server.close();
+    await receiver.close();
+  });
+
+  const { status, body } = await server.request('/api/callback/test', { method: 'POST', headers: ADMIN, body: { callbackUrl: `${receiver.url}/hook` } });
+  assert.strictEqual(status, 400);
+  assert.match(body.error, /private|not allowed/i);
+  assert.strictEqual(receiver.requests.length, 0);
+});
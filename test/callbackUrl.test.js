@@ -0,0 +1,55 @@
+// 回调地址校验：REQUIRE_HTTPS_CALLBACKS 下拒绝 http://，关闭时接受并记录警告；内网地址始终被 SSRF 防护拒绝
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+// TEST-NET-3 地址：不是内网地址，不需要 DNS 解析
+const PUBLIC_HTTP_CALLBACK = 'http://203.0.113.10/hook';
+
+function submit(server, callbackUrl) {
+  return server.request('/api/generate/async', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: 'a cat', apiKey: 'key', callbackUrl }
+  });
+}
+
+test('REQUIRE_HTTPS_CALLBACKS=true rejects http callback URLs', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, REQUIRE_HTTPS_CALLBACKS: 'true' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const response = await submit(server, PUBLIC_HTTP_CALLBACK);
+  assert.strictEqual(response.status, 400);
+  assert.strictEqual(response.body.errorCode, 'INVALID_REQUEST');
+  assert.ok(response.body.fields.some(field => field.field === 'callbackUrl' && /https/.test(field.message)));
+  assert.strictEqual(upstream.generationRequests().length, 0);
+});
+
+test('http callback URLs are accepted with a warning when the flag is off', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const response = await submit(server, PUBLIC_HTTP_CALLBACK);
+  assert.strictEqual(response.status, 200);
+  assert.ok(response.body.taskId);
+  await wait(100);
+  assert.match(server.logs, /Callback URL uses plaintext http/);
+});
+
+test('private callback addresses are rejected regardless of the flag', async t => {
+  const server = await startServer();
+  t.after(() => server.close());
+
+  for (const callbackUrl of ['http://127.0.0.1:8080/hook', 'https://10.0.0.5/hook', 'http://[::1]/hook']) {
+    const response = await submit(server, callbackUrl);
+    assert.strictEqual(response.status, 400, callbackUrl);
+    assert.ok(response.body.fields.some(field => field.field === 'callbackUrl'), callbackUrl);
+  }
+});
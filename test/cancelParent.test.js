@@ -0,0 +1,75 @@
+// POST /api/cancel/parent/:parentTaskId：取消批次中所有进行中的子任务并发送取消回调，返回取消和已结束的数量；需要管理员 token 或批次中任一子任务的 cancelToken
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+const ADMIN = { authorization: 'Bearer admin-token' };
+
+test('all running children of a parent can be cancelled', async t => {
+  const upstream = await startUpstream(request => {
+    if (request.body.includes('fail')) return { status: 400, body: { error: 'rejected' } };
+    return { body: soraResponse(), delayMs: request.body.includes('slow') ? 5000 : 0 };
+  });
+  const receiver = await startUpstream(() => ({ body: { received: true } }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ADMIN_TOKEN: 'admin-token', ALLOW_PRIVATE_CALLBACKS: 'true' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+    await receiver.close();
+  });
+
+  const submit = async (parentTaskId, prompt) => {
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt, apiKey: 'key', parentTaskId, maxRetries: 0, callbackUrl: `${receiver.url}/hook` }
+    });
+    return body;
+  };
+  const cancelParent = (parentTaskId, headers = {}) => server.request(`/api/cancel/parent/${parentTaskId}`, { method: 'POST', headers });
+
+  // story-1：一个已完成、一个已失败、两个进行中
+  const completed = await submit('story-1', 'done');
+  const failed = await submit('story-1', 'fail');
+  await Promise.all([completed, failed].map(({ taskId }) => server.waitForTask(taskId)));
+  const running = [await submit('story-1', 'slow a'), await submit('story-1', 'slow b')];
+  const other = await submit('story-2', 'slow other');
+  await wait(200);
+
+  await t.test('ownership is required', async () => {
+    assert.strictEqual((await cancelParent('story-1')).status, 403);
+    assert.strictEqual((await cancelParent('story-1', { 'x-cancel-token': 'wrong-token' })).status, 403);
+    // 其他批次的 cancelToken 不能取消这个批次
+    assert.strictEqual((await cancelParent('story-1', { 'x-cancel-token': other.cancelToken })).status, 403);
+  });
+
+  await t.test('with a cancelToken from the batch', async () => {
+    // 已完成子任务的 token 也可以，它只保存了哈希
+    const { status, body } = await cancelParent('story-1', { 'x-cancel-token': completed.cancelToken });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.cancelled, 2);
+    assert.strictEqual(body.alreadyFinished, 2);
+    assert.deepStrictEqual(body.cancelledTaskIds.sort(), running.map(({ taskId }) => taskId).sort());
+
+    for (const { taskId } of running) {
+      assert.strictEqual((await server.waitForTask(taskId)).status, 'cancelled');
+    }
+    for (let i = 0; i < 40 && receiver.requests.length < 4; i++) await wait(50);
+    const callbacks = receiver.requests.map(request => JSON.parse(request.body));
+    const cancelled = callbacks.filter(payload => payload.status === 'cancelled').map(payload => payload.taskId);
+    assert.deepStrictEqual(cancelled.sort(), running.map(({ taskId }) => taskId).sort());
+
+    // 其他批次不受影响
+    const { body: status2 } = await server.request(`/api/status/${other.taskId}`);
+    assert.strictEqual(status2.status, 'processing');
+  });
+
+  await t.test('with the admin token', async () => {
+    const { status, body } = await cancelParent('story-2', ADMIN);
+    assert.strictEqual(status, 200);
+    assert.deepStrictEqual(body.cancelledTaskIds, [other.taskId]);
+
+    const empty = await cancelParent('no-such-parent', ADMIN);
+    assert.strictEqual(empty.body.cancelled, 0);
+    assert.strictEqual(empty.body.alreadyFinished, 0);
+  });
+});
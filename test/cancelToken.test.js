@@ -0,0 +1,69 @@
+// 取消任务：POST /api/cancel/:taskId 需要管理员 token 或 X-Cancel-Token；DELETE /api/generate/:cancelToken 直接用 cancelToken 取消，任务结束后 token 失效
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+const ADMIN = { authorization: 'Bearer admin-token' };
+
+test('tasks are cancelled with their cancelToken', async t => {
+  const upstream = await startUpstream(request => ({ body: soraResponse(), delayMs: request.body.includes('slow') ? 5000 : 0 }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ADMIN_TOKEN: 'admin-token' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const submit = async prompt => {
+    const { body } = await server.request('/api/generate/async', { method: 'POST', body: { model: 'sora_image', prompt, apiKey: 'key' } });
+    return body;
+  };
+  const cancel = (taskId, headers = {}) => server.request(`/api/cancel/${taskId}`, { method: 'POST', headers });
+
+  await t.test('tokens are unguessable', async () => {
+    const { cancelToken } = await submit('fast');
+    assert.match(cancelToken, /^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$/);
+  });
+
+  await t.test('POST /api/cancel/:taskId', async () => {
+    const task = await submit('slow a');
+    const other = await submit('slow b');
+    await wait(100);
+
+    assert.strictEqual((await cancel(task.taskId)).status, 403);
+    assert.strictEqual((await cancel(task.taskId, { 'x-cancel-token': other.cancelToken })).status, 403);
+
+    const { status, body } = await cancel(task.taskId, { 'x-cancel-token': task.cancelToken });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.status, 'cancelling');
+    assert.strictEqual((await server.waitForTask(task.taskId)).status, 'cancelled');
+
+    // 结束后仍可用原 token 查询到 409，而不是 404
+    const finished = await cancel(task.taskId, { 'x-cancel-token': task.cancelToken });
+    assert.strictEqual(finished.status, 409);
+
+    assert.strictEqual((await cancel(other.taskId, ADMIN)).status, 200);
+    assert.strictEqual((await cancel('no-such-task', ADMIN)).status, 404);
+    assert.strictEqual((await cancel('no-such-task', { 'x-cancel-token': task.cancelToken })).status, 403);
+  });
+
+  await t.test('DELETE /api/generate/:cancelToken', async () => {
+    const task = await submit('slow c');
+    await wait(100);
+    const { status, body } = await server.request(`/api/generate/${task.cancelToken}`, { method: 'DELETE' });
+    assert.strictEqual(status, 200);
+    assert.deepStrictEqual(body, { success: true, taskId: task.taskId, status: 'cancelling' });
+    assert.strictEqual((await server.waitForTask(task.taskId)).status, 'cancelled');
+  });
+
+  await t.test('stale tokens', async () => {
+    // 已完成和已取消任务的 token 都失效
+    const done = await submit('fast done');
+    await server.waitForTask(done.taskId);
+    for (const token of [done.cancelToken, 'not-a-real-token']) {
+      const { status } = await server.request(`/api/generate/${token}`, { method: 'DELETE' });
+      assert.strictEqual(status, 404, token);
+    }
+    const completed = await server.waitForTask(done.taskId);
+    assert.strictEqual(completed.status, 'completed');
+  });
+});
@@ -0,0 +1,40 @@
+// 清理抖动：首轮清理在间隔之外再随机延迟，每个实例的间隔也在 ±CLEANUP_JITTER 范围内随机偏移
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer } = require('./helpers');
+
+const CLEANUP_INTERVAL_MS = 60 * 1000;
+
+async function readSchedule(env) {
+  const server = await startServer(env);
+  try {
+    const match = server.logs.match(/\[CLEANUP\] First sweep in (\d+)ms, then every (\d+)ms/);
+    assert.ok(match, 'cleanup schedule is logged at startup');
+    return { firstMs: Number(match[1]), intervalMs: Number(match[2]) };
+  } finally {
+    await server.close();
+  }
+}
+
+test('the first sweep includes the jitter offset', async () => {
+  const jitter = 0.5;
+  const schedules = [];
+  for (let i = 0; i < 4; i++) {
+    schedules.push(await readSchedule({ CLEANUP_JITTER: String(jitter) }));
+  }
+
+  for (const { firstMs, intervalMs } of schedules) {
+    assert.ok(intervalMs >= CLEANUP_INTERVAL_MS * (1 - jitter) && intervalMs <= CLEANUP_INTERVAL_MS * (1 + jitter), `interval ${intervalMs}`);
+    const offset = firstMs - intervalMs;
+    assert.ok(offset >= 0 && offset <= intervalMs * jitter, `first sweep offset ${offset}`);
+  }
+  // 各实例的时间点不同，不会同时扫描
+  assert.ok(new Set(schedules.map(({ firstMs }) => firstMs)).size > 1);
+  assert.ok(new Set(schedules.map(({ intervalMs }) => intervalMs)).size > 1);
+});
+
+test('CLEANUP_JITTER=0 keeps the fixed schedule', async () => {
+  const { firstMs, intervalMs } = await readSchedule({ CLEANUP_JITTER: '0' });
+  assert.strictEqual(intervalMs, CLEANUP_INTERVAL_MS);
+  assert.strictEqual(firstMs, CLEANUP_INTERVAL_MS);
+});
@@ -0,0 +1,46 @@
+// 结果清理：无法解析或删除失败的文件只记日志，同一轮继续处理其他文件，之后的清理照常进行
+const test = require('node:test');
+const assert = require('node:assert');
+const fs = require('node:fs');
+const path = require('node:path');
+const { startServer, wait } = require('./helpers');
+
+const HOUR_AGO = new Date(Date.now() - 60 * 60 * 1000);
+
+function writeExpired(dir, name, content) {
+  const file = path.join(dir, name);
+  fs.writeFileSync(file, content);
+  fs.utimesSync(file, HOUR_AGO, HOUR_AGO);
+}
+
+async function waitForRemoval(file) {
+  for (let i = 0; i < 60 && fs.existsSync(file); i++) await wait(50);
+  return !fs.existsSync(file);
+}
+
+test('cleanup keeps going past malformed stored values', async t => {
+  const server = await startServer({ CLEANUP_INTERVAL_MS: '200', CLEANUP_JITTER: '0', RESULT_TTL_MS: '1000' });
+  t.after(() => server.close());
+  const dir = server.resultDir;
+
+  writeExpired(dir, 'garbage.json', '{not json');
+  writeExpired(dir, 'null-value.json', 'null');
+  writeExpired(dir, 'wrong-shape.json', JSON.stringify({ success: 'yes' }));
+  // 同名目录无法 unlink，模拟删除时出错的文件
+  fs.mkdirSync(path.join(dir, 'stuck.json'));
+  fs.writeFileSync(path.join(dir, 'stuck.json', 'inner'), 'x');
+  fs.utimesSync(path.join(dir, 'stuck.json'), HOUR_AGO, HOUR_AGO);
+  writeExpired(dir, 'old-task.json', JSON.stringify({ success: true, status: 'completed', imageUrl: 'https://cdn.example.com/a.png' }));
+
+  for (const name of ['garbage.json', 'null-value.json', 'wrong-shape.json', 'old-task.json']) {
+    assert.ok(await waitForRemoval(path.join(dir, name)), `${name} was removed`);
+  }
+  assert.ok(fs.existsSync(path.join(dir, 'stuck.json')));
+  for (let i = 0; i < 40 && !server.logs.includes('[CLEANUP] Failed to clean up stuck.json'); i++) await wait(50);
+  assert.match(server.logs, /\[CLEANUP\] Failed to clean up stuck\.json:/);
+
+  // 后续的清理仍在运行
+  writeExpired(dir, 'later-task.json', JSON.stringify({ success: false, status: 'failed', error: 'boom' }));
+  assert.ok(await waitForRemoval(path.join(dir, 'later-task.json')));
+  assert.strictEqual((await server.request('/health')).status, 200);
+});
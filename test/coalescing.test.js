@@ -0,0 +1,63 @@
+// 相同请求合并：并发的相同生成请求共用一次上游调用；共享调用不受发起者截止时间限制，每个任务只按自己的 X-Task-Deadline 退出
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+async function startCoalescing(t, delayMs) {
+  const upstream = await startUpstream(() => ({ body: soraResponse(), delayMs }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+  return { upstream, server };
+}
+
+const submit = (server, prompt, headers = {}) => server.request('/api/generate/async', {
+  method: 'POST',
+  headers,
+  body: { model: 'sora_image', prompt, apiKey: 'key' }
+}).then(({ body }) => body.taskId);
+
+test('identical concurrent requests make one upstream call', async t => {
+  const { upstream, server } = await startCoalescing(t, 400);
+
+  const taskIds = await Promise.all([submit(server, 'same'), submit(server, 'same'), submit(server, 'different')]);
+  const results = await Promise.all(taskIds.map(taskId => server.waitForTask(taskId)));
+  assert.ok(results.every(result => result.status === 'completed'));
+  assert.strictEqual(upstream.generationRequests().length, 2);
+  assert.match(server.logs, /Joining in-flight generation started by/);
+
+  // 上一次调用结束后再来的相同请求重新调用
+  await server.waitForTask(await submit(server, 'same'));
+  assert.strictEqual(upstream.generationRequests().length, 3);
+});
+
+test('a follower is not cut short by the leader deadline', async t => {
+  const { upstream, server } = await startCoalescing(t, 1200);
+
+  const leader = await submit(server, 'same', { 'x-task-deadline': '0.5' });
+  await wait(50);
+  const follower = await submit(server, 'same');
+
+  const [leaderResult, followerResult] = await Promise.all([server.waitForTask(leader), server.waitForTask(follower)]);
+  assert.strictEqual(leaderResult.status, 'failed');
+  assert.strictEqual(leaderResult.errorCode, 'TIMEOUT');
+  assert.strictEqual(followerResult.status, 'completed');
+  assert.strictEqual(upstream.generationRequests().length, 1);
+});
+
+test('a follower with a shorter deadline leaves on its own deadline', async t => {
+  const { upstream, server } = await startCoalescing(t, 1200);
+
+  const leader = await submit(server, 'same');
+  await wait(50);
+  const started = Date.now();
+  const follower = await submit(server, 'same', { 'x-task-deadline': '0.4' });
+
+  const followerResult = await server.waitForTask(follower);
+  assert.strictEqual(followerResult.status, 'failed');
+  assert.ok(Date.now() - started < 1100, 'follower did not wait for the shared call');
+  assert.strictEqual((await server.waitForTask(leader)).status, 'completed');
+  assert.strictEqual(upstream.generationRequests().length, 1);
+});
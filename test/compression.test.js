@@ -0,0 +1,78 @@
+// 响应压缩：状态和结果接口按 Accept-Encoding 返回 gzip（ENABLE_BROTLI 时优先 br），小于 COMPRESSION_MIN_BYTES 的响应不压缩
+const test = require('node:test');
+const assert = require('node:assert');
+const http = require('http');
+const zlib = require('zlib');
+const crypto = require('crypto');
+const { startServer, startUpstream, geminiResponse } = require('./helpers');
+
+const ADMIN = { authorization: 'Bearer admin-token' };
+
+// fetch decodes bodies transparently, use http.get to see the encoded bytes
+function rawGet(url, headers) {
+  return new Promise((resolve, reject) => {
+    http.get(url, { headers }, res => {
+      const chunks = [];
+      res.on('data', chunk => chunks.push(chunk));
+      res.on('end', () => resolve({ status: res.statusCode, headers: res.headers, body: Buffer.concat(chunks) }));
+    }).on('error', reject);
+  });
+}
+
+async function startWithLargeResult(env = {}) {
+  const image = crypto.randomBytes(64 * 1024).toString('base64');
+  const upstream = await startUpstream(() => ({ body: geminiResponse(image) }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ADMIN_TOKEN: 'admin-token', ...env });
+  const { body } = await server.request('/api/generate/async', { method: 'POST', body: { model: 'gemini-2.5-flash-image-preview', prompt: 'p', apiKey: 'key' } });
+  await server.waitForTask(body.taskId);
+  return { upstream, server, taskId: body.taskId };
+}
+
+test('large responses are gzip encoded for clients that accept it', async t => {
+  const { upstream, server, taskId } = await startWithLargeResult();
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  await t.test('status', async () => {
+    const { status, headers, body } = await rawGet(`${server.url}/api/status/${taskId}`, { 'accept-encoding': 'gzip, br' });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(headers['content-encoding'], 'gzip');
+    assert.match(headers.vary, /Accept-Encoding/);
+    const decoded = JSON.parse(zlib.gunzipSync(body));
+    assert.strictEqual(decoded.status, 'completed');
+    assert.ok(body.length < Buffer.byteLength(JSON.stringify(decoded)));
+  });
+
+  await t.test('results', async () => {
+    const { headers, body } = await rawGet(`${server.url}/api/results`, { 'accept-encoding': 'gzip', ...ADMIN });
+    assert.strictEqual(headers['content-encoding'], 'gzip');
+    assert.strictEqual(JSON.parse(zlib.gunzipSync(body)).results[0].taskId, taskId);
+  });
+
+  await t.test('not compressed without Accept-Encoding or below the threshold', async () => {
+    const plain = await rawGet(`${server.url}/api/status/${taskId}`, {});
+    assert.strictEqual(plain.headers['content-encoding'], undefined);
+    assert.strictEqual(JSON.parse(plain.body).status, 'completed');
+
+    const refused = await rawGet(`${server.url}/api/status/${taskId}`, { 'accept-encoding': 'gzip;q=0' });
+    assert.strictEqual(refused.headers['content-encoding'], undefined);
+
+    const small = await rawGet(`${server.url}/api/status/no-such-task`, { 'accept-encoding': 'gzip' });
+    assert.strictEqual(small.headers['content-encoding'], undefined);
+    assert.strictEqual(JSON.parse(small.body).status, 'processing');
+  });
+});
+
+test('brotli is used when enabled', async t => {
+  const { upstream, server, taskId } = await startWithLargeResult({ ENABLE_BROTLI: 'true' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const { headers, body } = await rawGet(`${server.url}/api/status/${taskId}`, { 'accept-encoding': 'gzip, br' });
+  assert.strictEqual(headers['content-encoding'], 'br');
+  assert.strictEqual(JSON.parse(zlib.brotliDecompressSync(body)).status, 'completed');
+});
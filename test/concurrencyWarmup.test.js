@@ -0,0 +1,50 @@
+// 启动预热：并发上限从 CONCURRENCY_WARMUP_START 线性增长到 MAX_CONCURRENCY，预热期间超过上限的任务排队
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+const ADMIN = { authorization: 'Bearer admin-token' };
+
+test('the concurrency ceiling ramps up after startup', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse(), delayMs: 1500 }));
+  const server = await startServer({
+    UPSTREAM_REGIONS: upstream.url,
+    ADMIN_TOKEN: 'admin-token',
+    MAX_CONCURRENCY: '4',
+    CONCURRENCY_WARMUP_MS: '3000',
+    CONCURRENCY_WARMUP_START: '1'
+  });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const stats = async () => (await server.request('/admin/stats', { headers: ADMIN })).body.concurrency;
+
+  const initial = await stats();
+  assert.strictEqual(initial.warmupCeiling, 1);
+  assert.strictEqual(initial.limit, 1);
+  assert.match(server.logs, /\[CONCURRENCY\] Warming up from 1 to 4 over 3000ms/);
+
+  // 预热开始时只放行一个任务，第二个排队
+  const submissions = await Promise.all([1, 2].map(n => server.request('/api/generate/async', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: `p${n}`, apiKey: 'key' }
+  })));
+  await wait(200);
+  const during = await stats();
+  assert.strictEqual(during.running, 1);
+  assert.strictEqual(during.queued, 1);
+
+  const ceilings = [initial.warmupCeiling];
+  for (let i = 0; i < 10 && ceilings.at(-1) < 4; i++) {
+    await wait(500);
+    ceilings.push((await stats()).warmupCeiling);
+  }
+  assert.strictEqual(ceilings.at(-1), 4);
+  assert.ok(ceilings.some(ceiling => ceiling > 1 && ceiling < 4), `ceiling passed through intermediate steps: ${ceilings}`);
+  for (let i = 1; i < ceilings.length; i++) assert.ok(ceilings[i] >= ceilings[i - 1]);
+  assert.match(server.logs, /\[CONCURRENCY\] Warmup ceiling \d -> 4/);
+
+  for (const { body } of submissions) await server.waitForTask(body.taskId);
+});
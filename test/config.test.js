@@ -0,0 +1,85 @@
+// config.js：从环境变量对象构造配置，未设置时使用默认值，所有校验错误一次报告；启动日志中的密钥已脱敏
+const test = require('node:test');
+const assert = require('node:assert');
+const { loadConfig, redactConfig, parseList } = require('../config');
+const { startServer, wait } = require('./helpers');
+
+test('defaults when nothing is set', () => {
+  const config = loadConfig({});
+  assert.strictEqual(config.port, 8080);
+  assert.strictEqual(config.healthPath, '/health');
+  assert.strictEqual(config.upstreamAuthMode, 'bearer');
+  assert.strictEqual(config.maxConcurrency, 0);
+  assert.strictEqual(config.maxInflightTasks, 1000);
+  assert.strictEqual(config.resultStore, 'file');
+  assert.deepStrictEqual(config.corsAllowedOrigins, []);
+  assert.strictEqual(config.enableSimpleGet, false);
+  assert.strictEqual(config.retryJitterSeed, null);
+  assert.ok(Object.isFrozen(config));
+});
+
+test('values are read from the env map', () => {
+  const config = loadConfig({
+    PORT: '9000',
+    MAX_CONCURRENCY: '4',
+    CORS_ALLOWED_ORIGINS: ' https://a.example.com , https://b.example.com ,',
+    ENABLE_SIMPLE_GET: 'true',
+    ENABLE_BROTLI: 'yes',
+    LOG_LEVEL: 'DEBUG',
+    MODEL_COST_TABLE: 'sora_image=0.04,gemini-2.5-flash-image-preview=0.02'
+  });
+  assert.strictEqual(config.port, 9000);
+  assert.strictEqual(config.maxConcurrency, 4);
+  assert.deepStrictEqual(config.corsAllowedOrigins, ['https://a.example.com', 'https://b.example.com']);
+  assert.strictEqual(config.enableSimpleGet, true);
+  // 只有 "true" 开启
+  assert.strictEqual(config.enableBrotli, false);
+  assert.strictEqual(config.logLevel, 'debug');
+  assert.deepStrictEqual(config.modelCostTable, { sora_image: 0.04, 'gemini-2.5-flash-image-preview': 0.02 });
+});
+
+test('every validation error is reported at once', () => {
+  assert.throws(() => loadConfig({
+    PORT: 'eighty',
+    MAX_CONCURRENCY: '-1',
+    MEMORY_HIGH_WATER_PERCENT: '150',
+    RESULT_STORE: 'memcached',
+    UPSTREAM_AUTH_MODE: 'basic'
+  }), error => {
+    assert.match(error.message, /^Invalid configuration:/);
+    assert.match(error.message, /PORT must be an integer >= 1, got "eighty"/);
+    assert.match(error.message, /MAX_CONCURRENCY must be an integer >= 0, got "-1"/);
+    assert.match(error.message, /MEMORY_HIGH_WATER_PERCENT must be a number between 0 and 100/);
+    assert.match(error.message, /RESULT_STORE must be one of/);
+    assert.match(error.message, /UPSTREAM_AUTH_MODE must be bearer/);
+    return true;
+  });
+});
+
+test('cross-field checks', () => {
+  assert.throws(() => loadConfig({ MAX_CONCURRENCY: '2', MIN_CONCURRENCY: '3' }), /MIN_CONCURRENCY \(3\) must not exceed MAX_CONCURRENCY \(2\)/);
+  assert.throws(() => loadConfig({ PORT: '8080', HEALTH_PORT: '8080' }), /HEALTH_PORT must differ from PORT/);
+  assert.throws(() => loadConfig({ JWT_JWKS_URL: 'https://auth.example.com/jwks' }), /JWT_AUDIENCE and JWT_ISSUER are required/);
+});
+
+test('secrets are redacted', async t => {
+  const config = loadConfig({ ADMIN_TOKEN: 'admin-secret', CALLBACK_SIGNING_SECRET: 'signing-secret' });
+  const redacted = redactConfig(config);
+  assert.strictEqual(redacted.adminToken, '[redacted]');
+  assert.strictEqual(redacted.callbackSigningSecret, '[redacted]');
+  // 未设置的密钥保持为空，方便看出没有配置
+  assert.strictEqual(redacted.moderationApiKey, '');
+  assert.strictEqual(config.adminToken, 'admin-secret');
+
+  const server = await startServer({ ADMIN_TOKEN: 'admin-secret', CALLBACK_SIGNING_SECRET: 'signing-secret' });
+  t.after(() => server.close());
+  // 配置在监听成功的日志之后输出
+  for (let i = 0; i < 40 && !server.logs.includes('Effective config'); i++) await wait(25);
+  assert.match(server.logs, /Effective config: .*"adminToken":"\[redacted\]"/);
+  assert.doesNotMatch(server.logs, /admin-secret|signing-secret/);
+});
+
+test('parseList', () => {
+  assert.deepStrictEqual(parseList(undefined), []);
+  assert.deepStrictEqual(parseList(' a, ,b ,'), ['a', 'b']);
+});
@@ -0,0 +1,63 @@
+// CONNECT_RETRIES：连接被拒绝等连接阶段的错误按 CONNECT_RETRY_DELAY_MS 直接重连，不消耗请求级重试次数；默认关闭
+const test = require('node:test');
+const assert = require('node:assert');
+const path = require('path');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+const PRELOAD = `--require ${path.join(__dirname, 'flakyConnect.js')}`;
+
+async function startWithFlakyConnect(t, failures, env = {}) {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({
+    UPSTREAM_REGIONS: upstream.url,
+    NODE_OPTIONS: PRELOAD,
+    FLAKY_CONNECT_PORT: new URL(upstream.url).port,
+    FLAKY_CONNECT_FAILURES: String(failures),
+    CONNECT_RETRY_DELAY_MS: '20',
+    ...env
+  });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+  const run = async () => {
+    // maxRetries: 0，请求级没有重试，能成功只可能是连接级重连
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'p', apiKey: 'key', maxRetries: 0 }
+    });
+    return server.waitForTask(body.taskId);
+  };
+  return { upstream, server, run };
+}
+
+test('a refused connection is retried transparently', async t => {
+  const { upstream, server, run } = await startWithFlakyConnect(t, 1, { CONNECT_RETRIES: '2' });
+
+  const result = await run();
+  assert.strictEqual(result.status, 'completed');
+  assert.strictEqual(upstream.generationRequests().length, 1);
+  assert.match(server.logs, /\[FLAKY_CONNECT\] Refusing connection/);
+  assert.match(server.logs, /Connection failed \(ECONNREFUSED\), reconnecting \(1\/2\)/);
+  assert.doesNotMatch(server.logs, /Attempt 2 of/);
+});
+
+test('reconnects are bounded by CONNECT_RETRIES', async t => {
+  const { upstream, server, run } = await startWithFlakyConnect(t, 5, { CONNECT_RETRIES: '2' });
+
+  const result = await run();
+  assert.strictEqual(result.status, 'failed');
+  assert.strictEqual(upstream.generationRequests().length, 0);
+  assert.match(server.logs, /reconnecting \(2\/2\)/);
+  assert.doesNotMatch(server.logs, /reconnecting \(3\/2\)/);
+  assert.strictEqual(server.logs.match(/\[FLAKY_CONNECT\] Refusing connection/g).length, 3);
+});
+
+test('connection retries are off by default', async t => {
+  const { upstream, server, run } = await startWithFlakyConnect(t, 1);
+
+  const result = await run();
+  assert.strictEqual(result.status, 'failed');
+  assert.strictEqual(upstream.generationRequests().length, 0);
+  assert.doesNotMatch(server.logs, /reconnecting/);
+});
@@ -0,0 +1,51 @@
+// contentOrder：sora_image 和 Gemini 的请求内容默认文本在前，image-first 时图片在前
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse } = require('./helpers');
+
+const IMAGE = 'data:image/png;base64,iVBORw0KGgo=';
+
+// Part kinds of the assembled content, in order
+const PART_KINDS = {
+  sora_image: body => body.messages[0].content.map(part => (part.type === 'text' ? 'text' : 'image')),
+  'gemini-2.5-flash-image-preview': body => body.contents[0].parts.map(part => (part.text !== undefined ? 'text' : 'image'))
+};
+
+test('assembled content follows contentOrder', async t => {
+  const upstream = await startUpstream(request => ({
+    body: request.url.includes('generateContent') ? geminiResponse() : soraResponse()
+  }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const cases = [
+    { contentOrder: undefined, expected: ['text', 'image'] },
+    { contentOrder: 'text-first', expected: ['text', 'image'] },
+    { contentOrder: 'image-first', expected: ['image', 'text'] }
+  ];
+  for (const [model, partKinds] of Object.entries(PART_KINDS)) {
+    for (const { contentOrder, expected } of cases) {
+      await t.test(`${model} ${contentOrder || 'default'}`, async () => {
+        const { status } = await server.request('/api/generate', {
+          method: 'POST',
+          body: { model, prompt: 'describe this', apiKey: 'key', imageUrl: IMAGE, contentOrder }
+        });
+        assert.strictEqual(status, 200);
+        const sent = JSON.parse(upstream.generationRequests().at(-1).body);
+        assert.deepStrictEqual(partKinds(sent), expected);
+      });
+    }
+  }
+
+  await t.test('unknown orders are rejected', async () => {
+    const { status, body } = await server.request('/api/generate', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'p', apiKey: 'key', imageUrl: IMAGE, contentOrder: 'random' }
+    });
+    assert.strictEqual(status, 400);
+    assert.ok(body.fields.some(field => field.field === 'contentOrder'));
+  });
+});
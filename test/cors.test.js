@@ -0,0 +1,62 @@
+// CORS：CORS_ALLOWED_ORIGINS 限制允许的来源，未配置时保持原来的允许所有来源；OPTIONS 预检返回配置的方法和请求头
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer } = require('./helpers');
+
+const preflight = (server, origin) => server.request('/api/generate', {
+  method: 'OPTIONS',
+  headers: { origin, 'access-control-request-method': 'POST', 'access-control-request-headers': 'content-type' }
+});
+
+test('only the configured origins are allowed', async t => {
+  const server = await startServer({
+    CORS_ALLOWED_ORIGINS: 'https://app.example.com,https://admin.example.com',
+    CORS_ALLOWED_METHODS: 'GET,POST',
+    CORS_ALLOWED_HEADERS: 'Content-Type,Authorization'
+  });
+  t.after(() => server.close());
+
+  await t.test('allowed origin', async () => {
+    const { status, headers } = await server.request('/health', { headers: { origin: 'https://app.example.com' } });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(headers.get('access-control-allow-origin'), 'https://app.example.com');
+    assert.match(headers.get('vary'), /Origin/);
+    assert.match(headers.get('access-control-expose-headers'), /X-Request-Id/);
+  });
+
+  await t.test('disallowed origin', async () => {
+    const { status, headers } = await server.request('/health', { headers: { origin: 'https://evil.example.com' } });
+    // 请求本身照常处理，只是浏览器拿不到允许头，无法读取响应
+    assert.strictEqual(status, 200);
+    assert.strictEqual(headers.get('access-control-allow-origin'), null);
+  });
+
+  await t.test('preflight', async () => {
+    const { status, headers } = await preflight(server, 'https://admin.example.com');
+    assert.strictEqual(status, 204);
+    assert.strictEqual(headers.get('access-control-allow-origin'), 'https://admin.example.com');
+    assert.strictEqual(headers.get('access-control-allow-methods'), 'GET,POST');
+    assert.strictEqual(headers.get('access-control-allow-headers'), 'Content-Type,Authorization');
+
+    const denied = await preflight(server, 'https://evil.example.com');
+    assert.strictEqual(denied.headers.get('access-control-allow-origin'), null);
+  });
+});
+
+test('all origins are allowed when unset', async t => {
+  const server = await startServer();
+  t.after(() => server.close());
+
+  const { headers } = await server.request('/health', { headers: { origin: 'https://anywhere.example.com' } });
+  assert.strictEqual(headers.get('access-control-allow-origin'), '*');
+  const { status } = await preflight(server, 'https://anywhere.example.com');
+  assert.strictEqual(status, 204);
+});
+
+test('a wildcard entry allows any origin', async t => {
+  const server = await startServer({ CORS_ALLOWED_ORIGINS: 'https://app.example.com,*' });
+  t.after(() => server.close());
+
+  const { headers } = await server.request('/health', { headers: { origin: 'https://other.example.com' } });
+  assert.strictEqual(headers.get('access-control-allow-origin'), '*');
+});
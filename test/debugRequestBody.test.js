@@ -0,0 +1,51 @@
+// ?debug=true 时保存发给上游的请求体：key 类字段脱敏，base64 图片数据只保留长度
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse } = require('./helpers');
+
+const API_KEY = 'secret-upstream-key';
+const IMAGE_BASE64 = 'iVBORw0KGgo'.repeat(100);
+
+test('debug tasks store the redacted upstream request body', async t => {
+  const upstream = await startUpstream(request => ({
+    body: request.url.includes('generateContent') ? geminiResponse() : soraResponse()
+  }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ADMIN_TOKEN: 'admin-token' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+  const admin = { authorization: 'Bearer admin-token' };
+
+  for (const model of ['sora_image', 'gemini-2.5-flash-image-preview']) {
+    await t.test(model, async () => {
+      const { body: submitted } = await server.request('/api/generate/async?debug=true', {
+        method: 'POST',
+        body: { model, prompt: 'a cat', apiKey: API_KEY, imageUrl: `data:image/png;base64,${IMAGE_BASE64}` }
+      });
+      await server.waitForTask(submitted.taskId);
+
+      const { status, body: stored } = await server.request(`/api/raw/${submitted.taskId}/request`, { headers: admin });
+      assert.strictEqual(status, 200);
+      const text = JSON.stringify(stored);
+      assert.ok(text.includes('a cat'), 'prompt is kept');
+      assert.ok(!text.includes(API_KEY), 'apiKey is not stored');
+      assert.ok(!text.includes(IMAGE_BASE64), 'image data is not stored');
+      assert.match(text, new RegExp(`\\[(base64, )?${IMAGE_BASE64.length} chars\\]`));
+
+      // 上游实际收到的请求体带着完整图片
+      const sent = upstream.generationRequests().at(-1);
+      assert.ok(sent.body.includes(IMAGE_BASE64));
+    });
+  }
+
+  await t.test('tasks without debug store no request body', async () => {
+    const { body: submitted } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'a dog', apiKey: API_KEY }
+    });
+    await server.waitForTask(submitted.taskId);
+    const { status } = await server.request(`/api/raw/${submitted.taskId}/request`, { headers: admin });
+    assert.strictEqual(status, 404);
+  });
+});
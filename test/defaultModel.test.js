@@ -0,0 +1,50 @@
+// DEFAULT_MODEL：请求没有 model 时使用默认模型并记录到结果中；未配置时仍然返回校验错误
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse } = require('./helpers');
+
+test('an omitted model falls back to DEFAULT_MODEL', async t => {
+  const upstream = await startUpstream(request => ({
+    body: request.url.includes('generateContent') ? geminiResponse() : soraResponse()
+  }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, DEFAULT_MODEL: 'gemini-2.5-flash-image-preview' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const { status, body } = await server.request('/api/generate/async', { method: 'POST', body: { prompt: 'p', apiKey: 'key' } });
+  assert.strictEqual(status, 200);
+  const result = await server.waitForTask(body.taskId);
+  assert.strictEqual(result.status, 'completed');
+  assert.strictEqual(result.model, 'gemini-2.5-flash-image-preview');
+  assert.ok(upstream.generationRequests()[0].url.includes('generateContent'));
+
+  const sync = await server.request('/api/generate', { method: 'POST', body: { prompt: 'p', apiKey: 'key' } });
+  assert.strictEqual(sync.status, 200);
+  assert.strictEqual(sync.body.model, 'gemini-2.5-flash-image-preview');
+  assert.strictEqual(sync.headers.get('x-model'), 'gemini-2.5-flash-image-preview');
+
+  // 显式指定的 model 优先
+  const explicit = await server.request('/api/generate', { method: 'POST', body: { model: 'sora_image', prompt: 'p', apiKey: 'key' } });
+  assert.strictEqual(explicit.body.model, 'sora_image');
+
+  assert.strictEqual((await server.request('/api/config')).body.defaultModel, 'gemini-2.5-flash-image-preview');
+});
+
+test('an omitted model is rejected without DEFAULT_MODEL', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  for (const pathname of ['/api/generate', '/api/generate/async']) {
+    const { status, body } = await server.request(pathname, { method: 'POST', body: { prompt: 'p', apiKey: 'key' } });
+    assert.strictEqual(status, 400, pathname);
+    assert.strictEqual(body.errorCode, 'INVALID_REQUEST', pathname);
+    assert.ok(body.fields.some(field => field.field === 'model'), pathname);
+  }
+  assert.strictEqual(upstream.generationRequests().length, 0);
+});
@@ -0,0 +1,54 @@
+// DNS 解析失败：按 DNS_RETRY_DELAY_MS 的短间隔重试，不走指数退避，并单独记录 [DNS] 日志
+const test = require('node:test');
+const assert = require('node:assert');
+const path = require('path');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+const PRELOAD = `--require ${path.join(__dirname, 'flakyDns.js')}`;
+
+async function startWithFlakyDns(t, failures, env = {}) {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const port = new URL(upstream.url).port;
+  const server = await startServer({
+    UPSTREAM_REGIONS: `http://flaky.upstream.test:${port}`,
+    NODE_OPTIONS: PRELOAD,
+    FLAKY_DNS_HOST: 'flaky.upstream.test',
+    FLAKY_DNS_FAILURES: String(failures),
+    DNS_RETRY_DELAY_MS: '100',
+    ...env
+  });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+  return { upstream, server };
+}
+
+const generate = (server, fields = {}) => server.request('/api/generate', {
+  method: 'POST',
+  body: { model: 'sora_image', prompt: 'p', apiKey: 'key', ...fields }
+});
+
+test('a DNS failure is retried after the short DNS delay', async t => {
+  const { upstream, server } = await startWithFlakyDns(t, 1);
+
+  const started = Date.now();
+  const { status, headers } = await generate(server);
+  assert.strictEqual(status, 200);
+  assert.strictEqual(headers.get('x-attempts'), '2');
+  // 普通退避至少 1 秒
+  assert.ok(Date.now() - started < 1000, `took ${Date.now() - started}ms`);
+  assert.strictEqual(upstream.generationRequests().length, 1);
+  assert.match(server.logs, /\[FLAKY_DNS\] Failing lookup of flaky\.upstream\.test/);
+  assert.match(server.logs, /\[DNS\] Failed to resolve flaky\.upstream\.test \(ENOTFOUND\) on attempt 1/);
+  assert.match(server.logs, /Waiting 100ms before retry/);
+});
+
+test('repeated DNS failures use up the attempts', async t => {
+  const { upstream, server } = await startWithFlakyDns(t, 5);
+
+  const { status, body } = await generate(server, { maxRetries: 1 });
+  assert.notStrictEqual(status, 200);
+  assert.match(body.error, /DNS resolution failed for flaky\.upstream\.test: ENOTFOUND/);
+  assert.strictEqual(upstream.generationRequests().length, 0);
+});
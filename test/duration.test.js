@@ -0,0 +1,46 @@
+// durationMs：同步响应、任务状态和回调都带上服务端从开始到完成的耗时
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+const DELAY_MS = 400;
+
+test('the generation duration is reported', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse(), delayMs: DELAY_MS }));
+  const receiver = await startUpstream(() => ({ body: { received: true } }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ALLOW_PRIVATE_CALLBACKS: 'true' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+    await receiver.close();
+  });
+
+  // 至少包含上游的延迟，又不会多出太多
+  const assertRoughlyDelay = durationMs => {
+    assert.strictEqual(typeof durationMs, 'number');
+    assert.ok(durationMs >= DELAY_MS - 20, `durationMs ${durationMs}`);
+    assert.ok(durationMs < DELAY_MS + 1500, `durationMs ${durationMs}`);
+  };
+
+  await t.test('sync responses', async () => {
+    const { status, body, headers } = await server.request('/api/generate', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'sync', apiKey: 'key' }
+    });
+    assert.strictEqual(status, 200);
+    assertRoughlyDelay(body.durationMs);
+    assert.strictEqual(headers.get('x-duration-ms'), String(body.durationMs));
+  });
+
+  await t.test('task status and callbacks', async () => {
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'async', apiKey: 'key', callbackUrl: `${receiver.url}/hook` }
+    });
+    const result = await server.waitForTask(body.taskId);
+    assertRoughlyDelay(result.durationMs);
+
+    for (let i = 0; i < 40 && receiver.requests.length === 0; i++) await wait(50);
+    assert.strictEqual(JSON.parse(receiver.requests[0].body).durationMs, result.durationMs);
+  });
+});
@@ -0,0 +1,66 @@
+// ?echoRequest=true：响应中附上解析后的请求（默认值已填入、apiKey 脱敏、实际发给上游的提示词），任务照常执行；不带参数时不返回
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse } = require('./helpers');
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+const IMAGE = 'data:image/png;base64,iVBORw0KGgo=';
+
+test('the normalized request is echoed back', async t => {
+  const upstream = await startUpstream(request => ({ body: request.url.includes('generateContent') ? geminiResponse() : soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, TASK_TIMEOUT_MS: '600000' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  await t.test('async with defaults applied', async () => {
+    const { status, body } = await server.request('/api/generate/async?echoRequest=true', {
+      method: 'POST',
+      headers: { 'x-task-deadline': '30' },
+      body: { model: GEMINI, prompt: '  a red fox  ', negativePrompt: ' blurry ', imageUrl: IMAGE, imageDimensions: { width: 1024, height: 1024 }, apiKey: 'secret-key' }
+    });
+    assert.strictEqual(status, 200);
+    const { request } = body;
+    assert.strictEqual(request.taskId, body.taskId);
+    assert.strictEqual(request.model, GEMINI);
+    assert.deepStrictEqual(request.fallbackModels, []);
+    assert.strictEqual(request.prompt, '  a red fox  ');
+    assert.strictEqual(request.effectivePrompt, 'a red fox [1:1]\nAvoid: blurry');
+    assert.strictEqual(request.negativePrompt, 'blurry');
+    assert.deepStrictEqual(request.imageUrls, [IMAGE]);
+    assert.strictEqual(request.imageSize, '[1:1]');
+    assert.strictEqual(request.contentOrder, 'text-first');
+    assert.strictEqual(request.convertOutput, false);
+    assert.strictEqual(request.attempts, 3);
+    assert.ok(request.timeoutMs > 25000 && request.timeoutMs <= 30000, `timeoutMs ${request.timeoutMs}`);
+    assert.strictEqual(request.apiKey, '[redacted]');
+    assert.doesNotMatch(JSON.stringify(body), /secret-key/);
+
+    // 任务照常执行，上游收到的就是回显的提示词
+    assert.strictEqual((await server.waitForTask(body.taskId)).status, 'completed');
+    const sent = JSON.parse(upstream.generationRequests().at(-1).body);
+    assert.ok(sent.contents[0].parts.some(part => part.text === request.effectivePrompt));
+  });
+
+  await t.test('sync with explicit options', async () => {
+    const { status, body } = await server.request('/api/generate?echoRequest=true', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'a fox', negativePrompt: 'blurry', apiKey: 'secret-key', maxRetries: 0, contentOrder: 'image-first' }
+    });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.success, true);
+    // sora_image 的反向提示词单独传递，不拼进提示词
+    assert.strictEqual(body.request.effectivePrompt, 'a fox');
+    assert.strictEqual(body.request.attempts, 1);
+    assert.strictEqual(body.request.contentOrder, 'image-first');
+    assert.strictEqual(body.request.timeoutMs, 600000);
+    assert.strictEqual(body.request.apiKey, '[redacted]');
+  });
+
+  await t.test('not echoed without the flag', async () => {
+    const { body } = await server.request('/api/generate/async', { method: 'POST', body: { model: 'sora_image', prompt: 'no echo', apiKey: 'key' } });
+    assert.strictEqual(body.request, undefined);
+    await server.waitForTask(body.taskId);
+  });
+});
@@ -0,0 +1,62 @@
+// 空提示词：去掉空白后为空时返回 400；只有支持纯图片编辑的模型（sora_image）在带图片时允许空提示词
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse } = require('./helpers');
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+const PNG = `data:image/png;base64,${Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]).toString('base64')}`;
+
+test('empty prompts per model', async t => {
+  const upstream = await startUpstream(request => ({
+    body: request.url.includes('generateContent') ? geminiResponse('aW1n') : soraResponse()
+  }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const generate = fields => server.request('/api/generate', { method: 'POST', body: { apiKey: 'key', ...fields } });
+  const promptError = body => body.fields.find(item => item.field === 'prompt').message;
+
+  await t.test('rejected without images', async () => {
+    for (const model of ['sora_image', GEMINI]) {
+      for (const prompt of [undefined, '', '   \n\t']) {
+        const { status, body } = await generate({ model, prompt });
+        assert.strictEqual(status, 400, `${model} ${JSON.stringify(prompt)}`);
+        assert.strictEqual(body.errorCode, 'INVALID_REQUEST');
+      }
+    }
+    assert.strictEqual(promptError((await generate({ model: 'sora_image', prompt: ' ' })).body), 'prompt must not be empty unless input images are provided');
+    assert.strictEqual(promptError((await generate({ model: GEMINI, prompt: ' ' })).body), `prompt must not be empty for model ${GEMINI}`);
+    assert.strictEqual(upstream.generationRequests().length, 0);
+  });
+
+  await t.test('sora_image accepts images without a prompt', async () => {
+    const { status, body } = await generate({ model: 'sora_image', prompt: '  ', imageUrl: PNG });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.imageUrl, 'https://cdn.example.com/result.png');
+
+    const sent = JSON.parse(upstream.generationRequests().at(-1).body).messages[0].content;
+    const text = sent.filter(part => part.type === 'text');
+    assert.ok(text.every(part => part.text === part.text.trim()), 'no leading space before the size');
+  });
+
+  await t.test('other models still need a prompt with images', async () => {
+    const { status, body } = await generate({ model: GEMINI, prompt: '', imageUrl: PNG });
+    assert.strictEqual(status, 400);
+    assert.strictEqual(promptError(body), `prompt must not be empty for model ${GEMINI}`);
+  });
+
+  await t.test('every fallback model needs a usable prompt', async () => {
+    const { status, body } = await generate({ model: 'sora_image', fallbackModels: [GEMINI], imageUrl: PNG });
+    assert.strictEqual(status, 400);
+    assert.strictEqual(promptError(body), `prompt must not be empty for model ${GEMINI}`);
+  });
+
+  await t.test('type errors', async () => {
+    const { status, body } = await generate({ model: 'sora_image', prompt: 42 });
+    assert.strictEqual(status, 400);
+    assert.strictEqual(promptError(body), 'prompt must be a string');
+  });
+});
@@ -0,0 +1,85 @@
+// 提示词扩写（enhancePrompt: true）：生成前调用 PROMPT_ENHANCER_URL 扩写提示词，结果记录原始和扩写后的提示词；扩写和生成共用任务超时
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+const EXPANDED = 'A fluffy orange cat sitting on a sunlit windowsill, soft morning light, photorealistic';
+
+test('prompts are expanded before generation', async t => {
+  const upstream = await startUpstream(request => ({ body: soraResponse(), delayMs: request.body.includes('slow') ? 1000 : 0 }));
+  const enhancer = await startUpstream(request => {
+    const prompt = JSON.parse(request.body).messages[1].content;
+    if (prompt.includes('broken')) return { status: 500, body: { error: 'down' } };
+    return {
+      body: { choices: [{ message: { content: `  ${prompt.includes('slow') ? `slow ${EXPANDED}` : EXPANDED}\n` } }] },
+      delayMs: prompt.includes('slow') ? 1000 : 0
+    };
+  });
+  const server = await startServer({
+    UPSTREAM_REGIONS: upstream.url,
+    PROMPT_ENHANCER_URL: `${enhancer.url}/v1/chat/completions`,
+    PROMPT_ENHANCER_MODEL: 'enhancer-mini',
+    TASK_TIMEOUT_MS: '1500'
+  });
+  t.after(async () => {
+    await server.close();
+    await Promise.all([upstream.close(), enhancer.close()]);
+  });
+
+  const run = async (prompt, enhancePrompt = true) => {
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt, apiKey: 'user-key', enhancePrompt, maxRetries: 0 }
+    });
+    return server.waitForTask(body.taskId);
+  };
+  const lastPrompt = () => JSON.parse(upstream.generationRequests().at(-1).body).messages[0].content;
+
+  await t.test('the enhanced prompt is used and recorded', async () => {
+    const result = await run('a cat');
+    assert.strictEqual(result.status, 'completed');
+    assert.strictEqual(result.prompt, 'a cat');
+    assert.strictEqual(result.enhancedPrompt, EXPANDED);
+    assert.strictEqual(lastPrompt(), EXPANDED);
+
+    const request = enhancer.requests.at(-1);
+    assert.strictEqual(request.headers.authorization, 'Bearer user-key');
+    const sent = JSON.parse(request.body);
+    assert.strictEqual(sent.model, 'enhancer-mini');
+    assert.strictEqual(sent.messages[0].role, 'system');
+    assert.deepStrictEqual(sent.messages[1], { role: 'user', content: 'a cat' });
+  });
+
+  await t.test('sync requests', async () => {
+    const { body } = await server.request('/api/generate', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'a sync cat', apiKey: 'user-key', enhancePrompt: true }
+    });
+    assert.strictEqual(body.enhancedPrompt, EXPANDED);
+  });
+
+  await t.test('enhancer failures fall back to the original prompt', async () => {
+    const result = await run('a broken cat');
+    assert.strictEqual(result.status, 'completed');
+    assert.strictEqual(result.enhancedPrompt, undefined);
+    assert.strictEqual(lastPrompt(), 'a broken cat');
+    assert.match(server.logs, /Prompt enhancement failed, using original prompt: status 500/);
+  });
+
+  await t.test('off by default', async () => {
+    const calls = enhancer.requests.length;
+    const result = await run('a plain cat', false);
+    assert.strictEqual(result.enhancedPrompt, undefined);
+    assert.strictEqual(lastPrompt(), 'a plain cat');
+    assert.strictEqual(enhancer.requests.length, calls);
+  });
+
+  await t.test('both calls share the task timeout', async () => {
+    // 扩写 1 秒 + 生成 1 秒，超过 1.5 秒的任务超时
+    const startedAt = Date.now();
+    const result = await run('a slow cat');
+    assert.strictEqual(result.status, 'failed');
+    assert.strictEqual(result.errorCode, 'TIMEOUT');
+    assert.ok(Date.now() - startedAt < 3000);
+  });
+});
@@ -0,0 +1,44 @@
+// 过长的上游错误（如整页 HTML）在存储的结果和回调中截断到 MAX_ERROR_LENGTH，完整内容只在 debug 日志中出现
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, wait } = require('./helpers');
+
+const HUGE_ERROR = `<html><body>${'upstream exploded '.repeat(1000)}</body></html>`;
+const TRUNCATION_MARKER = /\.\.\. \[truncated \d+ chars\]$/;
+
+async function runFailingTask(env) {
+  const upstream = await startUpstream(() => ({ status: 400, headers: { 'content-type': 'text/html' }, body: HUGE_ERROR }));
+  const receiver = await startUpstream(() => ({ body: { received: true } }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ALLOW_PRIVATE_CALLBACKS: 'true', ...env });
+  try {
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'p', apiKey: 'key', callbackUrl: `${receiver.url}/hook` }
+    });
+    const result = await server.waitForTask(body.taskId);
+    for (let i = 0; i < 40 && receiver.requests.length === 0; i++) await wait(50);
+    return { result, callback: JSON.parse(receiver.requests[0].body), logs: server.logs };
+  } finally {
+    await server.close();
+    await upstream.close();
+    await receiver.close();
+  }
+}
+
+test('oversized errors are truncated in the stored result and the callback', async () => {
+  const { result, callback, logs } = await runFailingTask({ MAX_ERROR_LENGTH: '500' });
+  assert.strictEqual(result.status, 'failed');
+  for (const error of [result.error, callback.error]) {
+    assert.match(error, TRUNCATION_MARKER);
+    assert.strictEqual(error.replace(TRUNCATION_MARKER, '').length, 500);
+  }
+  assert.strictEqual(callback.error, result.error);
+  assert.ok(!logs.includes(HUGE_ERROR));
+});
+
+test('the full error is kept at debug log level', async () => {
+  const { result, logs } = await runFailingTask({ LOG_LEVEL: 'debug' });
+  assert.match(result.error, TRUNCATION_MARKER);
+  assert.ok(result.error.length < 2048 + 50);
+  assert.ok(logs.includes(HUGE_ERROR));
+});
@@ -0,0 +1,55 @@
+// POST /api/generate/estimate：按模型最近的上游耗时 EMA（没有样本时用默认值）和 MODEL_COST_TABLE 预估，不调用上游
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse } = require('./helpers');
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+const UPSTREAM_MS = 500;
+
+test('estimates reflect recorded per-model latencies', async t => {
+  const upstream = await startUpstream(request => (request.url.includes('generateContent')
+    ? { body: geminiResponse() }
+    : { body: soraResponse(), delayMs: UPSTREAM_MS }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, MODEL_COST_TABLE: `sora_image=2.5,${GEMINI}=1` });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const estimate = fields => server.request('/api/generate/estimate', { method: 'POST', body: { prompt: 'p', ...fields } });
+
+  await t.test('defaults before any samples', async () => {
+    const sora = (await estimate({ model: 'sora_image' })).body;
+    assert.deepStrictEqual(sora, { model: 'sora_image', estimatedSeconds: 60, estimatedRelativeCost: 2.5, latencySamples: 0 });
+    assert.strictEqual((await estimate({ model: GEMINI })).body.estimatedSeconds, 20);
+    const unknown = (await estimate({ model: 'claude-image-preview' })).body;
+    assert.strictEqual(unknown.estimatedSeconds, 30);
+    assert.strictEqual(unknown.estimatedRelativeCost, 1, 'models missing from the cost table cost 1');
+    assert.strictEqual(upstream.generationRequests().length, 0, 'no upstream call');
+  });
+
+  await t.test('input images add time and cost', async () => {
+    const { body } = await estimate({ model: 'sora_image', imageUrls: ['https://example.com/a.png', 'https://example.com/b.png'] });
+    assert.strictEqual(body.estimatedSeconds, 64);
+    assert.strictEqual(body.estimatedRelativeCost, 3);
+  });
+
+  await t.test('recorded latencies', async () => {
+    for (let i = 0; i < 2; i++) {
+      assert.strictEqual((await server.request('/api/generate', { method: 'POST', body: { model: 'sora_image', prompt: `p${i}`, apiKey: 'key' } })).status, 200);
+    }
+    const { body } = await estimate({ model: 'sora_image' });
+    assert.strictEqual(body.latencySamples, 2);
+    assert.ok(body.estimatedSeconds >= UPSTREAM_MS / 1000 && body.estimatedSeconds < 2, `estimate ${body.estimatedSeconds}s`);
+
+    const gemini = (await estimate({ model: GEMINI })).body;
+    assert.strictEqual(gemini.latencySamples, 0, 'tracked per model');
+    assert.strictEqual(gemini.estimatedSeconds, 20);
+  });
+
+  await t.test('invalid requests', async () => {
+    const { status, body } = await estimate({ model: 'sora_image', prompt: ' ' });
+    assert.strictEqual(status, 400);
+    assert.strictEqual(body.errorCode, 'INVALID_REQUEST');
+  });
+});
@@ -0,0 +1,54 @@
+// failFast 批次：一个子任务失败时取消同一 parentTaskId 下其余进行中的子任务，并记录触发取消的失败任务
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+test('a failed failFast batch item cancels the remaining items', async t => {
+  const upstream = await startUpstream(request => {
+    if (request.body.includes('item-2')) {
+      return { status: 400, body: { error: 'bad prompt' } };
+    }
+    return { body: soraResponse(), delayMs: 3000 };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const taskIds = [];
+  for (const item of [1, 2, 3, 4]) {
+    const { status, body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: `item-${item}`, apiKey: 'key', taskId: `batch-1-item-${item}`, parentTaskId: 'batch-1', failFast: true, maxRetries: 1 }
+    });
+    assert.strictEqual(status, 200);
+    taskIds.push(body.taskId);
+  }
+
+  const startedAt = Date.now();
+  const results = await Promise.all(taskIds.map(taskId => server.waitForTask(taskId)));
+  assert.ok(Date.now() - startedAt < 2500, 'remaining items did not wait for the slow upstream');
+
+  assert.strictEqual(results[1].status, 'failed');
+  for (const index of [0, 2, 3]) {
+    assert.strictEqual(results[index].status, 'cancelled', taskIds[index]);
+    assert.strictEqual(results[index].cancelledBy.taskId, 'batch-1-item-2');
+    assert.match(results[index].error, /batch task batch-1-item-2 failed/);
+  }
+
+  const { body: parent } = await server.request('/api/status/parent/batch-1');
+  assert.deepStrictEqual(parent.counts, { cancelled: 3, failed: 1 });
+});
+
+test('failFast requires a parentTaskId', async t => {
+  const server = await startServer();
+  t.after(() => server.close());
+
+  const { status, body } = await server.request('/api/generate/async', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: 'p', apiKey: 'key', failFast: true }
+  });
+  assert.strictEqual(status, 400);
+  assert.ok(body.fields.some(field => field.field === 'failFast'));
+});
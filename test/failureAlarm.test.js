@@ -0,0 +1,48 @@
+// 失败率告警：最近 FAILURE_ALARM_WINDOW 次生成的失败比例超过阈值时 /health 报告 degraded、/readyz 返回 503，比例回落后清除
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+test('a burst of failures trips the alarm and recoveries clear it', async t => {
+  const upstream = await startUpstream(request => (request.body.includes('fail')
+    ? { status: 400, body: { error: 'bad request' } }
+    : { body: soraResponse() }));
+  const server = await startServer({
+    UPSTREAM_REGIONS: upstream.url,
+    FAILURE_ALARM_WINDOW: '4',
+    FAILURE_ALARM_MIN_SAMPLES: '4',
+    FAILURE_ALARM_THRESHOLD_PERCENT: '50'
+  });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  let count = 0;
+  const generate = outcome => server.request('/api/generate', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: `${outcome} ${count++}`, apiKey: 'key', maxRetries: 0 }
+  });
+  const state = async () => {
+    const health = await server.request('/health');
+    const ready = await server.request('/readyz');
+    return { status: health.body.status, degraded: health.body.degraded, ready: ready.status };
+  };
+  const healthy = { status: 'healthy', degraded: false, ready: 200 };
+
+  for (let i = 0; i < 3; i++) await generate('fail');
+  assert.deepStrictEqual(await state(), healthy, 'not enough samples yet');
+
+  await generate('ok');
+  assert.deepStrictEqual(await state(), { status: 'degraded', degraded: true, ready: 503 }, '3 of 4 failed');
+  assert.match(server.logs, /\[ALARM\] Failure ratio 75\.0% over last 4 generations exceeds 50%, marking service degraded/);
+  assert.deepStrictEqual((await server.request('/readyz')).body, { ready: false, reason: 'failure ratio above threshold' });
+
+  // 窗口滑动后失败比例回到 50%，不再超过阈值
+  await generate('ok');
+  assert.deepStrictEqual(await state(), healthy);
+  assert.match(server.logs, /\[ALARM\] Failure ratio recovered to 50\.0%, clearing degraded flag/);
+
+  for (let i = 0; i < 3; i++) await generate('fail');
+  assert.strictEqual((await state()).degraded, true, 'the alarm trips again');
+});
@@ -0,0 +1,11 @@
+// 通过 --require 预加载到 server.js 进程：每收到一次 SIGUSR2，Date.now() 前进 FAKE_CLOCK_STEP_MS 毫秒，用于测试按时间滚动的统计
+const step = Number(process.env.FAKE_CLOCK_STEP_MS || 1000);
+const originalNow = Date.now;
+let offset = 0;
+
+Date.now = () => originalNow() + offset;
+
+process.on('SIGUSR2', () => {
+  offset += step;
+  console.log(`[FAKE_CLOCK] Advanced to +${offset}ms`);
+});
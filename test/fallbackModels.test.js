@@ -0,0 +1,82 @@
+// 备用模型链：主模型重试后仍失败时按 fallbackModels 顺序尝试，结果记录实际生成的模型；整个链共用 TASK_TIMEOUT_MS
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, geminiResponse } = require('./helpers');
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+
+test('a failing primary model falls back to the next model', async t => {
+  const upstream = await startUpstream(request => (request.url.includes('generateContent')
+    ? { body: geminiResponse() }
+    : { status: 500, body: { error: 'sora is down' } }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const { body } = await server.request('/api/generate/async', {
+    method: 'POST',
+    body: { model: 'sora_image', fallbackModels: [GEMINI], prompt: 'p', apiKey: 'key', maxRetries: 1 }
+  });
+  const result = await server.waitForTask(body.taskId);
+  assert.strictEqual(result.status, 'completed');
+  assert.strictEqual(result.model, GEMINI);
+
+  // 主模型用完重试后才切换
+  const calls = upstream.generationRequests().map(request => (request.url.includes('generateContent') ? 'gemini' : 'sora'));
+  assert.deepStrictEqual(calls, ['sora', 'sora', 'gemini']);
+});
+
+test('the last error is reported when every model fails', async t => {
+  const upstream = await startUpstream(request => ({
+    status: 400,
+    body: { error: request.url.includes('generateContent') ? 'gemini rejected the prompt' : 'sora rejected the prompt' }
+  }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const { status, body } = await server.request('/api/generate', {
+    method: 'POST',
+    body: { model: 'sora_image', fallbackModels: [GEMINI], prompt: 'p', apiKey: 'key', maxRetries: 0 }
+  });
+  assert.notStrictEqual(status, 200);
+  assert.strictEqual(upstream.generationRequests().length, 2);
+  assert.match(body.error, /gemini rejected the prompt/);
+});
+
+test('the chain shares one task timeout', async t => {
+  const upstream = await startUpstream(request => (request.url.includes('generateContent')
+    ? { body: geminiResponse() }
+    : { status: 500, body: { error: 'slow failure' }, delayMs: 1200 }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, TASK_TIMEOUT_MS: '1000' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const { body } = await server.request('/api/generate/async', {
+    method: 'POST',
+    body: { model: 'sora_image', fallbackModels: [GEMINI], prompt: 'p', apiKey: 'key', maxRetries: 0 }
+  });
+  const result = await server.waitForTask(body.taskId);
+  assert.strictEqual(result.status, 'failed');
+  assert.ok(!upstream.generationRequests().some(request => request.url.includes('generateContent')), 'fallback not started after the timeout');
+});
+
+test('fallback models are validated', async t => {
+  const server = await startServer();
+  t.after(() => server.close());
+
+  for (const fallbackModels of ['flux', [''], [42]]) {
+    const { status, body } = await server.request('/api/generate', {
+      method: 'POST',
+      body: { model: 'sora_image', fallbackModels, prompt: 'p', apiKey: 'key' }
+    });
+    assert.strictEqual(status, 400, JSON.stringify(fallbackModels));
+    assert.ok(body.fields.some(field => field.field === 'fallbackModels'));
+  }
+});
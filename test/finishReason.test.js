@@ -0,0 +1,60 @@
+// finishReason：对话补全格式的 finish_reason 记录在结果中；content_filter 时即使带了图片 URL 也按 CONTENT_REJECTED 失败
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream } = require('./helpers');
+
+const chat = (content, finishReason) => ({ choices: [{ message: { content }, finish_reason: finishReason }] });
+
+test('finish reasons are surfaced', async t => {
+  const upstream = await startUpstream(request => {
+    const prompt = JSON.parse(request.body).messages[0].content;
+    if (prompt.startsWith('filtered partial')) return { body: chat('![image](https://cdn.example.com/partial.png)', 'content_filter') };
+    if (prompt.startsWith('filtered')) return { body: chat('I cannot help with that.', 'content_filter') };
+    if (prompt.startsWith('truncated')) return { body: chat('![image](https://cdn.example.com/long.png)', 'length') };
+    return { body: chat('![image](https://cdn.example.com/ok.png)', 'stop') };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const runAsync = async prompt => {
+    const { body } = await server.request('/api/generate/async', { method: 'POST', body: { model: 'sora_image', prompt, apiKey: 'key' } });
+    return server.waitForTask(body.taskId);
+  };
+  const runSync = prompt => server.request('/api/generate', { method: 'POST', body: { model: 'sora_image', prompt: `${prompt} sync`, apiKey: 'key' } });
+
+  await t.test('stop', async () => {
+    const result = await runAsync('ok');
+    assert.strictEqual(result.status, 'completed');
+    assert.strictEqual(result.finishReason, 'stop');
+    assert.strictEqual(result.imageUrl, 'https://cdn.example.com/ok.png');
+
+    const { status, body } = await runSync('ok');
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.finishReason, 'stop');
+  });
+
+  await t.test('other finish reasons are passed through', async () => {
+    const result = await runAsync('truncated');
+    assert.strictEqual(result.status, 'completed');
+    assert.strictEqual(result.finishReason, 'length');
+  });
+
+  await t.test('content_filter', async () => {
+    for (const prompt of ['filtered', 'filtered partial']) {
+      const result = await runAsync(prompt);
+      assert.strictEqual(result.status, 'failed', prompt);
+      assert.strictEqual(result.errorCode, 'CONTENT_REJECTED');
+      assert.strictEqual(result.error, 'Content rejected by upstream content filter');
+      assert.strictEqual(result.finishReason, 'content_filter');
+      assert.strictEqual(result.imageUrl, undefined, 'a partial URL is discarded');
+
+      const { status, body } = await runSync(prompt);
+      assert.strictEqual(status, 422);
+      assert.strictEqual(body.errorCode, 'CONTENT_REJECTED');
+      assert.strictEqual(body.finishReason, 'content_filter');
+    }
+  });
+});
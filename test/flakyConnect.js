@@ -0,0 +1,21 @@
+// 通过 --require 预加载到 server.js 进程：连到 FLAKY_CONNECT_PORT 的前 FLAKY_CONNECT_FAILURES 次连接改连没有监听的端口，得到真实的 ECONNREFUSED
+const net = require('net');
+
+const port = Number(process.env.FLAKY_CONNECT_PORT);
+let failuresLeft = Number(process.env.FLAKY_CONNECT_FAILURES || 1);
+// 端口 1 在本机上没有服务监听，连接会被直接拒绝
+const REFUSED_PORT = 1;
+const originalConnect = net.connect;
+
+function connect(...args) {
+  const options = args[0];
+  if (options && typeof options === 'object' && Number(options.port) === port && failuresLeft > 0) {
+    failuresLeft--;
+    console.log(`[FLAKY_CONNECT] Refusing connection to port ${port}`);
+    args[0] = { ...options, port: REFUSED_PORT };
+  }
+  return originalConnect.apply(net, args);
+}
+
+net.connect = connect;
+net.createConnection = connect;
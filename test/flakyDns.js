@@ -0,0 +1,24 @@
+// 通过 --require 预加载到 server.js 进程：FLAKY_DNS_HOST 的前 FLAKY_DNS_FAILURES 次解析返回 ENOTFOUND，之后解析到 127.0.0.1
+const dns = require('dns');
+
+const host = process.env.FLAKY_DNS_HOST;
+let failuresLeft = Number(process.env.FLAKY_DNS_FAILURES || 1);
+const originalLookup = dns.lookup;
+
+dns.lookup = function lookup(hostname, options, callback) {
+  if (typeof options === 'function') {
+    callback = options;
+    options = {};
+  }
+  if (!host || hostname !== host) return originalLookup.call(dns, hostname, options, callback);
+
+  if (failuresLeft > 0) {
+    failuresLeft--;
+    console.log(`[FLAKY_DNS] Failing lookup of ${hostname}`);
+    const error = Object.assign(new Error(`getaddrinfo ENOTFOUND ${hostname}`), { code: 'ENOTFOUND', hostname });
+    return process.nextTick(callback, error);
+  }
+  const opts = typeof options === 'number' ? { family: options } : options;
+  if (opts.all) return process.nextTick(callback, null, [{ address: '127.0.0.1', family: 4 }]);
+  process.nextTick(callback, null, '127.0.0.1', 4);
+};
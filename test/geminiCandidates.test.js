@@ -0,0 +1,54 @@
+// Gemini 多图：收集所有 candidates 中所有图片 part，按顺序放入 imageUrls，第一张作为 imageUrl；文本 part 跳过
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream } = require('./helpers');
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+const image = (data, mimeType = 'image/png') => ({ inlineData: { mimeType, data } });
+
+test('images from every Gemini candidate are returned', async t => {
+  const responses = {
+    multiple: {
+      candidates: [
+        { content: { parts: [{ text: 'Here are two takes' }, image('iVBORw0KGgoA'), image('iVBORw0KGgoB')] } },
+        { content: { parts: [image('/9j/4AAQSkZJRgAB', 'image/jpeg'), { text: 'and a third' }] } },
+        { finishReason: 'SAFETY' }
+      ]
+    },
+    textOnly: {
+      candidates: [{ content: { parts: [{ text: 'see https://cdn.example.com/fallback.png' }] } }]
+    }
+  };
+  const upstream = await startUpstream(request => ({ body: responses[JSON.parse(request.body).contents[0].parts[0].text] }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const generate = prompt => server.request('/api/generate', { method: 'POST', body: { model: GEMINI, prompt, apiKey: 'key' } });
+
+  await t.test('multiple candidates', async () => {
+    const { status, body } = await generate('multiple');
+    assert.strictEqual(status, 200);
+    assert.deepStrictEqual(body.imageUrls, [
+      'data:image/png;base64,iVBORw0KGgoA',
+      'data:image/png;base64,iVBORw0KGgoB',
+      'data:image/jpeg;base64,/9j/4AAQSkZJRgAB'
+    ]);
+    assert.strictEqual(body.imageUrl, body.imageUrls[0]);
+  });
+
+  await t.test('async results keep every image', async () => {
+    const { body } = await server.request('/api/generate/async', { method: 'POST', body: { model: GEMINI, prompt: 'multiple', apiKey: 'key' } });
+    const result = await server.waitForTask(body.taskId);
+    assert.strictEqual(result.imageUrls.length, 3);
+    assert.strictEqual(result.imageUrl, result.imageUrls[0]);
+  });
+
+  await t.test('text-only responses fall back to a url in the text', async () => {
+    const { status, body } = await generate('textOnly');
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.imageUrl, 'https://cdn.example.com/fallback.png');
+  });
+});
@@ -0,0 +1,70 @@
+// POST /api/generate/test：生成并等待内部回调接收端收到回调，返回任务结果、回调内容和签名校验结果
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+test('generate-and-wait-for-callback endpoint', async t => {
+  const upstream = await startUpstream(request => {
+    if (request.body.includes('fail me')) return { status: 400, body: { error: 'prompt rejected' } };
+    return { body: soraResponse('https://cdn.example.com/test.png') };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, CALLBACK_SIGNING_SECRET: 'signing-secret' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  await t.test('successful generation delivers a signed success callback', async () => {
+    const { status, body } = await server.request('/api/generate/test', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'a cat', apiKey: 'key' }
+    });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.success, true);
+    assert.match(body.taskId, /^generate-test-/);
+    assert.strictEqual(body.result.imageUrl, 'https://cdn.example.com/test.png');
+    assert.strictEqual(body.callback.payload.taskId, body.taskId);
+    assert.strictEqual(body.callback.payload.status, 'completed');
+    assert.strictEqual(body.callback.payload.imageUrl, 'https://cdn.example.com/test.png');
+    assert.strictEqual(body.callback.signed, true);
+    assert.strictEqual(body.callback.signatureVerified, true);
+  });
+
+  await t.test('failed generation delivers a failure callback', async () => {
+    const { status, body } = await server.request('/api/generate/test', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'fail me', apiKey: 'key', maxRetries: 1 }
+    });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.success, false);
+    assert.strictEqual(body.result.success, false);
+    assert.strictEqual(body.callback.payload.status, 'failed');
+    assert.ok(body.callback.payload.error);
+    assert.strictEqual(body.callback.signatureVerified, true);
+  });
+
+  await t.test('callbackUrl can not be overridden', async () => {
+    const { status } = await server.request('/api/generate/test', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'a cat', apiKey: 'key', callbackUrl: 'https://example.com/hook' }
+    });
+    assert.strictEqual(status, 400);
+  });
+});
+
+test('the test endpoint honors DISABLE_SYNC_ENDPOINT', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, DISABLE_SYNC_ENDPOINT: 'true' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const { status, body } = await server.request('/api/generate/test', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: 'a cat', apiKey: 'key' }
+  });
+  assert.strictEqual(status, 501);
+  assert.strictEqual(body.errorCode, 'SYNC_DISABLED');
+  assert.strictEqual(upstream.generationRequests().length, 0);
+});
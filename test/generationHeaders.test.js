@@ -0,0 +1,31 @@
+// 同步生成的元数据响应头：X-Task-Id、X-Model、X-Duration-Ms、X-Attempts、X-Upstream-Request-Id
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+test('a successful sync response carries the generation metadata headers', async t => {
+  let calls = 0;
+  const upstream = await startUpstream(() => {
+    calls++;
+    // 第一次返回 5xx，重试后成功
+    if (calls === 1) return { status: 502, body: { error: 'bad gateway' } };
+    return { headers: { 'x-request-id': 'upstream-req-7' }, body: soraResponse() };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const { status, headers, body } = await server.request('/api/generate', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: 'p', apiKey: 'key' }
+  });
+  assert.strictEqual(status, 200);
+  assert.match(headers.get('x-task-id'), /^sync-/);
+  assert.strictEqual(headers.get('x-model'), 'sora_image');
+  assert.strictEqual(headers.get('x-model'), body.model);
+  assert.match(headers.get('x-duration-ms'), /^\d+$/);
+  assert.strictEqual(headers.get('x-attempts'), '2');
+  assert.strictEqual(headers.get('x-upstream-request-id'), 'upstream-req-7');
+});
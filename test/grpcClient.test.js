@@ -0,0 +1,116 @@
+// grpcClient 对进程内 gRPC 桩服务的测试：正常响应、错误状态、本地超时和响应大小上限
+const test = require('node:test');
+const assert = require('node:assert');
+const http2 = require('http2');
+const { callGenerate, GENERATE_PATH } = require('../grpcClient');
+
+// Encodes a GenerateResponse by hand so the test doesn't share the client's codec
+function encodeResponse(imageUrls, finishReason) {
+  const field = (number, value) => {
+    const bytes = Buffer.from(value, 'utf8');
+    return Buffer.concat([Buffer.from([(number << 3) | 2, bytes.length]), bytes]);
+  };
+  return Buffer.concat([...imageUrls.map(url => field(1, url)), field(2, finishReason)]);
+}
+
+function frame(message) {
+  const header = Buffer.alloc(5);
+  header.writeUInt32BE(message.length, 1);
+  return Buffer.concat([header, message]);
+}
+
+// Starts an h2c server whose Generate handler is handler(stream, requestBody, headers)
+async function startStub(handler) {
+  const server = http2.createServer();
+  const streams = new Set();
+  server.on('stream', (stream, headers) => {
+    streams.add(stream);
+    stream.on('close', () => streams.delete(stream));
+    const chunks = [];
+    stream.on('data', chunk => chunks.push(chunk));
+    stream.on('end', () => handler(stream, Buffer.concat(chunks), headers));
+  });
+  await new Promise(resolve => server.listen(0, '127.0.0.1', resolve));
+  return {
+    endpoint: `grpc://127.0.0.1:${server.address().port}`,
+    streams,
+    close: () => new Promise(resolve => server.close(resolve))
+  };
+}
+
+test('returns the decoded response and sends the request fields', async t => {
+  let received;
+  const stub = await startStub((stream, body, headers) => {
+    received = { body, headers };
+    stream.respond({ ':status': 200, 'content-type': 'application/grpc' }, { waitForTrailers: true });
+    stream.on('wantTrailers', () => stream.sendTrailers({ 'grpc-status': '0' }));
+    stream.end(frame(encodeResponse(['https://img/1.png', 'https://img/2.png'], 'stop')));
+  });
+  t.after(stub.close);
+
+  const response = await callGenerate(stub.endpoint, { model: 'local-model', prompt: 'a cat', imageUrls: ['https://in/1.png'] }, {
+    metadata: { authorization: 'Bearer key' },
+    timeoutMs: 5000
+  });
+  assert.deepStrictEqual(response.imageUrls, ['https://img/1.png', 'https://img/2.png']);
+  assert.strictEqual(response.finishReason, 'stop');
+  assert.strictEqual(received.headers[':path'], GENERATE_PATH);
+  assert.strictEqual(received.headers.authorization, 'Bearer key');
+  assert.strictEqual(received.headers['grpc-timeout'], '5000m');
+  const message = received.body.subarray(5).toString('utf8');
+  assert.ok(message.includes('local-model') && message.includes('a cat') && message.includes('https://in/1.png'));
+});
+
+test('rejects with the grpc status of a trailers-only error response', async t => {
+  const stub = await startStub(stream => {
+    stream.respond({ ':status': 200, 'content-type': 'application/grpc', 'grpc-status': '14', 'grpc-message': 'model%20loading' },
+      { endStream: true });
+  });
+  t.after(stub.close);
+
+  await assert.rejects(callGenerate(stub.endpoint, { model: 'm', prompt: 'p' }), error => {
+    assert.strictEqual(error.grpcCode, 14);
+    assert.match(error.message, /UNAVAILABLE: model loading/);
+    return true;
+  });
+});
+
+test('cancels the stream locally when the server ignores grpc-timeout', async t => {
+  const stub = await startStub(stream => {
+    stream.respond({ ':status': 200, 'content-type': 'application/grpc' });
+  });
+  t.after(stub.close);
+
+  const startedAt = Date.now();
+  await assert.rejects(callGenerate(stub.endpoint, { model: 'm', prompt: 'p' }, { timeoutMs: 200 }), error => {
+    assert.strictEqual(error.grpcCode, 4);
+    return true;
+  });
+  assert.ok(Date.now() - startedAt < 2000);
+  await new Promise(resolve => setTimeout(resolve, 50));
+  assert.strictEqual(stub.streams.size, 0);
+});
+
+test('cancels the call when the response exceeds maxMessageBytes', async t => {
+  const stub = await startStub(stream => {
+    stream.respond({ ':status': 200, 'content-type': 'application/grpc' });
+    stream.write(frame(encodeResponse(['x'.repeat(100)], 'stop')));
+  });
+  t.after(stub.close);
+
+  await assert.rejects(callGenerate(stub.endpoint, { model: 'm', prompt: 'p' }, { maxMessageBytes: 64, timeoutMs: 5000 }), error => {
+    assert.strictEqual(error.grpcCode, 8);
+    return true;
+  });
+});
+
+test('rejects with an AbortError when the signal is aborted', async t => {
+  const stub = await startStub(stream => {
+    stream.respond({ ':status': 200, 'content-type': 'application/grpc' });
+  });
+  t.after(stub.close);
+
+  const controller = new AbortController();
+  setTimeout(() => controller.abort(), 50);
+  await assert.rejects(callGenerate(stub.endpoint, { model: 'm', prompt: 'p' }, { signal: controller.signal }), { name: 'AbortError' });
+});
@@ -0,0 +1,45 @@
+// 健康检查：HEALTH_PATH 自定义路径，HEALTH_PORT 单独端口（此时业务端口不再提供健康检查路径）
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, freePort, wait } = require('./helpers');
+
+test('health is served on /health by default', async t => {
+  const server = await startServer();
+  t.after(() => server.close());
+
+  const { status, body } = await server.request('/health');
+  assert.strictEqual(status, 200);
+  assert.strictEqual(body.status, 'healthy');
+  assert.strictEqual((await server.request('/readyz')).body.ready, true);
+});
+
+test('HEALTH_PATH moves the health check', async t => {
+  const server = await startServer({ HEALTH_PATH: '/internal/healthz' });
+  t.after(() => server.close());
+
+  assert.strictEqual((await server.request('/internal/healthz')).status, 200);
+  assert.strictEqual((await server.request('/internal/healthz')).body.status, 'healthy');
+  assert.strictEqual((await server.request('/health')).status, 404);
+});
+
+test('HEALTH_PORT serves health checks on their own listener', async t => {
+  const healthPort = await freePort();
+  const server = await startServer({ HEALTH_PORT: String(healthPort), HEALTH_PATH: '/healthz' });
+  t.after(() => server.close());
+
+  let response;
+  for (let i = 0; i < 50; i++) {
+    response = await fetch(`http://127.0.0.1:${healthPort}/healthz`).catch(() => null);
+    if (response) break;
+    await wait(50);
+  }
+  assert.ok(response, 'health port is listening');
+  assert.strictEqual(response.status, 200);
+  assert.strictEqual((await response.json()).status, 'healthy');
+  assert.strictEqual((await fetch(`http://127.0.0.1:${healthPort}/readyz`)).status, 200);
+
+  // 健康检查端口只提供健康检查，业务端口不再提供 HEALTH_PATH
+  assert.strictEqual((await fetch(`http://127.0.0.1:${healthPort}/api/status/some-task`)).status, 404);
+  assert.strictEqual((await server.request('/healthz')).status, 404);
+  assert.strictEqual((await server.request('/api/status/some-task')).status, 200);
+});
@@ -0,0 +1,158 @@
+// 测试辅助：在子进程中启动 server.js（独立端口和临时 RESULT_DIR），以及本地的桩上游
+// 上游通过 UPSTREAM_REGIONS 指向桩服务，测试不访问外网
+const { spawn } = require('child_process');
+const fs = require('fs');
+const http = require('http');
+const net = require('net');
+const os = require('os');
+const path = require('path');
+
+const SERVER_PATH = path.join(__dirname, '..', 'server.js');
+const STARTUP_TIMEOUT_MS = 10 * 1000;
+
+function freePort() {
+  return new Promise((resolve, reject) => {
+    const server = net.createServer();
+    server.once('error', reject);
+    server.listen(0, '127.0.0.1', () => {
+      const { port } = server.address();
+      server.close(() => resolve(port));
+    });
+  });
+}
+
+// Chat completion body the sora branch extracts imageUrl from
+function soraResponse(imageUrl = 'https://cdn.example.com/result.png') {
+  return { choices: [{ message: { content: `![image](${imageUrl})` }, finish_reason: 'stop' }] };
+}
+
+// generateContent body the gemini branch extracts a base64 image from
+function geminiResponse(data = 'iVBORw0KGgo=', mimeType = 'image/png') {
+  return { candidates: [{ content: { parts: [{ inlineData: { mimeType, data } }] }, finishReason: 'STOP' }] };
+}
+
+// Starts a local HTTP server; handler(request, res) returns { status, headers, body, delayMs } or responds on res itself
+// Every request is recorded in requests as { method, url, headers, body, remotePort }
+async function startUpstream(handler) {
+  const requests = [];
+  const server = http.createServer((req, res) => {
+    const chunks = [];
+    req.on('data', chunk => chunks.push(chunk));
+    req.on('end', async () => {
+      const body = Buffer.concat(chunks).toString('utf8');
+      const request = { method: req.method, url: req.url, headers: req.headers, body, remotePort: req.socket.remotePort };
+      requests.push(request);
+      const reply = (await handler(request, res)) || {};
+      if (res.headersSent || res.writableEnded) return;
+      const send = () => {
+        if (res.destroyed) return;
+        const payload = typeof reply.body === 'string' || Buffer.isBuffer(reply.body) ? reply.body : JSON.stringify(reply.body ?? {});
+        res.writeHead(reply.status || 200, { 'content-type': 'application/json', ...reply.headers });
+        res.end(payload);
+      };
+      if (reply.delayMs) setTimeout(send, reply.delayMs);
+      else send();
+    });
+  });
+  await new Promise(resolve => server.listen(0, '127.0.0.1', resolve));
+  const url = `http://127.0.0.1:${server.address().port}`;
+  return {
+    url,
+    requests,
+    // Requests sent to the generation API, excluding image downloads and other paths
+    generationRequests: () => requests.filter(request => request.url.startsWith('/v1')),
+    close: () => new Promise(resolve => {
+      server.closeAllConnections();
+      server.close(resolve);
+    })
+  };
+}
+
+// Spawns server.js with env on a free port and a temporary RESULT_DIR (unless env sets one)
+// Resolves once the server is listening; logs holds its stdout and stderr
+async function startServer(env = {}) {
+  const port = await freePort();
+  const resultDir = env.RESULT_DIR || fs.mkdtempSync(path.join(os.tmpdir(), 'aiyoutube-test-'));
+  const child = spawn(process.execPath, [SERVER_PATH], {
+    env: { ...process.env, PORT: String(port), RESULT_DIR: resultDir, ...env },
+    stdio: ['ignore', 'pipe', 'pipe']
+  });
+  let logs = '';
+  const exited = new Promise(resolve => child.once('exit', code => resolve(code)));
+
+  await new Promise((resolve, reject) => {
+    const timer = setTimeout(() => reject(new Error(`server did not start:\n${logs}`)), STARTUP_TIMEOUT_MS);
+    const onData = chunk => {
+      logs += chunk;
+      if (logs.includes('Proxy server running')) {
+        clearTimeout(timer);
+        resolve();
+      }
+    };
+    child.stdout.on('data', onData);
+    child.stderr.on('data', onData);
+    exited.then(code => {
+      clearTimeout(timer);
+      reject(new Error(`server exited with code ${code}:\n${logs}`));
+    });
+  });
+
+  const server = {
+    url: `http://127.0.0.1:${port}`,
+    pid: child.pid,
+    resultDir,
+    get logs() {
+      return logs;
+    },
+    // fetch relative to the server, resolves to { status, headers, body } with body parsed as JSON when possible
+    async request(pathname, { method = 'GET', body, headers = {}, redirect = 'manual' } = {}) {
+      const response = await fetch(`${server.url}${pathname}`, {
+        method,
+        redirect,
+        headers: body === undefined ? headers : { 'content-type': 'application/json', ...headers },
+        body: body === undefined ? undefined : JSON.stringify(body)
+      });
+      const buffer = Buffer.from(await response.arrayBuffer());
+      let parsed = buffer;
+      if ((response.headers.get('content-type') || '').includes('json')) {
+        parsed = JSON.parse(buffer.toString('utf8'));
+      }
+      return { status: response.status, headers: response.headers, body: parsed };
+    },
+    // Polls /api/status/:taskId until the task reaches a terminal status
+    async waitForTask(taskId, { headers, timeoutMs = 10000 } = {}) {
+      const startedAt = Date.now();
+      for (;;) {
+        const { body } = await server.request(`/api/status/${taskId}`, { headers });
+        if (['completed', 'failed', 'cancelled'].includes(body.status)) return body;
+        if (Date.now() - startedAt > timeoutMs) throw new Error(`task ${taskId} did not finish: ${JSON.stringify(body)}`);
+        await wait(50);
+      }
+    },
+    async close() {
+      child.kill('SIGKILL');
+      await exited;
+      if (!env.RESULT_DIR) fs.rmSync(resultDir, { recursive: true, force: true });
+    }
+  };
+  return server;
+}
+
+// Runs server.js with env until it exits, for startup failures; resolves to { code, logs }
+function runServerToExit(env = {}) {
+  return new Promise(resolve => {
+    const child = spawn(process.execPath, [SERVER_PATH], { env: { ...process.env, PORT: '0', ...env }, stdio: ['ignore', 'pipe', 'pipe'] });
+    let logs = '';
+    child.stdout.on('data', chunk => (logs += chunk));
+    child.stderr.on('data', chunk => (logs += chunk));
+    const timer = setTimeout(() => child.kill('SIGKILL'), STARTUP_TIMEOUT_MS);
+    child.once('exit', code => {
+      clearTimeout(timer);
+      resolve({ code, logs });
+    });
+  });
+}
+
+const wait = ms => new Promise(resolve => setTimeout(resolve, ms));
+
+module.exports = { startServer, startUpstream, runServerToExit, soraResponse, geminiResponse, freePort, wait };
@@ -0,0 +1,57 @@
+// GET /api/image/:taskId：已完成任务返回原始图片字节和 Content-Length；未知、进行中或失败的任务 404，源地址失效 502
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('crypto');
+const { startServer, startUpstream, soraResponse, freePort } = require('./helpers');
+
+const IMAGE = crypto.randomBytes(64 * 1024);
+
+test('completed tasks return the image bytes', async t => {
+  const deadPort = await freePort();
+  const upstream = await startUpstream(request => {
+    if (request.url === '/image.png') return { headers: { 'content-type': 'image/png', 'content-length': IMAGE.length }, body: IMAGE };
+    if (request.body.includes('fail')) return { status: 400, body: { error: 'bad request' } };
+    if (request.body.includes('dead')) return { body: soraResponse(`http://127.0.0.1:${deadPort}/image.png`) };
+    return { body: soraResponse(`${upstream.url}/image.png`), delayMs: request.body.includes('slow') ? 2000 : 0 };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const submit = async prompt => {
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt, apiKey: 'key', maxRetries: 0 }
+    });
+    return body.taskId;
+  };
+
+  await t.test('bytes with content type and length', async () => {
+    const taskId = await submit('ok');
+    await server.waitForTask(taskId);
+    const response = await fetch(`${server.url}/api/image/${taskId}`);
+    assert.strictEqual(response.status, 200);
+    assert.strictEqual(response.headers.get('content-type'), 'image/png');
+    assert.strictEqual(response.headers.get('content-length'), String(IMAGE.length));
+    assert.ok(Buffer.from(await response.arrayBuffer()).equals(IMAGE));
+  });
+
+  await t.test('incomplete and failed tasks', async () => {
+    const running = await submit('slow');
+    assert.strictEqual((await server.request(`/api/image/${running}`)).status, 404);
+
+    const failed = await submit('fail');
+    await server.waitForTask(failed);
+    assert.strictEqual((await server.request(`/api/image/${failed}`)).status, 404);
+  });
+
+  await t.test('dead source url', async () => {
+    const taskId = await submit('dead');
+    await server.waitForTask(taskId);
+    const { status, body } = await server.request(`/api/image/${taskId}`);
+    assert.strictEqual(status, 502);
+    assert.strictEqual(body.error, 'Image source is no longer available');
+  });
+});
@@ -0,0 +1,65 @@
+// imageDimensions：结构化的 {width, height} 按模型限制校验后转成上游使用的比例标记；和 imageSize 同时提供时以 imageDimensions 为准
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse } = require('./helpers');
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+
+// Prompt text the upstream received for the last generation
+function sentPrompt(upstream) {
+  const body = JSON.parse(upstream.generationRequests().at(-1).body);
+  const parts = body.messages ? body.messages[0].content : body.contents[0].parts;
+  return typeof parts === 'string' ? parts : parts.find(part => part.text !== undefined).text;
+}
+
+test('structured image dimensions', async t => {
+  const upstream = await startUpstream(request => ({
+    body: request.url.includes('generateContent') ? geminiResponse() : soraResponse()
+  }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const generate = fields => server.request('/api/generate', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: 'a cat', apiKey: 'key', ...fields }
+  });
+
+  await t.test('parsed into the size marker', async () => {
+    assert.strictEqual((await generate({ imageDimensions: { width: 1536, height: 1024 } })).status, 200);
+    assert.strictEqual(sentPrompt(upstream), 'a cat [3:2]');
+
+    assert.strictEqual((await generate({ model: GEMINI, imageDimensions: { width: 1920, height: 1080 } })).status, 200);
+    assert.strictEqual(sentPrompt(upstream), 'a cat [16:9]');
+
+    // 只有字符串形式时原样使用
+    assert.strictEqual((await generate({ imageSize: '[2:3]' })).status, 200);
+    assert.strictEqual(sentPrompt(upstream), 'a cat [2:3]');
+  });
+
+  await t.test('structured dimensions take precedence', async () => {
+    assert.strictEqual((await generate({ imageSize: '[2:3]', imageDimensions: { width: 1024, height: 1024 } })).status, 200);
+    assert.strictEqual(sentPrompt(upstream), 'a cat [1:1]');
+  });
+
+  await t.test('validated against the model', async () => {
+    const calls = upstream.generationRequests().length;
+    const invalid = [
+      { imageDimensions: { width: '1024', height: 1024 } },
+      { imageDimensions: { width: 1024.5, height: 1024 } },
+      { imageDimensions: null },
+      { imageDimensions: { width: 128, height: 128 } },
+      { imageDimensions: { width: 4096, height: 4096 } },
+      { imageDimensions: { width: 1920, height: 1080 } },
+      { model: GEMINI, imageDimensions: { width: 32, height: 32 } }
+    ];
+    for (const fields of invalid) {
+      const { status, body } = await generate(fields);
+      assert.strictEqual(status, 400, JSON.stringify(fields));
+      assert.ok(body.fields.some(field => field.field === 'imageDimensions'));
+    }
+    assert.strictEqual(upstream.generationRequests().length, calls);
+  });
+});
@@ -0,0 +1,55 @@
+// IMAGE_DOWNLOAD_CONCURRENCY：输入图片下载和 uploadUrl 转存共用一个下载并发上限，与 MAX_CONCURRENCY 无关
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse } = require('./helpers');
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+const PNG = Buffer.concat([Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]), Buffer.alloc(64)]);
+const DOWNLOAD_MS = 300;
+
+test('concurrent image downloads stay under the limit', async t => {
+  const downloads = { active: 0, peak: 0, total: 0 };
+  const upstream = await startUpstream(request => {
+    if (request.url.startsWith('/ref') || request.url.startsWith('/out')) {
+      downloads.active++;
+      downloads.total++;
+      downloads.peak = Math.max(downloads.peak, downloads.active);
+      setTimeout(() => downloads.active--, DOWNLOAD_MS);
+      return { headers: { 'content-type': 'image/png' }, body: PNG, delayMs: DOWNLOAD_MS };
+    }
+    if (request.url.startsWith('/upload')) return { body: '' };
+    if (request.url.includes('generateContent')) return { body: geminiResponse() };
+    const id = JSON.parse(request.body).messages[0].content.match(/archive (\d+)/)[1];
+    return { body: soraResponse(`${upstream.url}/out-${id}.png`) };
+  });
+  const server = await startServer({
+    UPSTREAM_REGIONS: upstream.url,
+    IMAGE_DOWNLOAD_CONCURRENCY: '2',
+    ALLOW_PRIVATE_CALLBACKS: 'true'
+  });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const generations = [1, 2, 3, 4].map(i => server.request('/api/generate', {
+    method: 'POST',
+    body: { model: GEMINI, prompt: `edit ${i}`, apiKey: 'key', imageUrl: `${upstream.url}/ref-${i}.png` }
+  }));
+  const archived = [1, 2, 3, 4].map(async i => {
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: `archive ${i}`, apiKey: 'key', uploadUrl: `${upstream.url}/upload/${i}` }
+    });
+    return server.waitForTask(body.taskId);
+  });
+
+  const responses = await Promise.all(generations);
+  assert.ok(responses.every(({ status }) => status === 200));
+  const results = await Promise.all(archived);
+  assert.ok(results.every(result => result.status === 'completed'), JSON.stringify(results.map(result => result.error)));
+  assert.strictEqual(upstream.requests.filter(request => request.method === 'PUT').length, 4);
+
+  assert.strictEqual(downloads.total, 8);
+  assert.strictEqual(downloads.peak, 2);
+});
@@ -0,0 +1,51 @@
+// 输入图片下载去重：同一 URL 的并发下载只请求一次，IMAGE_CACHE_TTL_MS 内再次使用直接命中缓存
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, geminiResponse, wait } = require('./helpers');
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+const PNG = Buffer.concat([Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]), Buffer.alloc(64)]);
+
+test('concurrent generations share one reference image download', async t => {
+  const upstream = await startUpstream(request => (request.url.startsWith('/ref')
+    ? { headers: { 'content-type': 'image/png' }, body: PNG, delayMs: 300 }
+    : { body: geminiResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, IMAGE_CACHE_TTL_MS: '1000' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const downloads = path => upstream.requests.filter(request => request.url === path).length;
+  const generate = (imageUrl, prompt) => server.request('/api/generate', {
+    method: 'POST',
+    body: { model: GEMINI, prompt, apiKey: 'key', imageUrl }
+  });
+
+  await t.test('concurrent requests', async () => {
+    // 提示词各不相同，避免被生成合并成一次调用
+    const responses = await Promise.all([1, 2, 3, 4].map(i => generate(`${upstream.url}/ref.png`, `variation ${i}`)));
+    assert.ok(responses.every(({ status }) => status === 200));
+    assert.strictEqual(downloads('/ref.png'), 1);
+
+    // 每次生成都带上了下载到的图片
+    const sent = upstream.generationRequests().map(request => JSON.parse(request.body).contents[0].parts[1].inline_data.data);
+    assert.strictEqual(sent.length, 4);
+    assert.ok(sent.every(data => data === PNG.toString('base64')));
+  });
+
+  await t.test('cached within the ttl', async () => {
+    assert.strictEqual((await generate(`${upstream.url}/ref.png`, 'again')).status, 200);
+    assert.strictEqual(downloads('/ref.png'), 1);
+
+    await wait(1100);
+    assert.strictEqual((await generate(`${upstream.url}/ref.png`, 'expired')).status, 200);
+    assert.strictEqual(downloads('/ref.png'), 2);
+  });
+
+  await t.test('different urls are downloaded separately', async () => {
+    await Promise.all([generate(`${upstream.url}/ref-a.png`, 'a'), generate(`${upstream.url}/ref-b.png`, 'b')]);
+    assert.strictEqual(downloads('/ref-a.png'), 1);
+    assert.strictEqual(downloads('/ref-b.png'), 1);
+  });
+});
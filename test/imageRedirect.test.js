@@ -0,0 +1,54 @@
+// GET /api/image/:taskId/redirect：URL 结果 302 跳转，base64 结果直接返回图片字节，未知任务 404，进行中 409
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse } = require('./helpers');
+
+const PNG_BASE64 = 'iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg==';
+
+test('image redirect endpoint', async t => {
+  let delayMs = 0;
+  const upstream = await startUpstream(request => ({
+    body: request.url.includes('generateContent') ? geminiResponse(PNG_BASE64) : soraResponse('https://cdn.example.com/cat.png'),
+    delayMs
+  }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const submit = async model => {
+    const { body } = await server.request('/api/generate/async', { method: 'POST', body: { model, prompt: 'a cat', apiKey: 'key' } });
+    return body.taskId;
+  };
+
+  await t.test('redirects to the stored image URL', async () => {
+    const taskId = await submit('sora_image');
+    await server.waitForTask(taskId);
+    const response = await server.request(`/api/image/${taskId}/redirect`);
+    assert.strictEqual(response.status, 302);
+    assert.strictEqual(response.headers.get('location'), 'https://cdn.example.com/cat.png');
+  });
+
+  await t.test('streams the bytes of a base64 result', async () => {
+    const taskId = await submit('gemini-2.5-flash-image-preview');
+    await server.waitForTask(taskId);
+    const response = await server.request(`/api/image/${taskId}/redirect`);
+    assert.strictEqual(response.status, 200);
+    assert.strictEqual(response.headers.get('content-type'), 'image/png');
+    assert.deepStrictEqual(response.body, Buffer.from(PNG_BASE64, 'base64'));
+  });
+
+  await t.test('returns 404 for an unknown task', async () => {
+    const response = await server.request('/api/image/no-such-task/redirect');
+    assert.strictEqual(response.status, 404);
+  });
+
+  await t.test('returns 409 while the task is still running', async () => {
+    delayMs = 1000;
+    const taskId = await submit('sora_image');
+    const response = await server.request(`/api/image/${taskId}/redirect`);
+    assert.strictEqual(response.status, 409);
+    await server.waitForTask(taskId);
+  });
+});
@@ -0,0 +1,57 @@
+// GET /api/image/:taskId：base64 结果分块解码后流式返回，图片地址结果从源地址转发，Content-Type 和原图一致
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('crypto');
+const { startServer, startUpstream, soraResponse, geminiResponse } = require('./helpers');
+
+const IMAGE = crypto.randomBytes(3 * 1024 * 1024);
+
+test('result images are streamed as decoded bytes', async t => {
+  const upstream = await startUpstream(request => {
+    if (request.url === '/remote.webp') return { headers: { 'content-type': 'image/webp' }, body: IMAGE.subarray(0, 1000) };
+    if (request.url === '/gone.png') return { status: 404, body: 'not found' };
+    if (request.url.includes('generateContent')) return { body: geminiResponse(IMAGE.toString('base64'), 'image/jpeg') };
+    const path = request.body.includes('gone') ? '/gone.png' : '/remote.webp';
+    return { body: soraResponse(`${upstream.url}${path}`) };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const generate = async (model, prompt = 'p') => {
+    const { body } = await server.request('/api/generate/async', { method: 'POST', body: { model, prompt, apiKey: 'key' } });
+    await server.waitForTask(body.taskId);
+    return body.taskId;
+  };
+
+  await t.test('base64 results', async () => {
+    const taskId = await generate('gemini-2.5-flash-image-preview');
+    const response = await fetch(`${server.url}/api/image/${taskId}`);
+    assert.strictEqual(response.status, 200);
+    assert.strictEqual(response.headers.get('content-type'), 'image/jpeg');
+    assert.strictEqual(response.headers.get('content-length'), String(IMAGE.length));
+
+    // 分多块到达，而不是一次写出整张图片
+    const chunks = [];
+    for await (const chunk of response.body) chunks.push(Buffer.from(chunk));
+    assert.ok(chunks.length > 1, `received ${chunks.length} chunk(s)`);
+    assert.ok(Buffer.concat(chunks).equals(IMAGE));
+  });
+
+  await t.test('image url results', async () => {
+    const taskId = await generate('sora_image');
+    const response = await fetch(`${server.url}/api/image/${taskId}`);
+    assert.strictEqual(response.status, 200);
+    assert.strictEqual(response.headers.get('content-type'), 'image/webp');
+    assert.ok(Buffer.from(await response.arrayBuffer()).equals(IMAGE.subarray(0, 1000)));
+  });
+
+  await t.test('missing images', async () => {
+    assert.strictEqual((await server.request('/api/image/no-such-task')).status, 404);
+    const gone = await server.request(`/api/image/${await generate('sora_image', 'gone')}`);
+    assert.strictEqual(gone.status, 502);
+    assert.strictEqual(gone.body.sourceStatus, 404);
+  });
+});
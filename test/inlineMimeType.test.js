@@ -0,0 +1,44 @@
+// base64 输出的 mimeType：上游没给或只给 application/octet-stream 时按图片内容识别并记录日志，明确给出的类型原样使用
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, geminiResponse } = require('./helpers');
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+const PNG = Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0, 0, 0, 0]).toString('base64');
+const JPEG = Buffer.from([0xff, 0xd8, 0xff, 0xe0, 0, 0x10, 0x4a, 0x46, 0x49, 0x46, 0, 0]).toString('base64');
+const WEBP = Buffer.concat([Buffer.from('RIFF'), Buffer.alloc(4), Buffer.from('WEBPVP8 ')]).toString('base64');
+const UNKNOWN = Buffer.from('not an image at all').toString('base64');
+
+test('inline image data urls use the sniffed type when the reported one is missing or generic', async t => {
+  const cases = {
+    correct: { data: PNG, mimeType: 'image/png', expected: 'image/png' },
+    missing: { data: JPEG, mimeType: undefined, expected: 'image/jpeg' },
+    generic: { data: WEBP, mimeType: 'application/octet-stream', expected: 'image/webp' },
+    explicit: { data: JPEG, mimeType: 'image/png', expected: 'image/png' },
+    unrecognised: { data: UNKNOWN, mimeType: undefined, expected: 'application/octet-stream' }
+  };
+  const upstream = await startUpstream(request => {
+    const { data, mimeType } = cases[JSON.parse(request.body).contents[0].parts[0].text];
+    const body = geminiResponse(data, mimeType);
+    // geminiResponse 默认补上 image/png，这里去掉来模拟上游没给 mimeType
+    if (mimeType === undefined) delete body.candidates[0].content.parts[0].inlineData.mimeType;
+    return { body };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  for (const [name, { data, expected }] of Object.entries(cases)) {
+    await t.test(name, async () => {
+      const { status, body } = await server.request('/api/generate', { method: 'POST', body: { model: GEMINI, prompt: name, apiKey: 'key' } });
+      assert.strictEqual(status, 200);
+      assert.strictEqual(body.imageUrl, `data:${expected};base64,${data}`);
+    });
+  }
+
+  assert.match(server.logs, /Corrected inline image mimeType \(missing\) -> image\/jpeg/);
+  assert.match(server.logs, /Corrected inline image mimeType application\/octet-stream -> image\/webp/);
+  assert.doesNotMatch(server.logs, /Corrected inline image mimeType image\/png/);
+});
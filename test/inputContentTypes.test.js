@@ -0,0 +1,88 @@
+// 输入图片类型白名单（INPUT_IMAGE_CONTENT_TYPES）：下载的图片先看 Content-Type 再看文件头，不在白名单中时以 INVALID_INPUT_IMAGE 失败
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, geminiResponse } = require('./helpers');
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+const PADDING = Buffer.alloc(32);
+const FILES = {
+  'png': ['image/png', Buffer.concat([Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]), PADDING])],
+  'jpeg': ['image/jpeg; charset=binary', Buffer.concat([Buffer.from([0xff, 0xd8, 0xff, 0xe0]), PADDING])],
+  'gif': ['image/gif', Buffer.concat([Buffer.from('GIF89a'), PADDING])],
+  'webp': ['image/webp', Buffer.concat([Buffer.from('RIFF'), Buffer.alloc(4), Buffer.from('WEBP'), PADDING])],
+  'octet-png': ['application/octet-stream', Buffer.concat([Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]), PADDING])],
+  'html': ['text/html', Buffer.from('<html><body>not an image</body></html>')],
+  'svg': ['image/svg+xml', Buffer.from('<svg xmlns="http://www.w3.org/2000/svg"/>')],
+  'disguised': ['image/png', Buffer.from('<html><body>pretending to be a png</body></html>')]
+};
+
+async function start(env = {}) {
+  const upstream = await startUpstream(request => {
+    const name = request.url.match(/^\/files\/(.+)$/)?.[1];
+    if (!name) return { body: geminiResponse() };
+    const [contentType, body] = FILES[name];
+    return { headers: { 'content-type': contentType }, body };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ...env });
+  let count = 0;
+  const generate = name => server.request('/api/generate', {
+    method: 'POST',
+    body: { model: GEMINI, prompt: `p${count++}`, apiKey: 'key', imageUrl: `${upstream.url}/files/${name}` }
+  });
+  return { upstream, server, generate, close: () => Promise.all([server.close(), upstream.close()]) };
+}
+
+test('the default allowlist', async t => {
+  const stack = await start();
+  t.after(() => stack.close());
+  const { generate, upstream, server } = stack;
+
+  await t.test('allowed images', async () => {
+    for (const name of ['png', 'jpeg', 'gif', 'webp', 'octet-png']) {
+      assert.strictEqual((await generate(name)).status, 200, name);
+    }
+    assert.strictEqual(upstream.generationRequests().length, 5);
+  });
+
+  await t.test('disallowed content types', async () => {
+    for (const [name, type] of [['html', 'text/html'], ['svg', 'image/svg+xml']]) {
+      const { status, body } = await generate(name);
+      assert.strictEqual(status, 422, name);
+      assert.deepStrictEqual(body, {
+        success: false,
+        error: `Input image content type ${type} is not allowed (allowed: image/png, image/jpeg, image/webp, image/gif)`,
+        errorCode: 'INVALID_INPUT_IMAGE'
+      });
+    }
+  });
+
+  await t.test('content that does not match its type', async () => {
+    const { status, body } = await generate('disguised');
+    assert.strictEqual(status, 422);
+    assert.strictEqual(body.error, 'Input image content is not a recognised image (allowed: image/png, image/jpeg, image/webp, image/gif)');
+    assert.strictEqual(upstream.generationRequests().length, 5, 'nothing was forwarded');
+  });
+
+  await t.test('async tasks fail', async () => {
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: GEMINI, prompt: 'async', apiKey: 'key', imageUrl: `${upstream.url}/files/html` }
+    });
+    const result = await server.waitForTask(body.taskId);
+    assert.strictEqual(result.status, 'failed');
+    assert.strictEqual(result.errorCode, 'INVALID_INPUT_IMAGE');
+  });
+});
+
+test('INPUT_IMAGE_CONTENT_TYPES narrows the list', async t => {
+  const stack = await start({ INPUT_IMAGE_CONTENT_TYPES: 'IMAGE/PNG' });
+  t.after(() => stack.close());
+
+  assert.strictEqual((await stack.generate('png')).status, 200);
+  const jpeg = await stack.generate('jpeg');
+  assert.strictEqual(jpeg.status, 422);
+  assert.strictEqual(jpeg.body.error, 'Input image content type image/jpeg is not allowed (allowed: image/png)');
+  // Content-Type 未知时按文件头判断
+  const sniffed = await stack.generate('octet-png');
+  assert.strictEqual(sniffed.status, 200);
+});
@@ -0,0 +1,110 @@
+// JWT 鉴权：用本地 JWKS 的测试密钥签发 token，校验签名、有效期、aud 和 iss；管理员 token 同样放行
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('crypto');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+const AUDIENCE = 'image-proxy';
+const ISSUER = 'https://issuer.example.com';
+
+const { privateKey, publicKey } = crypto.generateKeyPairSync('rsa', { modulusLength: 2048 });
+const { privateKey: otherKey } = crypto.generateKeyPairSync('rsa', { modulusLength: 2048 });
+
+function encodeSegment(value) {
+  return Buffer.from(JSON.stringify(value)).toString('base64url');
+}
+
+// Signs an RS256 token for the test key, claims override the valid defaults
+function signToken(claims = {}, key = privateKey) {
+  const now = Math.floor(Date.now() / 1000);
+  const header = encodeSegment({ alg: 'RS256', typ: 'JWT', kid: 'test-key' });
+  const payload = encodeSegment({ sub: 'user-1', aud: AUDIENCE, iss: ISSUER, iat: now, exp: now + 300, ...claims });
+  const signature = crypto.sign('sha256', Buffer.from(`${header}.${payload}`), key).toString('base64url');
+  return `${header}.${payload}.${signature}`;
+}
+
+test('JWT bearer verification against a JWKS', async t => {
+  const jwks = await startUpstream(() => ({
+    body: { keys: [{ ...publicKey.export({ format: 'jwk' }), kid: 'test-key', alg: 'RS256', use: 'sig' }] }
+  }));
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({
+    UPSTREAM_REGIONS: upstream.url,
+    JWT_JWKS_URL: `${jwks.url}/.well-known/jwks.json`,
+    JWT_AUDIENCE: AUDIENCE,
+    JWT_ISSUER: ISSUER,
+    JWT_CLOCK_SKEW_SECONDS: '0',
+    ADMIN_TOKEN: 'admin-token'
+  });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+    await jwks.close();
+  });
+
+  const generate = token => server.request('/api/generate', {
+    method: 'POST',
+    headers: token ? { authorization: `Bearer ${token}` } : {},
+    body: { model: 'sora_image', prompt: 'p', apiKey: 'key' }
+  });
+
+  await t.test('a valid token is accepted', async () => {
+    const { status, body } = await generate(signToken());
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.success, true);
+  });
+
+  await t.test('rejected tokens', async () => {
+    const now = Math.floor(Date.now() / 1000);
+    const cases = {
+      missing: null,
+      expired: signToken({ exp: now - 60 }),
+      'wrong audience': signToken({ aud: 'someone-else' }),
+      'wrong issuer': signToken({ iss: 'https://evil.example.com' }),
+      'signed by another key': signToken({}, otherKey),
+      'null header and payload': 'bnVsbA.bnVsbA.x',
+      'not a jwt': 'admin-token-guess'
+    };
+    for (const [name, token] of Object.entries(cases)) {
+      const { status, body, headers } = await generate(token);
+      assert.strictEqual(status, 401, name);
+      assert.strictEqual(body.errorCode, token ? 'INVALID_TOKEN' : 'UNAUTHORIZED', name);
+      assert.match(headers.get('www-authenticate'), /^Bearer/, name);
+    }
+    assert.strictEqual(upstream.generationRequests().length, 1);
+  });
+
+  await t.test('task routes require a token', async () => {
+    const routes = [
+      ['GET', '/api/status/some-task'],
+      ['GET', '/api/status/parent/some-parent'],
+      ['POST', '/api/callback/resend/some-task'],
+      ['POST', '/api/cancel/some-task'],
+      ['DELETE', '/api/generate/some-cancel-token'],
+      ['POST', '/api/cancel/parent/some-parent'],
+      ['GET', '/api/generate/batch/some-parent/stream'],
+      ['GET', '/api/image/some-task'],
+      ['GET', '/api/image/some-task/redirect'],
+      ['GET', '/api/results'],
+      ['POST', '/api/generate/async']
+    ];
+    for (const [method, pathname] of routes) {
+      const { status } = await server.request(pathname, { method, redirect: 'manual' });
+      assert.strictEqual(status, 401, `${method} ${pathname}`);
+    }
+    const { status } = await server.request('/api/status/some-task', { headers: { authorization: `Bearer ${signToken()}` } });
+    assert.strictEqual(status, 200);
+  });
+
+  await t.test('the admin token is accepted in place of a JWT', async () => {
+    const admin = { authorization: 'Bearer admin-token' };
+    assert.strictEqual((await server.request('/api/status/some-task', { headers: admin })).status, 200);
+    assert.strictEqual((await server.request('/api/results', { headers: admin })).status, 200);
+    // JWT 不代表管理员
+    assert.strictEqual((await server.request('/api/results', { headers: { authorization: `Bearer ${signToken()}` } })).status, 401);
+  });
+
+  await t.test('the JWKS is fetched once and cached', () => {
+    assert.strictEqual(jwks.requests.length, 1);
+  });
+});
@@ -0,0 +1,66 @@
+// /health 的 lastMinute：最近 60 秒处理、成功、失败的生成数，按秒分桶滚动；totalProcessed 为累计值
+const test = require('node:test');
+const assert = require('node:assert');
+const path = require('node:path');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+const STEP_MS = 1000;
+
+test('per-minute counters roll over', async t => {
+  const upstream = await startUpstream(request => (request.body.includes('fail')
+    ? { status: 400, body: { error: 'bad request' } }
+    : { body: soraResponse() }));
+  const server = await startServer({
+    UPSTREAM_REGIONS: upstream.url,
+    NODE_OPTIONS: `--require ${path.join(__dirname, 'fakeClock.js')}`,
+    FAKE_CLOCK_STEP_MS: String(STEP_MS)
+  });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  let count = 0;
+  const run = async outcome => {
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: `${outcome} ${count++}`, apiKey: 'key', maxRetries: 0 }
+    });
+    await server.waitForTask(body.taskId);
+  };
+  const health = async () => (await server.request('/health')).body;
+  const advance = async seconds => {
+    // 连续发送的信号可能被合并，每次等到日志确认后再发下一个
+    for (let i = 0; i < seconds; i++) {
+      const marker = server.logs.length;
+      process.kill(server.pid, 'SIGUSR2');
+      while (!server.logs.slice(marker).includes('[FAKE_CLOCK]')) await wait(5);
+    }
+  };
+
+  assert.deepStrictEqual((await health()).lastMinute, { processed: 0, succeeded: 0, failed: 0 });
+
+  await run('ok');
+  await run('ok');
+  await run('fail');
+  assert.deepStrictEqual((await health()).lastMinute, { processed: 3, succeeded: 2, failed: 1 });
+
+  await advance(30);
+  await run('ok');
+  assert.deepStrictEqual((await health()).lastMinute, { processed: 4, succeeded: 3, failed: 1 });
+
+  // 第一批事件已超过 60 秒
+  await advance(31);
+  let snapshot = await health();
+  assert.deepStrictEqual(snapshot.lastMinute, { processed: 1, succeeded: 1, failed: 0 });
+  assert.strictEqual(snapshot.totalProcessed, 4, 'the cumulative total keeps counting');
+
+  await advance(60);
+  snapshot = await health();
+  assert.deepStrictEqual(snapshot.lastMinute, { processed: 0, succeeded: 0, failed: 0 });
+  assert.strictEqual(snapshot.totalProcessed, 4);
+
+  // 重新写入复用过期的桶
+  await run('fail');
+  assert.deepStrictEqual((await health()).lastMinute, { processed: 1, succeeded: 0, failed: 1 });
+});
@@ -0,0 +1,37 @@
+// /health 的 latencyMs：任务完成时更新耗时 EMA 和最近样本的 p50/p95
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+test('/health reports the latency trend', async t => {
+  // 提示词里带上这次调用的延迟
+  const upstream = await startUpstream(request => ({ body: soraResponse(), delayMs: Number(/delay (\d+)/.exec(request.body)[1]) }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const latency = async () => (await server.request('/health')).body.latencyMs;
+  const initial = await latency();
+  assert.strictEqual(initial.ema, null);
+  assert.strictEqual(initial.p50, null);
+  assert.strictEqual(initial.samples, 0);
+
+  // 9 次快速调用后跟 1 次慢调用，逐个执行让 EMA 的顺序确定
+  const delays = [...Array(9).fill(50), 700];
+  for (const [i, delay] of delays.entries()) {
+    const { status } = await server.request('/api/generate', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: `delay ${delay} #${i}`, apiKey: 'key' }
+    });
+    assert.strictEqual(status, 200);
+  }
+
+  const { ema, p50, p95, max, samples } = await latency();
+  assert.strictEqual(samples, 10);
+  assert.ok(p50 >= 50 && p50 < 300, `p50 ${p50}`);
+  assert.ok(p95 >= 700 && p95 === max, `p95 ${p95}`);
+  // 慢调用把 EMA 拉高，但只占 0.2 的权重
+  assert.ok(ema > p50 && ema < p95, `ema ${ema}`);
+});
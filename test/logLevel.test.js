@@ -0,0 +1,56 @@
+// POST /admin/loglevel：运行中修改日志级别，/health 报告当前级别；只有 debug 级别时输出 [DEBUG] 日志
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+const ADMIN = { authorization: 'Bearer admin-token' };
+
+test('the log level can be changed at runtime', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ADMIN_TOKEN: 'admin-token' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const setLevel = (level, headers = ADMIN) => server.request('/admin/loglevel', { method: 'POST', headers, body: { level } });
+  const generate = async taskId => {
+    const { status } = await server.request('/api/generate', { method: 'POST', body: { model: 'sora_image', prompt: taskId, apiKey: 'key', taskId } });
+    assert.strictEqual(status, 200);
+  };
+  const debugLogged = taskId => server.logs.includes(`[DEBUG] [${taskId}] Upstream request body:`);
+  const healthLevel = async () => (await server.request('/health')).body.logLevel;
+
+  assert.strictEqual(await healthLevel(), 'info');
+  await generate('before-debug');
+  assert.strictEqual(debugLogged('before-debug'), false);
+
+  const raised = await setLevel('DEBUG');
+  assert.deepStrictEqual(raised.body, { success: true, level: 'debug', previous: 'info' });
+  assert.strictEqual(await healthLevel(), 'debug');
+  assert.match(server.logs, /\[ADMIN\] Log level info -> debug/);
+  await generate('during-debug');
+  assert.strictEqual(debugLogged('during-debug'), true);
+
+  const lowered = await setLevel('warn');
+  assert.deepStrictEqual(lowered.body, { success: true, level: 'warn', previous: 'debug' });
+  assert.strictEqual(await healthLevel(), 'warn');
+  await generate('after-debug');
+  assert.strictEqual(debugLogged('after-debug'), false);
+
+  await t.test('invalid levels and auth', async () => {
+    const invalid = await setLevel('verbose');
+    assert.strictEqual(invalid.status, 400);
+    assert.deepStrictEqual(invalid.body, { error: 'level must be one of debug, info, warn, error' });
+    assert.strictEqual((await setLevel(undefined)).status, 400);
+    assert.strictEqual((await setLevel('debug', {})).status, 401);
+    assert.strictEqual((await setLevel('debug', { authorization: 'Bearer wrong' })).status, 401);
+    assert.strictEqual(await healthLevel(), 'warn');
+  });
+});
+
+test('LOG_LEVEL sets the starting level', async t => {
+  const server = await startServer({ LOG_LEVEL: 'debug' });
+  t.after(() => server.close());
+  assert.strictEqual((await server.request('/health')).body.logLevel, 'debug');
+});
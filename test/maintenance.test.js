@@ -0,0 +1,53 @@
+// 维护模式：生成接口返回 503 MAINTENANCE，状态查询和健康检查照常可用，可通过管理接口在运行中切换
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+const GENERATE = { model: 'sora_image', prompt: 'p', apiKey: 'key' };
+
+test('maintenance mode blocks generation but not status polling', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({
+    UPSTREAM_REGIONS: upstream.url,
+    ADMIN_TOKEN: 'admin-token',
+    MAINTENANCE_MODE: 'true',
+    MAINTENANCE_MESSAGE: 'Upstream upgrade until 10:00'
+  });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+  const admin = { authorization: 'Bearer admin-token' };
+
+  for (const pathname of ['/api/generate', '/api/generate/async', '/v1/images/generations']) {
+    const { status, body } = await server.request(pathname, { method: 'POST', body: GENERATE, headers: { authorization: 'Bearer key' } });
+    assert.strictEqual(status, 503, pathname);
+    assert.strictEqual(body.errorCode, 'MAINTENANCE', pathname);
+    assert.strictEqual(body.message, 'Upstream upgrade until 10:00', pathname);
+  }
+  assert.strictEqual(upstream.generationRequests().length, 0);
+
+  const health = await server.request('/health');
+  assert.strictEqual(health.status, 200);
+  assert.strictEqual(health.body.maintenance, true);
+  assert.strictEqual((await server.request('/readyz')).status, 200);
+  assert.strictEqual((await server.request('/api/status/some-task')).status, 200);
+  assert.strictEqual((await server.request('/admin/stats', { headers: admin })).status, 200);
+
+  // 运行中关闭维护模式后，生成和轮询恢复正常
+  const toggled = await server.request('/admin/maintenance', { method: 'POST', body: { enabled: false }, headers: admin });
+  assert.strictEqual(toggled.body.maintenance, false);
+  assert.strictEqual(toggled.body.previous, true);
+
+  const { status, body } = await server.request('/api/generate/async', { method: 'POST', body: GENERATE });
+  assert.strictEqual(status, 200);
+  const result = await server.waitForTask(body.taskId);
+  assert.strictEqual(result.status, 'completed');
+
+  // 再次开启：已完成任务的状态仍然可以查询
+  await server.request('/admin/maintenance', { method: 'POST', body: { enabled: true }, headers: admin });
+  assert.strictEqual((await server.request('/api/generate', { method: 'POST', body: GENERATE })).status, 503);
+  const polled = await server.request(`/api/status/${body.taskId}`);
+  assert.strictEqual(polled.status, 200);
+  assert.strictEqual(polled.body.status, 'completed');
+});
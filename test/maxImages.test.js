@@ -0,0 +1,63 @@
+// 每个模型的输入图片上限：默认 sora_image 5 张、Gemini 1 张、Claude 20 张，MAX_IMAGES_PER_MODEL 可按模型或家族覆盖，超出时返回 422
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse } = require('./helpers');
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+const CLAUDE = 'claude-image-preview';
+const PNG = `data:image/png;base64,${Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]).toString('base64')}`;
+const images = count => Array.from({ length: count }, () => PNG);
+
+async function start(env = {}) {
+  const upstream = await startUpstream(request => {
+    if (request.url.includes('generateContent')) return { body: geminiResponse() };
+    if (request.url === '/v1/messages') return { body: { content: [{ type: 'image', source: { type: 'url', url: 'https://cdn.example.com/c.png' } }] } };
+    return { body: soraResponse() };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ...env });
+  const generate = (fields, endpoint = '/api/generate') => server.request(endpoint, { method: 'POST', body: { prompt: 'p', apiKey: 'key', ...fields } });
+  return { upstream, server, generate, close: () => Promise.all([server.close(), upstream.close()]) };
+}
+
+function assertTooMany({ status, body }, model, limit, count, field = 'imageUrls') {
+  const message = `Model ${model} accepts at most ${limit} input image(s), got ${count}`;
+  assert.strictEqual(status, 422, message);
+  assert.deepStrictEqual(body, { error: message, errorCode: 'TOO_MANY_IMAGES', fields: [{ field, message }], model, limit });
+}
+
+test('default per-model limits', async t => {
+  const stack = await start();
+  t.after(() => stack.close());
+  const { generate, upstream } = stack;
+
+  for (const [model, limit] of [['sora_image', 5], [GEMINI, 1], [CLAUDE, 20]]) {
+    await t.test(model, async () => {
+      const before = upstream.generationRequests().length;
+      assertTooMany(await generate({ model, imageUrls: images(limit + 1) }), model, limit, limit + 1);
+      assertTooMany(await generate({ model, imageUrls: images(limit + 1) }, '/api/generate/async'), model, limit, limit + 1);
+      assert.strictEqual(upstream.generationRequests().length, before, 'no upstream call');
+
+      assert.strictEqual((await generate({ model, prompt: `at limit ${model}`, imageUrls: images(limit) })).status, 200);
+    });
+  }
+
+  await t.test('fallback models are checked too', async () => {
+    assertTooMany(await generate({ model: 'sora_image', fallbackModels: [GEMINI], imageUrls: images(2) }), GEMINI, 1, 2);
+  });
+
+  await t.test('a single imageUrl', async () => {
+    assert.strictEqual((await generate({ model: GEMINI, prompt: 'single', imageUrl: PNG })).status, 200);
+  });
+});
+
+test('MAX_IMAGES_PER_MODEL overrides', async t => {
+  const stack = await start({ MAX_IMAGES_PER_MODEL: `gemini=2,sora_image=1,${CLAUDE}=3` });
+  t.after(() => stack.close());
+  const { generate } = stack;
+
+  assertTooMany(await generate({ model: 'sora_image', imageUrl: PNG, imageUrls: images(2) }), 'sora_image', 1, 2);
+  assert.strictEqual((await generate({ model: GEMINI, imageUrls: images(2) })).status, 200, 'the family entry applies');
+  assertTooMany(await generate({ model: GEMINI, imageUrls: images(3) }), GEMINI, 2, 3);
+  assertTooMany(await generate({ model: CLAUDE, imageUrls: images(4) }), CLAUDE, 3, 4);
+  assertTooMany(await generate({ model: 'claude-other', imageUrls: images(21) }), 'claude-other', 20, 21);
+});
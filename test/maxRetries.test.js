@@ -0,0 +1,56 @@
+// maxRetries：请求级覆盖上游重试次数，0 表示不重试，未提供时默认共 3 次尝试；4xx 不重试
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream } = require('./helpers');
+
+test('maxRetries controls the number of upstream attempts', async t => {
+  const upstream = await startUpstream(request => (request.body.includes('bad request')
+    ? { status: 400, body: { error: 'invalid prompt' } }
+    : { status: 503, body: { error: 'overloaded' } }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  // Number of upstream calls made by one generation
+  const attempts = async fields => {
+    const before = upstream.generationRequests().length;
+    const { status } = await server.request('/api/generate', {
+      method: 'POST',
+      body: { model: 'sora_image', apiKey: 'key', prompt: `p ${Math.random()}`, ...fields }
+    });
+    assert.notStrictEqual(status, 200);
+    return upstream.generationRequests().length - before;
+  };
+
+  await t.test('0 disables retries', async () => {
+    const started = Date.now();
+    assert.strictEqual(await attempts({ maxRetries: 0 }), 1);
+    assert.ok(Date.now() - started < 1000, 'no backoff wait');
+  });
+
+  await t.test('1 retries once', async () => {
+    assert.strictEqual(await attempts({ maxRetries: 1 }), 2);
+  });
+
+  await t.test('default', async () => {
+    assert.strictEqual(await attempts({}), 3);
+  });
+
+  await t.test('client errors are not retried', async () => {
+    assert.strictEqual(await attempts({ prompt: 'bad request' }), 1);
+    assert.strictEqual(await attempts({ prompt: 'bad request', maxRetries: 2 }), 1);
+  });
+
+  await t.test('validated', async () => {
+    for (const maxRetries of [-1, 1.5, '2', null]) {
+      const { status, body } = await server.request('/api/generate', {
+        method: 'POST',
+        body: { model: 'sora_image', apiKey: 'key', prompt: 'p', maxRetries }
+      });
+      assert.strictEqual(status, 400, JSON.stringify(maxRetries));
+      assert.ok(body.fields.some(field => field.field === 'maxRetries'));
+    }
+  });
+});
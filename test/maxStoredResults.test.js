@@ -0,0 +1,73 @@
+// MAX_STORED_RESULTS：结果数超过上限时立即删除最后写入时间最早的结果并记录日志，正在运行的任务不淘汰；启动时按文件修改时间载入已有结果
+const test = require('node:test');
+const assert = require('node:assert');
+const fs = require('fs');
+const os = require('os');
+const path = require('path');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+function storedTaskIds(resultDir) {
+  return fs.readdirSync(resultDir).filter(file => file.endsWith('.json')).map(file => file.slice(0, -'.json'.length)).sort();
+}
+
+async function startWithCap(t, env = {}) {
+  const upstream = await startUpstream(request => ({ body: soraResponse(), delayMs: request.body.includes('slow') ? 1500 : 0 }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, MAX_STORED_RESULTS: '3', ...env });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+  const submit = async prompt => (await server.request('/api/generate/async', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt, apiKey: 'key' }
+  })).body.taskId;
+  const run = async prompt => {
+    const taskId = await submit(prompt);
+    await server.waitForTask(taskId);
+    return taskId;
+  };
+  return { server, submit, run };
+}
+
+test('the oldest results are evicted over the cap', async t => {
+  const { server, run } = await startWithCap(t);
+
+  const taskIds = [];
+  for (let i = 0; i < 5; i++) taskIds.push(await run(`task ${i}`));
+
+  assert.deepStrictEqual(storedTaskIds(server.resultDir), taskIds.slice(2).sort());
+  for (const taskId of taskIds.slice(2)) {
+    assert.strictEqual((await server.request(`/api/status/${taskId}`)).body.status, 'completed');
+  }
+  assert.match(server.logs, new RegExp(`\\[EVICT\\] Stored results over MAX_STORED_RESULTS \\(3\\), evicted 1 oldest: ${taskIds[0]}`));
+  assert.match(server.logs, new RegExp(`evicted 1 oldest: ${taskIds[1]}`));
+});
+
+test('running tasks are not evicted', async t => {
+  const { server, submit, run } = await startWithCap(t, { MAX_STORED_RESULTS: '2' });
+
+  const slow = await submit('slow');
+  const fast = [];
+  for (let i = 0; i < 3; i++) fast.push(await run(`fast ${i}`));
+  assert.ok(storedTaskIds(server.resultDir).includes(slow), 'the running task kept its stored state');
+
+  await server.waitForTask(slow);
+  // 完成时重新写入，成为最新的结果
+  assert.deepStrictEqual(storedTaskIds(server.resultDir), [fast[2], slow].sort());
+});
+
+test('existing results count towards the cap after a restart', async t => {
+  const resultDir = fs.mkdtempSync(path.join(os.tmpdir(), 'aiyoutube-test-'));
+  t.after(() => fs.rmSync(resultDir, { recursive: true, force: true }));
+  const now = Date.now() / 1000;
+  for (let i = 0; i < 4; i++) {
+    const file = path.join(resultDir, `old-${i}.json`);
+    fs.writeFileSync(file, JSON.stringify({ success: true, imageUrl: 'https://cdn.example.com/old.png', model: 'sora_image', timestamp: new Date().toISOString() }));
+    fs.utimesSync(file, now - 100 + i, now - 100 + i);
+  }
+
+  const { server, run } = await startWithCap(t, { RESULT_DIR: resultDir });
+  const taskId = await run('new');
+  assert.deepStrictEqual(storedTaskIds(resultDir), ['old-2', 'old-3', taskId].sort());
+  assert.match(server.logs, /evicted 2 oldest: old-0, old-1/);
+});
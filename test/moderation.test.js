@@ -0,0 +1,89 @@
+// 输入图片审核（moderateInputs）：生成前逐张发给 MODERATION_URL，被标记或分数达到 MODERATION_THRESHOLD 时以 CONTENT_REJECTED 失败，不调用上游
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+const VERDICTS = {
+  clean: { flagged: false, score: 0.1 },
+  borderline: { score: 0.59 },
+  risky: { score: 0.6 },
+  flagged: { flagged: true }
+};
+const image = name => `https://images.example.com/${name}.png`;
+
+test('input images are moderated before generation', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const moderation = await startUpstream(request => {
+    const name = JSON.parse(request.body).imageUrl.match(/\/(\w+)\.png$/)[1];
+    return name === 'outage' ? { status: 500, body: { error: 'down' } } : { body: VERDICTS[name] };
+  });
+  const server = await startServer({
+    UPSTREAM_REGIONS: upstream.url,
+    MODERATION_URL: `${moderation.url}/moderate`,
+    MODERATION_API_KEY: 'moderation-key',
+    MODERATION_THRESHOLD: '0.6'
+  });
+  t.after(async () => {
+    await server.close();
+    await Promise.all([upstream.close(), moderation.close()]);
+  });
+
+  let count = 0;
+  const generate = (imageUrls, moderateInputs = true) => server.request('/api/generate', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: `p${count++}`, apiKey: 'key', imageUrls, moderateInputs }
+  });
+  const checked = () => moderation.requests.map(request => JSON.parse(request.body).imageUrl);
+
+  await t.test('clean verdicts', async () => {
+    const { status } = await generate([image('clean'), image('borderline')]);
+    assert.strictEqual(status, 200);
+    assert.deepStrictEqual(checked(), [image('clean'), image('borderline')]);
+    assert.strictEqual(moderation.requests[0].headers.authorization, 'Bearer moderation-key');
+    assert.strictEqual(upstream.generationRequests().length, 1);
+  });
+
+  await t.test('flagged verdicts', async () => {
+    for (const name of ['flagged', 'risky']) {
+      const { status, body } = await generate([image('clean'), image(name)]);
+      assert.strictEqual(status, 422, name);
+      assert.deepStrictEqual(body, { success: false, error: 'Input image rejected by moderation', errorCode: 'CONTENT_REJECTED' });
+    }
+    assert.strictEqual(upstream.generationRequests().length, 1, 'no upstream call for rejected inputs');
+  });
+
+  await t.test('async tasks', async () => {
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'async', apiKey: 'key', imageUrl: image('flagged'), moderateInputs: true }
+    });
+    const result = await server.waitForTask(body.taskId);
+    assert.strictEqual(result.status, 'failed');
+    assert.strictEqual(result.errorCode, 'CONTENT_REJECTED');
+    assert.strictEqual(upstream.generationRequests().length, 1);
+  });
+
+  await t.test('moderation outages fail the task', async () => {
+    const { status, body } = await generate([image('outage')]);
+    assert.strictEqual(status, 500);
+    assert.match(body.error, /Input moderation failed: status 500/);
+    assert.strictEqual(upstream.generationRequests().length, 1);
+  });
+
+  await t.test('opt-in per request', async () => {
+    const before = moderation.requests.length;
+    assert.strictEqual((await generate([image('flagged')], false)).status, 200);
+    assert.strictEqual(moderation.requests.length, before);
+  });
+});
+
+test('moderateInputs requires MODERATION_URL', async t => {
+  const server = await startServer({});
+  t.after(() => server.close());
+  const { status, body } = await server.request('/api/generate', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: 'p', apiKey: 'key', imageUrl: image('clean'), moderateInputs: true }
+  });
+  assert.strictEqual(status, 400);
+  assert.deepStrictEqual(body.fields, [{ field: 'moderateInputs', message: 'moderateInputs requires MODERATION_URL to be configured' }]);
+});
@@ -0,0 +1,51 @@
+// 多模型对比：models 拆成每个模型一个子任务，共用 parentTaskId，通过父任务状态接口查询
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse } = require('./helpers');
+
+test('models fans out one child task per model under the parent id', async t => {
+  const upstream = await startUpstream(request => ({
+    body: request.url.includes('generateContent') ? geminiResponse() : soraResponse()
+  }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const models = ['sora_image', 'gemini-2.5-flash-image-preview'];
+  const { status, body } = await server.request('/api/generate/async', {
+    method: 'POST',
+    body: { models, prompt: 'a lighthouse at dusk', apiKey: 'key', taskId: 'compare-1' }
+  });
+  assert.strictEqual(status, 200);
+  assert.strictEqual(body.parentTaskId, 'compare-1');
+  assert.deepStrictEqual(body.tasks.map(task => task.model), models);
+  assert.deepStrictEqual(body.tasks.map(task => task.taskId), models.map(model => `compare-1:${model}`));
+
+  await Promise.all(body.tasks.map(task => server.waitForTask(task.taskId)));
+
+  const sent = upstream.generationRequests();
+  assert.strictEqual(sent.length, 2);
+  assert.ok(sent.some(request => request.url.includes('/chat/completions')));
+  assert.ok(sent.some(request => request.url.includes('generateContent')));
+  assert.ok(sent.every(request => request.body.includes('a lighthouse at dusk')));
+
+  const { body: parent } = await server.request('/api/status/parent/compare-1');
+  assert.strictEqual(parent.status, 'completed');
+  assert.strictEqual(parent.total, 2);
+  assert.deepStrictEqual(parent.tasks.map(task => task.model).sort(), [...models].sort());
+  assert.ok(parent.tasks.every(task => task.status === 'completed'));
+});
+
+test('models and model are mutually exclusive', async t => {
+  const server = await startServer();
+  t.after(() => server.close());
+
+  const { status, body } = await server.request('/api/generate/async', {
+    method: 'POST',
+    body: { model: 'sora_image', models: ['sora_image'], prompt: 'p', apiKey: 'key' }
+  });
+  assert.strictEqual(status, 400);
+  assert.match(body.error, /mutually exclusive/);
+});
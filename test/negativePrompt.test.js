@@ -0,0 +1,71 @@
+// negativePrompt：sora_image 通过 negative_prompt 字段传递，Gemini 和 Anthropic 追加到提示词（"Avoid: ..."），结果中记录实际使用的反向提示词
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse } = require('./helpers');
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+const CLAUDE = 'claude-image-preview';
+const ANTHROPIC_RESPONSE = { content: [{ type: 'image', source: { type: 'url', url: 'https://cdn.example.com/claude.png' } }] };
+
+test('negative prompts reach the upstream per model', async t => {
+  const upstream = await startUpstream(request => {
+    if (request.url.includes('generateContent')) return { body: geminiResponse() };
+    if (request.url === '/v1/messages') return { body: ANTHROPIC_RESPONSE };
+    return { body: soraResponse() };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const generate = fields => server.request('/api/generate', { method: 'POST', body: { prompt: 'a cat', apiKey: 'key', ...fields } });
+  const lastBody = () => JSON.parse(upstream.generationRequests().at(-1).body);
+
+  await t.test('sora_image uses a structured parameter', async () => {
+    const { status, body } = await generate({ model: 'sora_image', negativePrompt: '  dogs  ' });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.negativePrompt, 'dogs');
+    const sent = lastBody();
+    assert.strictEqual(sent.negative_prompt, 'dogs');
+    assert.ok(!JSON.stringify(sent.messages).includes('Avoid'));
+  });
+
+  await t.test('Gemini appends it to the prompt', async () => {
+    const { body } = await generate({ model: GEMINI, negativePrompt: 'dogs' });
+    assert.strictEqual(body.negativePrompt, 'dogs');
+    const sent = lastBody();
+    assert.strictEqual(sent.contents[0].parts[0].text, 'a cat\nAvoid: dogs');
+    assert.strictEqual(sent.negative_prompt, undefined);
+  });
+
+  await t.test('Anthropic appends it to the prompt', async () => {
+    await generate({ model: CLAUDE, negativePrompt: 'dogs' });
+    assert.deepStrictEqual(lastBody().messages[0].content.at(-1), { type: 'text', text: 'a cat\nAvoid: dogs' });
+  });
+
+  await t.test('blank negative prompts are dropped', async () => {
+    const { body } = await generate({ model: 'sora_image', prompt: 'blank', negativePrompt: '   ' });
+    assert.strictEqual(body.negativePrompt, undefined);
+    assert.strictEqual(lastBody().negative_prompt, undefined);
+  });
+
+  await t.test('recorded on async results', async () => {
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: GEMINI, prompt: 'async cat', apiKey: 'key', negativePrompt: 'dogs' }
+    });
+    const result = await server.waitForTask(body.taskId);
+    assert.strictEqual(result.negativePrompt, 'dogs');
+  });
+
+  await t.test('validation', async () => {
+    const requests = upstream.generationRequests().length;
+    const tooLong = await generate({ model: 'sora_image', negativePrompt: 'x'.repeat(1001) });
+    assert.strictEqual(tooLong.status, 400);
+    assert.deepStrictEqual(tooLong.body.fields, [{ field: 'negativePrompt', message: 'negativePrompt must be at most 1000 characters' }]);
+    const wrongType = await generate({ model: 'sora_image', negativePrompt: ['dogs'] });
+    assert.deepStrictEqual(wrongType.body.fields, [{ field: 'negativePrompt', message: 'negativePrompt must be a string' }]);
+    assert.strictEqual(upstream.generationRequests().length, requests);
+  });
+});
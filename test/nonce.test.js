@@ -0,0 +1,97 @@
+// 防重放：nonce + timestamp，超出时间窗口返回 400、用过的 nonce 返回 409；被其他检查拒绝的请求不记录 nonce，可以用同一个 nonce 重试
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+const now = () => Math.floor(Date.now() / 1000);
+let counter = 0;
+const freshNonce = () => `nonce-${process.pid}-${counter++}`;
+
+test('nonces are checked and recorded', async t => {
+  const upstream = await startUpstream(request => ({ body: soraResponse(), delayMs: request.body.includes('slow') ? 1500 : 0 }));
+  const server = await startServer({
+    UPSTREAM_REGIONS: upstream.url,
+    REQUIRE_NONCE: 'true',
+    NONCE_MAX_SKEW_SECONDS: '60',
+    MAX_INFLIGHT_TASKS: '1',
+    QUOTA_DAILY: '1'
+  });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const submit = (fields, { endpoint = '/api/generate/async', tenant = 'tenant-a', headers = {} } = {}) => server.request(endpoint, {
+    method: 'POST',
+    headers: { 'x-tenant-id': tenant, ...headers },
+    body: { model: 'sora_image', prompt: `p${counter++}`, apiKey: 'key', timestamp: now(), ...fields }
+  });
+
+  await t.test('fresh nonces', async () => {
+    const { status, body } = await submit({ nonce: freshNonce() }, { tenant: 'fresh' });
+    assert.strictEqual(status, 200);
+    await server.waitForTask(body.taskId);
+  });
+
+  await t.test('missing and stale', async () => {
+    const missing = await submit({ nonce: undefined });
+    assert.strictEqual(missing.status, 400);
+    assert.deepStrictEqual(missing.body.fields, [{ field: 'nonce', message: 'nonce and timestamp are required' }]);
+
+    for (const timestamp of [now() - 120, now() + 120]) {
+      const { status, body } = await submit({ nonce: freshNonce(), timestamp });
+      assert.strictEqual(status, 400);
+      assert.deepStrictEqual(body.fields, [{ field: 'timestamp', message: 'timestamp must be within 60s of server time' }]);
+    }
+  });
+
+  await t.test('replayed nonces', async () => {
+    const nonce = freshNonce();
+    const first = await submit({ nonce }, { tenant: 'replay' });
+    assert.strictEqual(first.status, 200);
+    await server.waitForTask(first.body.taskId);
+
+    for (const endpoint of ['/api/generate/async', '/api/generate']) {
+      const { status, body } = await submit({ nonce }, { endpoint, tenant: 'replay-other' });
+      assert.strictEqual(status, 409, endpoint);
+      assert.deepStrictEqual(body, { error: 'Nonce has already been used', errorCode: 'NONCE_REPLAYED' });
+    }
+  });
+
+  await t.test('concurrent requests with the same nonce', async () => {
+    const nonce = freshNonce();
+    const responses = await Promise.all(['race-1', 'race-2'].map(tenant => submit({ nonce }, { endpoint: '/api/generate', tenant })));
+    assert.deepStrictEqual(responses.map(({ status }) => status).sort(), [200, 409]);
+  });
+
+  await t.test('rejected requests do not use up the nonce', async () => {
+    const nonce = freshNonce();
+
+    const expired = await submit({ nonce }, { tenant: 'retry', headers: { 'x-task-deadline': '1970-01-01T00:00:00Z' } });
+    assert.strictEqual(expired.status, 504);
+
+    const badCallback = await submit({ nonce, callbackUrl: 'http://127.0.0.1:1/hook' }, { tenant: 'retry' });
+    assert.strictEqual(badCallback.status, 400);
+
+    // 503：唯一的后台名额被占用
+    const slow = await submit({ nonce: freshNonce(), prompt: 'slow' }, { tenant: 'busy' });
+    assert.strictEqual(slow.status, 200);
+    const busy = await submit({ nonce }, { tenant: 'retry' });
+    assert.strictEqual(busy.status, 503);
+
+    // 409：taskId 正在运行
+    const running = await submit({ nonce, taskId: slow.body.taskId }, { tenant: 'retry' });
+    assert.strictEqual(running.status, 409);
+    assert.strictEqual(running.body.errorCode, 'TASK_ALREADY_RUNNING');
+    await server.waitForTask(slow.body.taskId);
+
+    // 429：租户的配额已用完
+    const overQuota = await submit({ nonce }, { tenant: 'busy' });
+    assert.strictEqual(overQuota.status, 429);
+
+    const accepted = await submit({ nonce }, { tenant: 'retry' });
+    assert.strictEqual(accepted.status, 200);
+    await server.waitForTask(accepted.body.taskId);
+    assert.strictEqual((await submit({ nonce }, { tenant: 'retry-again' })).status, 409);
+  });
+});
@@ -0,0 +1,139 @@
+// OpenAI 兼容接口 POST /v1/images/generations：按 OpenAI 的请求格式解析 size、n、response_format，返回 { created, data }
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse, wait } = require('./helpers');
+
+const PNG_BASE64 = 'iVBORw0KGgo=';
+
+test('OpenAI-compatible image generations', async t => {
+  const upstream = await startUpstream(request => {
+    if (request.url === '/image.png') {
+      return { headers: { 'content-type': 'image/png' }, body: Buffer.from(PNG_BASE64, 'base64') };
+    }
+    if (request.url.includes('generateContent')) return { body: geminiResponse(PNG_BASE64) };
+    return { body: soraResponse(`${upstream.url}/image.png`) };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const generate = (body, headers = { authorization: 'Bearer upstream-key' }) => server.request('/v1/images/generations', { method: 'POST', headers, body });
+
+  await t.test('url format', async () => {
+    const { status, body } = await generate({ model: 'sora_image', prompt: 'a cat', size: '1024x1536' });
+    assert.strictEqual(status, 200);
+    assert.ok(Number.isInteger(body.created));
+    assert.ok(Math.abs(body.created - Date.now() / 1000) < 60);
+    assert.strictEqual(body.data.length, 1);
+    assert.deepStrictEqual(Object.keys(body.data[0]).filter(key => key !== 'revised_prompt'), ['url']);
+    assert.strictEqual(body.data[0].url, `${upstream.url}/image.png`);
+
+    const sent = upstream.generationRequests().at(-1);
+    assert.strictEqual(sent.headers.authorization, 'Bearer upstream-key');
+    assert.match(JSON.stringify(JSON.parse(sent.body).messages), /a cat \[2:3\]/);
+  });
+
+  await t.test('base64 images in url format are served from /api/image', async () => {
+    const { status, body } = await generate({ model: 'gemini-2.5-flash-image-preview', prompt: 'a cat' });
+    assert.strictEqual(status, 200);
+    assert.match(body.data[0].url, /\/api\/image\/openai-/);
+    const image = await fetch(body.data[0].url);
+    assert.strictEqual(image.status, 200);
+    assert.strictEqual(Buffer.from(await image.arrayBuffer()).toString('base64'), PNG_BASE64);
+  });
+
+  await t.test('b64_json format', async () => {
+    for (const model of ['sora_image', 'gemini-2.5-flash-image-preview']) {
+      const { status, body } = await generate({ model, prompt: 'a cat', response_format: 'b64_json' });
+      assert.strictEqual(status, 200, model);
+      assert.deepStrictEqual(Object.keys(body.data[0]).filter(key => key !== 'revised_prompt'), ['b64_json'], model);
+      assert.strictEqual(body.data[0].b64_json, PNG_BASE64, model);
+    }
+  });
+
+  await t.test('n generates that many images', async () => {
+    const before = upstream.generationRequests().length;
+    const { status, body } = await generate({ model: 'sora_image', prompt: 'a cat', n: 3 });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.data.length, 3);
+    assert.strictEqual(upstream.generationRequests().length - before, 3);
+  });
+
+  await t.test('invalid requests get OpenAI-style errors', async () => {
+    const cases = [
+      [{ model: 'sora_image', prompt: 'p', n: 0 }, 'n'],
+      [{ model: 'sora_image', prompt: 'p', n: 5 }, 'n'],
+      [{ model: 'sora_image', prompt: 'p', response_format: 'png' }, 'response_format'],
+      [{ model: 'sora_image', prompt: 'p', size: 'large' }, 'size'],
+      [{ model: 'sora_image', prompt: 'p', size: '1024x512' }, 'size']
+    ];
+    for (const [request, param] of cases) {
+      const { status, body } = await generate(request);
+      assert.strictEqual(status, 400, JSON.stringify(request));
+      assert.strictEqual(body.error.type, 'invalid_request_error');
+      assert.strictEqual(body.error.param, param, JSON.stringify(request));
+    }
+
+    const { status, body } = await generate({ model: 'sora_image', prompt: 'p' }, {});
+    assert.strictEqual(status, 401);
+    assert.strictEqual(body.error.code, 'invalid_api_key');
+  });
+});
+
+test('OpenAI generations get the same replay and admission checks', async t => {
+  const upstream = await startUpstream(request => {
+    if (request.url === '/image.png') {
+      return { headers: { 'content-type': 'image/png' }, body: Buffer.from(PNG_BASE64, 'base64') };
+    }
+    return { body: soraResponse(`${upstream.url}/image.png`), delayMs: request.body.includes('slow') ? 1000 : 0 };
+  });
+  // 只允许 JPEG 输入图片：生成结果的下载不受输入图片白名单限制
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, MAX_INFLIGHT_TASKS: '2', INPUT_IMAGE_CONTENT_TYPES: 'image/jpeg', ADMIN_TOKEN: 'admin-token' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const generate = body => server.request('/v1/images/generations', { method: 'POST', headers: { authorization: 'Bearer upstream-key' }, body });
+  const now = () => Math.floor(Date.now() / 1000);
+
+  await t.test('b64_json downloads the generated image as is', async () => {
+    const { status, body } = await generate({ model: 'sora_image', prompt: 'a png', response_format: 'b64_json' });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.data[0].b64_json, PNG_BASE64);
+  });
+
+  await t.test('nonces are checked and recorded', async () => {
+    const nonce = 'openai-nonce-1';
+    assert.strictEqual((await generate({ model: 'sora_image', prompt: 'nonce a', nonce, timestamp: now() })).status, 200);
+    const replayed = await generate({ model: 'sora_image', prompt: 'nonce b', nonce, timestamp: now() });
+    assert.strictEqual(replayed.status, 409);
+    assert.strictEqual(replayed.body.error.code, 'nonce_replayed');
+
+    const stale = await generate({ model: 'sora_image', prompt: 'nonce c', nonce: 'openai-nonce-2', timestamp: now() - 3600 });
+    assert.strictEqual(stale.status, 400);
+    assert.strictEqual(stale.body.error.param, 'timestamp');
+    const missing = await generate({ model: 'sora_image', prompt: 'nonce d', nonce: 'openai-nonce-3' });
+    assert.strictEqual(missing.status, 400);
+    assert.strictEqual(missing.body.error.param, 'timestamp');
+  });
+
+  await t.test('generations count towards MAX_INFLIGHT_TASKS', async () => {
+    const running = generate({ model: 'sora_image', prompt: 'slow', n: 2 });
+    while ((await server.request('/admin/stats', { headers: { authorization: 'Bearer admin-token' } })).body.tasks.inflightAsync < 2) await wait(10);
+
+    const { status, headers, body } = await generate({ model: 'sora_image', prompt: 'busy', nonce: 'openai-nonce-4', timestamp: now() });
+    assert.strictEqual(status, 503);
+    assert.ok(Number(headers.get('retry-after')) >= 1);
+    assert.strictEqual(body.retryAfter, Number(headers.get('retry-after')));
+    assert.strictEqual(body.error.code, 'server_busy');
+    const async = await server.request('/api/generate/async', { method: 'POST', body: { model: 'sora_image', prompt: 'busy async', apiKey: 'key' } });
+    assert.strictEqual(async.status, 503);
+
+    assert.strictEqual((await running).status, 200);
+    // 被拒绝的请求没有记录 nonce，可以重试
+    assert.strictEqual((await generate({ model: 'sora_image', prompt: 'busy', nonce: 'openai-nonce-4', timestamp: now() })).status, 200);
+  });
+});
@@ -0,0 +1,82 @@
+// outputImageFormat：base64 结果（convertOutput 时也包括 URL 结果）用 sharp 转成请求的格式；没有 sharp 或转换失败时保留原图
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, geminiResponse, soraResponse } = require('./helpers');
+
+let sharp = null;
+try {
+  sharp = require('sharp');
+} catch (error) {
+  // Optional dependency, the transcoding tests are skipped without it
+}
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+const DATA_URL = /^data:(image\/[a-z]+);base64,(.+)$/;
+
+async function startWithImage(t, png) {
+  const upstream = await startUpstream(request => {
+    if (request.url === '/remote.png') return { headers: { 'content-type': 'image/png' }, body: png };
+    if (request.url.includes('generateContent')) return { body: geminiResponse(png.toString('base64')) };
+    return { body: soraResponse(`${upstream.url}/remote.png`) };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+  const generate = async fields => {
+    const { status, body } = await server.request('/api/generate', { method: 'POST', body: { model: GEMINI, prompt: 'p', apiKey: 'key', ...fields } });
+    assert.strictEqual(status, 200);
+    return body;
+  };
+  return { server, generate };
+}
+
+test('a small PNG is transcoded to the requested format', { skip: sharp ? false : 'sharp is not installed' }, async t => {
+  const png = await sharp({ create: { width: 32, height: 32, channels: 3, background: { r: 200, g: 40, b: 40 } } }).png().toBuffer();
+  const { generate } = await startWithImage(t, png);
+
+  for (const [format, mimeType] of [['jpeg', 'image/jpeg'], ['webp', 'image/webp']]) {
+    await t.test(format, async () => {
+      const body = await generate({ outputImageFormat: format });
+      const [, type, data] = DATA_URL.exec(body.imageUrl);
+      assert.strictEqual(type, mimeType);
+      const metadata = await sharp(Buffer.from(data, 'base64')).metadata();
+      assert.strictEqual(metadata.format, format);
+      assert.strictEqual(metadata.width, 32);
+    });
+  }
+
+  await t.test('url results only with convertOutput', async () => {
+    assert.match((await generate({ model: 'sora_image', outputImageFormat: 'webp' })).imageUrl, /\/remote\.png$/);
+    const converted = await generate({ model: 'sora_image', outputImageFormat: 'webp', convertOutput: true });
+    assert.strictEqual(DATA_URL.exec(converted.imageUrl)[1], 'image/webp');
+  });
+
+  await t.test('undecodable images keep the original', async () => {
+    // 不是合法 PNG 的 base64 数据
+    const { generate: generateBroken } = await startWithImage(t, Buffer.concat([png.subarray(0, 16), Buffer.alloc(16)]));
+    const body = await generateBroken({ outputImageFormat: 'jpeg' });
+    assert.strictEqual(DATA_URL.exec(body.imageUrl)[1], 'image/png');
+  });
+});
+
+test('the original image is kept without sharp', { skip: sharp ? 'sharp is installed' : false }, async t => {
+  const png = Buffer.concat([Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]), Buffer.alloc(24)]);
+  const { server, generate } = await startWithImage(t, png);
+
+  const body = await generate({ outputImageFormat: 'webp' });
+  assert.strictEqual(body.imageUrl, `data:image/png;base64,${png.toString('base64')}`);
+  assert.match(server.logs, /outputImageFormat webp requested but sharp is not installed, keeping original image/);
+});
+
+test('output formats are validated', async t => {
+  const server = await startServer();
+  t.after(() => server.close());
+
+  for (const fields of [{ outputImageFormat: 'bmp' }, { convertOutput: 'yes' }, { outputQuality: 0 }, { outputQuality: 101 }]) {
+    const { status, body } = await server.request('/api/generate', { method: 'POST', body: { model: GEMINI, prompt: 'p', apiKey: 'key', ...fields } });
+    assert.strictEqual(status, 400, JSON.stringify(fields));
+    assert.strictEqual(body.fields.length, 1);
+  }
+});
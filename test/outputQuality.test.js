@@ -0,0 +1,75 @@
+// outputQuality（1-100）：转成 jpeg、webp 等有损格式时的编码质量，质量越低图片越小；不指定时按 80；没有 outputImageFormat 时不重新编码
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, geminiResponse } = require('./helpers');
+
+let sharp = null;
+try {
+  sharp = require('sharp');
+} catch (error) {
+  // Optional dependency, the size comparison is skipped without it
+}
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+const DATA_URL = /^data:(image\/[a-z]+);base64,(.+)$/;
+
+async function startWithImage(t, png) {
+  const upstream = await startUpstream(() => ({ body: geminiResponse(png.toString('base64')) }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+  const generate = async fields => server.request('/api/generate', { method: 'POST', body: { model: GEMINI, prompt: 'p', apiKey: 'key', ...fields } });
+  return { server, generate };
+}
+
+test('lower quality produces smaller output', { skip: sharp ? false : 'sharp is not installed' }, async t => {
+  // 噪点图，不同质量的编码大小差别明显
+  const png = await sharp({ create: { width: 128, height: 128, channels: 3, background: { r: 0, g: 0, b: 0 }, noise: { type: 'gaussian', mean: 128, sigma: 40 } } }).png().toBuffer();
+  const { server, generate } = await startWithImage(t, png);
+  const outputSize = async fields => {
+    const { status, body } = await generate(fields);
+    assert.strictEqual(status, 200);
+    const [, type, data] = DATA_URL.exec(body.imageUrl);
+    assert.strictEqual(type, `image/${fields.outputImageFormat}`);
+    return Buffer.from(data, 'base64').length;
+  };
+
+  for (const format of ['jpeg', 'webp']) {
+    await t.test(format, async () => {
+      const low = await outputSize({ outputImageFormat: format, outputQuality: 10 });
+      const high = await outputSize({ outputImageFormat: format, outputQuality: 95 });
+      assert.ok(low < high, `quality 10 gave ${low} bytes, quality 95 gave ${high} bytes`);
+      assert.strictEqual(await outputSize({ outputImageFormat: format }), await outputSize({ outputImageFormat: format, outputQuality: 80 }));
+    });
+  }
+
+  await t.test('the quality is logged', async () => {
+    await outputSize({ outputImageFormat: 'jpeg', outputQuality: 42 });
+    assert.match(server.logs, /Transcoded output image to image\/jpeg \(quality 42\)/);
+  });
+});
+
+test('quality without an output format keeps the original', async t => {
+  const png = Buffer.concat([Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]), Buffer.alloc(24)]);
+  const { generate } = await startWithImage(t, png);
+
+  const { status, body } = await generate({ outputQuality: 10 });
+  assert.strictEqual(status, 200);
+  assert.strictEqual(body.imageUrl, `data:image/png;base64,${png.toString('base64')}`);
+});
+
+test('outputQuality must be an integer from 1 to 100', async t => {
+  const server = await startServer();
+  t.after(() => server.close());
+
+  for (const outputQuality of [0, 101, 50.5, '80', null]) {
+    const { status, body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: GEMINI, prompt: 'p', apiKey: 'key', outputImageFormat: 'jpeg', outputQuality }
+    });
+    assert.strictEqual(status, 400, JSON.stringify(outputQuality));
+    assert.deepStrictEqual(body.fields, [{ field: 'outputQuality', message: 'outputQuality must be an integer between 1 and 100' }]);
+  }
+});
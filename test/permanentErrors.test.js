@@ -0,0 +1,48 @@
+// 上游 5xx 的响应体匹配 UPSTREAM_PERMANENT_ERROR_PATTERNS 时不重试，直接按 CONTENT_REJECTED 失败；其他 5xx 照常重试
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream } = require('./helpers');
+
+test('permanent 5xx errors are not retried', async t => {
+  const upstream = await startUpstream(request => (request.body.includes('forbidden')
+    ? { status: 500, body: { error: { message: 'Request blocked by the Safety System', code: 'moderation_blocked' } } }
+    : { status: 503, body: { error: 'temporarily overloaded' } }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, UPSTREAM_PERMANENT_ERROR_PATTERNS: 'safety system,content_policy_violation' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const callsFor = prompt => upstream.generationRequests().filter(request => request.body.includes(prompt)).length;
+
+  await t.test('sync request', async () => {
+    const { status, body } = await server.request('/api/generate', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'something forbidden', apiKey: 'key', maxRetries: 3 }
+    });
+    assert.strictEqual(status, 422);
+    assert.strictEqual(body.errorCode, 'CONTENT_REJECTED');
+    assert.strictEqual(callsFor('something forbidden'), 1);
+  });
+
+  await t.test('async task', async () => {
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'also forbidden', apiKey: 'key', maxRetries: 3 }
+    });
+    const result = await server.waitForTask(body.taskId);
+    assert.strictEqual(result.status, 'failed');
+    assert.strictEqual(result.errorCode, 'CONTENT_REJECTED');
+    assert.strictEqual(callsFor('also forbidden'), 1);
+  });
+
+  await t.test('other 5xx errors are still retried', async () => {
+    const { status, body } = await server.request('/api/generate', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'busy', apiKey: 'key', maxRetries: 1 }
+    });
+    assert.strictEqual(status, 500);
+    assert.notStrictEqual(body.errorCode, 'CONTENT_REJECTED');
+    assert.strictEqual(callsFor('busy'), 2);
+  });
+});
@@ -0,0 +1,79 @@
+// 预览图（wantPreviews: true，sora_image）：以 stream 模式调用上游，先出现的图片链接作为预览在轮询时可见，最后一张为最终图片
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+const PREVIEW = 'https://cdn.example.com/preview-low.png';
+const FINAL = 'https://cdn.example.com/final.png';
+
+const event = (delta, finishReason = null) => `data: ${JSON.stringify({ choices: [{ delta, finish_reason: finishReason }] })}\n\n`;
+
+test('previews are captured from the stream', async t => {
+  const upstream = await startUpstream((request, res) => {
+    if (!JSON.parse(request.body).stream) return { body: soraResponse(FINAL) };
+    res.writeHead(200, { 'content-type': 'text/event-stream' });
+    res.write(event({ role: 'assistant', content: 'Generating...\n' }));
+    res.write(event({ content: `![preview](${PREVIEW})\n` }));
+    setTimeout(() => {
+      res.write(event({ content: `![final](${FINAL})` }));
+      res.write(event({}, 'stop'));
+      res.end('data: [DONE]\n\n');
+    }, 1000);
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const submit = async fields => (await server.request('/api/generate/async', {
+    method: 'POST',
+    body: { model: 'sora_image', apiKey: 'key', ...fields }
+  })).body.taskId;
+
+  await t.test('async polling', async () => {
+    const taskId = await submit({ prompt: 'with previews', wantPreviews: true });
+    let progress;
+    for (let i = 0; i < 40 && !progress; i++) {
+      const { body } = await server.request(`/api/status/${taskId}`);
+      if (body.previews) progress = body;
+      else await wait(50);
+    }
+    assert.ok(progress, 'the preview was visible before completion');
+    assert.strictEqual(progress.status, 'processing');
+    assert.deepStrictEqual(progress.previews, [PREVIEW]);
+
+    const result = await server.waitForTask(taskId);
+    assert.strictEqual(result.status, 'completed');
+    assert.strictEqual(result.imageUrl, FINAL);
+    assert.deepStrictEqual(result.previews, [PREVIEW]);
+    assert.strictEqual(result.finishReason, 'stop');
+    assert.strictEqual(JSON.parse(upstream.generationRequests().at(-1).body).stream, true);
+  });
+
+  await t.test('sync requests', async () => {
+    const { status, body } = await server.request('/api/generate', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'sync previews', apiKey: 'key', wantPreviews: true }
+    });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.imageUrl, FINAL);
+    assert.deepStrictEqual(body.previews, [PREVIEW]);
+  });
+
+  await t.test('off by default', async () => {
+    const result = await server.waitForTask(await submit({ prompt: 'no previews' }));
+    assert.strictEqual(result.imageUrl, FINAL);
+    assert.strictEqual(result.previews, undefined);
+    assert.strictEqual(JSON.parse(upstream.generationRequests().at(-1).body).stream, undefined);
+  });
+
+  await t.test('validation', async () => {
+    const { status, body } = await server.request('/api/generate', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'p', apiKey: 'key', wantPreviews: 'yes' }
+    });
+    assert.strictEqual(status, 400);
+    assert.deepStrictEqual(body.fields, [{ field: 'wantPreviews', message: 'wantPreviews must be a boolean' }]);
+  });
+});
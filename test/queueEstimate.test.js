@@ -0,0 +1,41 @@
+// /api/generate/async 的 queueDepth 和 estimatedStartSeconds：按排队任务数、并发上限和平均任务耗时估算，队列越深等待越久
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+const ADMIN = { authorization: 'Bearer admin-token' };
+
+test('the start estimate grows with the queue', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse(), delayMs: 1500 }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, MAX_CONCURRENCY: '1', ADMIN_TOKEN: 'admin-token' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const submit = async i => (await server.request('/api/generate/async', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: `queued ${i}`, apiKey: 'key' }
+  })).body;
+
+  const pending = async () => {
+    const { running, queued } = (await server.request('/admin/stats', { headers: ADMIN })).body.concurrency;
+    return running + queued;
+  };
+
+  // 任务开始前有异步的准备步骤，等上一个任务占到名额或进入队列再提交下一个
+  const responses = [];
+  for (let i = 0; i < 4; i++) {
+    responses.push(await submit(i));
+    while (await pending() < i + 1) await wait(10);
+  }
+
+  // 还没有完成过的任务，平均耗时按 30 秒的默认值估算
+  assert.deepStrictEqual(responses.map(body => body.queueDepth), [0, 0, 1, 2]);
+  assert.deepStrictEqual(responses.map(body => body.estimatedStartSeconds), [0, 30, 60, 90]);
+
+  await Promise.all(responses.map(body => server.waitForTask(body.taskId)));
+  const idle = await submit(4);
+  assert.strictEqual(idle.queueDepth, 0);
+  assert.strictEqual(idle.estimatedStartSeconds, 0, 'a free slot means the task starts right away');
+});
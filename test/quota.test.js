@@ -0,0 +1,143 @@
+// 租户配额：成功的生成计入租户用量，超出上限返回 429 QUOTA_EXCEEDED；用量存放在 RESULT_DIR 中，重启和多实例共用
+const test = require('node:test');
+const assert = require('node:assert');
+const fs = require('fs');
+const os = require('os');
+const path = require('path');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+const ADMIN = { authorization: 'Bearer admin-token' };
+
+function generate(server, tenantId, prompt = 'p') {
+  return server.request('/api/generate', {
+    method: 'POST',
+    headers: { 'x-tenant-id': tenantId },
+    body: { model: 'sora_image', prompt, apiKey: 'key', maxRetries: 1 }
+  });
+}
+
+async function usedToday(server, tenantId) {
+  const { body } = await server.request(`/admin/quotas/${tenantId}`, { headers: ADMIN });
+  return body.daily.used;
+}
+
+test('tenants are limited to their quota, across restarts', async t => {
+  const upstream = await startUpstream(request => (request.body.includes('fail me')
+    ? { status: 400, body: { error: 'prompt rejected' } }
+    : { body: soraResponse() }));
+  const resultDir = fs.mkdtempSync(path.join(os.tmpdir(), 'aiyoutube-test-'));
+  const env = { UPSTREAM_REGIONS: upstream.url, RESULT_DIR: resultDir, ADMIN_TOKEN: 'admin-token', QUOTA_DAILY: '2', TENANT_DAILY_QUOTAS: 'vip=3' };
+  let server = await startServer(env);
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+    fs.rmSync(resultDir, { recursive: true, force: true });
+  });
+
+  await t.test('an over-quota tenant is rejected without reaching the upstream', async () => {
+    assert.strictEqual((await generate(server, 'acme')).status, 200);
+    assert.notStrictEqual((await generate(server, 'acme', 'fail me')).status, 200);
+    assert.strictEqual((await generate(server, 'acme')).status, 200);
+    const calls = upstream.generationRequests().length;
+
+    const { status, body, headers } = await generate(server, 'acme');
+    assert.strictEqual(status, 429);
+    assert.strictEqual(body.errorCode, 'QUOTA_EXCEEDED');
+    assert.strictEqual(body.period, 'daily');
+    assert.strictEqual(body.limit, 2);
+    assert.strictEqual(body.used, 2);
+    assert.ok(Number(headers.get('retry-after')) > 0);
+    assert.strictEqual(upstream.generationRequests().length, calls);
+  });
+
+  await t.test('other tenants keep their own quota', async () => {
+    assert.strictEqual((await generate(server, 'other')).status, 200);
+    for (let i = 0; i < 3; i++) assert.strictEqual((await generate(server, 'vip')).status, 200);
+    assert.strictEqual((await generate(server, 'vip')).status, 429);
+  });
+
+  await t.test('the admin can raise a tenant limit', async () => {
+    const { status, body } = await server.request('/admin/quotas/acme', { method: 'POST', headers: ADMIN, body: { daily: 3 } });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.daily.limit, 3);
+    assert.strictEqual((await generate(server, 'acme')).status, 200);
+    assert.strictEqual((await generate(server, 'acme')).status, 429);
+    assert.strictEqual(await usedToday(server, 'acme'), 3);
+  });
+
+  await t.test('usage and overrides survive a restart', async () => {
+    await server.close();
+    server = await startServer(env);
+    assert.strictEqual(await usedToday(server, 'acme'), 3);
+    assert.strictEqual((await generate(server, 'acme')).status, 429);
+    assert.strictEqual((await generate(server, 'other')).status, 200);
+    assert.strictEqual(await usedToday(server, 'other'), 2);
+  });
+});
+
+test('instances sharing RESULT_DIR count usage together', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse(), delayMs: 20 }));
+  const resultDir = fs.mkdtempSync(path.join(os.tmpdir(), 'aiyoutube-test-'));
+  const env = { UPSTREAM_REGIONS: upstream.url, RESULT_DIR: resultDir, ADMIN_TOKEN: 'admin-token' };
+  const servers = [await startServer(env), await startServer(env)];
+  t.after(async () => {
+    await Promise.all(servers.map(server => server.close()));
+    await upstream.close();
+    fs.rmSync(resultDir, { recursive: true, force: true });
+  });
+
+  const responses = await Promise.all(servers.flatMap(server => Array.from({ length: 10 }, () => generate(server, 'shared'))));
+  assert.ok(responses.every(({ status }) => status === 200));
+  for (const server of servers) {
+    assert.strictEqual(await usedToday(server, 'shared'), 20);
+  }
+});
+
+test('generations in progress on one instance hold quota for the others', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse(), delayMs: 800 }));
+  const resultDir = fs.mkdtempSync(path.join(os.tmpdir(), 'aiyoutube-test-'));
+  // TASK_TIMEOUT_MS 1000：崩溃实例留下的占用 2 秒后失效
+  const env = { UPSTREAM_REGIONS: upstream.url, RESULT_DIR: resultDir, ADMIN_TOKEN: 'admin-token', QUOTA_DAILY: '3', TASK_TIMEOUT_MS: '1000' };
+  const servers = [await startServer(env), await startServer(env)];
+  t.after(async () => {
+    await Promise.all(servers.map(server => server.close()));
+    await upstream.close();
+    fs.rmSync(resultDir, { recursive: true, force: true });
+  });
+
+  await t.test('concurrent requests across instances never exceed the limit', async () => {
+    const responses = await Promise.all(servers.flatMap((server, i) => Array.from({ length: 4 }, (_, j) => generate(server, 'busy', `busy ${i} ${j}`))));
+    assert.strictEqual(responses.filter(({ status }) => status === 200).length, 3);
+    assert.ok(responses.every(({ status }) => status === 200 || status === 429));
+    assert.strictEqual(await usedToday(servers[1], 'busy'), 3);
+  });
+
+  await t.test('the other instance reports reservations as in progress', async () => {
+    const running = generate(servers[0], 'reserved', 'reserved 0');
+    let quota;
+    do {
+      quota = (await servers[1].request('/admin/quotas/reserved', { headers: ADMIN })).body;
+    } while (quota.inProgress === 0);
+    assert.strictEqual(quota.inProgress, 1);
+    assert.strictEqual((await running).status, 200);
+    quota = (await servers[1].request('/admin/quotas/reserved', { headers: ADMIN })).body;
+    assert.strictEqual(quota.inProgress, 0);
+    assert.strictEqual(quota.daily.used, 1);
+  });
+
+  await t.test('reservations of a crashed instance expire', async () => {
+    const pending = Promise.all(Array.from({ length: 3 }, (_, i) => generate(servers[0], 'crashed', `crashed ${i}`)).map(request => request.catch(() => null)));
+    let quota;
+    do {
+      quota = (await servers[1].request('/admin/quotas/crashed', { headers: ADMIN })).body;
+    } while (quota.inProgress < 3);
+    await servers[0].close();
+    await pending;
+
+    const { status, body } = await generate(servers[1], 'crashed', 'crashed after');
+    assert.strictEqual(status, 429);
+    assert.strictEqual(body.inProgress, 3);
+    await new Promise(resolve => setTimeout(resolve, 2100));
+    assert.strictEqual((await generate(servers[1], 'crashed', 'crashed later')).status, 200);
+  });
+});
@@ -0,0 +1,29 @@
+// GET /api/raw/:taskId：返回任务存储的上游原始响应（需要管理员 token），普通状态接口不包含它
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+const ADMIN = { authorization: 'Bearer admin-token' };
+
+test('the raw upstream response can be fetched for a task', async t => {
+  const upstreamBody = { ...soraResponse(), id: 'chatcmpl-raw-1', usage: { total_tokens: 42 } };
+  const upstream = await startUpstream(() => ({ body: upstreamBody }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ADMIN_TOKEN: 'admin-token' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const { body: submitted } = await server.request('/api/generate/async', { method: 'POST', body: { model: 'sora_image', prompt: 'p', apiKey: 'key' } });
+  const { taskId } = submitted;
+  const status = await server.waitForTask(taskId);
+  assert.strictEqual(status.rawResponse, undefined);
+
+  const { status: code, headers, body } = await server.request(`/api/raw/${taskId}`, { headers: ADMIN });
+  assert.strictEqual(code, 200);
+  assert.match(headers.get('content-type'), /^application\/json/);
+  assert.deepStrictEqual(body, upstreamBody);
+
+  assert.strictEqual((await server.request(`/api/raw/${taskId}`)).status, 401);
+  assert.strictEqual((await server.request('/api/raw/no-such-task', { headers: ADMIN })).status, 404);
+});
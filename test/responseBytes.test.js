@@ -0,0 +1,37 @@
+// responseBytes：记录上游响应体的字节数，保存到任务结果，并汇总到 /health 的 responseBytes（p50/p95/max），debug 级别时写日志
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+// Serialized bodies of known length, padded with a field the parser ignores
+const body = padding => JSON.stringify({ ...soraResponse(), padding: 'x'.repeat(padding) });
+const SMALL = body(100);
+const LARGE = body(50000);
+
+test('upstream response sizes are recorded', async t => {
+  const upstream = await startUpstream(request => ({ body: request.body.includes('large') ? LARGE : SMALL }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, LOG_LEVEL: 'debug' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const { body: health } = await server.request('/health');
+  assert.strictEqual(health.responseBytes.samples, 0);
+
+  const sync = await server.request('/api/generate', { method: 'POST', body: { model: 'sora_image', prompt: 'small', apiKey: 'key' } });
+  assert.strictEqual(sync.body.responseBytes, Buffer.byteLength(SMALL));
+
+  const { body: submitted } = await server.request('/api/generate/async', { method: 'POST', body: { model: 'sora_image', prompt: 'large', apiKey: 'key' } });
+  const result = await server.waitForTask(submitted.taskId);
+  assert.strictEqual(result.responseBytes, Buffer.byteLength(LARGE));
+  assert.match(server.logs, new RegExp(`\\[${submitted.taskId}\\] Upstream response body: ${Buffer.byteLength(LARGE)} bytes`));
+
+  const { body: after } = await server.request('/health');
+  assert.deepStrictEqual(after.responseBytes, {
+    p50: Buffer.byteLength(SMALL),
+    p95: Buffer.byteLength(LARGE),
+    max: Buffer.byteLength(LARGE),
+    samples: 2
+  });
+});
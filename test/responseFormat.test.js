@@ -0,0 +1,48 @@
+// responseFormat：sora_image 请求体带上 OpenAI 兼容的 response_format，json_object 返回的 JSON 内容里的图片地址照常提取
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream } = require('./helpers');
+
+test('responseFormat reaches the upstream body', async t => {
+  const upstream = await startUpstream(request => {
+    const { response_format: format } = JSON.parse(request.body);
+    const content = format?.type === 'json_object'
+      ? JSON.stringify({ image_url: 'https://cdn.example.com/json.png', caption: 'a cat' })
+      : '![image](https://cdn.example.com/text.png)';
+    return { body: { choices: [{ message: { content }, finish_reason: 'stop' }] } };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const generate = fields => server.request('/api/generate', { method: 'POST', body: { model: 'sora_image', prompt: 'p', apiKey: 'key', ...fields } });
+  const sent = () => JSON.parse(upstream.generationRequests().at(-1).body);
+
+  await t.test('json_object', async () => {
+    const { status, body } = await generate({ responseFormat: 'json_object' });
+    assert.strictEqual(status, 200);
+    assert.deepStrictEqual(sent().response_format, { type: 'json_object' });
+    assert.strictEqual(body.imageUrl, 'https://cdn.example.com/json.png');
+  });
+
+  await t.test('text and unset', async () => {
+    assert.strictEqual((await generate({ responseFormat: 'text' })).status, 200);
+    assert.deepStrictEqual(sent().response_format, { type: 'text' });
+
+    const { body } = await generate({});
+    assert.strictEqual(sent().response_format, undefined);
+    assert.strictEqual(body.imageUrl, 'https://cdn.example.com/text.png');
+  });
+
+  await t.test('validated', async () => {
+    const calls = upstream.generationRequests().length;
+    for (const fields of [{ responseFormat: 'xml' }, { responseFormat: { type: 'json_object' } }, { model: 'gemini-2.5-flash-image-preview', responseFormat: 'json_object' }]) {
+      const { status, body } = await generate(fields);
+      assert.strictEqual(status, 400, JSON.stringify(fields));
+      assert.ok(body.fields.some(field => field.field === 'responseFormat'));
+    }
+    assert.strictEqual(upstream.generationRequests().length, calls);
+  });
+});
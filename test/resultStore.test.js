@@ -0,0 +1,106 @@
+// 结果存储：所有读写经过 resultStore，形状不对的结果按不存在处理；结果写入 RESULT_DIR，重启后仍可查询；过期结果和残留的临时文件由清理周期删除
+const test = require('node:test');
+const assert = require('node:assert');
+const fs = require('fs');
+const os = require('os');
+const path = require('path');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+const HOUR_AGO = new Date(Date.now() - 60 * 60 * 1000);
+
+test('malformed stored results are treated as missing', async t => {
+  const resultDir = fs.mkdtempSync(path.join(os.tmpdir(), 'aiyoutube-test-'));
+  const stored = {
+    good: JSON.stringify({ success: true, status: 'completed', imageUrl: 'https://cdn.example.com/good.png' }),
+    truncated: '{"success": tr',
+    'no-success-flag': JSON.stringify({ status: 'completed', imageUrl: 'https://cdn.example.com/bad.png' }),
+    'string-flag': JSON.stringify({ success: 'yes' }),
+    array: JSON.stringify([{ success: true }]),
+    'null': 'null'
+  };
+  for (const [taskId, data] of Object.entries(stored)) {
+    fs.writeFileSync(path.join(resultDir, `${taskId}.json`), data);
+  }
+  const server = await startServer({ RESULT_DIR: resultDir, ADMIN_TOKEN: 'admin-token' });
+  t.after(async () => {
+    await server.close();
+    fs.rmSync(resultDir, { recursive: true, force: true });
+  });
+
+  assert.strictEqual((await server.request('/api/status/good')).body.status, 'completed');
+  for (const taskId of Object.keys(stored).filter(taskId => taskId !== 'good')) {
+    const { status, body } = await server.request(`/api/status/${taskId}`);
+    assert.strictEqual(status, 200, taskId);
+    assert.strictEqual(body.status, 'processing', taskId);
+  }
+
+  const { body } = await server.request('/api/results', { headers: { authorization: 'Bearer admin-token' } });
+  assert.deepStrictEqual(body.results.map(result => result.taskId), ['good']);
+});
+
+test('listing stops at the requested limit', async t => {
+  const resultDir = fs.mkdtempSync(path.join(os.tmpdir(), 'aiyoutube-test-'));
+  for (let i = 0; i < 5; i++) {
+    fs.writeFileSync(path.join(resultDir, `task-${i}.json`), JSON.stringify({ success: true, status: 'completed', imageUrl: `https://cdn.example.com/${i}.png` }));
+  }
+  const server = await startServer({ RESULT_DIR: resultDir, ADMIN_TOKEN: 'admin-token' });
+  t.after(async () => {
+    await server.close();
+    fs.rmSync(resultDir, { recursive: true, force: true });
+  });
+
+  const { body } = await server.request('/api/results?limit=2', { headers: { authorization: 'Bearer admin-token' } });
+  assert.strictEqual(body.count, 2);
+});
+
+test('results are stored atomically and survive a restart', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse('https://cdn.example.com/stored.png') }));
+  const resultDir = fs.mkdtempSync(path.join(os.tmpdir(), 'aiyoutube-test-'));
+  t.after(async () => {
+    await upstream.close();
+    fs.rmSync(resultDir, { recursive: true, force: true });
+  });
+
+  const first = await startServer({ UPSTREAM_REGIONS: upstream.url, RESULT_DIR: resultDir });
+  const { body } = await first.request('/api/generate/async', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: 'p', apiKey: 'key' }
+  });
+  const result = await first.waitForTask(body.taskId);
+  await first.close();
+  assert.strictEqual(result.status, 'completed');
+
+  const files = fs.readdirSync(resultDir);
+  assert.ok(files.includes(`${body.taskId}.json`));
+  assert.ok(!files.some(file => file.endsWith('.tmp')), 'no temp files left after writes');
+
+  const second = await startServer({ UPSTREAM_REGIONS: upstream.url, RESULT_DIR: resultDir });
+  t.after(() => second.close());
+  const { body: restored } = await second.request(`/api/status/${body.taskId}`);
+  assert.strictEqual(restored.status, 'completed');
+  assert.strictEqual(restored.imageUrl, 'https://cdn.example.com/stored.png');
+});
+
+test('the cleanup sweep removes expired results and stale temp files', async t => {
+  const resultDir = fs.mkdtempSync(path.join(os.tmpdir(), 'aiyoutube-test-'));
+  const stored = { success: true, status: 'completed', imageUrl: 'https://cdn.example.com/old.png', completedAt: HOUR_AGO.toISOString() };
+  for (const taskId of ['expired', 'fresh']) {
+    fs.writeFileSync(path.join(resultDir, `${taskId}.json`), JSON.stringify(stored));
+  }
+  fs.utimesSync(path.join(resultDir, 'expired.json'), HOUR_AGO, HOUR_AGO);
+  fs.writeFileSync(path.join(resultDir, 'crashed.json.123.abcdef.tmp'), '{"succ');
+  fs.utimesSync(path.join(resultDir, 'crashed.json.123.abcdef.tmp'), HOUR_AGO, HOUR_AGO);
+
+  const server = await startServer({ RESULT_DIR: resultDir, CLEANUP_INTERVAL_MS: '200', CLEANUP_JITTER: '0' });
+  t.after(async () => {
+    await server.close();
+    fs.rmSync(resultDir, { recursive: true, force: true });
+  });
+  assert.strictEqual((await server.request('/api/status/expired')).body.status, 'completed');
+
+  await wait(600);
+  const files = fs.readdirSync(resultDir).filter(file => file !== 'quotas');
+  assert.deepStrictEqual(files, ['fresh.json']);
+  assert.strictEqual((await server.request('/api/status/expired')).body.status, 'processing');
+  assert.strictEqual((await server.request('/api/status/fresh')).body.status, 'completed');
+});
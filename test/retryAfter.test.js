@@ -0,0 +1,61 @@
+// 拒绝时的重试建议：准入 503 按并发上限和平均任务耗时估算排空时间，配额 429 按配额重置时间，都在 Retry-After 头和响应体 retryAfter 中返回
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+function assertRetryAfter({ headers, body }) {
+  const header = headers.get('retry-after');
+  assert.match(header, /^\d+$/);
+  assert.strictEqual(body.retryAfter, Number(header));
+  return body.retryAfter;
+}
+
+test('queue-full rejections estimate the drain time', async t => {
+  const upstream = await startUpstream(request => ({ body: soraResponse(), delayMs: request.body.includes('slow') ? 3000 : 1500 }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, MAX_INFLIGHT_TASKS: '1', MAX_CONCURRENCY: '1' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const submit = prompt => server.request('/api/generate/async', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt, apiKey: 'key' }
+  });
+
+  // 还没有完成过的任务，按 30 秒的默认平均耗时估算
+  const first = await submit('first');
+  const rejected = await submit('rejected');
+  assert.strictEqual(rejected.status, 503);
+  assert.strictEqual(assertRetryAfter(rejected), 30);
+  await server.waitForTask(first.body.taskId);
+
+  // 完成一个约 1.5 秒的任务后，估算改用实际耗时
+  const second = await submit('slow second');
+  const again = await submit('rejected again');
+  assert.strictEqual(again.status, 503);
+  assert.strictEqual(assertRetryAfter(again), 2);
+  await server.waitForTask(second.body.taskId);
+});
+
+test('quota rejections point at the quota reset', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, QUOTA_DAILY: '1' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const generate = prompt => server.request('/api/generate', {
+    method: 'POST',
+    headers: { 'x-tenant-id': 'acme' },
+    body: { model: 'sora_image', prompt, apiKey: 'key' }
+  });
+
+  assert.strictEqual((await generate('first')).status, 200);
+  const rejected = await generate('second');
+  assert.strictEqual(rejected.status, 429);
+  const retryAfter = assertRetryAfter(rejected);
+  const untilReset = (Date.parse(rejected.body.resetAt) - Date.now()) / 1000;
+  assert.ok(retryAfter > 0 && Math.abs(retryAfter - untilReset) <= 2, `retryAfter ${retryAfter}s, reset in ${untilReset}s`);
+});
@@ -0,0 +1,55 @@
+// 重试退避抖动：设置 RETRY_JITTER_SEED 后退避时间可复现，相同种子得到相同的等待序列
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, runServerToExit, freePort } = require('./helpers');
+
+// Same mulberry32 generator and backoff formula as server.js, used to compute the expected delays
+function seededRandom(seed) {
+  let state = seed >>> 0;
+  return () => {
+    state = (state + 0x6d2b79f5) >>> 0;
+    let t = state;
+    t = Math.imul(t ^ (t >>> 15), t | 1);
+    t ^= t + Math.imul(t ^ (t >>> 7), t | 61);
+    return ((t ^ (t >>> 14)) >>> 0) / 4294967296;
+  };
+}
+
+function expectedDelays(seed, count) {
+  const random = seededRandom(seed);
+  return Array.from({ length: count }, (_, i) => {
+    const base = Math.min(1000 * Math.pow(2, i + 1), 10000);
+    return Math.round(base / 2 + random() * base / 2);
+  });
+}
+
+// Runs one failing generation with two retries and returns the logged backoff delays
+async function loggedDelays(env) {
+  const upstream = await startUpstream(() => ({ status: 503, body: { error: 'overloaded' } }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ...env });
+  try {
+    await server.request('/api/generate', { method: 'POST', body: { model: 'sora_image', prompt: 'p', apiKey: 'key', maxRetries: 2 } });
+    return [...server.logs.matchAll(/Waiting (\d+)ms before retry/g)].map(match => Number(match[1]));
+  } finally {
+    await server.close();
+    await upstream.close();
+  }
+}
+
+test('seeded jitter gives deterministic backoff delays', async () => {
+  const [first, second, other] = await Promise.all([
+    loggedDelays({ RETRY_JITTER_SEED: '42' }),
+    loggedDelays({ RETRY_JITTER_SEED: '42' }),
+    loggedDelays({ RETRY_JITTER_SEED: '7' })
+  ]);
+  assert.deepStrictEqual(first, expectedDelays(42, 2));
+  assert.deepStrictEqual(second, first);
+  assert.deepStrictEqual(other, expectedDelays(7, 2));
+  assert.notDeepStrictEqual(other, first);
+});
+
+test('RETRY_JITTER_SEED must be an integer', async () => {
+  const { code, logs } = await runServerToExit({ RETRY_JITTER_SEED: 'abc', PORT: String(await freePort()) });
+  assert.strictEqual(code, 1);
+  assert.match(logs, /RETRY_JITTER_SEED/);
+});
@@ -0,0 +1,83 @@
+// 上游的安全评分：Gemini 的 safetyRatings / promptFeedback 和对话补全格式的 content_filter_results 统一存到结果的 safety 并在状态接口返回，没有时省略
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse } = require('./helpers');
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+
+function geminiWithRatings() {
+  const body = geminiResponse();
+  body.candidates[0].safetyRatings = [
+    { category: 'HARM_CATEGORY_HARASSMENT', probability: 'NEGLIGIBLE', probabilityScore: 0.02 },
+    { category: 'HARM_CATEGORY_DANGEROUS_CONTENT', probability: 'LOW', probabilityScore: 0.31 }
+  ];
+  body.promptFeedback = { safetyRatings: [{ category: 'HARM_CATEGORY_HATE_SPEECH', probability: 'NEGLIGIBLE', probabilityScore: 0.01 }] };
+  return body;
+}
+
+function soraWithFilterResults(filtered) {
+  const body = soraResponse();
+  body.prompt_filter_results = [{ prompt_index: 0, content_filter_results: { hate: { filtered: false, severity: 'safe' } } }];
+  body.choices[0].content_filter_results = { violence: { filtered, severity: filtered ? 'high' : 'low' }, sexual: { filtered: false, severity: 'safe' } };
+  if (filtered) body.choices[0].finish_reason = 'content_filter';
+  return body;
+}
+
+test('safety scores are stored and returned', async t => {
+  const upstream = await startUpstream(request => {
+    if (request.url.includes('generateContent')) return { body: request.body.includes('plain') ? geminiResponse() : geminiWithRatings() };
+    return { body: soraWithFilterResults(request.body.includes('filtered')) };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const run = async (model, prompt) => {
+    const { body } = await server.request('/api/generate/async', { method: 'POST', body: { model, prompt, apiKey: 'key' } });
+    await server.waitForTask(body.taskId);
+    return (await server.request(`/api/status/${body.taskId}`)).body;
+  };
+
+  await t.test('gemini safety ratings', async () => {
+    const result = await run(GEMINI, 'rated');
+    assert.strictEqual(result.status, 'completed');
+    assert.deepStrictEqual(result.safety, {
+      ratings: [
+        { category: 'HARM_CATEGORY_HATE_SPEECH', level: 'NEGLIGIBLE', score: 0.01, blocked: false },
+        { category: 'HARM_CATEGORY_HARASSMENT', level: 'NEGLIGIBLE', score: 0.02, blocked: false },
+        { category: 'HARM_CATEGORY_DANGEROUS_CONTENT', level: 'LOW', score: 0.31, blocked: false }
+      ]
+    });
+  });
+
+  await t.test('content filter results', async () => {
+    const result = await run('sora_image', 'rated');
+    assert.deepStrictEqual(result.safety, {
+      ratings: [
+        { category: 'hate', level: 'safe', blocked: false },
+        { category: 'violence', level: 'low', blocked: false },
+        { category: 'sexual', level: 'safe', blocked: false }
+      ]
+    });
+  });
+
+  await t.test('kept on content-filtered failures', async () => {
+    const result = await run('sora_image', 'filtered');
+    assert.strictEqual(result.status, 'failed');
+    assert.strictEqual(result.errorCode, 'CONTENT_REJECTED');
+    assert.deepStrictEqual(result.safety.ratings.find(rating => rating.category === 'violence'), { category: 'violence', level: 'high', blocked: true });
+  });
+
+  await t.test('omitted when absent', async () => {
+    const result = await run(GEMINI, 'plain');
+    assert.strictEqual(result.status, 'completed');
+    assert.ok(!('safety' in result));
+  });
+
+  await t.test('sync responses', async () => {
+    const { body } = await server.request('/api/generate', { method: 'POST', body: { model: GEMINI, prompt: 'sync rated', apiKey: 'key' } });
+    assert.strictEqual(body.safety.ratings.length, 3);
+  });
+});
@@ -0,0 +1,53 @@
+// GET /api/generate/simple：只在 ENABLE_SIMPLE_GET 开启时提供，查询参数映射到同步生成请求并按 POST 接口的规则校验
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+test('GET-only integrations can generate through query parameters', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ENABLE_SIMPLE_GET: 'true' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const get = query => server.request(`/api/generate/simple?${new URLSearchParams(query)}`);
+
+  await t.test('a valid request', async () => {
+    const { status, body } = await get({ model: 'sora_image', prompt: 'a red fox', apiKey: 'key', imageSize: '[3:2]' });
+    assert.strictEqual(status, 200);
+    assert.strictEqual(body.imageUrl, 'https://cdn.example.com/result.png');
+    const sent = JSON.parse(upstream.generationRequests().at(-1).body);
+    assert.strictEqual(sent.messages[0].content, 'a red fox [3:2]');
+    assert.match(server.logs, /\[SIMPLE_GET\] GET \/api\/generate\/simple is enabled, API keys will appear in query strings/);
+  });
+
+  await t.test('missing and repeated parameters', async () => {
+    const missing = await get({ apiKey: 'key' });
+    assert.strictEqual(missing.status, 400);
+    assert.match(missing.body.error, /Missing query parameters: model, prompt/);
+
+    const repeated = await server.request('/api/generate/simple?model=sora_image&prompt=a&prompt=b&apiKey=key');
+    assert.strictEqual(repeated.status, 400);
+    assert.match(repeated.body.error, /prompt must be given once/);
+
+    assert.strictEqual((await get({ model: 'sora_image', prompt: 'p' })).status, 401);
+  });
+
+  await t.test('validated like the POST endpoint', async () => {
+    const calls = upstream.generationRequests().length;
+    const { status, body } = await get({ model: 'sora_image', prompt: '   ', apiKey: 'key' });
+    assert.strictEqual(status, 400);
+    assert.ok(body.fields.some(field => field.field === 'prompt'));
+    assert.strictEqual(upstream.generationRequests().length, calls);
+  });
+});
+
+test('the GET endpoint is off by default', async t => {
+  const server = await startServer();
+  t.after(() => server.close());
+
+  const { status } = await server.request('/api/generate/simple?model=sora_image&prompt=p&apiKey=key');
+  assert.strictEqual(status, 404);
+  assert.doesNotMatch(server.logs, /\[SIMPLE_GET\]/);
+});
@@ -0,0 +1,75 @@
+// 查询结果的缓存头：进行中的任务 no-store；最终结果 max-age=STATUS_CACHE_MAX_AGE 并带弱 ETag，If-None-Match 命中时返回 304
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+test('status responses carry cache headers', async t => {
+  const upstream = await startUpstream(request => {
+    if (request.body.includes('broken')) return { status: 400, body: { error: 'bad request' } };
+    return { body: soraResponse(), delayMs: request.body.includes('slow') ? 2000 : 0 };
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, STATUS_CACHE_MAX_AGE: '120' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const submit = async prompt => (await server.request('/api/generate/async', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt, apiKey: 'key', maxRetries: 0 }
+  })).body;
+  const status = (taskId, headers) => server.request(`/api/status/${taskId}`, { headers });
+
+  await t.test('running and unknown tasks are not cached', async () => {
+    const { taskId, cancelToken } = await submit('slow');
+    await wait(200);
+    const running = await status(taskId);
+    assert.strictEqual(running.body.status, 'processing');
+    assert.strictEqual(running.headers.get('cache-control'), 'no-store');
+    assert.strictEqual(running.headers.get('etag'), null);
+
+    const unknown = await status('no-such-task');
+    assert.strictEqual(unknown.headers.get('cache-control'), 'no-store');
+    assert.strictEqual(unknown.headers.get('etag'), null);
+
+    await server.request(`/api/cancel/${taskId}`, { method: 'POST', headers: { 'x-cancel-token': cancelToken } });
+    const cancelled = await server.waitForTask(taskId);
+    assert.strictEqual(cancelled.status, 'cancelled');
+    const { headers } = await status(taskId);
+    assert.strictEqual(headers.get('cache-control'), 'private, max-age=120');
+    assert.match(headers.get('etag'), /^W\/"[\w-]+"$/);
+  });
+
+  await t.test('completed tasks', async () => {
+    const { taskId } = await submit('done');
+    await server.waitForTask(taskId);
+    const first = await status(taskId);
+    assert.strictEqual(first.status, 200);
+    assert.strictEqual(first.headers.get('cache-control'), 'private, max-age=120');
+    const etag = first.headers.get('etag');
+    assert.match(etag, /^W\/"[\w-]+"$/);
+    assert.strictEqual((await status(taskId)).headers.get('etag'), etag, 'stable across requests');
+
+    const notModified = await status(taskId, { 'if-none-match': etag });
+    assert.strictEqual(notModified.status, 304);
+    assert.strictEqual(notModified.body.length, 0);
+    assert.strictEqual(notModified.headers.get('etag'), etag);
+
+    // 弱比较：不带 W/ 前缀、列表中任意一个或 * 都算命中
+    assert.strictEqual((await status(taskId, { 'if-none-match': etag.slice(2) })).status, 304);
+    assert.strictEqual((await status(taskId, { 'if-none-match': `W/"other", ${etag}` })).status, 304);
+    assert.strictEqual((await status(taskId, { 'if-none-match': '*' })).status, 304);
+
+    const changed = await status(taskId, { 'if-none-match': 'W/"stale"' });
+    assert.strictEqual(changed.status, 200);
+    assert.strictEqual(changed.body.status, 'completed');
+  });
+
+  await t.test('failed tasks', async () => {
+    const { taskId } = await submit('broken');
+    assert.strictEqual((await server.waitForTask(taskId)).status, 'failed');
+    const { headers } = await status(taskId);
+    assert.strictEqual(headers.get('cache-control'), 'private, max-age=120');
+    assert.strictEqual((await status(taskId, { 'if-none-match': headers.get('etag') })).status, 304);
+  });
+});
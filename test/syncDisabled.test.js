@@ -0,0 +1,67 @@
+// DISABLE_SYNC_ENDPOINT=true：所有同步生成接口返回 501 SYNC_DISABLED 并指向异步接口，/api/generate/async 照常可用，/api/config 报告可用的接口
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+const BODY = { model: 'sora_image', prompt: 'p', apiKey: 'key' };
+
+test('the sync endpoints are disabled by the flag', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, DISABLE_SYNC_ENDPOINT: 'true', ENABLE_SIMPLE_GET: 'true' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  await t.test('POST /api/generate', async () => {
+    const { status, body } = await server.request('/api/generate', { method: 'POST', body: BODY });
+    assert.strictEqual(status, 501);
+    assert.strictEqual(body.errorCode, 'SYNC_DISABLED');
+    assert.strictEqual(body.asyncEndpoint, '/api/generate/async');
+  });
+
+  await t.test('GET /api/generate/simple', async () => {
+    const { status, body } = await server.request(`/api/generate/simple?${new URLSearchParams(BODY)}`);
+    assert.strictEqual(status, 501);
+    assert.strictEqual(body.errorCode, 'SYNC_DISABLED');
+  });
+
+  await t.test('POST /v1/images/generations', async () => {
+    const { status, body } = await server.request('/v1/images/generations', {
+      method: 'POST',
+      headers: { authorization: 'Bearer key' },
+      body: { prompt: 'p' }
+    });
+    assert.strictEqual(status, 501);
+    assert.strictEqual(body.error.code, 'SYNC_DISABLED');
+  });
+
+  await t.test('the async endpoint still works', async () => {
+    const { status, body } = await server.request('/api/generate/async', { method: 'POST', body: BODY });
+    assert.strictEqual(status, 200);
+    assert.strictEqual((await server.waitForTask(body.taskId)).status, 'completed');
+  });
+
+  await t.test('/api/config reports the endpoints', async () => {
+    const { endpoints } = (await server.request('/api/config')).body;
+    assert.strictEqual(endpoints.sync, false);
+    assert.strictEqual(endpoints.simpleGet, false);
+    assert.strictEqual(endpoints.async, true);
+  });
+
+  assert.strictEqual(upstream.generationRequests().length, 1, 'only the async task called the upstream');
+});
+
+test('the sync endpoint is enabled by default', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  assert.strictEqual((await server.request('/api/config')).body.endpoints.sync, true);
+  const { status, body } = await server.request('/api/generate', { method: 'POST', body: BODY });
+  assert.strictEqual(status, 200);
+  assert.strictEqual(body.success, true);
+});
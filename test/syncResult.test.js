@@ -0,0 +1,44 @@
+// 同步接口直接使用生成结果，不经过结果存储：并发请求时不断删除存储目录中的文件，所有请求仍然成功
+const test = require('node:test');
+const assert = require('node:assert');
+const fs = require('fs');
+const path = require('path');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+test('sync responses survive results being removed from the store', async t => {
+  let counter = 0;
+  const upstream = await startUpstream(() => ({
+    body: soraResponse(`https://cdn.example.com/${++counter}.png`),
+    delayMs: 20 + Math.floor(Math.random() * 30)
+  }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  // 模拟清理：持续删除所有已写入的结果
+  let sweeping = true;
+  const sweeper = (async () => {
+    while (sweeping) {
+      for (const file of fs.readdirSync(server.resultDir)) {
+        if (file.endsWith('.json')) fs.rmSync(path.join(server.resultDir, file), { force: true });
+      }
+      await new Promise(resolve => setImmediate(resolve));
+    }
+  })();
+
+  const responses = await Promise.all(Array.from({ length: 30 }, (_, i) => server.request('/api/generate', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: `prompt ${i}`, apiKey: 'key', taskId: `sync-stress-${i}` }
+  })));
+  sweeping = false;
+  await sweeper;
+
+  for (const response of responses) {
+    assert.strictEqual(response.status, 200, JSON.stringify(response.body));
+    assert.strictEqual(response.body.success, true);
+    assert.match(response.body.imageUrl, /^https:\/\/cdn\.example\.com\/\d+\.png$/);
+  }
+  assert.strictEqual(new Set(responses.map(response => response.body.imageUrl)).size, responses.length);
+});
@@ -0,0 +1,112 @@
+// 同步请求在 HTTP 层超时（客户端断开）后任务继续执行，结果可以通过 /api/status/:taskId 取回，并发名额在任务结束后释放
+// SYNC_EARLY_HINTS=true 时 taskId 在生成开始前通过 103 Early Hints 的 X-Task-Id 头发出；运行中的同步任务占用 taskId，重复提交返回 409
+const test = require('node:test');
+const assert = require('node:assert');
+const http = require('http');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+// Sends a sync generation and gives up after abortAfterMs, resolves to the 103 Early Hints headers received before that
+function syncRequestThatTimesOut(server, body, abortAfterMs) {
+  return new Promise((resolve, reject) => {
+    const request = http.request(`${server.url}/api/generate`, { method: 'POST', headers: { 'content-type': 'application/json' } });
+    let hints = null;
+    request.on('information', info => {
+      if (info.statusCode === 103) hints = info.headers;
+    });
+    request.on('response', () => reject(new Error('the sync request was expected to time out')));
+    request.on('error', () => {});
+    request.end(JSON.stringify(body));
+    setTimeout(() => {
+      request.destroy();
+      resolve(hints);
+    }, abortAfterMs);
+  });
+}
+
+test('a sync request that times out at the HTTP layer can be resumed by polling', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse('https://cdn.example.com/late.png'), delayMs: 1000 }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ADMIN_TOKEN: 'admin-token', SYNC_EARLY_HINTS: 'true' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const hints = await syncRequestThatTimesOut(server, { model: 'sora_image', prompt: 'p', apiKey: 'key' }, 300);
+  assert.ok(hints, '103 Early Hints received before generation finished');
+  const taskId = hints['x-task-id'];
+  assert.match(taskId, /^sync-[0-9a-f-]{36}$/);
+  assert.strictEqual(hints.link, `</api/status/${taskId}>; rel="monitor"`);
+
+  const pending = await server.request(`/api/status/${taskId}`);
+  assert.strictEqual(pending.body.status, 'processing');
+
+  const result = await server.waitForTask(taskId);
+  assert.strictEqual(result.status, 'completed');
+  assert.strictEqual(result.imageUrl, 'https://cdn.example.com/late.png');
+
+  const { body: stats } = await server.request('/admin/stats', { headers: { authorization: 'Bearer admin-token' } });
+  assert.strictEqual(stats.concurrency.running, 0);
+  assert.strictEqual(stats.concurrency.queued, 0);
+  assert.deepStrictEqual(stats.generations.byModel, {});
+});
+
+test('generated sync task ids are unique under concurrent requests', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const responses = await Promise.all(Array.from({ length: 20 }, () => server.request('/api/generate', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: 'p', apiKey: 'key' }
+  })));
+  const taskIds = responses.map(response => response.headers.get('x-task-id'));
+  assert.ok(taskIds.every(Boolean));
+  assert.strictEqual(new Set(taskIds).size, taskIds.length);
+});
+
+test('no Early Hints by default, the client taskId is polled instead', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse('https://cdn.example.com/late.png'), delayMs: 1000 }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const hints = await syncRequestThatTimesOut(server, { model: 'sora_image', prompt: 'p', apiKey: 'key', taskId: 'my-sync-task' }, 300);
+  assert.strictEqual(hints, null, 'no 103 response was sent');
+  const result = await server.waitForTask('my-sync-task');
+  assert.strictEqual(result.imageUrl, 'https://cdn.example.com/late.png');
+});
+
+test('a running sync task id cannot be reused', async t => {
+  const upstream = await startUpstream(request => ({ body: soraResponse(request.body.includes('second') ? 'https://cdn.example.com/second.png' : 'https://cdn.example.com/first.png'), delayMs: 800 }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const sync = prompt => server.request('/api/generate', { method: 'POST', body: { model: 'sora_image', prompt, apiKey: 'key', taskId: 'shared-id' } });
+  const first = sync('first');
+  await wait(200);
+
+  const duplicate = await sync('second');
+  assert.strictEqual(duplicate.status, 409);
+  assert.strictEqual(duplicate.body.errorCode, 'TASK_ALREADY_RUNNING');
+  const asyncDuplicate = await server.request('/api/generate/async', { method: 'POST', body: { model: 'sora_image', prompt: 'second', apiKey: 'key', taskId: 'shared-id' } });
+  assert.strictEqual(asyncDuplicate.status, 409);
+
+  assert.strictEqual((await server.request('/api/image/shared-id/redirect')).status, 409);
+  assert.strictEqual((await server.request('/api/status/shared-id')).body.status, 'processing');
+
+  const { status, body } = await first;
+  assert.strictEqual(status, 200);
+  assert.strictEqual(body.imageUrl, 'https://cdn.example.com/first.png');
+  assert.strictEqual(upstream.generationRequests().length, 1);
+
+  // 结束后 taskId 可以再次使用
+  assert.strictEqual((await sync('second')).status, 200);
+});
@@ -0,0 +1,62 @@
+// 任务标签：tags 存入结果并随回调发出，/api/results?tag=key:value 按标签筛选；标签数量和长度有上限
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+const ADMIN = { authorization: 'Bearer admin-token' };
+
+test('tags are stored, echoed in callbacks and filterable', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const receiver = await startUpstream(() => ({ body: { received: true } }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ALLOW_PRIVATE_CALLBACKS: 'true', ADMIN_TOKEN: 'admin-token' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+    await receiver.close();
+  });
+
+  const submit = async (tags, callbackUrl) => {
+    const { status, body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: 'p', apiKey: 'key', tags, callbackUrl }
+    });
+    assert.strictEqual(status, 200);
+    return server.waitForTask(body.taskId).then(result => ({ taskId: body.taskId, result }));
+  };
+
+  const tagged = await submit({ userId: '42', project: 'demo' }, `${receiver.url}/hook`);
+  const other = await submit({ userId: '7', project: 'demo' });
+  const untagged = await submit(undefined);
+
+  await t.test('stored and echoed', async () => {
+    assert.deepStrictEqual(tagged.result.tags, { userId: '42', project: 'demo' });
+    for (let i = 0; i < 40 && receiver.requests.length === 0; i++) await wait(50);
+    assert.deepStrictEqual(JSON.parse(receiver.requests[0].body).tags, { userId: '42', project: 'demo' });
+  });
+
+  await t.test('filtered listing', async () => {
+    const list = async query => {
+      const { status, body } = await server.request(`/api/results${query}`, { headers: ADMIN });
+      assert.strictEqual(status, 200);
+      return body.results.map(result => result.taskId).sort();
+    };
+    assert.deepStrictEqual(await list('?tag=userId:42'), [tagged.taskId]);
+    assert.deepStrictEqual(await list('?tag=project:demo'), [tagged.taskId, other.taskId].sort());
+    assert.deepStrictEqual(await list('?tag=project:demo&tag=userId:7'), [other.taskId]);
+    assert.deepStrictEqual(await list('?tag=project:other'), []);
+    assert.deepStrictEqual(await list(''), [tagged.taskId, other.taskId, untagged.taskId].sort());
+    assert.strictEqual((await server.request('/api/results?tag=nocolon', { headers: ADMIN })).status, 400);
+  });
+
+  await t.test('oversized tags are rejected', async () => {
+    const tooMany = Object.fromEntries(Array.from({ length: 11 }, (_, i) => [`key${i}`, 'v']));
+    for (const tags of [tooMany, { long: 'x'.repeat(257) }, { ['k'.repeat(65)]: 'v' }, { count: 3 }, ['a']]) {
+      const { status, body } = await server.request('/api/generate/async', {
+        method: 'POST',
+        body: { model: 'sora_image', prompt: 'p', apiKey: 'key', tags }
+      });
+      assert.strictEqual(status, 400, JSON.stringify(tags).slice(0, 40));
+      assert.ok(body.fields.some(field => field.field === 'tags'));
+    }
+  });
+});
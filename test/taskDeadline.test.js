@@ -0,0 +1,57 @@
+// X-Task-Deadline：RFC3339 时间或距现在的秒数，任务的超时不超过客户端截止时间；已过期时直接 504 TIMEOUT，不调用上游
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+test('client deadlines bound the task', async t => {
+  const upstream = await startUpstream(request => ({ body: soraResponse(), delayMs: request.body.includes('slow') ? 3000 : 0 }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const submit = (prompt, deadline, path = '/api/generate/async') => server.request(path, {
+    method: 'POST',
+    headers: { 'x-task-deadline': deadline },
+    body: { model: 'sora_image', prompt, apiKey: 'key', maxRetries: 0 }
+  });
+
+  await t.test('a near-future deadline in seconds', async () => {
+    const started = Date.now();
+    const { body } = await submit('slow seconds', '0.5');
+    const result = await server.waitForTask(body.taskId);
+    assert.strictEqual(result.status, 'failed');
+    assert.strictEqual(result.errorCode, 'TIMEOUT');
+    assert.ok(Date.now() - started < 2500, `gave up after ${Date.now() - started}ms`);
+  });
+
+  await t.test('a near-future RFC3339 deadline', async () => {
+    const { body } = await submit('slow rfc3339', new Date(Date.now() + 500).toISOString());
+    const result = await server.waitForTask(body.taskId);
+    assert.strictEqual(result.errorCode, 'TIMEOUT');
+  });
+
+  await t.test('a generous deadline does not cut the task short', async () => {
+    const { body } = await submit('fast', '30');
+    assert.strictEqual((await server.waitForTask(body.taskId)).status, 'completed');
+  });
+
+  await t.test('an already-passed deadline', async () => {
+    const before = upstream.generationRequests().length;
+    for (const [path, deadline] of [['/api/generate/async', new Date(Date.now() - 1000).toISOString()], ['/api/generate', '2000-01-01T00:00:00Z'], ['/api/generate/async', '0']]) {
+      const { status, body } = await submit(`passed ${path} ${deadline}`, deadline, path);
+      assert.strictEqual(status, 504, `${path} ${deadline}`);
+      assert.strictEqual(body.errorCode, 'TIMEOUT');
+    }
+    assert.strictEqual(upstream.generationRequests().length, before, 'the upstream was never called');
+  });
+
+  await t.test('unparseable deadlines', async () => {
+    for (const deadline of ['tomorrow', '2030-01-01', '-5']) {
+      const { status, body } = await submit('bad deadline', deadline);
+      assert.strictEqual(status, 400, deadline);
+      assert.strictEqual(body.fields[0].field, 'X-Task-Deadline');
+    }
+  });
+});
@@ -0,0 +1,70 @@
+// taskId 校验：提交时只接受 UUID 或字母数字加 . _ : -（最长 128），路径中的 taskId 同样校验，日志中转义控制字符
+const test = require('node:test');
+const assert = require('node:assert');
+const crypto = require('node:crypto');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+const MESSAGE = 'must be 1-128 characters of letters, digits, ".", "_", ":" or "-"';
+const MALICIOUS = ['../../etc/passwd', 'task\nINJECTED log line', 'has space', 'semi;colon', '-leading-dash', 'x'.repeat(129), 42, ['array']];
+
+test('client-supplied taskIds are validated', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ADMIN_TOKEN: 'admin-token' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const submit = fields => server.request('/api/generate/async', { method: 'POST', body: { model: 'sora_image', prompt: 'p', apiKey: 'key', ...fields } });
+
+  await t.test('UUIDs and custom safe ids', async () => {
+    for (const taskId of [crypto.randomUUID(), 'order_42:v1.2-a', 'A', 'x'.repeat(128)]) {
+      const { status, body } = await submit({ taskId, prompt: `p ${taskId}` });
+      assert.strictEqual(status, 200, taskId);
+      assert.strictEqual(body.taskId, taskId);
+      assert.strictEqual((await server.waitForTask(taskId)).status, 'completed');
+    }
+
+    // 空字符串按未提供处理，自动生成 taskId
+    const { body } = await submit({ taskId: '', prompt: 'generated' });
+    assert.match(body.taskId, /^[0-9a-f-]{36}$/);
+    await server.waitForTask(body.taskId);
+  });
+
+  await t.test('malicious ids are rejected on submission', async () => {
+    const requests = upstream.generationRequests().length;
+    for (const taskId of MALICIOUS) {
+      for (const field of ['taskId', 'parentTaskId']) {
+        const { status, body } = await submit({ [field]: taskId });
+        assert.strictEqual(status, 400, `${field} ${JSON.stringify(taskId)}`);
+        assert.deepStrictEqual(body.fields, [{ field, message: `${field} ${MESSAGE}` }]);
+      }
+      const sync = await server.request('/api/generate', { method: 'POST', body: { model: 'sora_image', prompt: 'p', apiKey: 'key', taskId } });
+      assert.strictEqual(sync.status, 400);
+    }
+    assert.strictEqual(upstream.generationRequests().length, requests);
+  });
+
+  await t.test('path parameters', async () => {
+    const encoded = encodeURIComponent('task\nINJECTED log line');
+    const routes = [
+      ['GET', `/api/status/${encoded}`],
+      ['POST', `/api/cancel/${encoded}`],
+      ['GET', `/api/image/${encoded}`],
+      ['GET', `/api/raw/${encoded}`],
+      ['GET', `/api/status/${'x'.repeat(129)}`],
+      ['GET', '/api/status/has%20space']
+    ];
+    for (const [method, path] of routes) {
+      const { status, body } = await server.request(path, { method, headers: { authorization: 'Bearer admin-token' } });
+      assert.strictEqual(status, 400, path);
+      assert.deepStrictEqual(body, { error: 'Invalid taskId' });
+    }
+    assert.strictEqual((await server.request(`/api/cancel/parent/${encoded}`, { method: 'POST' })).status, 400);
+  });
+
+  await t.test('control characters are escaped in logs', () => {
+    assert.match(server.logs, /Rejected request with invalid taskId: task\\x0aINJECTED log line/);
+    assert.ok(!server.logs.split('\n').some(line => line.startsWith('INJECTED')), 'no forged log line');
+  });
+});
@@ -0,0 +1,57 @@
+// 任务状态：轮询 /api/status/:taskId 能看到 pending（排队等待并发名额）→ processing → completed/failed/cancelled
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+test('polling observes each status transition', async t => {
+  const upstream = await startUpstream(request => (request.body.includes('fail')
+    ? { status: 400, body: { error: 'rejected' }, delayMs: 300 }
+    : { body: soraResponse(), delayMs: 500 }));
+  // 并发为 1，后提交的任务先排队
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, MAX_CONCURRENCY: '1' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const submit = async prompt => {
+    const { body } = await server.request('/api/generate/async', { method: 'POST', body: { model: 'sora_image', prompt, apiKey: 'key', maxRetries: 0 } });
+    return body;
+  };
+  // Polls until the task is terminal and returns the distinct statuses seen, in order
+  const observe = async taskId => {
+    const seen = [];
+    for (let i = 0; i < 100; i++) {
+      const { status, body } = await server.request(`/api/status/${taskId}`);
+      assert.strictEqual(status, 200);
+      if (seen.at(-1) !== body.status) seen.push(body.status);
+      if (['completed', 'failed', 'cancelled'].includes(body.status)) return { seen, body };
+      await wait(40);
+    }
+    throw new Error(`Task ${taskId} did not finish, saw ${seen.join(', ')}`);
+  };
+
+  await t.test('pending, processing and completed', async () => {
+    const first = await submit('first');
+    const second = await submit('second');
+    const [, { seen, body }] = await Promise.all([observe(first.taskId), observe(second.taskId)]);
+    assert.deepStrictEqual(seen, ['pending', 'processing', 'completed']);
+    assert.strictEqual(body.success, true);
+  });
+
+  await t.test('failed', async () => {
+    const { taskId } = await submit('fail');
+    const { seen, body } = await observe(taskId);
+    assert.deepStrictEqual(seen.slice(-2), ['processing', 'failed']);
+    assert.strictEqual(body.success, false);
+  });
+
+  await t.test('cancelled', async () => {
+    const { taskId, cancelToken } = await submit('cancel me');
+    await wait(100);
+    assert.strictEqual((await server.request(`/api/status/${taskId}`)).body.status, 'processing');
+    await server.request(`/api/cancel/${taskId}`, { method: 'POST', headers: { 'x-cancel-token': cancelToken } });
+    const { seen } = await observe(taskId);
+    assert.deepStrictEqual(seen, ['processing', 'cancelled']);
+  });
+});
@@ -0,0 +1,68 @@
+// createdAt（提交时间）和 completedAt（进入最终状态的时间）：状态接口、回调和存储的结果都有，timestamp 保留为 completedAt 的别名
+const test = require('node:test');
+const assert = require('node:assert');
+const fs = require('fs');
+const path = require('path');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+const ISO = /^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{3}Z$/;
+
+test('results record when they were created and completed', async t => {
+  const upstream = await startUpstream(request => (request.body.includes('fail')
+    ? { status: 400, body: { error: 'bad request' }, delayMs: 300 }
+    : { body: soraResponse(), delayMs: 600 }));
+  const receiver = await startUpstream(() => ({ body: { received: true } }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ALLOW_PRIVATE_CALLBACKS: 'true' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+    await receiver.close();
+  });
+
+  const submit = async prompt => {
+    const before = Date.now();
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt, apiKey: 'key', maxRetries: 0, callbackUrl: `${receiver.url}/hook` }
+    });
+    return { taskId: body.taskId, before, after: Date.now() };
+  };
+
+  await t.test('completed tasks', async () => {
+    const { taskId, before, after } = await submit('ok');
+    await wait(200);
+    const processing = (await server.request(`/api/status/${taskId}`)).body;
+    assert.strictEqual(processing.status, 'processing');
+    assert.strictEqual(processing.completedAt, undefined);
+
+    const result = await server.waitForTask(taskId);
+    assert.match(result.createdAt, ISO);
+    assert.match(result.completedAt, ISO);
+    const createdAt = Date.parse(result.createdAt);
+    assert.ok(createdAt >= before - 1 && createdAt <= after + 1, 'createdAt is the submission time');
+    assert.ok(Date.parse(result.completedAt) - createdAt >= 500, `${result.createdAt} -> ${result.completedAt}`);
+    assert.strictEqual(processing.createdAt, result.createdAt);
+
+    const stored = JSON.parse(fs.readFileSync(path.join(server.resultDir, `${taskId}.json`), 'utf8'));
+    assert.strictEqual(stored.createdAt, result.createdAt);
+    assert.strictEqual(stored.timestamp, stored.completedAt);
+  });
+
+  await t.test('failed tasks', async () => {
+    const { taskId } = await submit('fail');
+    const result = await server.waitForTask(taskId);
+    assert.strictEqual(result.status, 'failed');
+    assert.ok(Date.parse(result.completedAt) > Date.parse(result.createdAt));
+  });
+
+  await t.test('callback payloads', async () => {
+    for (let i = 0; i < 50 && receiver.requests.length < 2; i++) await wait(50);
+    assert.strictEqual(receiver.requests.length, 2);
+    for (const request of receiver.requests) {
+      const payload = JSON.parse(request.body);
+      assert.match(payload.createdAt, ISO);
+      assert.strictEqual(payload.timestamp, payload.completedAt);
+      assert.ok(payload.completedAt > payload.createdAt);
+    }
+  });
+});
@@ -0,0 +1,59 @@
+// TRUSTED_PROXIES：只信任列出的代理转发的 X-Forwarded-For，未配置时客户端 IP 就是直连的对端地址
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, runServerToExit, freePort, wait } = require('./helpers');
+
+const FORWARDED = '198.51.100.1, 203.0.113.7';
+
+// Client IP the access log recorded for one request
+async function loggedClientIp(server, headers) {
+  const marker = `probe-${Math.random().toString(36).slice(2)}`;
+  await server.request(`/api/status/${marker}`, { headers });
+  for (let i = 0; i < 40; i++) {
+    const line = server.logs.split('\n').find(entry => entry.includes(`[ACCESS] GET /api/status/${marker}`));
+    if (line) return line.match(/ip=(\S+)/)[1];
+    await wait(25);
+  }
+  throw new Error('no access log line');
+}
+
+test('forwarded addresses are ignored without TRUSTED_PROXIES', async t => {
+  const server = await startServer({});
+  t.after(() => server.close());
+  assert.strictEqual(await loggedClientIp(server, { 'x-forwarded-for': FORWARDED }), '127.0.0.1');
+});
+
+test('trusted proxies', async t => {
+  for (const trusted of ['127.0.0.1', '127.0.0.0/8', 'loopback']) {
+    await t.test(trusted, async () => {
+      const server = await startServer({ TRUSTED_PROXIES: trusted });
+      try {
+        assert.strictEqual(await loggedClientIp(server, { 'x-forwarded-for': FORWARDED }), '203.0.113.7', 'the closest untrusted hop');
+        assert.strictEqual(await loggedClientIp(server, {}), '127.0.0.1');
+      } finally {
+        await server.close();
+      }
+    });
+  }
+
+  await t.test('every trusted hop is skipped', async () => {
+    const server = await startServer({ TRUSTED_PROXIES: 'loopback,203.0.113.0/24' });
+    try {
+      assert.strictEqual(await loggedClientIp(server, { 'x-forwarded-for': FORWARDED }), '198.51.100.1');
+    } finally {
+      await server.close();
+    }
+  });
+});
+
+test('proxies that are not the peer are not trusted', async t => {
+  const server = await startServer({ TRUSTED_PROXIES: '10.0.0.0/8' });
+  t.after(() => server.close());
+  assert.strictEqual(await loggedClientIp(server, { 'x-forwarded-for': FORWARDED }), '127.0.0.1');
+});
+
+test('invalid entries fail startup', async () => {
+  const { code, logs } = await runServerToExit({ PORT: String(await freePort()), TRUSTED_PROXIES: 'loopback,not-an-ip,10.0.0.0/99' });
+  assert.notStrictEqual(code, 0);
+  assert.match(logs, /TRUSTED_PROXIES entries must be IPs, CIDRs or one of loopback, linklocal, uniquelocal, got "not-an-ip, 10\.0\.0\.0\/99"/);
+});
@@ -0,0 +1,75 @@
+// uploadUrl：生成的图片流式 PUT 到调用方提供的预签名地址，结果和回调中只返回上传后的地址（不含查询参数），上传失败时任务失败
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, geminiResponse, wait } = require('./helpers');
+
+const GEMINI = 'gemini-2.5-flash-image-preview';
+const PNG = Buffer.concat([Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]), Buffer.alloc(4096, 7)]);
+
+test('results are uploaded to presigned URLs', async t => {
+  const upstream = await startUpstream(request => {
+    if (request.url === '/result.png') return { headers: { 'content-type': 'image/png' }, body: PNG };
+    if (request.url.includes('generateContent')) return { body: geminiResponse(PNG.toString('base64')) };
+    return { body: soraResponse(`${upstream.url}/result.png`) };
+  });
+  const bucket = await startUpstream(request => (request.url.startsWith('/denied') ? { status: 403, body: 'AccessDenied' } : { body: '' }));
+  const receiver = await startUpstream(() => ({ body: { received: true } }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ALLOW_PRIVATE_CALLBACKS: 'true' });
+  t.after(async () => {
+    await server.close();
+    await Promise.all([upstream, bucket, receiver].map(stub => stub.close()));
+  });
+
+  const submit = async (model, prompt, uploadPath) => {
+    const { status, body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model, prompt, apiKey: 'key', maxRetries: 0, uploadUrl: `${bucket.url}${uploadPath}`, callbackUrl: `${receiver.url}/hook` }
+    });
+    assert.strictEqual(status, 200);
+    return { taskId: body.taskId, result: await server.waitForTask(body.taskId) };
+  };
+  const callbackFor = async taskId => {
+    for (let i = 0; i < 40; i++) {
+      const found = receiver.requests.map(request => JSON.parse(request.body)).find(payload => payload.taskId === taskId);
+      if (found) return found;
+      await wait(50);
+    }
+    throw new Error(`no callback for ${taskId}`);
+  };
+  const uploadTo = path => bucket.requests.find(request => request.url === path);
+
+  await t.test('Gemini base64 results', async () => {
+    const { taskId, result } = await submit(GEMINI, 'inline', '/images/a.png?X-Amz-Signature=secret');
+    assert.strictEqual(result.status, 'completed');
+    assert.strictEqual(result.imageUrl, `${bucket.url}/images/a.png`);
+    assert.deepStrictEqual(result.imageUrls, [`${bucket.url}/images/a.png`]);
+
+    const upload = uploadTo('/images/a.png?X-Amz-Signature=secret');
+    assert.strictEqual(upload.method, 'PUT');
+    assert.strictEqual(upload.headers['content-type'], 'image/png');
+    assert.strictEqual(upload.headers['content-length'], String(PNG.length));
+    assert.strictEqual(upload.body, PNG.toString('utf8'), 'the decoded image bytes');
+
+    const callback = await callbackFor(taskId);
+    assert.strictEqual(callback.status, 'completed');
+    assert.strictEqual(callback.imageUrl, `${bucket.url}/images/a.png`);
+    assert.ok(!JSON.stringify(callback).includes('base64'), 'no base64 in the callback');
+  });
+
+  await t.test('URL results are streamed through', async () => {
+    const { result } = await submit('sora_image', 'remote', '/images/b.png');
+    assert.strictEqual(result.imageUrl, `${bucket.url}/images/b.png`);
+    const upload = uploadTo('/images/b.png');
+    assert.strictEqual(upload.headers['content-type'], 'image/png');
+    assert.strictEqual(upload.body, PNG.toString('utf8'));
+  });
+
+  await t.test('failed uploads fail the task', async () => {
+    const { taskId, result } = await submit(GEMINI, 'denied', '/denied/c.png');
+    assert.strictEqual(result.status, 'failed');
+    assert.strictEqual(result.error, 'Upload to uploadUrl failed with status 403');
+    const callback = await callbackFor(taskId);
+    assert.strictEqual(callback.status, 'failed');
+    assert.strictEqual(callback.imageUrl, undefined);
+  });
+});
@@ -0,0 +1,71 @@
+// 上游鉴权方式：bearer（默认）、header:<name>、query:<param>，UPSTREAM_AUTH_MODE 设置默认值，请求中的 authMode 可以覆盖
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+const API_KEY = 'sk-upstream-secret-1234';
+
+// Where the key ended up on the last generation request
+function keyPlacement(upstream) {
+  const request = upstream.generationRequests().at(-1);
+  const url = new URL(request.url, 'http://upstream');
+  return {
+    authorization: request.headers.authorization,
+    xApiKey: request.headers['x-api-key'],
+    query: Object.fromEntries(url.searchParams)
+  };
+}
+
+test('each auth mode places the key correctly', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const generate = authMode => server.request('/api/generate', {
+    method: 'POST',
+    body: { model: 'sora_image', prompt: 'p', apiKey: API_KEY, authMode }
+  });
+
+  await t.test('bearer by default', async () => {
+    assert.strictEqual((await generate(undefined)).status, 200);
+    assert.deepStrictEqual(keyPlacement(upstream), { authorization: `Bearer ${API_KEY}`, xApiKey: undefined, query: {} });
+  });
+
+  await t.test('header:<name>', async () => {
+    assert.strictEqual((await generate('header:x-api-key')).status, 200);
+    assert.deepStrictEqual(keyPlacement(upstream), { authorization: undefined, xApiKey: API_KEY, query: {} });
+  });
+
+  await t.test('query:<param>', async () => {
+    assert.strictEqual((await generate('query:key')).status, 200);
+    assert.deepStrictEqual(keyPlacement(upstream), { authorization: undefined, xApiKey: undefined, query: { key: API_KEY } });
+  });
+
+  await t.test('unknown modes are rejected', async () => {
+    const { status, body } = await generate('cookie:session');
+    assert.strictEqual(status, 400);
+    assert.ok(body.fields.some(field => field.field === 'authMode'));
+  });
+
+  await t.test('the key is never logged', () => {
+    assert.ok(!server.logs.includes(API_KEY));
+  });
+});
+
+test('UPSTREAM_AUTH_MODE sets the default mode', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, UPSTREAM_AUTH_MODE: 'header:x-api-key' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  await server.request('/api/generate', { method: 'POST', body: { model: 'sora_image', prompt: 'p', apiKey: API_KEY } });
+  assert.strictEqual(keyPlacement(upstream).xApiKey, API_KEY);
+
+  await server.request('/api/generate', { method: 'POST', body: { model: 'sora_image', prompt: 'p', apiKey: API_KEY, authMode: 'bearer' } });
+  assert.strictEqual(keyPlacement(upstream).authorization, `Bearer ${API_KEY}`);
+});
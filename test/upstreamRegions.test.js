@@ -0,0 +1,84 @@
+// UPSTREAM_REGIONS：先测量每个区域，之后新任务走耗时最短的健康区域；UPSTREAM_PROBE_PERCENT 控制探测其他区域，失败的区域暂停使用
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+async function startRegions(delays, isDown = () => false) {
+  return Promise.all(delays.map((delayMs, i) => startUpstream(() => (isDown(i)
+    ? { status: 500, body: { error: 'region down' } }
+    : { body: soraResponse(), delayMs }))));
+}
+
+async function runTasks(server, count, prefix) {
+  const results = [];
+  for (let i = 0; i < count; i++) {
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt: `${prefix} ${i}`, apiKey: 'key', maxRetries: 0 }
+    });
+    results.push(await server.waitForTask(body.taskId));
+  }
+  return results;
+}
+
+test('new tasks go to the fastest region', async t => {
+  const [fast, slow] = await startRegions([20, 400]);
+  // 百分比必须大于 0，取一个极小值让测试中基本不会探测
+  const server = await startServer({ UPSTREAM_REGIONS: `${slow.url},${fast.url}`, UPSTREAM_PROBE_PERCENT: '0.0001' });
+  t.after(async () => {
+    await server.close();
+    await Promise.all([fast, slow].map(stub => stub.close()));
+  });
+
+  // 前两个任务各测量一个区域
+  const measured = await runTasks(server, 2, 'measure');
+  assert.deepStrictEqual(measured.map(result => result.upstreamRegion).sort(), [fast.url, slow.url].sort());
+
+  const results = await runTasks(server, 5, 'fast');
+  for (const result of results) {
+    assert.strictEqual(result.upstreamRegion, fast.url);
+    assert.ok(result.upstreamLatencyMs < 400, `latency ${result.upstreamLatencyMs}ms`);
+  }
+  assert.strictEqual(fast.generationRequests().length, 6);
+  assert.strictEqual(slow.generationRequests().length, 1);
+
+  const { upstreamRegions } = (await server.request('/health')).body;
+  const summary = Object.fromEntries(upstreamRegions.map(region => [region.baseUrl, region]));
+  assert.strictEqual(summary[fast.url].samples, 6);
+  assert.strictEqual(summary[slow.url].samples, 1);
+  assert.ok(summary[fast.url].latencyMs < summary[slow.url].latencyMs);
+});
+
+test('other regions are probed', async t => {
+  const [fast, slow] = await startRegions([20, 200]);
+  const server = await startServer({ UPSTREAM_REGIONS: `${fast.url},${slow.url}`, UPSTREAM_PROBE_PERCENT: '100' });
+  t.after(async () => {
+    await server.close();
+    await Promise.all([fast, slow].map(stub => stub.close()));
+  });
+
+  await runTasks(server, 2, 'measure');
+  const results = await runTasks(server, 3, 'probe');
+  assert.deepStrictEqual(results.map(result => result.upstreamRegion), [slow.url, slow.url, slow.url]);
+});
+
+test('a failing region is skipped', async t => {
+  let fastDown = false;
+  const [fast, slow] = await startRegions([20, 200], i => i === 0 && fastDown);
+  const server = await startServer({ UPSTREAM_REGIONS: `${fast.url},${slow.url}`, UPSTREAM_PROBE_PERCENT: '0.0001' });
+  t.after(async () => {
+    await server.close();
+    await Promise.all([fast, slow].map(stub => stub.close()));
+  });
+
+  await runTasks(server, 2, 'measure');
+  fastDown = true;
+  const [failed] = await runTasks(server, 1, 'down');
+  assert.strictEqual(failed.success, false);
+  assert.strictEqual(failed.upstreamRegion, undefined);
+
+  const results = await runTasks(server, 2, 'after');
+  assert.deepStrictEqual(results.map(result => result.upstreamRegion), [slow.url, slow.url]);
+  const { upstreamRegions } = (await server.request('/health')).body;
+  assert.strictEqual(upstreamRegions.find(region => region.baseUrl === fast.url).healthy, false);
+});
@@ -0,0 +1,61 @@
+// 上游返回的请求 ID（x-request-id 等响应头）保存到结果中，并出现在状态查询和回调里
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+test('the upstream request id reaches the status response and the callback', async t => {
+  const upstream = await startUpstream(request => {
+    if (request.body.includes('rejected')) {
+      return { status: 400, headers: { 'x-request-id': 'upstream-req-400' }, body: { error: 'bad prompt' } };
+    }
+    return { headers: { 'x-request-id': 'upstream-req-42' }, body: soraResponse() };
+  });
+  const receiver = await startUpstream(() => ({ body: { received: true } }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, ALLOW_PRIVATE_CALLBACKS: 'true' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+    await receiver.close();
+  });
+
+  const run = async prompt => {
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      body: { model: 'sora_image', prompt, apiKey: 'key', maxRetries: 1, callbackUrl: `${receiver.url}/hook` }
+    });
+    const result = await server.waitForTask(body.taskId);
+    for (let i = 0; i < 40 && !receiver.requests.some(request => request.body.includes(body.taskId)); i++) await wait(50);
+    const callback = receiver.requests.find(request => request.body.includes(body.taskId));
+    return { result, callback: JSON.parse(callback.body) };
+  };
+
+  await t.test('successful task', async () => {
+    const { result, callback } = await run('a cat');
+    assert.strictEqual(result.status, 'completed');
+    assert.strictEqual(result.upstreamRequestId, 'upstream-req-42');
+    assert.strictEqual(callback.upstreamRequestId, 'upstream-req-42');
+  });
+
+  await t.test('failed task', async () => {
+    const { result, callback } = await run('rejected');
+    assert.strictEqual(result.status, 'failed');
+    assert.strictEqual(result.upstreamRequestId, 'upstream-req-400');
+    assert.strictEqual(callback.upstreamRequestId, 'upstream-req-400');
+  });
+});
+
+test('UPSTREAM_REQUEST_ID_HEADERS picks the first configured header present', async t => {
+  const upstream = await startUpstream(() => ({
+    headers: { 'x-request-id': 'generic-id', 'x-provider-trace': 'provider-trace-7' },
+    body: soraResponse()
+  }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, UPSTREAM_REQUEST_ID_HEADERS: 'x-provider-trace,x-request-id' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const { body } = await server.request('/api/generate/async', { method: 'POST', body: { model: 'sora_image', prompt: 'p', apiKey: 'key' } });
+  const result = await server.waitForTask(body.taskId);
+  assert.strictEqual(result.upstreamRequestId, 'provider-trace-7');
+});
@@ -0,0 +1,54 @@
+// 超时任务的上游耗时分解：桩上游故意不响应或只发响应头，检查结果中的 timings 各字段
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream } = require('./helpers');
+
+test('timed-out tasks report the phase the upstream stalled in', async t => {
+  const upstream = await startUpstream((request, res) => {
+    if (request.body.includes('stall-body')) {
+      // 先发响应头，正文一直不发完
+      res.writeHead(200, { 'content-type': 'application/json' });
+      res.write('{"choices":');
+    }
+    // stall-headers：什么都不发
+    return new Promise(() => {});
+  });
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const runWithDeadline = async prompt => {
+    const { body } = await server.request('/api/generate/async', {
+      method: 'POST',
+      headers: { 'X-Task-Deadline': '1' },
+      body: { model: 'sora_image', prompt, apiKey: 'key' }
+    });
+    return server.waitForTask(body.taskId);
+  };
+
+  await t.test('stalled before the response headers', async () => {
+    const result = await runWithDeadline('stall-headers');
+    assert.strictEqual(result.status, 'failed');
+    assert.strictEqual(result.errorCode, 'TIMEOUT');
+    const { timings } = result;
+    assert.ok(timings, 'timings are reported');
+    assert.strictEqual(typeof timings.connectMs, 'number');
+    assert.strictEqual(timings.tls, false);
+    assert.strictEqual(timings.reusedConnection, false);
+    assert.strictEqual(timings.firstByteMs, undefined);
+    assert.ok(timings.totalMs >= 900, `totalMs ${timings.totalMs}`);
+    assert.ok(!('dnsMs' in timings), 'DNS is not reported separately');
+  });
+
+  await t.test('stalled while reading the response body', async () => {
+    const result = await runWithDeadline('stall-body');
+    assert.strictEqual(result.errorCode, 'TIMEOUT');
+    const { timings } = result;
+    assert.ok(timings, 'timings are reported');
+    assert.strictEqual(typeof timings.firstByteMs, 'number');
+    assert.ok(timings.firstByteMs < timings.totalMs);
+    assert.ok(timings.totalMs >= 900, `totalMs ${timings.totalMs}`);
+  });
+});
@@ -0,0 +1,66 @@
+// 参数校验：一次返回所有不合法的字段 { errorCode: 'INVALID_REQUEST', fields: [{ field, message }] }，请求体不是 JSON 时同样是结构化错误
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse } = require('./helpers');
+
+test('invalid requests list every bad field', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const fieldsOf = body => Object.fromEntries(body.fields.map(({ field, message }) => [field, message]));
+
+  await t.test('missing fields', async () => {
+    for (const endpoint of ['/api/generate', '/api/generate/async']) {
+      const { status, body } = await server.request(endpoint, { method: 'POST', body: { apiKey: 'key' } });
+      assert.strictEqual(status, 400);
+      assert.strictEqual(body.errorCode, 'INVALID_REQUEST');
+      const fields = fieldsOf(body);
+      assert.strictEqual(fields.model, 'model is required');
+      assert.ok(fields.prompt, 'the prompt is reported alongside the model');
+      assert.strictEqual(body.error, body.fields.map(item => item.message).join('; '));
+    }
+  });
+
+  await t.test('wrongly typed fields', async () => {
+    const { status, body } = await server.request('/api/generate', {
+      method: 'POST',
+      body: { model: 42, prompt: ['p'], apiKey: 'key', imageUrl: 7, imageUrls: 'https://example.com/a.png', enhancePrompt: 'yes', wantPreviews: 1, timestamp: '123', maxRetries: 'three' }
+    });
+    assert.strictEqual(status, 400);
+    const fields = fieldsOf(body);
+    assert.strictEqual(fields.model, 'model is required');
+    assert.strictEqual(fields.prompt, 'prompt must be a string');
+    assert.strictEqual(fields.imageUrl, 'imageUrl must be a string');
+    assert.strictEqual(fields.imageUrls, 'imageUrls must be an array of strings');
+    assert.strictEqual(fields.enhancePrompt, 'enhancePrompt must be a boolean');
+    assert.strictEqual(fields.wantPreviews, 'wantPreviews must be a boolean');
+    assert.strictEqual(fields.timestamp, 'timestamp must be a Unix time in seconds');
+    assert.ok(fields.maxRetries);
+    assert.strictEqual(upstream.generationRequests().length, 0);
+  });
+
+  await t.test('async-only fields', async () => {
+    const body = { model: 'sora_image', prompt: 'p', apiKey: 'key', failFast: 'yes', uploadUrl: 'ftp://example.com' };
+    assert.strictEqual((await server.request('/api/generate', { method: 'POST', body })).status, 200, 'ignored by the sync endpoint');
+
+    const { status, body: error } = await server.request('/api/generate/async', { method: 'POST', body });
+    assert.strictEqual(status, 400);
+    const fields = fieldsOf(error);
+    assert.strictEqual(fields.failFast, 'failFast must be a boolean');
+    assert.strictEqual(fields.uploadUrl, 'uploadUrl must be an http(s) URL');
+  });
+
+  await t.test('malformed JSON', async () => {
+    const response = await fetch(`${server.url}/api/generate`, {
+      method: 'POST',
+      headers: { 'content-type': 'application/json' },
+      body: '{"model": "sora_image",'
+    });
+    assert.strictEqual(response.status, 400);
+    assert.deepStrictEqual(await response.json(), { error: 'Request body must be valid JSON', errorCode: 'INVALID_REQUEST', fields: [] });
+  });
+});
@@ -0,0 +1,40 @@
+// 连接预热：WARM_POOL_SIZE 大于 0 时定期向上游发送预热请求保持 keep-alive 连接，之后的生成请求复用这些连接；默认关闭
+const test = require('node:test');
+const assert = require('node:assert');
+const { startServer, startUpstream, soraResponse, wait } = require('./helpers');
+
+test('connections to the upstream are opened proactively', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, WARM_POOL_SIZE: '2', WARM_INTERVAL: '200' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  await wait(700);
+  const warmups = upstream.requests.filter(request => request.method === 'OPTIONS');
+  assert.ok(warmups.length >= 4, `${warmups.length} warm-up requests`);
+  assert.strictEqual(upstream.generationRequests().length, 0);
+  assert.match(server.logs, /\[WARM\] Keeping 2 connection\(s\) warm to http:\/\/127\.0\.0\.1:\d+/);
+
+  // 预热保持的连接数不超过 WARM_POOL_SIZE，每轮复用同一批连接
+  const warmPorts = new Set(warmups.map(request => request.remotePort));
+  assert.strictEqual(warmPorts.size, 2);
+
+  const { status } = await server.request('/api/generate', { method: 'POST', body: { model: 'sora_image', prompt: 'p', apiKey: 'key' } });
+  assert.strictEqual(status, 200);
+  assert.ok(warmPorts.has(upstream.generationRequests()[0].remotePort), 'generation reused a warm connection');
+});
+
+test('the warmer is off by default', async t => {
+  const upstream = await startUpstream(() => ({ body: soraResponse() }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  await wait(500);
+  assert.strictEqual(upstream.requests.length, 0);
+  assert.doesNotMatch(server.logs, /\[WARM\]/);
+});
@@ -0,0 +1,53 @@
+// 水印（WATERMARK_TEXT）：结果图片在 WATERMARK_POSITION 角落叠加文字，其余区域不变；没有 sharp 时拒绝启动
+const test = require('node:test');
+const assert = require('node:assert');
+const os = require('os');
+const path = require('path');
+const { startServer, startUpstream, runServerToExit, geminiResponse, freePort } = require('./helpers');
+
+let sharp = null;
+try {
+  sharp = require('sharp');
+} catch (error) {
+  // Optional dependency, the pixel test is skipped without it
+}
+
+const SIZE = 256;
+const GRAY = 128;
+const REGION = 48;
+
+// Mean absolute difference from plain gray over a REGION x REGION square at (left, top)
+async function regionDifference(png, left, top) {
+  const { data, info } = await sharp(png).extract({ left, top, width: REGION, height: REGION }).removeAlpha().raw().toBuffer({ resolveWithObject: true });
+  let total = 0;
+  for (const value of data) total += Math.abs(value - GRAY);
+  return total / (info.width * info.height * info.channels);
+}
+
+test('WATERMARK_TEXT overlays the configured corner only', { skip: sharp ? false : 'sharp is not installed' }, async t => {
+  const original = await sharp({ create: { width: SIZE, height: SIZE, channels: 3, background: { r: GRAY, g: GRAY, b: GRAY } } }).png().toBuffer();
+  const upstream = await startUpstream(() => ({ body: geminiResponse(original.toString('base64')) }));
+  const server = await startServer({ UPSTREAM_REGIONS: upstream.url, WATERMARK_TEXT: 'SAMPLE', WATERMARK_POSITION: 'bottom-right', WATERMARK_OPACITY: '1' });
+  t.after(async () => {
+    await server.close();
+    await upstream.close();
+  });
+
+  const { status, body } = await server.request('/api/generate', {
+    method: 'POST',
+    body: { model: 'gemini-2.5-flash-image-preview', prompt: 'p', apiKey: 'key' }
+  });
+  assert.strictEqual(status, 200);
+  const watermarked = Buffer.from(body.imageUrl.slice(body.imageUrl.indexOf(',') + 1), 'base64');
+  assert.deepStrictEqual(await sharp(watermarked).metadata().then(({ width, height }) => [width, height]), [SIZE, SIZE]);
+
+  assert.strictEqual(await regionDifference(original, SIZE - REGION, SIZE - REGION), 0);
+  assert.ok(await regionDifference(watermarked, SIZE - REGION, SIZE - REGION) > 1, 'bottom-right corner changed');
+  assert.strictEqual(await regionDifference(watermarked, 0, 0), 0, 'top-left corner unchanged');
+});
+
+test('WATERMARK_TEXT without sharp refuses to start', { skip: sharp ? 'sharp is installed' : false }, async () => {
+  const { code, logs } = await runServerToExit({ PORT: String(await freePort()), WATERMARK_TEXT: 'SAMPLE', RESULT_DIR: path.join(os.tmpdir(), 'aiyoutube-test-watermark') });
+  assert.strictEqual(code, 1);
+  assert.match(logs, /WATERMARK_TEXT is set but the optional dependency sharp is not installed/);
+});